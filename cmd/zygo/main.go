@@ -17,6 +17,31 @@ func usage(myflags *flag.FlagSet) {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "gen" {
+		// zygo gen: Go structs from (struct ...) declarations.
+		if err := zygo.GenMain(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "zygo gen: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "dap" {
+		// zygo dap: a debug adapter, for editors.
+		if err := zygo.DapMain(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "zygo dap: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "lsp" {
+		// zygo lsp: a language server, for editors.
+		if err := zygo.LspMain(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "zygo lsp: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	cfg := zygo.NewZlispConfig("zygo")
 	cfg.DefineFlags()
 	err := cfg.Flags.Parse(os.Args[1:])
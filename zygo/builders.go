@@ -56,6 +56,7 @@ type SexpUserVarDefn struct {
 }
 
 type RecordDefn struct {
+	env       *Zlisp
 	Name      string
 	Fields    []*SexpField
 	FieldType map[string]*RegisteredType
@@ -74,14 +75,15 @@ func (r *RecordDefn) SetFields(flds []*SexpField) {
 	r.Fields = flds
 	for _, f := range flds {
 		g := (*SexpHash)(f)
-		rt, err := g.HashGet(nil, f.KeyOrder[0])
+		key := g.Keys()[0]
+		rt, err := g.HashGet(nil, key)
 		panicOn(err)
-		r.FieldType[g.KeyOrder[0].(*SexpSymbol).name] = rt.(*RegisteredType)
+		r.FieldType[key.(*SexpSymbol).name] = rt.(*RegisteredType)
 	}
 }
 
 func (p *RecordDefn) Type() *RegisteredType {
-	rt := GoStructRegistry.Registry[p.Name]
+	rt := p.env.LookupType(p.Name)
 	//Q("RecordDefn) Type() sees rt = %v", rt)
 	return rt
 }
@@ -152,7 +154,7 @@ func (r SexpField) Type() *RegisteredType {
 func (f *SexpField) FieldWidths() []int {
 	hash := (*SexpHash)(f)
 	wide := []int{}
-	for _, key := range hash.KeyOrder {
+	for _, key := range hash.Keys() {
 		val, err := hash.HashGet(nil, key)
 		str := ""
 		if err == nil {
@@ -177,7 +179,7 @@ func (f *SexpField) AlignString(pad []int) string {
 	hash := (*SexpHash)(f)
 	str := " (" + hash.TypeName + " "
 	spc := " "
-	for i, key := range hash.KeyOrder {
+	for i, key := range hash.Keys() {
 		val, err := hash.HashGet(nil, key)
 		r := ""
 		if err == nil {
@@ -207,7 +209,7 @@ func (f *SexpField) AlignString(pad []int) string {
 		}
 		str += r
 	}
-	if len(hash.Map) > 0 {
+	if hash.NumKeys > 0 {
 		return str[:len(str)-1] + ")"
 	}
 	return str + ")"
@@ -217,7 +219,7 @@ func (f *SexpField) SexpString(ps *PrintState) string {
 	hash := (*SexpHash)(f)
 	str := " (" + hash.TypeName + " "
 
-	for i, key := range hash.KeyOrder {
+	for i, key := range hash.Keys() {
 		val, err := hash.HashGet(nil, key)
 		if err == nil {
 			switch s := key.(type) {
@@ -237,7 +239,7 @@ func (f *SexpField) SexpString(ps *PrintState) string {
 			panic(err)
 		}
 	}
-	if len(hash.Map) > 0 {
+	if hash.NumKeys > 0 {
 		return str[:len(str)-1] + ")"
 	}
 	return str + ")"
@@ -280,13 +282,14 @@ func StructBuilder(env *Zlisp, name string,
 		// begin enable recursion -- add ourselves to the env early, then
 		// update later, so that structs can refer to themselves.
 		udsR := NewRecordDefn()
+		udsR.env = env
 		udsR.SetName(structName)
 		rtR := NewRegisteredType(func(env *Zlisp, h *SexpHash) (interface{}, error) {
 			return udsR, nil
 		})
 		rtR.UserStructDefn = udsR
 		rtR.DisplayAs = structName
-		GoStructRegistry.RegisterUserdef(rtR, false, structName)
+		env.TypeRegistry().RegisterUserdef(rtR, false, structName)
 
 		// overwrite any existing definition, deliberately ignore any error,
 		// as there may not be a prior definition present at all.
@@ -337,7 +340,7 @@ func StructBuilder(env *Zlisp, name string,
 							structName, i, ev, ev.SexpString(nil))
 					}
 					Q("good eval i=%v, ev=%#v / %v", i, ev, ev.SexpString(nil))
-					ko := asHash.KeyOrder
+					ko := (*SexpHash)(asHash).Keys()
 					if len(ko) == 0 {
 						return SexpNull, fmt.Errorf("bad struct declaration '%v': bad "+
 							"field array at entry %v; field had no name",
@@ -356,6 +359,7 @@ func StructBuilder(env *Zlisp, name string,
 	} // end n == 2
 
 	uds := NewRecordDefn()
+	uds.env = env
 	uds.SetName(structName)
 	uds.SetFields(flat)
 	Q("good: made typeDefnHash: '%s'", uds.SexpString(nil))
@@ -364,7 +368,7 @@ func StructBuilder(env *Zlisp, name string,
 	})
 	rt.UserStructDefn = uds
 	rt.DisplayAs = structName
-	GoStructRegistry.RegisterUserdef(rt, false, structName)
+	env.TypeRegistry().RegisterUserdef(rt, false, structName)
 	Q("good: registered new userdefined struct '%s'", structName)
 
 	// replace our recursive-reference-enabling symbol with the real one.
@@ -459,6 +463,7 @@ func InterfaceBuilder(env *Zlisp, name string,
 	decl := &SexpInterfaceDecl{
 		name:    iname,
 		methods: methods,
+		env:     env,
 	}
 	return decl, nil
 }
@@ -487,7 +492,7 @@ func SliceOfFunction(env *Zlisp, name string,
 
 	Q("sliceOf arg = '%s' with type %T", args[0].SexpString(nil), args[0])
 
-	sliceRt := GoStructRegistry.GetOrCreateSliceType(rt)
+	sliceRt := env.TypeRegistry().GetOrCreateSliceType(rt)
 	Q("in SliceOfFunction: returning sliceRt = '%#v'", sliceRt)
 	return sliceRt, nil
 }
@@ -538,7 +543,7 @@ func PointerToFunction(env *Zlisp, name string,
 
 	Q("pointer-to arg = '%s' with type %T", args[0].SexpString(nil), args[0])
 
-	ptrRt := GoStructRegistry.GetOrCreatePointerType(rt)
+	ptrRt := env.TypeRegistry().GetOrCreatePointerType(rt)
 	return ptrRt, nil
 }
 
@@ -667,7 +672,7 @@ func ArrayOfFunction(env *Zlisp, name string,
 	})
 	arrayRt.DisplayAs = fmt.Sprintf("(%s %s)", name, rt.DisplayAs)
 	arrayName := "arrayOf" + rt.RegisteredName
-	GoStructRegistry.RegisterUserdef(arrayRt, false, arrayName)
+	env.TypeRegistry().RegisterUserdef(arrayRt, false, arrayName)
 	return arrayRt, nil
 }
 
@@ -733,9 +738,9 @@ func VarBuilder(env *Zlisp, name string,
 		case ***RecordDefn:
 			Q("we have RecordDefn rd = %#v", *rd)
 		}
-		valSexp = &SexpReflect{Val: reflect.ValueOf(v)}
+		valSexp = &SexpReflect{Val: reflect.ValueOf(v), Typ: rt, env: env}
 	default:
-		valSexp = &SexpReflect{Val: reflect.ValueOf(v)}
+		valSexp = &SexpReflect{Val: reflect.ValueOf(v), Typ: rt, env: env}
 	}
 
 	Q("var decl: valSexp is '%v'", valSexp.SexpString(nil))
@@ -774,7 +779,7 @@ func ExpectErrorBuilder(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 	ev, err := dup.EvalExpressions(args[1:2])
 	Q("done with eval, ev=%v / type %T. err = %v", ev.SexpString(nil), ev, err)
 	if err != nil {
-		if err.Error() == expectedError.S {
+		if errorWithoutPos(err) == expectedError.S {
 			return SexpNull, nil
 		}
 		return SexpNull, fmt.Errorf("expectError expected '%s' but saw '%s'", expectedError.S, err)
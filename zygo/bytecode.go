@@ -0,0 +1,1022 @@
+package zygo
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// BytecodeVersion is written at the front of every compiled
+// file; ReadCompiled refuses files of any other version. Bump
+// it whenever an instruction or the encoding changes shape.
+const BytecodeVersion = 3
+
+var bytecodeMagic = []byte("zygobc\n")
+
+var ErrBytecodeVersion = fmt.Errorf("compiled code is from a different bytecode version")
+
+// CompiledCode is source that has been parsed and generated but
+// not yet run. Main holds the top level instructions; Macros
+// holds the macros the source defined, since those take effect
+// at generation time and so are not in Main.
+type CompiledCode struct {
+	Key    uint64
+	Main   *SexpFunction
+	Macros map[string]*SexpFunction
+}
+
+// BytecodeKey hashes src read from file (which may be empty).
+// The file name is included because it ends up in the source
+// positions of the compiled code. What src compiles to also
+// depends on the environment compiling it; CompileKey covers
+// that too, and is what the cache uses.
+func BytecodeKey(file string, src []byte) uint64 {
+	return Blake2bUint64(append([]byte(file+"\x00"), src...))
+}
+
+// CompileKey is the cache key for src read from file, compiled
+// in env: BytecodeKey, with BytecodeVersion and what of env the
+// generated code depends on, namely the macros defined and
+// WrapLoadExpressionsInInfix.
+func (env *Zlisp) CompileKey(file string, src []byte) uint64 {
+	var buf bytes.Buffer
+	var key [8]byte
+	binary.LittleEndian.PutUint64(key[:], BytecodeKey(file, src))
+	buf.Write(key[:])
+	fmt.Fprintf(&buf, "%d %v\x00", BytecodeVersion, env.WrapLoadExpressionsInInfix)
+
+	macros := make(map[string]*SexpFunction)
+	var names []string
+	for num, m := range env.macros.snapshot() {
+		name := env.symtable.name(num)
+		macros[name] = m
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		buf.WriteString(name + "\x00")
+		m := macros[name]
+		if m.user {
+			// a Go macro; the binary fixes what it does.
+			continue
+		}
+		bw := &bcWriter{w: bufio.NewWriter(&buf), loops: make(map[*Loop]int)}
+		bw.function(m)
+		bw.w.Flush()
+		if bw.err != nil {
+			// no stable form, so no hits across environments.
+			fmt.Fprintf(&buf, "%p", m)
+		}
+	}
+	return Blake2bUint64(buf.Bytes())
+}
+
+// Compile parses and generates src without running it. file
+// names the source for positions in error messages, and may
+// be empty.
+func (env *Zlisp) Compile(src []byte, file string) (*CompiledCode, error) {
+	var stream io.RuneScanner = bytes.NewBuffer(src)
+	if file != "" {
+		stream = &SourceStream{RuneScanner: stream, File: file}
+	}
+	key := env.CompileKey(file, src)
+	expressions, err := env.parseStream(stream)
+	if err != nil {
+		return nil, err
+	}
+	expressions = env.prepareLoadExpressions(expressions)
+
+	before := env.macros.snapshot()
+	gen := NewGenerator(env)
+	err = gen.GenerateBegin(expressions)
+	if err != nil {
+		return nil, err
+	}
+
+	cc := &CompiledCode{
+		Key:    key,
+		Main:   env.MakeFunction("__compiled", 0, false, gen.instructions, nil),
+		Macros: make(map[string]*SexpFunction),
+	}
+	for k, v := range env.macros.snapshot() {
+		if before[k] != v {
+			cc.Macros[env.symtable.name(k)] = v
+		}
+	}
+	return cc, nil
+}
+
+// LoadCompiled readies cc to run, as LoadExpressions does
+// for freshly parsed code; call Run to execute it.
+func (env *Zlisp) LoadCompiled(cc *CompiledCode) error {
+	for name, m := range cc.Macros {
+		env.macros.set(env.MakeSymbol(name).number, m)
+	}
+	if !env.ReachedEnd() {
+		env.mainfunc.fun = append(env.mainfunc.fun, PopInstr(0))
+	}
+	for _, instr := range cc.Main.fun {
+		// break and continue cache the loop position they
+		// find in the function running them; start afresh.
+		switch x := instr.(type) {
+		case *BreakInstr:
+			instr = &BreakInstr{loop: x.loop}
+		case *ContinueInstr:
+			instr = &ContinueInstr{loop: x.loop}
+		}
+		env.mainfunc.fun = append(env.mainfunc.fun, instr)
+	}
+	env.curfunc = env.mainfunc
+	return nil
+}
+
+// LoadStringCached is LoadString with a cache of compiled code
+// in the directory cacheDir, where the compiled form of str is
+// kept in a file named for its CompileKey. A missing, stale or
+// unreadable cache file is (re)written from str. The cache is
+// only an optimization: when the compiled code cannot be
+// written, say for holding a value made by a macro that has
+// no serialized form, str is loaded all the same.
+func (env *Zlisp) LoadStringCached(str string, cacheDir string) error {
+	return env.loadCached([]byte(str), "", cacheDir)
+}
+
+// LoadFileCached loads the source file path, through the
+// compiled code cache in cacheDir; see LoadStringCached.
+func (env *Zlisp) LoadFileCached(path string, cacheDir string) error {
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return env.loadCached(src, path, cacheDir)
+}
+
+func (env *Zlisp) loadCached(src []byte, file string, cacheDir string) error {
+	key := env.CompileKey(file, src)
+	cachePath := filepath.Join(cacheDir, fmt.Sprintf("%016x.zyc", key))
+
+	if f, err := os.Open(cachePath); err == nil {
+		cc, err := env.ReadCompiled(f)
+		f.Close()
+		if err == nil && cc.Key == key {
+			return env.LoadCompiled(cc)
+		}
+	}
+
+	cc, err := env.Compile(src, file)
+	if err != nil {
+		return err
+	}
+	cc.writeFile(cachePath)
+	return env.LoadCompiled(cc)
+}
+
+// writeFile writes cc to path by way of a temporary file, so
+// that a concurrent reader never sees a partial file.
+func (cc *CompiledCode) writeFile(path string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".zyc")
+	if err != nil {
+		return err
+	}
+	_, err = cc.WriteTo(tmp)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// WriteTo writes cc in the binary bytecode format. Values that
+// cannot be serialized, such as hashes made by a macro during
+// generation, make WriteTo fail; such code must be loaded from
+// source.
+func (cc *CompiledCode) WriteTo(w io.Writer) (int64, error) {
+	cw := &countWriter{w: w}
+	bw := &bcWriter{w: bufio.NewWriter(cw), loops: make(map[*Loop]int)}
+
+	bw.w.Write(bytecodeMagic)
+	bw.uvarint(BytecodeVersion)
+	var key [8]byte
+	binary.LittleEndian.PutUint64(key[:], cc.Key)
+	bw.w.Write(key[:])
+
+	bw.function(cc.Main)
+	bw.uvarint(uint64(len(cc.Macros)))
+	for name, m := range cc.Macros {
+		bw.str(name)
+		bw.function(m)
+	}
+	if bw.err == nil {
+		bw.err = bw.w.Flush()
+	}
+	return cw.n, bw.err
+}
+
+// ReadCompiled reads code written by CompiledCode.WriteTo,
+// interning its symbols in env and resolving the builtins
+// it calls against env.
+func (env *Zlisp) ReadCompiled(r io.Reader) (*CompiledCode, error) {
+	br := &bcReader{r: bufio.NewReader(r), env: env}
+
+	magic := make([]byte, len(bytecodeMagic))
+	_, err := io.ReadFull(br.r, magic)
+	if err != nil || !bytes.Equal(magic, bytecodeMagic) {
+		return nil, fmt.Errorf("not a zygo compiled code file")
+	}
+	if v := br.uvarint(); v != BytecodeVersion {
+		if br.err != nil {
+			return nil, br.err
+		}
+		return nil, ErrBytecodeVersion
+	}
+	var key [8]byte
+	_, err = io.ReadFull(br.r, key[:])
+	if err != nil {
+		return nil, err
+	}
+
+	cc := &CompiledCode{
+		Key:    binary.LittleEndian.Uint64(key[:]),
+		Macros: make(map[string]*SexpFunction),
+	}
+	cc.Main = br.function()
+	n := br.uvarint()
+	for i := uint64(0); i < n && br.err == nil; i++ {
+		name := br.str()
+		cc.Macros[name] = br.function()
+	}
+	if br.err != nil {
+		return nil, br.err
+	}
+	return cc, nil
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// instruction opcodes. Append only; reordering changes
+// the format and needs a new BytecodeVersion.
+const (
+	opJump byte = iota
+	opGoto
+	opBranch
+	opPush
+	opPop
+	opDup
+	opEnvToStack
+	opPopStackPutEnv
+	opUpdate
+	opCall
+	opDispatch
+	opReturn
+	opAddScope
+	opAddFuncScope
+	opRemoveScope
+	opExplode
+	opSquash
+	opBindlist
+	opVectorize
+	opHashize
+	opLabel
+	opBreak
+	opContinue
+	opLoopStart
+	opPushStackmark
+	opPopUntilStackmark
+	opClearStackmark
+	opDebug
+	opCreateClosure
+	opAssign
+	opPopScopeTransferToDataStack
+	opTryStart
+	opTryEnd
+	opRethrow
+	opLexLoad
+	opLexStore
+)
+
+// value tags
+const (
+	tagNull byte = iota
+	tagEnd
+	tagMarker
+	tagInt
+	tagFloat
+	tagStr
+	tagChar
+	tagBool
+	tagSymbol
+	tagPair
+	tagArray
+	tagComma
+	tagSemicolon
+	tagBuiltin
+	tagFunction
+	tagRaw
+)
+
+// bcWriter writes the bytecode encoding. The first error
+// sticks, and makes the rest of the writes no-ops.
+type bcWriter struct {
+	w     *bufio.Writer
+	loops map[*Loop]int
+	err   error
+}
+
+func (bw *bcWriter) byte(b byte) {
+	if bw.err == nil {
+		bw.err = bw.w.WriteByte(b)
+	}
+}
+
+func (bw *bcWriter) uvarint(x uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	if bw.err == nil {
+		_, bw.err = bw.w.Write(buf[:binary.PutUvarint(buf[:], x)])
+	}
+}
+
+func (bw *bcWriter) varint(x int64) {
+	var buf [binary.MaxVarintLen64]byte
+	if bw.err == nil {
+		_, bw.err = bw.w.Write(buf[:binary.PutVarint(buf[:], x)])
+	}
+}
+
+func (bw *bcWriter) int(x int) {
+	bw.varint(int64(x))
+}
+
+func (bw *bcWriter) bool(b bool) {
+	if b {
+		bw.byte(1)
+	} else {
+		bw.byte(0)
+	}
+}
+
+func (bw *bcWriter) str(s string) {
+	bw.uvarint(uint64(len(s)))
+	if bw.err == nil {
+		_, bw.err = bw.w.WriteString(s)
+	}
+}
+
+func (bw *bcWriter) symbol(sym *SexpSymbol) {
+	bw.str(sym.name)
+	bw.bool(sym.isDot)
+	bw.bool(sym.colonTail)
+}
+
+func (bw *bcWriter) pos(p *Pos) {
+	if p == nil {
+		bw.bool(false)
+		return
+	}
+	bw.bool(true)
+	bw.str(p.File)
+	bw.int(p.Line)
+	bw.int(p.Col)
+}
+
+// lexref writes a lexical address; the generator is done
+// with the rest of it.
+func (bw *bcWriter) lexref(ref *lexRef) {
+	if ref == nil {
+		bw.bool(false)
+		return
+	}
+	bw.bool(true)
+	bw.int(ref.depth)
+	bw.bool(ref.closed)
+	bw.bool(ref.dynamic)
+}
+
+// loop writes the loop's index in the table of loops seen so
+// far, followed by the loop itself if it is new. Break and
+// continue find their loop by identity, so it must be shared.
+func (bw *bcWriter) loop(l *Loop) {
+	if k, seen := bw.loops[l]; seen {
+		bw.uvarint(uint64(k))
+		return
+	}
+	k := len(bw.loops)
+	bw.loops[l] = k
+	bw.uvarint(uint64(k))
+	bw.symbol(l.stmtname)
+	if l.label == nil {
+		bw.bool(false)
+	} else {
+		bw.bool(true)
+		bw.symbol(l.label)
+	}
+	bw.int(l.loopStart)
+	bw.int(l.loopLen)
+	bw.int(l.breakOffset)
+	bw.int(l.continueOffset)
+}
+
+func (bw *bcWriter) function(f *SexpFunction) {
+	bw.str(f.name)
+	bw.int(f.nargs)
+	bw.bool(f.varargs)
+	bw.bool(f.hasBody)
+
+	// orig is only for display, so leave it out
+	// rather than fail when it has odd contents.
+	var orig Sexp = SexpNull
+	if f.orig != nil && canEncode(f.orig) {
+		orig = f.orig
+	}
+	bw.sexp(orig)
+
+	bw.uvarint(uint64(len(f.fun)))
+	for _, instr := range f.fun {
+		bw.instr(instr)
+	}
+}
+
+func (bw *bcWriter) instr(instr Instruction) {
+	switch x := instr.(type) {
+	case JumpInstr:
+		bw.byte(opJump)
+		bw.int(x.addpc)
+		bw.str(x.where)
+	case GotoInstr:
+		bw.byte(opGoto)
+		bw.int(x.location)
+	case BranchInstr:
+		bw.byte(opBranch)
+		bw.bool(x.direction)
+		bw.int(x.location)
+	case PushInstr:
+		bw.byte(opPush)
+		bw.sexp(x.expr)
+	case PopInstr:
+		bw.byte(opPop)
+		bw.int(int(x))
+	case DupInstr:
+		bw.byte(opDup)
+		bw.int(int(x))
+	case EnvToStackInstr:
+		bw.byte(opEnvToStack)
+		bw.symbol(x.sym)
+	case PopStackPutEnvInstr:
+		bw.byte(opPopStackPutEnv)
+		bw.symbol(x.sym)
+	case UpdateInstr:
+		bw.byte(opUpdate)
+		bw.symbol(x.sym)
+	case CallInstr:
+		bw.byte(opCall)
+		bw.symbol(x.sym)
+		bw.int(x.nargs)
+		bw.pos(x.pos)
+		bw.bool(x.tail)
+		bw.int(x.scopes)
+		bw.lexref(x.ref)
+	case DispatchInstr:
+		bw.byte(opDispatch)
+		bw.int(x.nargs)
+		bw.pos(x.pos)
+		bw.bool(x.tail)
+		bw.int(x.scopes)
+	case ReturnInstr:
+		bw.byte(opReturn)
+		if x.err == nil {
+			bw.bool(false)
+		} else {
+			bw.bool(true)
+			bw.str(x.err.Error())
+		}
+	case AddScopeInstr:
+		bw.byte(opAddScope)
+		bw.str(x.Name)
+	case AddFuncScopeInstr:
+		bw.byte(opAddFuncScope)
+		bw.str(x.Name)
+	case RemoveScopeInstr:
+		bw.byte(opRemoveScope)
+	case ExplodeInstr:
+		bw.byte(opExplode)
+		bw.int(int(x))
+	case SquashInstr:
+		bw.byte(opSquash)
+		bw.int(int(x))
+	case BindlistInstr:
+		bw.byte(opBindlist)
+		bw.uvarint(uint64(len(x.syms)))
+		for _, sym := range x.syms {
+			bw.symbol(sym)
+		}
+	case VectorizeInstr:
+		bw.byte(opVectorize)
+		bw.int(int(x))
+	case HashizeInstr:
+		bw.byte(opHashize)
+		bw.int(x.HashLen)
+		bw.str(x.TypeName)
+	case LabelInstr:
+		bw.byte(opLabel)
+		bw.str(x.label)
+	case *BreakInstr:
+		bw.byte(opBreak)
+		bw.loop(x.loop)
+	case *ContinueInstr:
+		bw.byte(opContinue)
+		bw.loop(x.loop)
+	case LoopStartInstr:
+		bw.byte(opLoopStart)
+		bw.loop(x.loop)
+	case PushStackmarkInstr:
+		bw.byte(opPushStackmark)
+		bw.symbol(x.sym)
+	case PopUntilStackmarkInstr:
+		bw.byte(opPopUntilStackmark)
+		bw.symbol(x.sym)
+	case ClearStackmarkInstr:
+		bw.byte(opClearStackmark)
+		bw.symbol(x.sym)
+	case DebugInstr:
+		bw.byte(opDebug)
+		bw.str(x.diagnostic)
+	case CreateClosureInstr:
+		bw.byte(opCreateClosure)
+		bw.function(x.sfun)
+	case AssignInstr:
+		bw.byte(opAssign)
+	case PopScopeTransferToDataStackInstr:
+		bw.byte(opPopScopeTransferToDataStack)
+		bw.str(x.PackageName)
+	case TryStartInstr:
+		bw.byte(opTryStart)
+		bw.int(x.catchOffset)
+	case TryEndInstr:
+		bw.byte(opTryEnd)
+	case RethrowInstr:
+		bw.byte(opRethrow)
+	case LexLoadInstr:
+		bw.byte(opLexLoad)
+		bw.symbol(x.sym)
+		bw.lexref(x.ref)
+	case LexStoreInstr:
+		bw.byte(opLexStore)
+		bw.symbol(x.sym)
+		bw.lexref(x.ref)
+	default:
+		if bw.err == nil {
+			bw.err = fmt.Errorf("cannot serialize instruction %T", instr)
+		}
+	}
+}
+
+func (bw *bcWriter) sexp(x Sexp) {
+	switch e := x.(type) {
+	case *SexpSentinel:
+		switch e {
+		case SexpNull:
+			bw.byte(tagNull)
+		case SexpEnd:
+			bw.byte(tagEnd)
+		case SexpMarker:
+			bw.byte(tagMarker)
+		default:
+			bw.err = fmt.Errorf("cannot serialize sentinel %v", e.Val)
+		}
+	case *SexpInt:
+		bw.byte(tagInt)
+		bw.varint(e.Val)
+	case *SexpFloat:
+		bw.byte(tagFloat)
+		bw.uvarint(math.Float64bits(e.Val))
+	case *SexpStr:
+		bw.byte(tagStr)
+		bw.str(e.S)
+		bw.bool(e.backtick)
+	case *SexpChar:
+		bw.byte(tagChar)
+		bw.varint(int64(e.Val))
+	case *SexpBool:
+		bw.byte(tagBool)
+		bw.bool(e.Val)
+	case *SexpSymbol:
+		bw.byte(tagSymbol)
+		bw.symbol(e)
+	case *SexpPair:
+		bw.byte(tagPair)
+		bw.pos(e.Pos)
+		bw.sexp(e.Head)
+		bw.sexp(e.Tail)
+	case *SexpArray:
+		bw.byte(tagArray)
+		bw.bool(e.Infix)
+		bw.bool(e.IsFuncDeclTypeArray)
+		bw.uvarint(uint64(len(e.Val)))
+		for _, v := range e.Val {
+			bw.sexp(v)
+		}
+	case *SexpComma:
+		bw.byte(tagComma)
+	case *SexpSemicolon:
+		bw.byte(tagSemicolon)
+	case *SexpFunction:
+		if e.user {
+			bw.byte(tagBuiltin)
+			bw.str(e.name)
+		} else {
+			bw.byte(tagFunction)
+			bw.function(e)
+		}
+	case *SexpRaw:
+		bw.byte(tagRaw)
+		bw.uvarint(uint64(len(e.Val)))
+		if bw.err == nil {
+			_, bw.err = bw.w.Write(e.Val)
+		}
+	default:
+		if bw.err == nil {
+			bw.err = fmt.Errorf("cannot serialize value of type %T", x)
+		}
+	}
+}
+
+// canEncode reports whether bcWriter.sexp can write x.
+func canEncode(x Sexp) bool {
+	bw := &bcWriter{w: bufio.NewWriter(ioutil.Discard), loops: make(map[*Loop]int)}
+	bw.sexp(x)
+	return bw.err == nil
+}
+
+// bcReader decodes what bcWriter wrote. Like bcWriter, the
+// first error sticks.
+type bcReader struct {
+	r     *bufio.Reader
+	env   *Zlisp
+	loops []*Loop
+	err   error
+}
+
+var errBadBytecode = errors.New("corrupt compiled code")
+
+// generatedBuiltins are the builtins that macros put into the
+// code they expand to by value, not by a name in env.
+var generatedBuiltins = map[string]*SexpFunction{
+	sxSelect.name: sxSelect,
+}
+
+func (br *bcReader) fail(err error) {
+	if br.err == nil {
+		br.err = err
+	}
+}
+
+func (br *bcReader) byte() byte {
+	if br.err != nil {
+		return 0
+	}
+	b, err := br.r.ReadByte()
+	if err != nil {
+		br.fail(err)
+	}
+	return b
+}
+
+func (br *bcReader) uvarint() uint64 {
+	if br.err != nil {
+		return 0
+	}
+	x, err := binary.ReadUvarint(br.r)
+	if err != nil {
+		br.fail(err)
+	}
+	return x
+}
+
+func (br *bcReader) varint() int64 {
+	if br.err != nil {
+		return 0
+	}
+	x, err := binary.ReadVarint(br.r)
+	if err != nil {
+		br.fail(err)
+	}
+	return x
+}
+
+func (br *bcReader) int() int {
+	return int(br.varint())
+}
+
+func (br *bcReader) bool() bool {
+	return br.byte() != 0
+}
+
+func (br *bcReader) bytes() []byte {
+	n := br.uvarint()
+	if br.err != nil {
+		return nil
+	}
+	if n > 1<<30 {
+		br.fail(errBadBytecode)
+		return nil
+	}
+	buf := make([]byte, n)
+	_, err := io.ReadFull(br.r, buf)
+	if err != nil {
+		br.fail(err)
+	}
+	return buf
+}
+
+func (br *bcReader) str() string {
+	return string(br.bytes())
+}
+
+func (br *bcReader) symbol() *SexpSymbol {
+	name := br.str()
+	isDot := br.bool()
+	colonTail := br.bool()
+	if br.err != nil {
+		return nil
+	}
+	sym := br.env.MakeSymbol(name)
+	sym.isDot = isDot
+	sym.colonTail = colonTail
+	return sym
+}
+
+func (br *bcReader) pos() *Pos {
+	if !br.bool() {
+		return nil
+	}
+	p := &Pos{}
+	p.File = br.str()
+	p.Line = br.int()
+	p.Col = br.int()
+	return p
+}
+
+func (br *bcReader) lexref(sym *SexpSymbol) *lexRef {
+	if !br.bool() || sym == nil {
+		return nil
+	}
+	ref := &lexRef{sym: sym.number}
+	ref.depth = br.int()
+	ref.closed = br.bool()
+	ref.dynamic = br.bool()
+	return ref
+}
+
+func (br *bcReader) loop() *Loop {
+	k := br.uvarint()
+	if br.err != nil {
+		return nil
+	}
+	if k < uint64(len(br.loops)) {
+		return br.loops[k]
+	}
+	if k != uint64(len(br.loops)) {
+		br.fail(errBadBytecode)
+		return nil
+	}
+	l := &Loop{}
+	br.loops = append(br.loops, l)
+	l.stmtname = br.symbol()
+	if br.bool() {
+		l.label = br.symbol()
+	}
+	l.loopStart = br.int()
+	l.loopLen = br.int()
+	l.breakOffset = br.int()
+	l.continueOffset = br.int()
+	return l
+}
+
+func (br *bcReader) function() *SexpFunction {
+	name := br.str()
+	nargs := br.int()
+	varargs := br.bool()
+	hasBody := br.bool()
+	orig := br.sexp()
+
+	n := br.uvarint()
+	var fun []Instruction
+	var helpers []*AddFuncScopeHelper
+	for i := uint64(0); i < n && br.err == nil; i++ {
+		instr := br.instr()
+		if afs, isAfs := instr.(AddFuncScopeInstr); isAfs {
+			helpers = append(helpers, afs.Helper)
+		}
+		fun = append(fun, instr)
+	}
+	if br.err != nil {
+		return nil
+	}
+	if orig == SexpNull {
+		orig = nil
+	}
+	sfun := br.env.MakeFunction(name, nargs, varargs, fun, orig)
+	sfun.hasBody = hasBody
+	for _, h := range helpers {
+		h.MyFunction = sfun
+	}
+	return sfun
+}
+
+func (br *bcReader) instr() Instruction {
+	op := br.byte()
+	if br.err != nil {
+		return nil
+	}
+	switch op {
+	case opJump:
+		addpc := br.int()
+		return JumpInstr{addpc: addpc, where: br.str()}
+	case opGoto:
+		return GotoInstr{location: br.int()}
+	case opBranch:
+		direction := br.bool()
+		return BranchInstr{direction: direction, location: br.int()}
+	case opPush:
+		return PushInstr{expr: br.sexp()}
+	case opPop:
+		return PopInstr(br.int())
+	case opDup:
+		return DupInstr(br.int())
+	case opEnvToStack:
+		return EnvToStackInstr{sym: br.symbol()}
+	case opPopStackPutEnv:
+		return PopStackPutEnvInstr{sym: br.symbol()}
+	case opUpdate:
+		return UpdateInstr{sym: br.symbol()}
+	case opCall:
+		sym := br.symbol()
+		nargs := br.int()
+		pos := br.pos()
+		tail := br.bool()
+		scopes := br.int()
+		return CallInstr{sym: sym, nargs: nargs, pos: pos, tail: tail, scopes: scopes,
+			ref: br.lexref(sym)}
+	case opDispatch:
+		nargs := br.int()
+		pos := br.pos()
+		tail := br.bool()
+		return DispatchInstr{nargs: nargs, pos: pos, tail: tail, scopes: br.int()}
+	case opReturn:
+		if br.bool() {
+			return ReturnInstr{err: errors.New(br.str())}
+		}
+		return ReturnInstr{}
+	case opAddScope:
+		return AddScopeInstr{Name: br.str()}
+	case opAddFuncScope:
+		return AddFuncScopeInstr{Name: br.str(), Helper: &AddFuncScopeHelper{}}
+	case opRemoveScope:
+		return RemoveScopeInstr{}
+	case opExplode:
+		return ExplodeInstr(br.int())
+	case opSquash:
+		return SquashInstr(br.int())
+	case opBindlist:
+		n := br.uvarint()
+		var syms []*SexpSymbol
+		for i := uint64(0); i < n && br.err == nil; i++ {
+			syms = append(syms, br.symbol())
+		}
+		return BindlistInstr{syms: syms}
+	case opVectorize:
+		return VectorizeInstr(br.int())
+	case opHashize:
+		hashLen := br.int()
+		return HashizeInstr{HashLen: hashLen, TypeName: br.str()}
+	case opLabel:
+		return LabelInstr{label: br.str()}
+	case opBreak:
+		return &BreakInstr{loop: br.loop()}
+	case opContinue:
+		return &ContinueInstr{loop: br.loop()}
+	case opLoopStart:
+		return LoopStartInstr{loop: br.loop()}
+	case opPushStackmark:
+		return PushStackmarkInstr{sym: br.symbol()}
+	case opPopUntilStackmark:
+		return PopUntilStackmarkInstr{sym: br.symbol()}
+	case opClearStackmark:
+		return ClearStackmarkInstr{sym: br.symbol()}
+	case opDebug:
+		return DebugInstr{diagnostic: br.str()}
+	case opCreateClosure:
+		return CreateClosureInstr{sfun: br.function()}
+	case opAssign:
+		return AssignInstr{}
+	case opPopScopeTransferToDataStack:
+		return PopScopeTransferToDataStackInstr{PackageName: br.str()}
+	case opTryStart:
+		return TryStartInstr{catchOffset: br.int()}
+	case opTryEnd:
+		return TryEndInstr{}
+	case opRethrow:
+		return RethrowInstr{}
+	case opLexLoad:
+		sym := br.symbol()
+		return LexLoadInstr{sym: sym, ref: br.lexref(sym)}
+	case opLexStore:
+		sym := br.symbol()
+		return LexStoreInstr{sym: sym, ref: br.lexref(sym)}
+	}
+	br.fail(fmt.Errorf("%v: unknown opcode %d", errBadBytecode, op))
+	return nil
+}
+
+func (br *bcReader) sexp() Sexp {
+	tag := br.byte()
+	if br.err != nil {
+		return SexpNull
+	}
+	switch tag {
+	case tagNull:
+		return SexpNull
+	case tagEnd:
+		return SexpEnd
+	case tagMarker:
+		return SexpMarker
+	case tagInt:
+		return &SexpInt{Val: br.varint()}
+	case tagFloat:
+		return &SexpFloat{Val: math.Float64frombits(br.uvarint())}
+	case tagStr:
+		s := br.str()
+		return &SexpStr{S: s, backtick: br.bool()}
+	case tagChar:
+		return &SexpChar{Val: rune(br.varint())}
+	case tagBool:
+		return &SexpBool{Val: br.bool()}
+	case tagSymbol:
+		return br.symbol()
+	case tagPair:
+		pos := br.pos()
+		head := br.sexp()
+		return &SexpPair{Head: head, Tail: br.sexp(), Pos: pos}
+	case tagArray:
+		infix := br.bool()
+		funcDecl := br.bool()
+		n := br.uvarint()
+		var vals []Sexp
+		for i := uint64(0); i < n && br.err == nil; i++ {
+			vals = append(vals, br.sexp())
+		}
+		return &SexpArray{Val: vals, Infix: infix, IsFuncDeclTypeArray: funcDecl, Env: br.env}
+	case tagComma:
+		return &SexpComma{}
+	case tagSemicolon:
+		return &SexpSemicolon{}
+	case tagBuiltin:
+		name := br.str()
+		if br.err != nil {
+			return SexpNull
+		}
+		if f, found := br.env.builtins[br.env.MakeSymbol(name).number]; found {
+			return f
+		}
+		obj, found := br.env.FindObject(name)
+		if f, isFunc := obj.(*SexpFunction); found && isFunc && f.user {
+			return f
+		}
+		if f, found := generatedBuiltins[name]; found {
+			return f
+		}
+		br.fail(fmt.Errorf("compiled code uses builtin '%s', which this environment lacks", name))
+		return SexpNull
+	case tagFunction:
+		f := br.function()
+		if f == nil {
+			return SexpNull
+		}
+		return f
+	case tagRaw:
+		return &SexpRaw{Val: br.bytes()}
+	}
+	br.fail(fmt.Errorf("%v: unknown value tag %d", errBadBytecode, tag))
+	return SexpNull
+}
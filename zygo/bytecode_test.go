@@ -0,0 +1,154 @@
+package zygo
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+const bytecodeTestSrc = `
+(defmac twice [x] ^(begin ~x ~x))
+(defn fact [n] (cond (<= n 1) 1 (* n (fact (- n 1)))))
+(defn adder [k] (fn [x] (+ x k)))
+(def add3 (adder 3))
+(def total 0)
+(for [(def i 0) (< i 100) (set i (+ i 1))]
+  (cond (== i 5) (break) (set total (+ total i))))
+(twice (set total (+ total 1)))
+(def caught (try (/ 1 0) (catch e "div")))
+[(fact 10) (add3 4) total caught (quote (a "b" 2.5)) (concat "x" "y")]
+`
+
+func Test404CompiledCodeRoundTrips(t *testing.T) {
+
+	cv.Convey(`Code compiled by one environment, written out and read back into a fresh one, should run without reparsing and give the same result as loading the source`, t, func() {
+
+		direct := NewZlisp()
+		defer direct.Stop()
+		direct.StandardSetup()
+		want, err := direct.EvalString(bytecodeTestSrc)
+		cv.So(err, cv.ShouldBeNil)
+
+		compiler := NewZlisp()
+		defer compiler.Stop()
+		compiler.StandardSetup()
+		cc, err := compiler.Compile([]byte(bytecodeTestSrc), "prog.zy")
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(cc.Macros["twice"], cv.ShouldNotBeNil)
+
+		var buf bytes.Buffer
+		_, err = cc.WriteTo(&buf)
+		cv.So(err, cv.ShouldBeNil)
+
+		env := NewZlisp()
+		defer env.Stop()
+		env.StandardSetup()
+		loaded, err := env.ReadCompiled(bytes.NewReader(buf.Bytes()))
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(loaded.Key, cv.ShouldEqual, env.CompileKey("prog.zy", []byte(bytecodeTestSrc)))
+		cv.So(env.LoadCompiled(loaded), cv.ShouldBeNil)
+		got, err := env.Run()
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(got.SexpString(nil), cv.ShouldEqual, want.SexpString(nil))
+
+		// the macro came along, and positions survived
+		_, err = env.EvalString(`(def m 0) (twice (set m (+ m 1))) (assert (== m 2))`)
+		cv.So(err, cv.ShouldBeNil)
+		bad, err := compiler.Compile([]byte("\n(+ 1 \"a\")"), "bad.zy")
+		cv.So(err, cv.ShouldBeNil)
+		buf.Reset()
+		_, err = bad.WriteTo(&buf)
+		cv.So(err, cv.ShouldBeNil)
+		loaded, err = env.ReadCompiled(&buf)
+		cv.So(err, cv.ShouldBeNil)
+		env.Clear()
+		cv.So(env.LoadCompiled(loaded), cv.ShouldBeNil)
+		_, err = env.Run()
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(err.Error(), cv.ShouldStartWith, "bad.zy:2:1: ")
+
+		// other versions are refused
+		buf.Reset()
+		_, err = cc.WriteTo(&buf)
+		cv.So(err, cv.ShouldBeNil)
+		b := buf.Bytes()
+		b[len(bytecodeMagic)] = BytecodeVersion + 1
+		_, err = env.ReadCompiled(bytes.NewReader(b))
+		cv.So(err, cv.ShouldEqual, ErrBytecodeVersion)
+	})
+
+	cv.Convey(`LoadStringCached should write the compiled code under its content hash, and use it on the next load`, t, func() {
+		dir, err := ioutil.TempDir("", "zygo-bytecode")
+		cv.So(err, cv.ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		for i := 0; i < 2; i++ {
+			env := NewZlisp()
+			env.StandardSetup()
+			cv.So(env.LoadStringCached(bytecodeTestSrc, dir), cv.ShouldBeNil)
+			res, err := env.Run()
+			cv.So(err, cv.ShouldBeNil)
+			cv.So(res.(*SexpArray).Val[0].(*SexpInt).Val, cv.ShouldEqual, 3628800)
+			env.Stop()
+		}
+		files, err := filepath.Glob(filepath.Join(dir, "*.zyc"))
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(len(files), cv.ShouldEqual, 1)
+
+		// what the macros in force make of the source is part of the key.
+		env := NewZlisp()
+		defer env.Stop()
+		env.StandardSetup()
+		key := env.CompileKey("", []byte(`(twice 1)`))
+		_, err = env.EvalString(`(defmac twice [x] ^(begin ~x ~x))`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(env.CompileKey("", []byte(`(twice 1)`)), cv.ShouldNotEqual, key)
+		key = env.CompileKey("", []byte(`(twice 1)`))
+		_, err = env.EvalString(`(defmac twice [x] ^(list ~x ~x))`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(env.CompileKey("", []byte(`(twice 1)`)), cv.ShouldNotEqual, key)
+		env.WrapLoadExpressionsInInfix = true
+		cv.So(env.CompileKey("", []byte(`(twice 1)`)), cv.ShouldNotEqual, key)
+	})
+
+	cv.Convey(`LoadStringCached should reload code using select, and still load code it cannot cache`, t, func() {
+		dir, err := ioutil.TempDir("", "zygo-bytecode")
+		cv.So(err, cv.ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		const selectSrc = `(def ch (makeChan 1)) (send ch 7) (select (recv ch v (* v 2)))`
+		const goSrc = `(wait (go 42))`
+		for i := 0; i < 2; i++ {
+			env := NewZlisp()
+			env.StandardSetup()
+			cv.So(env.LoadStringCached(selectSrc, dir), cv.ShouldBeNil)
+			res, err := env.Run()
+			cv.So(err, cv.ShouldBeNil)
+			cv.So(res, cv.ShouldResemble, &SexpInt{Val: 14})
+
+			// a (go ...) block holds its code in a value
+			// with no serialized form.
+			env.Clear()
+			cv.So(env.LoadStringCached(goSrc, dir), cv.ShouldBeNil)
+			res, err = env.Run()
+			cv.So(err, cv.ShouldBeNil)
+			cv.So(res, cv.ShouldResemble, &SexpInt{Val: 42})
+			env.Stop()
+		}
+		files, err := filepath.Glob(filepath.Join(dir, "*.zyc"))
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(len(files), cv.ShouldEqual, 1)
+		f, err := os.Open(files[0])
+		cv.So(err, cv.ShouldBeNil)
+		defer f.Close()
+		env := NewZlisp()
+		defer env.Stop()
+		env.StandardSetup()
+		_, err = env.ReadCompiled(f)
+		cv.So(err, cv.ShouldBeNil)
+	})
+}
@@ -10,8 +10,10 @@ import (
 
 // Using reflection, invoke a Go method on a struct or interface.
 // args[0] is a hash with an an attached GoStruct
-// args[1] is a hash representing a method call on that struct.
-// The returned Sexp is a hash that represents the result of that call.
+// args[1] is the method name, as a symbol or string; args[2:] are
+// its arguments, converted to the method's parameter types.
+// The returned Sexp is an array holding the results of that call.
+// A non-nil error in the method's last result is returned as err.
 func CallGoMethodFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 	Q("_method user func running!\n")
 
@@ -73,122 +75,26 @@ func CallGoMethodFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 		}
 		// INVAR: var method holds our call target
 
-		// try always expecting this to be already done... test crashes
-		//P("in CallGoMethod '%s' obj.GoShadowStructVa = '%#v'", methodname, obj.GoShadowStructVa)
 		if obj.GoShadowStructVa.Kind() == reflect.Invalid {
-			// ready the struct... but only because there isn't already a shadow struct there!!
-			if !obj.ShadowSet {
-				_, err := ToGoFunction(env, "togo", []Sexp{obj})
-				if err != nil {
-					return SexpNull, fmt.Errorf("error converting object to Go struct: '%s'", err)
-				}
-			}
-		}
-		inputVa := []reflect.Value{(obj.GoShadowStructVa)}
-
-		// prep args.
-		needed := method.Type.NumIn() - 1 // one for the receiver
-		avail := narg - 2
-		if needed != avail {
-			// TODO: support varargs eventually
-			return SexpNull, fmt.Errorf("method %s needs %d arguments, but we have %d", method.Name, needed, avail)
-		}
-
-		var va reflect.Value
-		for i := 2; i < narg; i++ {
-			typ := method.Type.In(i - 1)
-			pdepth := PointerDepth(typ)
-			// we only handle 0 and 1 for now
-			Q("pdepth = %v\n", pdepth)
-			switch pdepth {
-			case 0:
-				va = reflect.New(typ)
-			case 1:
-				// handle the common single pointer to struct case
-				va = reflect.New(typ.Elem())
-			default:
-				return SexpNull, fmt.Errorf("error converting %d-th argument to "+
-					"Go: we don't handle double pointers", i-2)
-			}
-			Q("converting to go '%#v' into -> %#v\n", args[i], va.Interface())
-			iface, err := SexpToGoStructs(args[i], va.Interface(), env, nil)
+			// ready the struct, as there is none there yet.
+			_, err := ToGoFunction(env, "togo", []Sexp{obj})
 			if err != nil {
-				return SexpNull, fmt.Errorf("error converting %d-th "+
-					"argument to Go: '%s'", i-2, err)
-			}
-			switch pdepth {
-			case 0:
-				inputVa = append(inputVa, reflect.ValueOf(iface).Elem())
-			case 1:
-				inputVa = append(inputVa, reflect.ValueOf(iface))
+				return SexpNull, fmt.Errorf("error converting object to Go struct: '%s'", err)
 			}
-			Q("\n allocated new %T/val=%#v /i=%#v\n", va, va, va.Interface())
 		}
 
-		//P("_method: about to .Call by reflection!\n")
-
-		out := method.Func.Call(inputVa)
-
-		var iout []interface{}
-		for _, o := range out {
-			iout = append(iout, o.Interface())
+		// bound to the receiver, value receivers included.
+		fv := obj.GoShadowStructVa.MethodByName(method.Name)
+		if !fv.IsValid() {
+			return SexpNull, fmt.Errorf("method %s is not callable on %s",
+				method.Name, obj.GoShadowStructVa.Type())
 		}
-		Q("done with _method call, iout = %#v\n", iout)
-		Q("done with _method call, iout[0] = %#v\n", iout[0])
 
-		nout := len(out)
-		r := make([]Sexp, 0)
-		for i := 0; i < nout; i++ {
-			f := out[i].Interface()
-			switch e := f.(type) {
-			case nil:
-				r = append(r, SexpNull)
-			case int64:
-				r = append(r, &SexpInt{Val: e})
-			case int:
-				r = append(r, &SexpInt{Val: int64(e)})
-			case error:
-				r = append(r, &SexpError{e})
-			case string:
-				r = append(r, &SexpStr{S: e})
-			case float64:
-				r = append(r, &SexpFloat{Val: e})
-			case []byte:
-				r = append(r, &SexpRaw{Val: e})
-			case rune:
-				r = append(r, &SexpChar{Val: e})
-			default:
-				// go through the type registry
-				found := false
-				for hashName, factory := range GoStructRegistry.Registry {
-					st, err := factory.Factory(env, nil)
-					if err != nil {
-						return SexpNull, fmt.Errorf("MakeHash '%s' problem on Factory call: %s",
-							hashName, err)
-					}
-					Q("got st from Factory, checking if types match")
-					if reflect.ValueOf(st).Type() == out[i].Type() {
-						Q("types match")
-						retHash, err := MakeHash([]Sexp{}, factory.RegisteredName, env)
-						if err != nil {
-							return SexpNull, fmt.Errorf("MakeHash '%s' problem: %s",
-								hashName, err)
-						}
-
-						Q("filling from shadow")
-						err = retHash.FillHashFromShadow(env, f)
-						if err != nil {
-							return SexpNull, err
-						}
-						r = append(r, retHash)
-						found = true
-						break
-					}
-				}
-				if !found {
-					r = append(r, &SexpReflect{Val: out[i]})
-				}
-			}
+		// a non-nil trailing error comes back as err; the
+		// other results, a nil error among them, in r.
+		r, err := env.callGo(method.Name, fv, args[2:])
+		if err != nil {
+			return SexpNull, err
 		}
 		return env.NewSexpArray(r), nil
 	}()
@@ -200,6 +106,29 @@ func CallGoMethodFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 	return sx, err
 }
 
+// boundGoMethod returns a function that calls the Go method
+// methodname on h's attached Go struct, as _method does, or nil
+// if there is no such method. It lets (obj.Method args...) stand
+// for (_method obj Method args...).
+func (h *SexpHash) boundGoMethod(env *Zlisp, methodname string) *SexpFunction {
+	if h.GoStructFactory == nil || !h.GoStructFactory.hasShadowStruct {
+		return nil
+	}
+	if h.NumMethod == -1 && h.SetMethodList(env) != nil {
+		return nil
+	}
+	for _, me := range h.GoMethods {
+		if me.Name == methodname {
+			return MakeUserFunction(h.TypeName+"."+methodname,
+				func(env *Zlisp, name string, args []Sexp) (Sexp, error) {
+					return CallGoMethodFunction(env, name,
+						append([]Sexp{h, env.MakeSymbol(methodname)}, args...))
+				})
+		}
+	}
+	return nil
+}
+
 // detect if inteface is holding anything
 func NilOrHoldsNil(iface interface{}) bool {
 	if iface == nil {
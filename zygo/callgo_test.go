@@ -1,8 +1,9 @@
 package zygo
 
 import (
-	//"fmt"
+	"fmt"
 	"testing"
+	"time"
 
 	cv "github.com/glycerine/goconvey/convey"
 )
@@ -356,3 +357,143 @@ func Test018ReflectCallOnGoMethodsComplexReturnType(t *testing.T) {
 				` size:12 type:"sunny" details:[]byte{0x31, 0x32, 0x33})]`)
 		})
 }
+
+type Acct411 struct {
+	Owner   string `json:"owner"`
+	Balance int    `json:"balance"`
+}
+
+func (a *Acct411) Sum(base int, xs ...int) int {
+	for _, x := range xs {
+		base += x
+	}
+	return base
+}
+
+func (a Acct411) Label() string { return "acct of " + a.Owner }
+
+func (a *Acct411) Tally(m map[string]int, keys []string) (int, int) {
+	tot := 0
+	for _, k := range keys {
+		tot += m[k]
+	}
+	return tot, len(keys)
+}
+
+func (a *Acct411) Kind(v interface{}) string { return fmt.Sprintf("%T", v) }
+
+func (a *Acct411) Bump(pp **int) int {
+	**pp++
+	return **pp
+}
+
+func (a *Acct411) Withdraw(n int) (int, error) {
+	if n > a.Balance {
+		return 0, fmt.Errorf("%s cannot withdraw %d", a.Owner, n)
+	}
+	a.Balance -= n
+	return a.Balance, nil
+}
+
+func (a *Acct411) Counts() map[string]int {
+	return map[string]int{"b": 2, "a": 1}
+}
+
+func Test411CallGoMethodsOfAnyShape(t *testing.T) {
+
+	cv.Convey(`Given a Go type whose methods are variadic, take `+
+		`maps, slices, interfaces and double pointers, have value `+
+		`receivers, or return several results and errors, (obj.Method `+
+		`args...) and _method should call them all`, t, func() {
+
+		env := NewZlisp()
+		defer env.parser.Stop()
+		env.StandardSetup()
+		_, err := env.RegisterGoType("acct", &Acct411{})
+		panicOn(err)
+
+		x, err := env.EvalString(`
+(def a (acct owner:"ann" balance:10))
+[(a.Sum 1) (a.Sum 1 2 3) (_method a Sum: 4 5) (a.Label)
+ (a.Tally (hash b:3 c:4) ["b" "c" "d"])
+ (a.Kind 7) (a.Kind "s") (a.Bump 41) (a.Counts)]
+`)
+		panicOn(err)
+		cv.So(x.SexpString(nil), cv.ShouldEqual, `[[1] [6] [9] ["acct of ann"] `+
+			`[7 3] ["int64"] ["string"] [42] [ (hash a:1 b:2)]]`)
+
+		x, err = env.EvalString(`(a.Withdraw 4)`)
+		panicOn(err)
+		cv.So(x.SexpString(nil), cv.ShouldEqual, `[6 nil]`)
+
+		_, err = env.EvalString(`(a.Withdraw 40)`)
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "ann cannot withdraw 40")
+		env.Clear()
+
+		_, err = env.EvalString(`(a.Tally ["not" "a" "hash"] [])`)
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "argument 0 of Tally")
+		env.Clear()
+
+		_, err = env.EvalString(`(a.Nope)`)
+		cv.So(err, cv.ShouldNotBeNil)
+	})
+}
+
+func Test412MapsSlicesAndInterfacesRoundTrip(t *testing.T) {
+
+	cv.Convey(`Given a record for a Go struct with map, nested slice,`+
+		` array, interface{} and time.Duration fields, translating`+
+		` it to Go and back should lose nothing`, t, func() {
+
+		env := NewZlisp()
+		defer env.parser.Stop()
+
+		env.StandardSetup()
+
+		x, err := env.EvalString(`
+(def ck (cockpit dials:(hash alt:3 fuel:9)
+                 channels:(hash 121:"tower" 118:"ground" 9:"guard")
+                 notes:(hash n:1 f:2.5 s:"x" xs:[1 "two"] sub:(hash k:true))
+                 crew:(hash pilot:(persondemo first:"Amelia" last:"Earhart"))
+                 grid:[[1.0 2.0] [3.0]]
+                 trim:[0.5 1 2]
+                 extra:[7 "up"]
+                 timeout:"1m30s"))
+`)
+		panicOn(err)
+
+		var ck Cockpit
+		_, err = SexpToGoStructs(x, &ck, env, nil)
+		panicOn(err)
+		expect := Cockpit{
+			Dials:    map[string]int{"alt": 3, "fuel": 9},
+			Channels: map[int64]string{121: "tower", 118: "ground", 9: "guard"},
+			Notes: map[string]interface{}{"n": int64(1), "f": 2.5, "s": "x",
+				"xs":  []interface{}{int64(1), "two"},
+				"sub": map[string]interface{}{"k": true}},
+			Crew:    map[string]*Person{"pilot": {First: "Amelia", Last: "Earhart"}},
+			Grid:    [][]float64{{1, 2}, {3}},
+			Trim:    [3]float64{0.5, 1, 2},
+			Extra:   []interface{}{int64(7), "up"},
+			Timeout: 90 * time.Second,
+		}
+		cv.So(ck, cv.ShouldResemble, expect)
+
+		back, err := MakeHash(nil, "cockpit", env)
+		panicOn(err)
+		panicOn(back.FillHashFromShadow(env, &ck))
+		cv.So(back.SexpString(nil), cv.ShouldEqual, ` (cockpit dials: (hash alt:3 fuel:9)`+
+			` channels: (hash 9:"guard" 118:"ground" 121:"tower")`+
+			` notes: (hash f:2.50 n:1 s:"x" sub: (hash k:true) xs:[1 "two"])`+
+			` crew: (hash pilot: (persondemo first:"Amelia" last:"Earhart"))`+
+			` grid:[[1.00 2.00] [3.00]] trim:[0.50 1.00 2.00] extra:[7 "up"]`+
+			` timeout:90000000000)`)
+
+		var ck2 Cockpit
+		_, err = SexpToGoStructs(back, &ck2, env, nil)
+		panicOn(err)
+		cv.So(ck2, cv.ShouldResemble, expect)
+	})
+}
@@ -22,6 +22,9 @@ type ZlispConfig struct {
 	NoLiner bool
 	Prompt  string // default "zygo> "
 
+	// Stacks caps how deep the VM's stacks may grow;
+	// zero fields take the defaults.
+	Stacks StackSizes
 }
 
 func NewZlispConfig(cmdname string) *ZlispConfig {
@@ -41,6 +44,10 @@ func (c *ZlispConfig) DefineFlags() {
 	c.Flags.BoolVar(&c.Quiet, "quiet", false, "start repl without printing the version/mode/help banner")
 	c.Flags.BoolVar(&c.Trace, "trace", false, "trace execution (warning: very verbose and slow)")
 	c.Flags.BoolVar(&c.LoadDemoStructs, "demo", false, "load the demo structs: Event, Snoopy, Hornet, Weather and friends.")
+	c.Flags.IntVar(&c.Stacks.CallStack, "callstack", CallStackSize, "most calls in progress at once; deeper recursion is a stack overflow")
+	c.Flags.IntVar(&c.Stacks.ScopeStack, "scopestack", ScopeStackSize, "most scopes open at once")
+	c.Flags.IntVar(&c.Stacks.DataStack, "datastack", DataStackSize, "most values on the data stack")
+	c.Flags.IntVar(&c.Stacks.LoopStack, "loopstack", LoopStackSize, "most deeply loops may nest")
 }
 
 // call c.ValidateConfig() after myflags.Parse()
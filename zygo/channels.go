@@ -3,14 +3,20 @@ package zygo
 import (
 	"errors"
 	"fmt"
+	"reflect"
 )
 
+// SexpChannel is made by (makeChan). When Typ is set, only
+// values of that type (or assignable to it) may be sent.
 type SexpChannel struct {
 	Val chan Sexp
 	Typ *RegisteredType
 }
 
 func (ch *SexpChannel) SexpString(ps *PrintState) string {
+	if ch.Typ != nil {
+		return "[chan " + ch.Typ.ShortName() + "]"
+	}
 	return "[chan]"
 }
 
@@ -18,12 +24,22 @@ func (ch *SexpChannel) Type() *RegisteredType {
 	return ch.Typ // TODO what should this be?
 }
 
+// (makeChan), (makeChan size), (makeChan type) or
+// (makeChan type size), e.g. (makeChan int64 10).
 func MakeChanFunction(env *Zlisp, name string,
 	args []Sexp) (Sexp, error) {
-	if len(args) > 1 {
+	if len(args) > 2 {
 		return SexpNull, WrongNargs
 	}
 
+	var typ *RegisteredType
+	if len(args) > 0 {
+		if rt, isType := args[0].(*RegisteredType); isType {
+			typ = rt
+			args = args[1:]
+		}
+	}
+
 	size := 0
 	if len(args) == 1 {
 		switch t := args[0].(type) {
@@ -33,9 +49,38 @@ func MakeChanFunction(env *Zlisp, name string,
 			return SexpNull, errors.New(
 				fmt.Sprintf("argument to %s must be int", name))
 		}
+	} else if len(args) > 1 {
+		return SexpNull, WrongNargs
+	}
+
+	return &SexpChannel{Val: make(chan Sexp, size), Typ: typ}, nil
+}
+
+// checkSend reports an error if v may not be sent on ch.
+func (ch *SexpChannel) checkSend(v Sexp) error {
+	if ch.Typ == nil || v == SexpNull {
+		return nil
+	}
+	vt := v.Type()
+	if vt == ch.Typ {
+		return nil
+	}
+	if vt != nil && vt.TypeCache != nil && ch.Typ.TypeCache != nil &&
+		vt.TypeCache.AssignableTo(ch.Typ.TypeCache) {
+		return nil
+	}
+	vname := "untyped value"
+	if vt != nil {
+		vname = vt.ShortName()
 	}
+	return fmt.Errorf("cannot send %s on channel of %s", vname, ch.Typ.ShortName())
+}
 
-	return &SexpChannel{Val: make(chan Sexp, size)}, nil
+// send and close panic on a closed channel; turn that into an error.
+func recoverClosed(err *error) {
+	if r := recover(); r != nil {
+		*err = fmt.Errorf("%v", r)
+	}
 }
 
 func ChanTxFunction(env *Zlisp, name string,
@@ -56,15 +101,221 @@ func ChanTxFunction(env *Zlisp, name string,
 		if len(args) != 2 {
 			return SexpNull, WrongNargs
 		}
-		channel <- args[1]
-		return SexpNull, nil
+		return SexpNull, env.send(args[0].(*SexpChannel), args[1])
+	}
+
+	if len(args) != 1 {
+		return SexpNull, WrongNargs
+	}
+	v, ok, err := env.receive(channel)
+	if err != nil {
+		return SexpNull, err
+	}
+	if name == "recv" {
+		return env.NewSexpArray([]Sexp{v, &SexpBool{Val: ok}}), nil
+	}
+	return v, nil
+}
+
+func (env *Zlisp) send(ch *SexpChannel, v Sexp) (err error) {
+	err = ch.checkSend(v)
+	if err != nil {
+		return err
+	}
+	defer recoverClosed(&err)
+	if env.ctx == nil {
+		ch.Val <- v
+		return nil
+	}
+	select {
+	case ch.Val <- v:
+		return nil
+	case <-env.ctx.Done():
+		return env.checkContext()
+	}
+}
+
+// receive takes the next value from channel, or SexpNull and
+// false once channel is closed.
+func (env *Zlisp) receive(channel chan Sexp) (Sexp, bool, error) {
+	if env.ctx == nil {
+		v, ok := <-channel
+		if !ok {
+			return SexpNull, false, nil
+		}
+		return v, true, nil
+	}
+	select {
+	case v, ok := <-channel:
+		if !ok {
+			return SexpNull, false, nil
+		}
+		return v, true, nil
+	case <-env.ctx.Done():
+		return SexpNull, false, env.checkContext()
+	}
+}
+
+func CloseChanFunction(env *Zlisp, name string,
+	args []Sexp) (result Sexp, err error) {
+	if len(args) != 1 {
+		return SexpNull, WrongNargs
+	}
+	ch, isChan := args[0].(*SexpChannel)
+	if !isChan {
+		return SexpNull, fmt.Errorf("argument to %s must be channel", name)
+	}
+	defer recoverClosed(&err)
+	close(ch.Val)
+	return SexpNull, nil
+}
+
+var sxSelect = MakeUserFunction("__select", SelectFunction)
+
+// SelectFunction does the work of the select macro. Its
+// arguments are a bool saying whether there is a default
+// clause, then a triple of kind ("recv" or "send"), channel
+// and value to send for each case. It returns [index value ok],
+// where index is that of the case chosen, or -1 for default.
+func SelectFunction(env *Zlisp, name string,
+	args []Sexp) (result Sexp, err error) {
+	if len(args) < 1 || (len(args)-1)%3 != 0 {
+		return SexpNull, WrongNargs
+	}
+	hasDefault := IsTruthy(args[0])
+	var cases []reflect.SelectCase
+	for i := 1; i < len(args); i += 3 {
+		ch, isChan := args[i+1].(*SexpChannel)
+		if !isChan {
+			return SexpNull, fmt.Errorf("select case %d: %s is not a channel",
+				i/3, args[i+1].SexpString(nil))
+		}
+		c := reflect.SelectCase{Chan: reflect.ValueOf(ch.Val)}
+		switch args[i].(*SexpStr).S {
+		case "send":
+			err = ch.checkSend(args[i+2])
+			if err != nil {
+				return SexpNull, err
+			}
+			c.Dir = reflect.SelectSend
+			c.Send = reflect.ValueOf(&args[i+2]).Elem()
+		default:
+			c.Dir = reflect.SelectRecv
+		}
+		cases = append(cases, c)
+	}
+	ncase := len(cases)
+	if hasDefault {
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectDefault})
+	} else if env.ctx != nil {
+		cases = append(cases, reflect.SelectCase{
+			Dir: reflect.SelectRecv, Chan: reflect.ValueOf(env.ctx.Done())})
+	}
+
+	defer recoverClosed(&err)
+	chosen, recv, ok := reflect.Select(cases)
+	if chosen == ncase {
+		if hasDefault {
+			chosen = -1
+		} else {
+			return SexpNull, env.checkContext()
+		}
+	}
+	var v Sexp = SexpNull
+	if ok {
+		v = recv.Interface().(Sexp)
+	}
+	return env.NewSexpArray([]Sexp{&SexpInt{Val: int64(chosen)}, v, &SexpBool{Val: ok}}), nil
+}
+
+// SelectMacro expands
+//
+//	(select (recv ch v body...) (send ch x body...) (default body...))
+//
+// into a call of SelectFunction followed by a cond on the case
+// chosen. A recv clause may bind [v ok] instead of v, ok being
+// false when the channel has been closed.
+func SelectMacro(env *Zlisp, name string,
+	args []Sexp) (Sexp, error) {
+
+	sel := env.GenSymbol("__select")
+	idx := env.GenSymbol("__selidx")
+	aget := env.MakeSymbol("aget")
+	begin := env.MakeSymbol("begin")
+
+	hasDefault := false
+	var defaultBody []Sexp
+	callArgs := []Sexp{nil}
+	var arms []Sexp
+
+	for i, clause := range args {
+		parts, err := ListToArray(clause)
+		if err != nil || len(parts) == 0 {
+			return SexpNull, fmt.Errorf("select clause %d must be a list", i)
+		}
+		kind, isSym := parts[0].(*SexpSymbol)
+		if !isSym {
+			return SexpNull, fmt.Errorf("select clause %d must start with recv, send or default", i)
+		}
+		switch kind.name {
+		case "default":
+			if hasDefault {
+				return SexpNull, fmt.Errorf("select has more than one default clause")
+			}
+			hasDefault = true
+			defaultBody = parts[1:]
+			continue
+		case "recv", "send":
+			if len(parts) < 3 {
+				return SexpNull, fmt.Errorf("select clause %d: %s needs a channel and a value", i, kind.name)
+			}
+		default:
+			return SexpNull, fmt.Errorf("select clause %d must start with recv, send or default, not %s", i, kind.name)
+		}
+
+		n := &SexpInt{Val: int64(len(arms) / 2)}
+		body := MakeList(append([]Sexp{begin}, parts[3:]...))
+		if kind.name == "send" {
+			callArgs = append(callArgs, &SexpStr{S: "send"}, parts[1], parts[2])
+		} else {
+			callArgs = append(callArgs, &SexpStr{S: "recv"}, parts[1], SexpNull)
+			var bindings []Sexp
+			switch v := parts[2].(type) {
+			case *SexpSymbol:
+				bindings = []Sexp{v, MakeList([]Sexp{aget, sel, &SexpInt{Val: 1}})}
+			case *SexpArray:
+				if len(v.Val) != 2 {
+					return SexpNull, fmt.Errorf("select clause %d: recv binds v or [v ok]", i)
+				}
+				bindings = []Sexp{
+					v.Val[0], MakeList([]Sexp{aget, sel, &SexpInt{Val: 1}}),
+					v.Val[1], MakeList([]Sexp{aget, sel, &SexpInt{Val: 2}})}
+			default:
+				return SexpNull, fmt.Errorf("select clause %d: recv binds v or [v ok]", i)
+			}
+			body = MakeList([]Sexp{env.MakeSymbol("let"),
+				&SexpArray{Val: bindings, Env: env}, body})
+		}
+		arms = append(arms, MakeList([]Sexp{env.MakeSymbol("=="), idx, n}), body)
 	}
+	callArgs[0] = &SexpBool{Val: hasDefault}
+	arms = append(arms, MakeList(append([]Sexp{begin}, defaultBody...)))
 
-	return <-channel, nil
+	// (letseq [sel (apply SelectFunction [...]) idx (aget sel 0)] (cond ...))
+	call := MakeList([]Sexp{env.MakeSymbol("apply"),
+		sxSelect,
+		&SexpArray{Val: callArgs, Env: env}})
+	return MakeList([]Sexp{env.MakeSymbol("letseq"),
+		&SexpArray{Val: []Sexp{sel, call,
+			idx, MakeList([]Sexp{aget, sel, &SexpInt{Val: 0}})}, Env: env},
+		MakeList(append([]Sexp{env.MakeSymbol("cond")}, arms...))}), nil
 }
 
 func (env *Zlisp) ImportChannels() {
 	env.AddFunction("makeChan", MakeChanFunction)
 	env.AddFunction("send", ChanTxFunction)
 	env.AddFunction("<!", ChanTxFunction)
+	env.AddFunction("recv", ChanTxFunction)
+	env.AddFunction("close", CloseChanFunction)
+	env.AddMacro("select", SelectMacro)
 }
@@ -69,7 +69,7 @@ func (env *Zlisp) FunctionCallNameTypeCheck(f *SexpFunction, nargs *int) error {
 		}
 
 		// prep finalArgs in the order dictated
-		for i, key := range f.inputTypes.KeyOrder {
+		for i, key := range f.inputTypes.Keys() {
 			switch sy := key.(type) {
 			case *SexpSymbol:
 				// search for sy.name in our submittedByName args
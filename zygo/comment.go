@@ -10,7 +10,7 @@ func (p *SexpComment) SexpString(ps *PrintState) string {
 }
 
 func (p *SexpComment) Type() *RegisteredType {
-	return GoStructRegistry.Registry["comment"]
+	return GoStructRegistry.Lookup("comment")
 }
 
 // Filters return true to keep, false to drop.
@@ -101,5 +101,9 @@ func (env *Zlisp) FilterList(h *SexpPair, f Filter) Sexp {
 		return h
 	}
 	res = env.FilterArray(arr, f)
-	return MakeList(res)
+	list := MakeList(res)
+	if pair, isPair := list.(*SexpPair); isPair {
+		pair.Pos = h.Pos
+	}
+	return list
 }
@@ -2,28 +2,101 @@ package zygo
 
 import (
 	"errors"
+	"fmt"
+	"runtime"
 )
 
+// SexpGoroutine is what (go ...) returns: a handle on the
+// running body, for (wait g), (done? g) and (waitAll [g ...]).
+// The (go ...) macro also uses one, never started, to hold the
+// body's code; each start makes a fresh handle from it.
 type SexpGoroutine struct {
 	env *Zlisp
+
+	// done is closed once the body has finished,
+	// after result and err are set.
+	done   chan struct{}
+	result Sexp
+	err    error
 }
 
 func (goro *SexpGoroutine) SexpString(ps *PrintState) string {
-	return "[coroutine]"
+	if goro.done == nil {
+		return "[coroutine]"
+	}
+	if goro.IsDone() {
+		return "[coroutine done]"
+	}
+	return "[coroutine running]"
 }
 func (goro *SexpGoroutine) Type() *RegisteredType {
 	return nil // TODO what goes here
 }
 
+// IsDone reports whether the goroutine has finished.
+func (goro *SexpGoroutine) IsDone() bool {
+	select {
+	case <-goro.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Wait blocks until the goroutine finishes, and returns the
+// value of its body or the error that stopped it.
+func (goro *SexpGoroutine) Wait() (Sexp, error) {
+	<-goro.done
+	return goro.result, goro.err
+}
+
+// wait is Wait, giving up if env is cancelled first.
+func (env *Zlisp) wait(goro *SexpGoroutine) (Sexp, error) {
+	if env.ctx == nil {
+		return goro.Wait()
+	}
+	select {
+	case <-goro.done:
+		return goro.result, goro.err
+	case <-env.ctx.Done():
+		return SexpNull, env.checkContext()
+	}
+}
+
 func StartGoroutineFunction(env *Zlisp, name string,
 	args []Sexp) (Sexp, error) {
 	switch t := args[0].(type) {
 	case *SexpGoroutine:
-		go t.env.Run()
-	default:
-		return SexpNull, errors.New("not a goroutine")
+		// a (go ...) inside a loop is started many times over,
+		// so give each start its own stacks.
+		goroenv := t.env.Duplicate()
+		goroenv.mainfunc.fun = t.env.mainfunc.fun
+		goroenv.ctx = env.ctx
+		goro := &SexpGoroutine{env: goroenv, done: make(chan struct{})}
+		if env.limits != nil {
+			// the body spends the budget of the Run starting it,
+			// and is stopped once that is spent.
+			goroenv.limits = env.limits
+			goroenv.budget = env.instrBudget()
+			goroenv.budgetContext(goro.done)
+		}
+		go func() {
+			defer close(goro.done)
+			// a panic must not take the host process down
+			// with it; (wait g) raises it instead.
+			defer func() {
+				if recovered := recover(); recovered != nil {
+					tr := make([]byte, 16384)
+					tr = tr[:runtime.Stack(tr, false)]
+					goro.result = SexpNull
+					goro.err = fmt.Errorf("goroutine panicked: '%v'\nstack trace:\n%s", recovered, tr)
+				}
+			}()
+			goro.result, goro.err = goroenv.Run()
+		}()
+		return goro, nil
 	}
-	return SexpNull, nil
+	return SexpNull, errors.New("not a goroutine")
 }
 
 func CreateGoroutineMacro(env *Zlisp, name string,
@@ -31,9 +104,9 @@ func CreateGoroutineMacro(env *Zlisp, name string,
 	goroenv := env.Duplicate()
 	err := goroenv.LoadExpressions(args)
 	if err != nil {
-		return SexpNull, nil
+		return SexpNull, err
 	}
-	goro := &SexpGoroutine{goroenv}
+	goro := &SexpGoroutine{env: goroenv}
 
 	// (apply StartGoroutineFunction [goro])
 	return MakeList([]Sexp{env.MakeSymbol("apply"),
@@ -41,6 +114,86 @@ func CreateGoroutineMacro(env *Zlisp, name string,
 		&SexpArray{Val: []Sexp{goro}, Env: env}}), nil
 }
 
+func toGoroutine(name string, x Sexp) (*SexpGoroutine, error) {
+	goro, isGoro := x.(*SexpGoroutine)
+	if !isGoro || goro.done == nil {
+		return nil, fmt.Errorf("%s needs a goroutine started by (go ...), not %s",
+			name, x.SexpString(nil))
+	}
+	return goro, nil
+}
+
+// (wait g) returns the value of g's body, or raises its error.
+func WaitGoroutineFunction(env *Zlisp, name string,
+	args []Sexp) (Sexp, error) {
+	if len(args) != 1 {
+		return SexpNull, WrongNargs
+	}
+	goro, err := toGoroutine(name, args[0])
+	if err != nil {
+		return SexpNull, err
+	}
+	return env.wait(goro)
+}
+
+// (done? g) reports whether g has finished, without blocking.
+func DoneGoroutineFunction(env *Zlisp, name string,
+	args []Sexp) (Sexp, error) {
+	if len(args) != 1 {
+		return SexpNull, WrongNargs
+	}
+	goro, err := toGoroutine(name, args[0])
+	if err != nil {
+		return SexpNull, err
+	}
+	return &SexpBool{Val: goro.IsDone()}, nil
+}
+
+// (waitAll [g1 g2 ...]) waits for every goroutine to finish and
+// returns their values in an array. If any failed, the first
+// such error (in array order) is raised once all are done.
+func WaitAllGoroutinesFunction(env *Zlisp, name string,
+	args []Sexp) (Sexp, error) {
+	if len(args) != 1 {
+		return SexpNull, WrongNargs
+	}
+	arr, isArr := args[0].(*SexpArray)
+	if !isArr {
+		return SexpNull, fmt.Errorf("%s needs an array of goroutines", name)
+	}
+	goros := make([]*SexpGoroutine, len(arr.Val))
+	for i, x := range arr.Val {
+		goro, err := toGoroutine(name, x)
+		if err != nil {
+			return SexpNull, err
+		}
+		goros[i] = goro
+	}
+
+	results := make([]Sexp, len(goros))
+	var firstErr error
+	for i, goro := range goros {
+		res, err := env.wait(goro)
+		if err != nil {
+			if _, cancelled := err.(*CancelledError); cancelled {
+				return SexpNull, err
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			res = SexpNull
+		}
+		results[i] = res
+	}
+	if firstErr != nil {
+		return SexpNull, firstErr
+	}
+	return env.NewSexpArray(results), nil
+}
+
 func (env *Zlisp) ImportGoroutines() {
 	env.AddMacro("go", CreateGoroutineMacro)
+	env.AddFunction("wait", WaitGoroutineFunction)
+	env.AddFunction("done?", DoneGoroutineFunction)
+	env.AddFunction("waitAll", WaitAllGoroutinesFunction)
 }
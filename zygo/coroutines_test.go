@@ -0,0 +1,114 @@
+package zygo
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+// run these with go test -race to be useful.
+
+func Test405GoroutinesShareStateSafely(t *testing.T) {
+
+	cv.Convey(`Scripts that start many (go ...) blocks, each interning new symbols, defining globals, macros and struct types, and talking over channels, should run without data races`, t, func() {
+		env := NewZlisp()
+		defer env.Stop()
+		env.StandardSetup()
+
+		res, err := env.EvalString(`
+(def ch (makeChan))
+(def n 16)
+(def shared 0)
+(defn work []
+  (def total 0)
+  (for [(def j 0) (< j 10) (set j (+ j 1))]
+    (cond (== j 5) (break) (set total (+ total j))))
+  total)
+(for [(def i 0) (< i n) (set i (+ i 1))]
+  (go
+    (def mine (gensym))
+    (str2sym (concat "fresh" (str mine)))
+    (eval (quote (defmac twice [x] ^(begin ~x ~x))))
+    (struct Pt [(field X: int64) (field Next: (* Pt))])
+    (set shared (+ 1 shared))
+    (send ch [mine (work)])))
+(def got 0)
+(for [(def k 0) (< k n) (set k (+ k 1))]
+  (def r (<! ch))
+  (assert (== (aget r 1) 10))
+  (set got (+ got 1)))
+got
+`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.(*SexpInt).Val, cv.ShouldEqual, 16)
+	})
+
+	cv.Convey(`Environments made with Duplicate should agree on symbol numbers when interning concurrently`, t, func() {
+		env := NewZlisp()
+		defer env.Stop()
+		env.StandardSetup()
+
+		var wg sync.WaitGroup
+		syms := make([][]*SexpSymbol, 8)
+		for g := range syms {
+			wg.Add(1)
+			dup := env.Duplicate()
+			go func(g int, dup *Zlisp) {
+				defer wg.Done()
+				for i := 0; i < 100; i++ {
+					syms[g] = append(syms[g], dup.MakeSymbol(fmt.Sprintf("concurrent%d", i)))
+				}
+				_, err := dup.EvalString(fmt.Sprintf(`(def fromDup%d %d)`, g, g))
+				if err != nil {
+					t.Error(err)
+				}
+			}(g, dup)
+		}
+		wg.Wait()
+
+		for g := range syms {
+			for i, sym := range syms[g] {
+				cv.So(sym.number, cv.ShouldEqual, syms[0][i].number)
+			}
+			v, err := env.EvalString(fmt.Sprintf(`(+ fromDup%d 0)`, g))
+			cv.So(err, cv.ShouldBeNil)
+			cv.So(v.(*SexpInt).Val, cv.ShouldEqual, g)
+		}
+	})
+}
+
+func Test406GoReturnsAWaitableHandle(t *testing.T) {
+
+	cv.Convey(`(go ...) should return a *SexpGoroutine whose Wait gives the body's value or error`, t, func() {
+		env := NewZlisp()
+		defer env.Stop()
+		env.StandardSetup()
+
+		x, err := env.EvalString(`(go (* 6 7))`)
+		cv.So(err, cv.ShouldBeNil)
+		goro, isGoro := x.(*SexpGoroutine)
+		cv.So(isGoro, cv.ShouldBeTrue)
+		res, err := goro.Wait()
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.(*SexpInt).Val, cv.ShouldEqual, 42)
+		cv.So(goro.IsDone(), cv.ShouldBeTrue)
+
+		x, err = env.EvalString(`(go (+ 1 "a"))`)
+		cv.So(err, cv.ShouldBeNil)
+		_, err = x.(*SexpGoroutine).Wait()
+		cv.So(err, cv.ShouldNotBeNil)
+		// a panic in the body comes back from Wait.
+		env.AddPreHook(func(env *Zlisp, name string, args []Sexp) {
+			if name == "explode" {
+				panic("boom")
+			}
+		})
+		x, err = env.EvalString(`(defn explode [] 1) (go (explode))`)
+		cv.So(err, cv.ShouldBeNil)
+		_, err = x.(*SexpGoroutine).Wait()
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(err.Error(), cv.ShouldStartWith, "goroutine panicked: 'boom'")
+	})
+}
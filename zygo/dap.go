@@ -0,0 +1,682 @@
+package zygo
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The Debug Adapter Protocol.
+//
+// `zygo dap` lets an editor debug a script: it reads requests
+// from stdin and writes responses and events to stdout, each a
+// JSON message after a Content-Length header, as the protocol
+// at https://microsoft.github.io/debug-adapter-protocol/ has
+// it. The editor launches one script, with the program named
+// in the launch arguments, and drives the Debugger through it.
+//
+// The script runs in a goroutine of its own. When it stops,
+// its OnStop handler waits for the editor to resume it; in the
+// meantime the requests that look at the paused script are
+// served from the goroutine reading them. There is one thread,
+// numbered 1.
+
+// DapMain implements `zygo dap`. What the script prints goes
+// to the editor as output events.
+func DapMain(args []string) error {
+	fs := flag.NewFlagSet("zygo dap", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: zygo dap\n\nspeaks the Debug Adapter Protocol on stdin and stdout.\n")
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+
+	out := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	os.Stdout = w
+	defer func() {
+		os.Stdout = out
+		w.Close()
+	}()
+	s := newDapServer(out)
+	go s.copyOutput(r)
+	return s.serve(os.Stdin)
+}
+
+// ServeDAP serves the Debug Adapter Protocol, reading requests
+// from in and writing to out, until the editor disconnects or
+// in ends.
+func ServeDAP(in io.Reader, out io.Writer) error {
+	return newDapServer(out).serve(in)
+}
+
+type dapRequest struct {
+	Seq       int             `json:"seq"`
+	Type      string          `json:"type"`
+	Command   string          `json:"command"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+type dapResponse struct {
+	Seq        int         `json:"seq"`
+	Type       string      `json:"type"`
+	RequestSeq int         `json:"request_seq"`
+	Success    bool        `json:"success"`
+	Command    string      `json:"command"`
+	Message    string      `json:"message,omitempty"`
+	Body       interface{} `json:"body,omitempty"`
+}
+
+type dapEvent struct {
+	Seq   int         `json:"seq"`
+	Type  string      `json:"type"`
+	Event string      `json:"event"`
+	Body  interface{} `json:"body,omitempty"`
+}
+
+type dapSource struct {
+	Name string `json:"name,omitempty"`
+	Path string `json:"path,omitempty"`
+}
+
+type dapBreakpoint struct {
+	ID       int        `json:"id"`
+	Verified bool       `json:"verified"`
+	Line     int        `json:"line,omitempty"`
+	Source   *dapSource `json:"source,omitempty"`
+}
+
+type dapStackFrame struct {
+	ID     int        `json:"id"`
+	Name   string     `json:"name"`
+	Source *dapSource `json:"source,omitempty"`
+	Line   int        `json:"line"`
+	Column int        `json:"column"`
+}
+
+type dapScope struct {
+	Name               string `json:"name"`
+	VariablesReference int    `json:"variablesReference"`
+	Expensive          bool   `json:"expensive"`
+}
+
+type dapVariable struct {
+	Name               string `json:"name"`
+	Value              string `json:"value"`
+	Type               string `json:"type,omitempty"`
+	VariablesReference int    `json:"variablesReference"`
+}
+
+type dapServer struct {
+	wmu sync.Mutex // guards w and seq
+	w   io.Writer
+	seq int
+
+	env *Zlisp
+	d   *Debugger
+
+	// the breakpoints set for each source path, "" for the
+	// function breakpoints, as the editor sets them all at
+	// once.
+	breaks map[string][]int
+
+	launched, configured bool
+	stopOnEntry          bool
+	ctx                  context.Context
+	cancel               context.CancelFunc
+	done                 chan struct{}
+
+	// mu guards stopped and refs, which the goroutine
+	// running the script sets when it stops, and the one
+	// serving requests when it resumes the script.
+	mu      sync.Mutex
+	stopped bool
+	resume  chan func(d *Debugger) error
+
+	// refs holds what each variablesReference, less one,
+	// stands for while the script is stopped: the []Local
+	// of a scope, a Sexp, or a reflect.Value.
+	refs []interface{}
+}
+
+func newDapServer(w io.Writer) *dapServer {
+	s := &dapServer{
+		w:      w,
+		breaks: make(map[string][]int),
+		resume: make(chan func(d *Debugger) error, 1),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	s.env = NewZlisp()
+	s.env.StandardSetup()
+	s.d = s.env.Debugger()
+	s.d.OnStop = s.onStop
+	return s
+}
+
+func (s *dapServer) serve(in io.Reader) error {
+	defer s.shutdown()
+	r := bufio.NewReader(in)
+	for {
+		buf, err := readFramed(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var req dapRequest
+		if err := json.Unmarshal(buf, &req); err != nil {
+			return fmt.Errorf("bad message: %s", err)
+		}
+		if req.Type != "request" {
+			continue
+		}
+		body, then, err := s.handle(&req)
+		resp := &dapResponse{Type: "response", RequestSeq: req.Seq, Command: req.Command, Success: err == nil, Body: body}
+		if err != nil {
+			resp.Message = err.Error()
+		}
+		if err := s.send(resp); err != nil {
+			return err
+		}
+		// what starts or resumes the script waits for the
+		// response, so that its events come after it.
+		if then != nil && err == nil {
+			then()
+		}
+		switch req.Command {
+		case "initialize":
+			s.event("initialized", nil)
+		case "disconnect", "terminate":
+			return nil
+		}
+	}
+}
+
+// readFramed reads one message, after its headers. The debug
+// adapter and language server protocols frame messages alike.
+func readFramed(r *bufio.Reader) ([]byte, error) {
+	n := -1
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			if err == io.EOF && line != "" {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		if i := strings.Index(line, ":"); i > 0 && strings.EqualFold(line[:i], "Content-Length") {
+			n, err = strconv.Atoi(strings.TrimSpace(line[i+1:]))
+			if err != nil {
+				return nil, fmt.Errorf("bad header '%s'", line)
+			}
+		}
+	}
+	if n < 0 {
+		return nil, fmt.Errorf("message without a Content-Length")
+	}
+	buf := make([]byte, n)
+	_, err := io.ReadFull(r, buf)
+	return buf, err
+}
+
+func (s *dapServer) send(msg interface{}) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	s.seq++
+	switch m := msg.(type) {
+	case *dapResponse:
+		m.Seq = s.seq
+	case *dapEvent:
+		m.Seq = s.seq
+	}
+	return writeFramed(s.w, msg)
+}
+
+// writeFramed writes msg as JSON, after its header.
+func writeFramed(w io.Writer, msg interface{}) error {
+	buf, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "Content-Length: %d\r\n\r\n%s", len(buf), buf)
+	return err
+}
+
+func (s *dapServer) event(name string, body interface{}) {
+	s.send(&dapEvent{Type: "event", Event: name, Body: body})
+}
+
+// copyOutput sends what the script prints as output events.
+func (s *dapServer) copyOutput(r io.Reader) {
+	buf := make([]byte, 4096)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			s.event("output", map[string]interface{}{"category": "stdout", "output": string(buf[:n])})
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// handle answers req. What it returns to do next is run once
+// the response has been sent.
+func (s *dapServer) handle(req *dapRequest) (body interface{}, then func(), err error) {
+	switch req.Command {
+	case "initialize":
+		return map[string]interface{}{
+			"supportsConfigurationDoneRequest": true,
+			"supportsFunctionBreakpoints":      true,
+			"supportsEvaluateForHovers":        true,
+			"supportsTerminateRequest":         true,
+		}, nil, nil
+	case "launch":
+		return nil, s.start, s.launch(req.Arguments)
+	case "setBreakpoints":
+		body, err = s.setBreakpoints(req.Arguments)
+		return body, nil, err
+	case "setFunctionBreakpoints":
+		body, err = s.setFunctionBreakpoints(req.Arguments)
+		return body, nil, err
+	case "setExceptionBreakpoints":
+		return map[string]interface{}{"breakpoints": []dapBreakpoint{}}, nil, nil
+	case "configurationDone":
+		s.configured = true
+		return nil, s.start, nil
+	case "threads":
+		return map[string]interface{}{"threads": []map[string]interface{}{{"id": 1, "name": "main"}}}, nil, nil
+	case "pause":
+		s.d.Pause()
+		return nil, nil, nil
+	case "continue":
+		then, err = s.resumeWith((*Debugger).Continue)
+		return map[string]interface{}{"allThreadsContinued": true}, then, err
+	case "next":
+		then, err = s.resumeWith((*Debugger).StepOver)
+		return nil, then, err
+	case "stepIn":
+		then, err = s.resumeWith((*Debugger).StepInto)
+		return nil, then, err
+	case "stepOut":
+		then, err = s.resumeWith((*Debugger).StepOut)
+		return nil, then, err
+	case "disconnect", "terminate":
+		return nil, nil, nil
+	}
+
+	// the rest look at the stopped script.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.stopped {
+		return nil, nil, fmt.Errorf("%s: the script is not stopped", req.Command)
+	}
+	switch req.Command {
+	case "stackTrace":
+		return s.stackTrace(), nil, nil
+	case "scopes":
+		var a struct {
+			FrameID int `json:"frameId"`
+		}
+		if err := dapArgs(req.Arguments, &a); err != nil {
+			return nil, nil, err
+		}
+		return map[string]interface{}{"scopes": []dapScope{
+			{Name: "Locals", VariablesReference: s.ref(s.d.FrameLocals(a.FrameID - 1))},
+			{Name: "Globals", VariablesReference: s.ref(s.d.Globals()), Expensive: true},
+		}}, nil, nil
+	case "variables":
+		var a struct {
+			VariablesReference int `json:"variablesReference"`
+		}
+		if err := dapArgs(req.Arguments, &a); err != nil {
+			return nil, nil, err
+		}
+		if a.VariablesReference < 1 || a.VariablesReference > len(s.refs) {
+			return nil, nil, fmt.Errorf("no variables %d", a.VariablesReference)
+		}
+		return map[string]interface{}{"variables": s.children(s.refs[a.VariablesReference-1])}, nil, nil
+	case "evaluate":
+		var a struct {
+			Expression string `json:"expression"`
+		}
+		if err := dapArgs(req.Arguments, &a); err != nil {
+			return nil, nil, err
+		}
+		x, err := s.d.Eval(a.Expression)
+		if err != nil {
+			return nil, nil, err
+		}
+		v := s.variable("", x)
+		return map[string]interface{}{"result": v.Value, "type": v.Type, "variablesReference": v.VariablesReference}, nil, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported request '%s'", req.Command)
+}
+
+// dapArgs decodes the arguments of a request into v.
+func dapArgs(raw json.RawMessage, v interface{}) error {
+	if len(raw) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return fmt.Errorf("bad arguments: %s", err)
+	}
+	return nil
+}
+
+func (s *dapServer) launch(raw json.RawMessage) error {
+	var a struct {
+		Program     string `json:"program"`
+		StopOnEntry bool   `json:"stopOnEntry"`
+	}
+	if err := dapArgs(raw, &a); err != nil {
+		return err
+	}
+	if s.launched {
+		return fmt.Errorf("a script is already launched")
+	}
+	if a.Program == "" {
+		return fmt.Errorf("no program to launch")
+	}
+	f, err := os.Open(a.Program)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := s.env.LoadFile(f); err != nil {
+		return fmt.Errorf("%s: %s", a.Program, err)
+	}
+	s.launched = true
+	s.stopOnEntry = a.StopOnEntry
+	return nil
+}
+
+// start runs the script once it is both launched and
+// configured.
+func (s *dapServer) start() {
+	if !s.launched || !s.configured || s.done != nil {
+		return
+	}
+	s.done = make(chan struct{})
+	if s.stopOnEntry {
+		s.d.StepInto()
+	}
+	go func() {
+		defer close(s.done)
+		_, err := s.env.RunContext(s.ctx)
+		if s.ctx.Err() != nil {
+			// the editor is gone.
+			return
+		}
+		code := 0
+		if err != nil {
+			code = 1
+			s.event("output", map[string]interface{}{"category": "stderr", "output": err.Error() + "\n"})
+		}
+		s.event("exited", map[string]interface{}{"exitCode": code})
+		s.event("terminated", nil)
+	}()
+}
+
+// onStop tells the editor that the script stopped, and waits
+// for it to be resumed.
+func (s *dapServer) onStop(d *Debugger, stop *Stop) error {
+	body := map[string]interface{}{"threadId": 1, "allThreadsStopped": true, "reason": stop.Reason, "description": stop.String()}
+	switch {
+	case s.stopOnEntry:
+		s.stopOnEntry = false
+		body["reason"] = "entry"
+	case stop.Breakpoint != nil:
+		body["hitBreakpointIds"] = []int{stop.Breakpoint.ID}
+		if stop.Breakpoint.Func != "" {
+			body["reason"] = "function breakpoint"
+		}
+	}
+	s.mu.Lock()
+	s.stopped = true
+	s.mu.Unlock()
+	s.event("stopped", body)
+	select {
+	case resume := <-s.resume:
+		return resume(d)
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+}
+
+func (s *dapServer) resumeWith(how func(d *Debugger)) (func(), error) {
+	return s.resumeScript(func(d *Debugger) error {
+		how(d)
+		return nil
+	})
+}
+
+// resumeScript returns what resumes the stopped script with f.
+func (s *dapServer) resumeScript(f func(d *Debugger) error) (func(), error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.stopped {
+		return nil, fmt.Errorf("the script is not stopped")
+	}
+	s.stopped = false
+	s.refs = nil
+	return func() { s.resume <- f }, nil
+}
+
+// shutdown ends the script, if it is still running.
+func (s *dapServer) shutdown() {
+	if s.done == nil {
+		return
+	}
+	s.cancel()
+	<-s.done
+}
+
+func (s *dapServer) setBreakpoints(raw json.RawMessage) (interface{}, error) {
+	var a struct {
+		Source      dapSource `json:"source"`
+		Breakpoints []struct {
+			Line int `json:"line"`
+		} `json:"breakpoints"`
+	}
+	if err := dapArgs(raw, &a); err != nil {
+		return nil, err
+	}
+	path := a.Source.Path
+	if path == "" {
+		path = a.Source.Name
+	}
+	s.clearBreaks(path)
+	set := []dapBreakpoint{}
+	for _, sb := range a.Breakpoints {
+		b := s.d.BreakLine(path, sb.Line)
+		s.breaks[path] = append(s.breaks[path], b.ID)
+		set = append(set, dapBreakpoint{ID: b.ID, Verified: true, Line: b.Line, Source: &a.Source})
+	}
+	return map[string]interface{}{"breakpoints": set}, nil
+}
+
+func (s *dapServer) setFunctionBreakpoints(raw json.RawMessage) (interface{}, error) {
+	var a struct {
+		Breakpoints []struct {
+			Name string `json:"name"`
+		} `json:"breakpoints"`
+	}
+	if err := dapArgs(raw, &a); err != nil {
+		return nil, err
+	}
+	s.clearBreaks("")
+	set := []dapBreakpoint{}
+	for _, fb := range a.Breakpoints {
+		b := s.d.BreakFunc(fb.Name)
+		s.breaks[""] = append(s.breaks[""], b.ID)
+		set = append(set, dapBreakpoint{ID: b.ID, Verified: true})
+	}
+	return map[string]interface{}{"breakpoints": set}, nil
+}
+
+func (s *dapServer) clearBreaks(path string) {
+	for _, id := range s.breaks[path] {
+		s.d.ClearBreakpoint(id)
+	}
+	delete(s.breaks, path)
+}
+
+func (s *dapServer) stackTrace() interface{} {
+	frames := []dapStackFrame{}
+	for i, f := range s.d.Backtrace() {
+		sf := dapStackFrame{ID: i + 1, Name: f.Func}
+		if f.Pos != nil {
+			sf.Line, sf.Column = f.Pos.Line, f.Pos.Col
+			if f.Pos.File != "" {
+				sf.Source = &dapSource{Name: filepath.Base(f.Pos.File), Path: f.Pos.File}
+			}
+		}
+		frames = append(frames, sf)
+	}
+	return map[string]interface{}{"stackFrames": frames, "totalFrames": len(frames)}
+}
+
+// ref returns a variablesReference for x.
+func (s *dapServer) ref(x interface{}) int {
+	s.refs = append(s.refs, x)
+	return len(s.refs)
+}
+
+// variable describes x, and gives it a variablesReference if
+// it has parts to show.
+func (s *dapServer) variable(name string, x Sexp) dapVariable {
+	v := dapVariable{Name: name, Value: x.SexpString(nil), Type: TypeOf(x).S}
+	switch e := x.(type) {
+	case *SexpHash:
+		if e.NumKeys > 0 || e.GoShadowStruct != nil {
+			v.VariablesReference = s.ref(x)
+		}
+	case *SexpArray:
+		if len(e.Val) > 0 {
+			v.VariablesReference = s.ref(x)
+		}
+	case *SexpPair:
+		v.VariablesReference = s.ref(x)
+	case *SexpReflect:
+		v.VariablesReference = s.goRef(e.Val)
+	}
+	return v
+}
+
+// goVariable describes a Go value, such as a field of the
+// shadow struct of a record.
+func (s *dapServer) goVariable(name string, rv reflect.Value) dapVariable {
+	v := dapVariable{Name: name, Value: "nil"}
+	if !rv.IsValid() {
+		return v
+	}
+	v.Type = rv.Type().String()
+	v.Value = fmt.Sprintf("%#v", rv)
+	v.VariablesReference = s.goRef(rv)
+	return v
+}
+
+// goRef is the variablesReference for a Go value, or zero if
+// it is nil or has no parts.
+func (s *dapServer) goRef(rv reflect.Value) int {
+	for rv.IsValid() && (rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface) {
+		if rv.IsNil() {
+			return 0
+		}
+		rv = rv.Elem()
+	}
+	if !rv.IsValid() {
+		return 0
+	}
+	switch rv.Kind() {
+	case reflect.Struct:
+		if rv.NumField() > 0 {
+			return s.ref(rv)
+		}
+	case reflect.Slice, reflect.Array, reflect.Map:
+		if rv.Len() > 0 {
+			return s.ref(rv)
+		}
+	}
+	return 0
+}
+
+func (s *dapServer) children(x interface{}) []dapVariable {
+	vars := []dapVariable{}
+	switch e := x.(type) {
+	case []Local:
+		for _, l := range e {
+			vars = append(vars, s.variable(l.Name, l.Value))
+		}
+	case *SexpHash:
+		e.Each(func(key, val Sexp) bool {
+			vars = append(vars, s.variable(key.SexpString(nil), val))
+			return true
+		})
+		if e.GoShadowStruct != nil {
+			vars = append(vars, s.goVariable("(go)", reflect.ValueOf(e.GoShadowStruct)))
+		}
+	case *SexpArray:
+		for i, val := range e.Val {
+			vars = append(vars, s.variable(fmt.Sprintf("[%d]", i), val))
+		}
+	case *SexpPair:
+		var i int
+		var rest Sexp = e
+		for {
+			pair, ok := rest.(*SexpPair)
+			if !ok {
+				break
+			}
+			vars = append(vars, s.variable(fmt.Sprintf("[%d]", i), pair.Head))
+			rest = pair.Tail
+			i++
+		}
+		if rest != SexpNull {
+			vars = append(vars, s.variable("tail", rest))
+		}
+	case reflect.Value:
+		for e.Kind() == reflect.Ptr || e.Kind() == reflect.Interface {
+			e = e.Elem()
+		}
+		switch e.Kind() {
+		case reflect.Struct:
+			for i := 0; i < e.NumField(); i++ {
+				vars = append(vars, s.goVariable(e.Type().Field(i).Name, e.Field(i)))
+			}
+		case reflect.Slice, reflect.Array:
+			for i := 0; i < e.Len(); i++ {
+				vars = append(vars, s.goVariable(fmt.Sprintf("[%d]", i), e.Index(i)))
+			}
+		case reflect.Map:
+			iter := e.MapRange()
+			for iter.Next() {
+				vars = append(vars, s.goVariable(fmt.Sprintf("%#v", iter.Key()), iter.Value()))
+			}
+		}
+	}
+	return vars
+}
@@ -0,0 +1,185 @@
+package zygo
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+const dapSrc = `(def ev (eventdemo id:456 user:(persondemo first:"jay" last:"son") flight:"A"))
+(togo ev)
+(defn sq [x]
+  (def y (* x x))
+  (+ y 0))
+(sq 3)
+`
+
+// dapClient plays the editor's part. The events that come while
+// it waits for a response are queued for waitEvent.
+type dapClient struct {
+	w      io.Writer
+	seq    int
+	msgs   chan map[string]interface{}
+	events []map[string]interface{}
+}
+
+func (c *dapClient) call(command string, args interface{}) map[string]interface{} {
+	c.seq++
+	buf, err := json.Marshal(map[string]interface{}{"seq": c.seq, "type": "request", "command": command, "arguments": args})
+	panicOn(err)
+	_, err = fmt.Fprintf(c.w, "Content-Length: %d\r\n\r\n%s", len(buf), buf)
+	panicOn(err)
+	for m := range c.msgs {
+		if m["type"] == "event" {
+			c.events = append(c.events, m)
+		}
+		if m["type"] == "response" && int(m["request_seq"].(float64)) == c.seq {
+			return m
+		}
+	}
+	panic("no response to " + command)
+}
+
+// queued reports whether event has come, and not been waited for.
+func (c *dapClient) queued(event string) bool {
+	for _, m := range c.events {
+		if m["event"] == event {
+			return true
+		}
+	}
+	return false
+}
+
+// waitEvent returns the body of the next event named event,
+// dropping the other events before it.
+func (c *dapClient) waitEvent(event string) map[string]interface{} {
+	for len(c.events) > 0 {
+		m := c.events[0]
+		c.events = c.events[1:]
+		if m["event"] == event {
+			body, _ := m["body"].(map[string]interface{})
+			return body
+		}
+	}
+	for m := range c.msgs {
+		if m["type"] == "event" && m["event"] == event {
+			body, _ := m["body"].(map[string]interface{})
+			return body
+		}
+	}
+	panic("no " + event + " event")
+}
+
+func (c *dapClient) body(command string, args interface{}) map[string]interface{} {
+	m := c.call(command, args)
+	if m["success"] != true {
+		panic(fmt.Sprintf("%s failed: %v", command, m["message"]))
+	}
+	body, _ := m["body"].(map[string]interface{})
+	return body
+}
+
+// variables returns the variables of ref, by name.
+func (c *dapClient) variables(ref interface{}) map[string]map[string]interface{} {
+	vars := make(map[string]map[string]interface{})
+	for _, v := range c.body("variables", map[string]interface{}{"variablesReference": ref})["variables"].([]interface{}) {
+		v := v.(map[string]interface{})
+		vars[v["name"].(string)] = v
+	}
+	return vars
+}
+
+func Test422DebugAdapterProtocol(t *testing.T) {
+
+	cv.Convey(`zygo dap should launch a script, stop at its breakpoints, show the stack, locals, records and their Go shadow structs, evaluate, step and run it to the end`, t, func() {
+		program := filepath.Join(t.TempDir(), "prog.zy")
+		panicOn(os.WriteFile(program, []byte(dapSrc), 0644))
+
+		inR, inW := io.Pipe()
+		outR, outW := io.Pipe()
+		served := make(chan error, 1)
+		go func() {
+			served <- ServeDAP(inR, outW)
+			outW.Close()
+		}()
+		c := &dapClient{w: inW, msgs: make(chan map[string]interface{}, 100)}
+		go func() {
+			defer close(c.msgs)
+			r := bufio.NewReader(outR)
+			for {
+				buf, err := readFramed(r)
+				if err != nil {
+					return
+				}
+				var m map[string]interface{}
+				panicOn(json.Unmarshal(buf, &m))
+				c.msgs <- m
+			}
+		}()
+
+		caps := c.body("initialize", map[string]interface{}{"adapterID": "zygo"})
+		cv.So(caps["supportsConfigurationDoneRequest"], cv.ShouldEqual, true)
+		c.waitEvent("initialized")
+
+		bps := c.body("setBreakpoints", map[string]interface{}{
+			"source":      map[string]interface{}{"path": program},
+			"breakpoints": []map[string]interface{}{{"line": 4}},
+		})["breakpoints"].([]interface{})
+		cv.So(len(bps), cv.ShouldEqual, 1)
+		cv.So(bps[0].(map[string]interface{})["verified"], cv.ShouldEqual, true)
+
+		c.body("launch", map[string]interface{}{"program": program})
+		cv.So(c.call("stackTrace", nil)["success"], cv.ShouldEqual, false)
+		c.body("configurationDone", nil)
+		cv.So(c.queued("stopped"), cv.ShouldBeFalse)
+
+		stopped := c.waitEvent("stopped")
+		cv.So(stopped["reason"], cv.ShouldEqual, "breakpoint")
+		frames := c.body("stackTrace", map[string]interface{}{"threadId": 1})["stackFrames"].([]interface{})
+		cv.So(len(frames), cv.ShouldEqual, 2)
+		top := frames[0].(map[string]interface{})
+		cv.So(top["name"], cv.ShouldEqual, "sq")
+		cv.So(top["line"], cv.ShouldEqual, 4)
+		cv.So(top["source"].(map[string]interface{})["path"], cv.ShouldEqual, program)
+
+		scopes := c.body("scopes", map[string]interface{}{"frameId": top["id"]})["scopes"].([]interface{})
+		cv.So(len(scopes), cv.ShouldEqual, 2)
+		locals := c.variables(scopes[0].(map[string]interface{})["variablesReference"])
+		cv.So(locals["x"]["value"], cv.ShouldEqual, "3")
+		cv.So(locals["x"]["type"], cv.ShouldEqual, "int64")
+
+		// a record, and its Go shadow struct
+		globals := c.variables(scopes[1].(map[string]interface{})["variablesReference"])
+		ev := c.variables(globals["ev"]["variablesReference"])
+		cv.So(ev["flight"]["value"], cv.ShouldEqual, `"A"`)
+		user := c.variables(ev["user"]["variablesReference"])
+		cv.So(user["first"]["value"], cv.ShouldEqual, `"jay"`)
+		shadow := c.variables(ev["(go)"]["variablesReference"])
+		cv.So(shadow["Id"]["value"], cv.ShouldEqual, "456")
+		cv.So(c.variables(shadow["User"]["variablesReference"])["Last"]["value"], cv.ShouldEqual, `"son"`)
+
+		cv.So(c.body("evaluate", map[string]interface{}{"expression": "(* x 10)"})["result"], cv.ShouldEqual, "30")
+		cv.So(c.call("evaluate", map[string]interface{}{"expression": "(undefinedFn)"})["success"], cv.ShouldEqual, false)
+
+		c.body("next", map[string]interface{}{"threadId": 1})
+		cv.So(c.queued("stopped"), cv.ShouldBeFalse)
+		stopped = c.waitEvent("stopped")
+		cv.So(stopped["reason"], cv.ShouldEqual, "step")
+		top = c.body("stackTrace", nil)["stackFrames"].([]interface{})[0].(map[string]interface{})
+		cv.So(top["line"], cv.ShouldEqual, 5)
+
+		c.body("continue", map[string]interface{}{"threadId": 1})
+		cv.So(c.queued("exited"), cv.ShouldBeFalse)
+		cv.So(c.waitEvent("exited")["exitCode"], cv.ShouldEqual, 0)
+		c.waitEvent("terminated")
+
+		c.body("disconnect", nil)
+		cv.So(<-served, cv.ShouldBeNil)
+	})
+}
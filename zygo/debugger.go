@@ -0,0 +1,646 @@
+package zygo
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Debugging.
+//
+// A Debugger attached to an environment is consulted by Run
+// before every instruction. It stops the script at breakpoints,
+// set on entry to a function or on a file:line, and after each
+// step, and calls its OnStop handler there, in the goroutine
+// running the script. While the handler runs the script is
+// paused: the handler can look at the Backtrace and the Locals,
+// and Eval expressions in the paused scope. When it returns,
+// the script carries on as the handler said: Continue, or
+// StepInto, StepOver or StepOut.
+//
+// Breakpoints can be set and cleared, and the script asked to
+// Pause, from other goroutines while it runs; everything else
+// belongs to the goroutine running the script, or to whoever
+// holds it paused.
+//
+// Steps go a line at a time. A line is done once the script
+// moves on to another line in the same call, or returns from
+// it; the calls it makes along the way are lines of their own.
+
+// Breakpoint stops a script on entry to the function named
+// Func, or else when it gets to line Line of File.
+type Breakpoint struct {
+	ID   int
+	Func string
+	File string
+	Line int
+	Hits int
+}
+
+func (b *Breakpoint) String() string {
+	if b.Func != "" {
+		return fmt.Sprintf("%d: %s", b.ID, b.Func)
+	}
+	return fmt.Sprintf("%d: %s:%d", b.ID, b.File, b.Line)
+}
+
+// matches reports whether a line breakpoint is at pos. File
+// names match if one is the other with a directory prefixed,
+// and an empty File matches code from any file.
+func (b *Breakpoint) matches(pos *Pos) bool {
+	if b.Func != "" || b.Line != pos.Line {
+		return false
+	}
+	return b.File == "" || b.File == pos.File ||
+		strings.HasSuffix(pos.File, "/"+b.File) ||
+		strings.HasSuffix(b.File, "/"+pos.File)
+}
+
+// Frame is one call in progress: Func is at instruction Pc,
+// from the source at Pos, if known.
+type Frame struct {
+	Func string
+	Pc   int
+	Pos  *Pos
+}
+
+func (f Frame) String() string {
+	if f.Pos != nil {
+		return fmt.Sprintf("%s (%s)", f.Func, f.Pos)
+	}
+	return fmt.Sprintf("%s:%d", f.Func, f.Pc)
+}
+
+// Stop tells an OnStop handler where the script stopped, and
+// why: Reason is "breakpoint", with the Breakpoint, "step" or
+// "pause".
+type Stop struct {
+	Reason     string
+	Breakpoint *Breakpoint
+	Frame      Frame
+}
+
+func (s *Stop) String() string {
+	if s.Breakpoint != nil {
+		return fmt.Sprintf("breakpoint %s at %s", s.Breakpoint, s.Frame)
+	}
+	return fmt.Sprintf("%s at %s", s.Reason, s.Frame)
+}
+
+// Local is a name bound in the scopes of a paused call.
+type Local struct {
+	Name  string
+	Value Sexp
+}
+
+type stepMode int
+
+const (
+	stepNone stepMode = iota // run to the next breakpoint
+	stepInto
+	stepOver
+	stepOut
+)
+
+type srcLine struct {
+	file string
+	line int
+}
+
+// Debugger steps through the scripts an environment runs.
+// Get one with env.Debugger().
+type Debugger struct {
+	// OnStop is called whenever the script stops. Before
+	// returning it may call StepInto, StepOver or StepOut;
+	// otherwise the script continues. If it returns an
+	// error, Run stops with that error.
+	OnStop func(d *Debugger, stop *Stop) error
+
+	env *Zlisp
+
+	mu     sync.Mutex // guards breaks, nextID and Hits
+	breaks []*Breakpoint
+	nextID int
+
+	// pausing is set, atomically, by Pause.
+	pausing int32
+
+	mode  stepMode
+	depth int // of the addrstack, where the step began
+
+	// entering is set by callFunction: the next
+	// instruction starts a call. entered is the breakpoint
+	// on the function called, if any.
+	entering bool
+	entered  *Breakpoint
+
+	// lines holds the line each call in progress is on,
+	// indexed by addrstack depth.
+	lines []srcLine
+
+	// paused is set while OnStop runs, so that the Runs
+	// it makes, through Eval, do not stop.
+	paused bool
+}
+
+// Debugger returns env's debugger, attaching a new one the
+// first time.
+func (env *Zlisp) Debugger() *Debugger {
+	if env.debugger == nil {
+		env.debugger = &Debugger{env: env, nextID: 1}
+	}
+	return env.debugger
+}
+
+// DetachDebugger removes env's debugger, and with it all
+// breakpoints.
+func (env *Zlisp) DetachDebugger() {
+	env.debugger = nil
+}
+
+// BreakFunc sets a breakpoint on entry to the function name.
+func (d *Debugger) BreakFunc(name string) *Breakpoint {
+	return d.addBreak(&Breakpoint{Func: name})
+}
+
+// BreakLine sets a breakpoint on line of file.
+func (d *Debugger) BreakLine(file string, line int) *Breakpoint {
+	return d.addBreak(&Breakpoint{File: file, Line: line})
+}
+
+func (d *Debugger) addBreak(b *Breakpoint) *Breakpoint {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	b.ID = d.nextID
+	d.nextID++
+	d.breaks = append(d.breaks, b)
+	return b
+}
+
+// Breakpoints returns the breakpoints set, in the order they
+// were set.
+func (d *Debugger) Breakpoints() []*Breakpoint {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]*Breakpoint(nil), d.breaks...)
+}
+
+// ClearBreakpoint removes the breakpoint numbered id.
+func (d *Debugger) ClearBreakpoint(id int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i, b := range d.breaks {
+		if b.ID == id {
+			d.breaks = append(d.breaks[:i], d.breaks[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("no breakpoint %d", id)
+}
+
+// Continue runs the script to the next breakpoint.
+func (d *Debugger) Continue() {
+	d.mode = stepNone
+}
+
+// Pause stops the script at the next line it gets to. Unlike
+// the other methods it may be called from any goroutine.
+func (d *Debugger) Pause() {
+	atomic.StoreInt32(&d.pausing, 1)
+}
+
+// StepInto stops at the next line, in this call or any other.
+func (d *Debugger) StepInto() {
+	d.step(stepInto)
+}
+
+// StepOver stops at the next line of this call, or in its
+// caller if it returns first.
+func (d *Debugger) StepOver() {
+	d.step(stepOver)
+}
+
+// StepOut stops in the caller, once this call returns.
+func (d *Debugger) StepOut() {
+	d.step(stepOut)
+}
+
+// start is called by the outermost Run: no call is on any
+// line yet.
+func (d *Debugger) start() {
+	d.lines = d.lines[:0]
+	d.entering = false
+	d.entered = nil
+}
+
+func (d *Debugger) step(mode stepMode) {
+	d.mode = mode
+	d.depth = d.env.addrstack.Size()
+}
+
+// before is called by Run before it executes instruction
+// pc of fun.
+func (d *Debugger) before(fun *SexpFunction, pc int) error {
+	if d.paused {
+		return nil
+	}
+	depth := d.env.addrstack.Size()
+	if d.entering {
+		d.entering = false
+		if depth < len(d.lines) {
+			d.lines = d.lines[:depth]
+		}
+		d.entered = d.funcBreak(fun.name)
+	}
+	p, ok := fun.fun[pc].(positioned)
+	if !ok || p.Position() == nil {
+		return nil
+	}
+	pos := p.Position()
+	if atomic.CompareAndSwapInt32(&d.pausing, 1, 0) {
+		d.onNewLine(depth, pos)
+		return d.stop(&Stop{Reason: "pause"})
+	}
+	// a step that returns from the call it began in stops
+	// in the caller, even part way through a line.
+	returned := d.mode != stepNone && depth < d.depth
+	if !d.onNewLine(depth, pos) {
+		if returned {
+			return d.stop(&Stop{Reason: "step"})
+		}
+		return nil
+	}
+	if b := d.entered; b != nil {
+		// stop at the first line of the body, once
+		// the arguments are bound.
+		d.entered = nil
+		return d.stop(&Stop{Reason: "breakpoint", Breakpoint: b})
+	}
+	if b := d.lineBreak(pos); b != nil {
+		return d.stop(&Stop{Reason: "breakpoint", Breakpoint: b})
+	}
+	switch {
+	case returned,
+		d.mode == stepInto,
+		d.mode == stepOver && depth == d.depth:
+		return d.stop(&Stop{Reason: "step"})
+	}
+	return nil
+}
+
+func (d *Debugger) funcBreak(name string) *Breakpoint {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, b := range d.breaks {
+		if b.Func != "" && b.Func == name {
+			return b
+		}
+	}
+	return nil
+}
+
+func (d *Debugger) lineBreak(pos *Pos) *Breakpoint {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, b := range d.breaks {
+		if b.matches(pos) {
+			return b
+		}
+	}
+	return nil
+}
+
+// onNewLine notes that the call at depth is at pos, and
+// reports whether it was on another line before.
+func (d *Debugger) onNewLine(depth int, pos *Pos) bool {
+	if depth+1 < len(d.lines) {
+		d.lines = d.lines[:depth+1]
+	}
+	for len(d.lines) <= depth {
+		d.lines = append(d.lines, srcLine{})
+	}
+	here := srcLine{file: pos.File, line: pos.Line}
+	if d.lines[depth] == here {
+		return false
+	}
+	d.lines[depth] = here
+	return true
+}
+
+func (d *Debugger) stop(stop *Stop) error {
+	if stop.Breakpoint != nil {
+		d.mu.Lock()
+		stop.Breakpoint.Hits++
+		d.mu.Unlock()
+	}
+	stop.Frame = d.Backtrace()[0]
+	d.mode = stepNone
+	if d.OnStop == nil {
+		return nil
+	}
+	d.paused = true
+	defer func() { d.paused = false }()
+	return d.OnStop(d, stop)
+}
+
+// Backtrace returns the calls in progress, innermost first.
+func (d *Debugger) Backtrace() []Frame {
+	env := d.env
+	frames := []Frame{{Func: env.curfunc.name, Pc: env.pc, Pos: env.curfunc.PosAt(env.pc)}}
+	for i := 0; i < env.addrstack.Size(); i++ {
+		elem, _ := env.addrstack.Get(i)
+		addr := elem.(Address)
+		// addresses below zero end a nested Run, as
+		// from Apply; they are no call.
+		if addr.position <= 0 {
+			continue
+		}
+		// the call is just before where it returns to.
+		pc := addr.position - 1
+		frames = append(frames, Frame{Func: addr.function.name, Pc: pc, Pos: addr.function.PosAt(pc)})
+	}
+	return frames
+}
+
+// Locals returns the names bound in the scopes of the current
+// call, innermost scope first, each sorted by name. Globals are
+// left out.
+func (d *Debugger) Locals() []Local {
+	return d.FrameLocals(0)
+}
+
+// FrameLocals is like Locals, for call n of the Backtrace.
+func (d *Debugger) FrameLocals(n int) []Local {
+	env := d.env
+	var locals []Local
+	seen := make(map[int]bool)
+	frame := 0
+	for i := 0; i < env.linearstack.Size() && frame <= n; i++ {
+		elem, _ := env.linearstack.Get(i)
+		scope, ok := elem.(*Scope)
+		if !ok || scope.IsGlobal {
+			break
+		}
+		// the scopes of each call end with its
+		// function scope.
+		mine := frame == n
+		if scope.IsFunction {
+			frame++
+		}
+		if !mine {
+			continue
+		}
+		var these []Local
+		scope.mut.RLock()
+		for num, val := range scope.Map {
+			if !seen[num] {
+				seen[num] = true
+				these = append(these, Local{Name: env.symtable.name(num), Value: val})
+			}
+		}
+		scope.mut.RUnlock()
+		sort.Slice(these, func(i, j int) bool { return these[i].Name < these[j].Name })
+		locals = append(locals, these...)
+	}
+	return locals
+}
+
+// Globals returns the names bound in the global scope, sorted
+// by name.
+func (d *Debugger) Globals() []Local {
+	return d.env.globals()
+}
+
+func (env *Zlisp) globals() []Local {
+	elem, err := env.linearstack.Get(env.linearstack.Size() - 1)
+	scope, ok := elem.(*Scope)
+	if err != nil || !ok {
+		return nil
+	}
+	var globals []Local
+	scope.mut.RLock()
+	for num, val := range scope.Map {
+		globals = append(globals, Local{Name: env.symtable.name(num), Value: val})
+	}
+	scope.mut.RUnlock()
+	sort.Slice(globals, func(i, j int) bool { return globals[i].Name < globals[j].Name })
+	return globals
+}
+
+// Eval evaluates src in the scope the script is paused in, and
+// returns the value of the last expression. Inside a closure,
+// that includes the variables it closed over.
+func (d *Debugger) Eval(src string) (Sexp, error) {
+	env := d.env
+	xs, err := env.ParseString(src)
+	if err != nil {
+		return SexpNull, err
+	}
+	gen := NewGenerator(env)
+	if err := gen.GenerateBegin(xs); err != nil {
+		return SexpNull, err
+	}
+	fun := env.MakeFunction("__debug_eval", 0, false, gen.instructions, nil)
+	if env.curfunc != nil {
+		fun.SetClosing(env.curfunc.closingOverScopes, env.curfunc)
+	}
+
+	paused := d.paused
+	d.paused = true
+	saved := env.saveFrame()
+	defer func() {
+		env.restoreFrame(saved)
+		d.paused = paused
+	}()
+	env.curfunc, env.pc = fun, 0
+	return env.Run()
+}
+
+// The REPL's debugger commands. These work any time:
+//
+//	.break name         stop on entry to the function name
+//	.break file:line    stop at line of file
+//	.breaks             list the breakpoints
+//	.delete id          remove breakpoint id
+//	.step               stop at the first line of the next expression
+//
+// and these while a script is stopped:
+//
+//	.step               step into: on to the next line, wherever it is
+//	.next               step over: on to the next line of this call
+//	.finish             step out: on to the caller
+//	.continue           run to the next breakpoint
+//	.bt                 show the calls in progress
+//	.locals             show the names bound in this call
+//	.abort              stop the script
+//
+// Anything else typed while stopped is evaluated in the paused
+// scope, and its value printed.
+
+var debugPrompt = "debug> "
+
+var debugCommands = map[string]bool{
+	".break": true, ".breaks": true, ".delete": true, ".step": true,
+	".next": true, ".finish": true, ".continue": true,
+	".bt": true, ".locals": true, ".abort": true,
+}
+
+// replDebugger is the OnStop handler for the REPL, reading
+// commands from the user until one resumes the script.
+type replDebugger struct {
+	pr      *Prompter
+	reader  *bufio.Reader
+	noLiner bool
+	out     io.Writer
+
+	// the lines of source files shown, by name.
+	sources map[string][]string
+}
+
+func (r *replDebugger) onStop(d *Debugger, stop *Stop) error {
+	fmt.Fprintf(r.out, "stopped: %s\n", stop)
+	if src := r.source(stop.Frame.Pos); src != "" {
+		fmt.Fprintf(r.out, "%5d    %s\n", stop.Frame.Pos.Line, src)
+	}
+	for {
+		var line string
+		var err error
+		if r.noLiner {
+			fmt.Fprint(r.out, debugPrompt)
+			line, err = getLine(r.reader)
+		} else {
+			line, err = r.pr.Getline(&debugPrompt)
+		}
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		handled, resume, err := replDebugCommand(d, r.out, line, true)
+		switch {
+		case err != nil:
+			return err
+		case resume:
+			return nil
+		case handled:
+			continue
+		}
+		x, err := d.Eval(line)
+		if err != nil {
+			fmt.Fprintln(r.out, err)
+			continue
+		}
+		fmt.Fprintln(r.out, x.SexpString(nil))
+	}
+}
+
+// source returns the text of the line at pos, if its file
+// can be read.
+func (r *replDebugger) source(pos *Pos) string {
+	if pos == nil || pos.File == "" {
+		return ""
+	}
+	lines, ok := r.sources[pos.File]
+	if !ok {
+		if buf, err := os.ReadFile(pos.File); err == nil {
+			lines = strings.Split(string(buf), "\n")
+		}
+		r.sources[pos.File] = lines
+	}
+	if pos.Line < 1 || pos.Line > len(lines) {
+		return ""
+	}
+	return strings.TrimSpace(lines[pos.Line-1])
+}
+
+// ErrDebugAbort is returned by Run when the user aborts a
+// script stopped in the REPL's debugger.
+var ErrDebugAbort = fmt.Errorf("aborted in the debugger")
+
+// replDebugCommand carries out line if it is a debugger
+// command, and says so. While the script is paused, resume is
+// set by the commands that carry on with it.
+func replDebugCommand(d *Debugger, out io.Writer, line string, paused bool) (handled, resume bool, err error) {
+	parts := strings.Fields(line)
+	if len(parts) == 0 {
+		return false, false, nil
+	}
+	switch parts[0] {
+	case ".break":
+		if len(parts) != 2 {
+			fmt.Fprintln(out, "usage: .break name, or .break file:line")
+			return true, false, nil
+		}
+		var b *Breakpoint
+		if i := strings.LastIndex(parts[1], ":"); i >= 0 {
+			n, err := strconv.Atoi(parts[1][i+1:])
+			if err != nil {
+				fmt.Fprintf(out, "bad line number in '%s'\n", parts[1])
+				return true, false, nil
+			}
+			b = d.BreakLine(parts[1][:i], n)
+		} else {
+			b = d.BreakFunc(parts[1])
+		}
+		fmt.Fprintf(out, "breakpoint %s\n", b)
+	case ".breaks":
+		for _, b := range d.Breakpoints() {
+			fmt.Fprintf(out, "breakpoint %s (hit %d times)\n", b, b.Hits)
+		}
+	case ".delete":
+		if len(parts) != 2 {
+			fmt.Fprintln(out, "usage: .delete id")
+			return true, false, nil
+		}
+		id, err := strconv.Atoi(parts[1])
+		if err == nil {
+			err = d.ClearBreakpoint(id)
+		}
+		if err != nil {
+			fmt.Fprintln(out, err)
+		}
+	case ".step":
+		d.StepInto()
+		if !paused {
+			fmt.Fprintln(out, "stepping into the next expression.")
+		}
+		return true, paused, nil
+	case ".next", ".finish", ".continue", ".bt", ".locals", ".abort":
+		if !paused {
+			fmt.Fprintln(out, "no script is stopped.")
+			return true, false, nil
+		}
+		switch parts[0] {
+		case ".next":
+			d.StepOver()
+		case ".finish":
+			d.StepOut()
+		case ".continue":
+			d.Continue()
+		case ".bt":
+			for i, f := range d.Backtrace() {
+				fmt.Fprintf(out, "#%d %s\n", i, f)
+			}
+			return true, false, nil
+		case ".locals":
+			for _, l := range d.Locals() {
+				fmt.Fprintf(out, "%s = %s\n", l.Name, l.Value.SexpString(nil))
+			}
+			return true, false, nil
+		case ".abort":
+			return true, false, ErrDebugAbort
+		}
+		return true, true, nil
+	default:
+		return false, false, nil
+	}
+	return true, false, nil
+}
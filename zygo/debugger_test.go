@@ -0,0 +1,152 @@
+package zygo
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+const debugSrc = `(defn sq [x]
+  (def y (* x x))
+  (+ y 0))
+(defn sumsq [n]
+  (let [a (sq n)
+        b (sq (+ n 1))]
+    (+ a b)))
+(+ 0 (sumsq 2))
+`
+
+func Test421Debugger(t *testing.T) {
+
+	cv.Convey(`the debugger should stop at function and line breakpoints, step into, over and out of calls, and show the backtrace and locals of the paused call`, t, func() {
+		env := NewZlisp()
+		defer env.Stop()
+		env.StandardSetup()
+
+		load := func() {
+			err := env.LoadStream(&SourceStream{RuneScanner: strings.NewReader(debugSrc), File: "rules.zy"})
+			panicOn(err)
+		}
+
+		d := env.Debugger()
+		var stops []string
+		var steps []func()
+		d.OnStop = func(d *Debugger, stop *Stop) error {
+			stops = append(stops, stop.String())
+			if len(steps) > 0 {
+				steps[0]()
+				steps = steps[1:]
+			}
+			return nil
+		}
+		b := d.BreakFunc("sq")
+		load()
+		x, err := env.Run()
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(x.SexpString(nil), cv.ShouldEqual, `13`)
+		cv.So(stops, cv.ShouldResemble, []string{
+			"breakpoint 1: sq at sq (rules.zy:2:10)",
+			"breakpoint 1: sq at sq (rules.zy:2:10)"})
+		cv.So(b.Hits, cv.ShouldEqual, 2)
+
+		// step into, over and out, from the first stop.
+		var bt []Frame
+		var locals []Local
+		stops, steps = nil, []func(){
+			func() {
+				bt = d.Backtrace()
+				locals = d.Locals()
+				d.StepInto()
+			},
+			d.StepOver,
+			d.StepOut,
+			d.StepOver,
+		}
+		load()
+		_, err = env.Run()
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(stops, cv.ShouldResemble, []string{
+			"breakpoint 1: sq at sq (rules.zy:2:10)",
+			"step at sq (rules.zy:3:3)",
+			"step at sumsq (rules.zy:6:15)",
+			"breakpoint 1: sq at sq (rules.zy:2:10)",
+			"step at sq (rules.zy:3:3)",
+		})
+		cv.So(len(bt), cv.ShouldEqual, 3)
+		cv.So(bt[1].String(), cv.ShouldEqual, "sumsq (rules.zy:5:11)")
+		cv.So(len(locals), cv.ShouldEqual, 1)
+		cv.So(locals[0].Name, cv.ShouldEqual, "x")
+		cv.So(locals[0].Value.SexpString(nil), cv.ShouldEqual, `2`)
+
+		// line breakpoints, Eval in the paused scope, clearing.
+		cv.So(d.ClearBreakpoint(b.ID), cv.ShouldBeNil)
+		cv.So(d.ClearBreakpoint(b.ID), cv.ShouldNotBeNil)
+		d.BreakLine("rules.zy", 7)
+		var sum Sexp
+		stops, steps = nil, []func(){func() {
+			sum, err = d.Eval(`(+ a b 100)`)
+			panicOn(err)
+		}}
+		load()
+		x, err = env.Run()
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(x.SexpString(nil), cv.ShouldEqual, `13`)
+		cv.So(stops, cv.ShouldResemble, []string{"breakpoint 2: rules.zy:7 at sumsq (rules.zy:7:5)"})
+		cv.So(sum.SexpString(nil), cv.ShouldEqual, `113`)
+
+		// the REPL's commands
+		var out bytes.Buffer
+		r := &replDebugger{
+			reader:  bufio.NewReader(strings.NewReader(".bt\n.locals\n(* a 2)\n.next\n.abort\n")),
+			noLiner: true,
+			out:     &out,
+			sources: make(map[string][]string),
+		}
+		d.OnStop = r.onStop
+		load()
+		_, err = env.Run()
+		cv.So(err, cv.ShouldEqual, ErrDebugAbort)
+		env.Clear()
+		for _, want := range []string{
+			"stopped: breakpoint 2: rules.zy:7 at sumsq (rules.zy:7:5)",
+			"#1 __main (rules.zy:8:6)",
+			"a = 4\nb = 9\nn = 2\n",
+			"debug> 8\n",
+			"stopped: step at __main (rules.zy:8:1)",
+		} {
+			cv.So(out.String(), cv.ShouldContainSubstring, want)
+		}
+
+		handled, _, _ := replDebugCommand(d, &out, ".break rules.zy:3", false)
+		cv.So(handled, cv.ShouldBeTrue)
+		cv.So(len(d.Breakpoints()), cv.ShouldEqual, 2)
+		handled, _, _ = replDebugCommand(d, &out, ".ls", false)
+		cv.So(handled, cv.ShouldBeFalse)
+
+		// Eval inside a closure sees what it closed over.
+		d.BreakLine("adder.zy", 3)
+		stops, steps = nil, []func(){func() {
+			sum, err = d.Eval(`(+ x k)`)
+			panicOn(err)
+		}}
+		d.OnStop = func(d *Debugger, stop *Stop) error {
+			stops = append(stops, stop.String())
+			steps[0]()
+			return nil
+		}
+		err = env.LoadStream(&SourceStream{RuneScanner: strings.NewReader("(defn adder [k]\n  (fn [x]\n    (+ x k)))\n((adder 5) 1)\n"), File: "adder.zy"})
+		panicOn(err)
+		_, err = env.Run()
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(len(stops), cv.ShouldEqual, 1)
+		cv.So(sum.SexpString(nil), cv.ShouldEqual, `6`)
+
+		env.DetachDebugger()
+		x, err = env.EvalString(`(sumsq 3)`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(x.SexpString(nil), cv.ShouldEqual, `25`)
+	})
+}
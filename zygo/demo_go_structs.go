@@ -7,7 +7,7 @@ import (
 
 //go:generate msgp
 
-//msgp:ignore Plane Wings Snoopy Hornet Hellcat SetOfPlanes
+//msgp:ignore Plane Wings Snoopy Hornet Hellcat SetOfPlanes Cockpit
 
 // the pointer wasn't getting followed.
 type NestOuter struct {
@@ -103,6 +103,19 @@ func (b *Hellcat) Fly(w *Weather) (s string, err error) {
 	return
 }
 
+// Cockpit has the maps, nested slices, arrays and
+// interface{} fields that config structs tend to.
+type Cockpit struct {
+	Dials    map[string]int         `json:"dials"`
+	Channels map[int64]string       `json:"channels"`
+	Notes    map[string]interface{} `json:"notes"`
+	Crew     map[string]*Person     `json:"crew"`
+	Grid     [][]float64            `json:"grid"`
+	Trim     [3]float64             `json:"trim"`
+	Extra    interface{}            `json:"extra"`
+	Timeout  time.Duration          `json:"timeout"`
+}
+
 type Flyer interface {
 	Fly(w *Weather) (s string, err error)
 }
@@ -2,13 +2,13 @@ package zygo
 
 import (
 	"bufio"
-	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"runtime"
-	"strconv"
+	"strings"
 )
 
 type PreHook func(*Zlisp, string, []Sexp)
@@ -25,17 +25,20 @@ type Zlisp struct {
 	// loopstack: let break and continue find the nearest enclosing loop.
 	loopstack *Stack
 
-	symtable    map[string]int
-	revsymtable map[int]string
-	builtins    map[int]*SexpFunction
-	reserved    map[int]bool
-	macros      map[int]*SexpFunction
-	curfunc     *SexpFunction
-	mainfunc    *SexpFunction
-	pc          int
-	nextsymbol  int
-	before      []PreHook
-	after       []PostHook
+	// symtable and macros are shared with environments made
+	// by Clone and Duplicate, and are safe for concurrent use.
+	// builtins and reserved are filled in at setup and only
+	// read afterwards.
+	symtable *symbolTable
+	builtins map[int]*SexpFunction
+	reserved map[int]bool
+	macros   *macroTable
+	types    *GoStructRegistryType
+	curfunc  *SexpFunction
+	mainfunc *SexpFunction
+	pc       int
+	before   []PreHook
+	after    []PostHook
 
 	debugExec           bool
 	debugSymbolNotFound bool
@@ -50,6 +53,28 @@ type Zlisp struct {
 
 	// API use, since infix is already default at repl
 	WrapLoadExpressionsInInfix bool
+
+	// ctx is non-nil only while inside RunContext; Run
+	// polls it every ContextCheckInterval instructions.
+	ctx context.Context
+
+	// limits, if set, are enforced by Run and CallUserFunction.
+	// budget counts the instructions run against them; see
+	// instrBudget.
+	limits       *ResourceLimits
+	budget       *instrBudget
+	sharesBudget bool
+	runDepth     int
+
+	// stacks caps the depth of the stacks; see StackSizes.
+	stacks StackSizes
+
+	// debugger, if attached, is consulted before every
+	// instruction; see debugger.go.
+	debugger *Debugger
+
+	// handlers are the open (try) blocks, innermost last.
+	handlers []tryHandler
 }
 
 // allow clients to establish a callback to
@@ -63,16 +88,33 @@ func (env *Zlisp) SetBooter(b Booter) {
 // for any new Go struct created by the ToGoFunction (togo).
 type Booter func(s interface{})
 
-const CallStackSize = 25
-const ScopeStackSize = 50
-const DataStackSize = 100
+// The default StackSizes: how many entries each of the VM's
+// stacks may hold before Run fails with a StackOverflow.
+const CallStackSize = 10000
+const ScopeStackSize = 100000
+const DataStackSize = 1000000
 const StackStackSize = 5
-const LoopStackSize = 5
+const LoopStackSize = 1000
+
+// ContextCheckInterval is how many instructions Run executes
+// between checks of the context given to RunContext.
+const ContextCheckInterval = 1024
+
+var ReservedWords = []string{"byte", "defbuild", "builder", "field", "and", "or", "cond", "quote", "def", "mdef", "fn", "defn", "begin", "let", "letseq", "assert", "try", "defmac", "macexpand", "syntaxQuote", "include", "for", "set", "break", "continue", "newScope", "_ls", "int8", "int16", "int32", "int64", "uint8", "uint16", "uint32", "uint64", "float32", "float64", "complex64", "complex128", "bool", "string", "any", "break", "case", "chan", "const", "continue", "default", "else", "defer", "fallthrough", "for", "func", "go", "goto", "if", "import", "interface", "map", "package", "range", "return", "select", "struct", "switch", "type", "var", "append", "cap", "close", "complex", "copy", "delete", "imag", "len", "make", "new", "panic", "print", "println", "real", "recover", "null", "nil", "-", "+", "--", "++", "-=", "+=", ":=", "=", ">", "<", ">=", "<=", "send", "NaN", "nan"}
+
+// ZlispOption configures an environment as NewZlisp makes it.
+type ZlispOption func(env *Zlisp)
 
-var ReservedWords = []string{"byte", "defbuild", "builder", "field", "and", "or", "cond", "quote", "def", "mdef", "fn", "defn", "begin", "let", "letseq", "assert", "defmac", "macexpand", "syntaxQuote", "include", "for", "set", "break", "continue", "newScope", "_ls", "int8", "int16", "int32", "int64", "uint8", "uint16", "uint32", "uint64", "float32", "float64", "complex64", "complex128", "bool", "string", "any", "break", "case", "chan", "const", "continue", "default", "else", "defer", "fallthrough", "for", "func", "go", "goto", "if", "import", "interface", "map", "package", "range", "return", "select", "struct", "switch", "type", "var", "append", "cap", "close", "complex", "copy", "delete", "imag", "len", "make", "new", "panic", "print", "println", "real", "recover", "null", "nil", "-", "+", "--", "++", "-=", "+=", ":=", "=", ">", "<", ">=", "<=", "send", "NaN", "nan"}
+// WithStackSizes sets how deep the environment's stacks may
+// grow; see StackSizes.
+func WithStackSizes(s StackSizes) ZlispOption {
+	return func(env *Zlisp) {
+		env.SetStackSizes(s)
+	}
+}
 
-func NewZlisp() *Zlisp {
-	return NewZlispWithFuncs(AllBuiltinFunctions())
+func NewZlisp(opts ...ZlispOption) *Zlisp {
+	return NewZlispWithFuncs(AllBuiltinFunctions(), opts...)
 }
 
 func (env *Zlisp) Stop() error {
@@ -81,16 +123,16 @@ func (env *Zlisp) Stop() error {
 
 // NewZlispSandbox returns a new *Zlisp instance that does not allow the
 // user to get to the outside world
-func NewZlispSandbox() *Zlisp {
-	return NewZlispWithFuncs(SandboxSafeFunctions())
+func NewZlispSandbox(opts ...ZlispOption) *Zlisp {
+	return NewZlispWithFuncs(SandboxSafeFunctions(), opts...)
 }
 
 // NewZlispWithFuncs returns a new *Zlisp instance with access to only the given builtin functions
-func NewZlispWithFuncs(funcs map[string]ZlispUserFunction) *Zlisp {
+func NewZlispWithFuncs(funcs map[string]ZlispUserFunction, opts ...ZlispOption) *Zlisp {
 	env := new(Zlisp)
+	env.SetStackSizes(StackSizes{})
 	env.baseTypeCtor = MakeUserFunction("__basetype_ctor", BaseTypeConstructorFunction)
 	env.parser = env.NewParser()
-	env.parser.Start()
 	env.datastack = env.NewStack(DataStackSize)
 	env.linearstack = env.NewStack(ScopeStackSize)
 
@@ -101,10 +143,9 @@ func NewZlispWithFuncs(funcs map[string]ZlispUserFunction) *Zlisp {
 	env.loopstack = env.NewStack(LoopStackSize)
 	env.builtins = make(map[int]*SexpFunction)
 	env.reserved = make(map[int]bool)
-	env.macros = make(map[int]*SexpFunction)
-	env.symtable = make(map[string]int)
-	env.revsymtable = make(map[int]string)
-	env.nextsymbol = 1
+	env.macros = newMacroTable()
+	env.symtable = newSymbolTable()
+	env.types = NewGoStructRegistry(&GoStructRegistry)
 	env.before = []PreHook{}
 	env.after = []PostHook{}
 	env.infixOps = make(map[string]*InfixOp)
@@ -131,6 +172,9 @@ func NewZlispWithFuncs(funcs map[string]ZlispUserFunction) *Zlisp {
 	//env.debugExec = true
 	env.InitInfixOps()
 
+	for _, opt := range opts {
+		opt(env)
+	}
 	return env
 
 }
@@ -142,13 +186,13 @@ func (env *Zlisp) Clone() *Zlisp {
 	dupenv.datastack = env.datastack.Clone()
 	dupenv.linearstack = env.linearstack.Clone()
 	dupenv.addrstack = env.addrstack.Clone()
+	dupenv.loopstack = dupenv.NewStack(LoopStackSize)
 
 	dupenv.builtins = env.builtins
 	dupenv.reserved = env.reserved
 	dupenv.macros = env.macros
 	dupenv.symtable = env.symtable
-	dupenv.revsymtable = env.revsymtable
-	dupenv.nextsymbol = env.nextsymbol
+	dupenv.types = env.types
 	dupenv.before = env.before
 	dupenv.after = env.after
 	dupenv.infixOps = env.infixOps
@@ -161,6 +205,11 @@ func (env *Zlisp) Clone() *Zlisp {
 	dupenv.debugExec = env.debugExec
 	dupenv.debugSymbolNotFound = env.debugSymbolNotFound
 	dupenv.showGlobalScope = env.showGlobalScope
+	dupenv.ctx = env.ctx
+	dupenv.limits = env.limits
+	dupenv.budget = env.budget
+	dupenv.sharesBudget = true
+	dupenv.stacks = env.stacks
 	return dupenv
 }
 
@@ -171,12 +220,12 @@ func (env *Zlisp) Duplicate() *Zlisp {
 	dupenv.datastack = dupenv.NewStack(DataStackSize)
 	dupenv.linearstack = dupenv.NewStack(ScopeStackSize)
 	dupenv.addrstack = dupenv.NewStack(CallStackSize)
+	dupenv.loopstack = dupenv.NewStack(LoopStackSize)
 	dupenv.builtins = env.builtins
 	dupenv.reserved = env.reserved
 	dupenv.macros = env.macros
 	dupenv.symtable = env.symtable
-	dupenv.revsymtable = env.revsymtable
-	dupenv.nextsymbol = env.nextsymbol
+	dupenv.types = env.types
 	dupenv.before = env.before
 	dupenv.after = env.after
 	dupenv.infixOps = env.infixOps
@@ -190,6 +239,11 @@ func (env *Zlisp) Duplicate() *Zlisp {
 	dupenv.debugExec = env.debugExec
 	dupenv.debugSymbolNotFound = env.debugSymbolNotFound
 	dupenv.showGlobalScope = env.showGlobalScope
+	dupenv.ctx = env.ctx
+	dupenv.limits = env.limits
+	dupenv.budget = env.budget
+	dupenv.sharesBudget = true
+	dupenv.stacks = env.stacks
 
 	return dupenv
 }
@@ -221,32 +275,21 @@ func (env *Zlisp) DetectSigils(sym *SexpSymbol) {
 }
 
 func (env *Zlisp) DumpSymTable() {
-	for kk, vv := range env.symtable {
+	env.symtable.each(func(kk string, vv int) {
 		fmt.Printf("symtable entry: kk: '%v' -> '%v'\n", kk, vv)
-	}
+	})
 }
 func (env *Zlisp) MakeSymbol(name string) *SexpSymbol {
 	if env == nil {
 		panic("internal problem:  env.MakeSymbol called with nil env")
 	}
-	symnum, ok := env.symtable[name]
-	if ok {
-		symbol := &SexpSymbol{name: name, number: symnum}
-		env.DetectSigils(symbol)
-		return symbol
-	}
-	symbol := &SexpSymbol{name: name, number: env.nextsymbol}
-	env.symtable[name] = symbol.number
-	env.revsymtable[symbol.number] = name
-
-	env.nextsymbol++
+	symbol := &SexpSymbol{name: name, number: env.symtable.intern(name)}
 	env.DetectSigils(symbol)
 	return symbol
 }
 
 func (env *Zlisp) GenSymbol(prefix string) *SexpSymbol {
-	symname := prefix + strconv.Itoa(env.nextsymbol)
-	return env.MakeSymbol(symname)
+	return env.MakeSymbol(env.symtable.gensym(prefix))
 }
 
 func (env *Zlisp) CurrentFunctionSize() int {
@@ -275,6 +318,21 @@ func (env *Zlisp) wrangleOptargs(fnargs, nargs int) error {
 }
 
 func (env *Zlisp) CallFunction(function *SexpFunction, nargs int) error {
+	return env.callFunction(function, nargs, -1)
+}
+
+// TailCallFunction calls function in place of the function
+// running, once its arguments are on the datastack: it closes
+// the caller's function scope and the scopes extra scopes open
+// above it, and function returns straight to the caller's
+// caller, so that calls in tail position do not grow the
+// addrstack however deep they go.
+func (env *Zlisp) TailCallFunction(function *SexpFunction, nargs int, scopes int) error {
+	return env.callFunction(function, nargs, scopes)
+}
+
+// callFunction is a tail call if scopes >= 0.
+func (env *Zlisp) callFunction(function *SexpFunction, nargs int, scopes int) error {
 	for _, prehook := range env.before {
 		expressions, err := env.datastack.GetExpressions(nargs)
 		if err != nil {
@@ -304,7 +362,18 @@ func (env *Zlisp) CallFunction(function *SexpFunction, nargs int) error {
 		panic("where's the global scope?")
 	}
 
-	env.addrstack.PushAddr(env.curfunc, env.pc+1)
+	if scopes < 0 {
+		if err := env.checkStacks(); err != nil {
+			return err
+		}
+		env.addrstack.PushAddr(env.curfunc, env.pc+1)
+	} else {
+		for i := 0; i <= scopes; i++ {
+			if err := env.linearstack.PopScope(); err != nil {
+				return err
+			}
+		}
+	}
 
 	//P("DEBUG linearstack with this next:")
 	//env.showStackHelper(env.linearstack, "linearstack")
@@ -313,6 +382,9 @@ func (env *Zlisp) CallFunction(function *SexpFunction, nargs int) error {
 	// next instructions to happen once we exit.
 	env.curfunc = function
 	env.pc = 0
+	if env.debugger != nil {
+		env.debugger.entering = true
+	}
 
 	//Q("\n CallFunction starting with stack:\n")
 	//env.ShowStackStackAndScopeStack()
@@ -330,9 +402,43 @@ func (env *Zlisp) ReturnFromFunction() error {
 	}
 	var err error
 	env.curfunc, env.pc, err = env.addrstack.PopAddr()
+	if len(env.handlers) > 0 {
+		env.dropHandlers(env.runDepth + 1)
+	}
 	return err
 }
 
+// applyArgs replaces the two arguments of (apply fun args) on
+// the datastack with the args, if fun is a zygo function, so
+// that it can be called like any other.
+func (env *Zlisp) applyArgs() (fun *SexpFunction, nargs int, isZygo bool) {
+	x, err := env.datastack.GetExpr(1)
+	if err != nil {
+		return nil, 0, false
+	}
+	fun, isFun := x.(*SexpFunction)
+	if !isFun || fun.user {
+		return nil, 0, false
+	}
+	var args []Sexp
+	y, _ := env.datastack.GetExpr(0)
+	switch e := y.(type) {
+	case *SexpArray:
+		args = e.Val
+	case *SexpPair:
+		if args, err = ListToArray(e); err != nil {
+			return nil, 0, false
+		}
+	default:
+		return nil, 0, false
+	}
+	env.datastack.PopExpressions(2)
+	for _, arg := range args {
+		env.datastack.PushExpr(arg)
+	}
+	return fun, len(args), true
+}
+
 func (env *Zlisp) CallUserFunction(
 	function *SexpFunction, name string, nargs int) (nargReturned int, err error) {
 	Q("CallUserFunction calling name '%s' with nargs=%v", name, nargs)
@@ -350,6 +456,9 @@ func (env *Zlisp) CallUserFunction(
 			fmt.Sprintf("Error calling '%s': %v", name, err))
 	}
 
+	if err := env.checkStacks(); err != nil {
+		return 0, err
+	}
 	env.addrstack.PushAddr(env.curfunc, env.pc+1)
 	env.curfunc = function
 	env.pc = -1
@@ -360,15 +469,14 @@ func (env *Zlisp) CallUserFunction(
 	// protect against bad calls/bad reflection in usercalls
 	var wasPanic bool
 	var recovered interface{}
-	tr := make([]byte, 16384)
-	trace := &tr
+	var trace []byte
 	res, err := func() (Sexp, error) {
 		defer func() {
 			recovered = recover()
 			if recovered != nil {
 				wasPanic = true
-				nbyte := runtime.Stack(*trace, false)
-				*trace = (*trace)[:nbyte]
+				trace = make([]byte, 16384)
+				trace = trace[:runtime.Stack(trace, false)]
 			}
 		}()
 
@@ -382,12 +490,22 @@ func (env *Zlisp) CallUserFunction(
 	if wasPanic {
 		err = fmt.Errorf("CallUserFunction caught panic during call of "+
 			"'%s': '%v'\n stack trace:\n%v\n",
-			name, recovered, string(*trace))
+			name, recovered, string(trace))
 	}
 	if err != nil {
+		switch err.(type) {
+		case *CancelledError, *ResourceLimitExceeded, *StackOverflow, *SexpError:
+			// keep it distinct, so the embedder can recognize it.
+			return 0, err
+		}
 		return 0, errors.New(
 			fmt.Sprintf("Error calling '%s': %v", name, err))
 	}
+	if env.limits != nil {
+		if err = env.checkResultSize(res); err != nil {
+			return 0, err
+		}
+	}
 
 	env.datastack.PushExpr(res)
 
@@ -401,17 +519,7 @@ func (env *Zlisp) CallUserFunction(
 
 func (env *Zlisp) LoadExpressions(xs []Sexp) error {
 
-	expressions := xs
-	if env.WrapLoadExpressionsInInfix {
-		infixSym := env.MakeSymbol("infix")
-		expressions = []Sexp{MakeList([]Sexp{infixSym, &SexpArray{Val: xs, Env: env}})}
-	}
-
-	//P("expressions before RemoveCommentsFilter: '%s'", (&SexpArray{Val: expressions, Env: env}).SexpString(0))
-	expressions = env.FilterArray(expressions, RemoveCommentsFilter)
-
-	//P("expressions after RemoveCommentsFilter: '%s'", (&SexpArray{Val: expressions, Env: env}).SexpString(0))
-	expressions = env.FilterArray(expressions, RemoveEndsFilter)
+	expressions := env.prepareLoadExpressions(xs)
 
 	gen := NewGenerator(env)
 	if !env.ReachedEnd() {
@@ -428,19 +536,32 @@ func (env *Zlisp) LoadExpressions(xs []Sexp) error {
 	return nil
 }
 
+// prepareLoadExpressions readies freshly parsed top level
+// expressions for the generator.
+func (env *Zlisp) prepareLoadExpressions(xs []Sexp) []Sexp {
+	expressions := xs
+	if env.WrapLoadExpressionsInInfix {
+		infixSym := env.MakeSymbol("infix")
+		expressions = []Sexp{MakeList([]Sexp{infixSym, &SexpArray{Val: xs, Env: env}})}
+	}
+
+	//P("expressions before RemoveCommentsFilter: '%s'", (&SexpArray{Val: expressions, Env: env}).SexpString(0))
+	expressions = env.FilterArray(expressions, RemoveCommentsFilter)
+
+	//P("expressions after RemoveCommentsFilter: '%s'", (&SexpArray{Val: expressions, Env: env}).SexpString(0))
+	expressions = env.FilterArray(expressions, RemoveEndsFilter)
+	return expressions
+}
+
 func (env *Zlisp) ParseFile(file string) ([]Sexp, error) {
 	in, err := os.Open(file)
 	if err != nil {
 		return nil, err
 	}
 
-	var exp []Sexp
-
-	env.parser.Reset()
-	env.parser.NewInput(bufio.NewReader(in))
-	exp, err = env.parser.ParseTokens()
+	exp, err := env.parseStream(&SourceStream{RuneScanner: bufio.NewReader(in), File: file})
 	if err != nil {
-		return nil, fmt.Errorf("Error on line %d: %v\n", env.parser.lexer.Linenum(), err)
+		return nil, err
 	}
 
 	in.Close()
@@ -449,10 +570,9 @@ func (env *Zlisp) ParseFile(file string) ([]Sexp, error) {
 }
 
 func (env *Zlisp) LoadStream(stream io.RuneScanner) error {
-	env.parser.ResetAddNewInput(stream)
-	expressions, err := env.parser.ParseTokens()
+	expressions, err := env.parseStream(stream)
 	if err != nil {
-		return fmt.Errorf("Error on line %d: %v\n", env.parser.lexer.Linenum(), err)
+		return err
 	}
 	return env.LoadExpressions(expressions)
 }
@@ -466,6 +586,16 @@ func (env *Zlisp) EvalString(str string) (Sexp, error) {
 	return env.Run()
 }
 
+// EvalStringContext is like EvalString, but gives up with a
+// *CancelledError once ctx is cancelled or its deadline passes.
+func (env *Zlisp) EvalStringContext(ctx context.Context, str string) (Sexp, error) {
+	err := env.LoadString(str)
+	if err != nil {
+		return SexpNull, err
+	}
+	return env.RunContext(ctx)
+}
+
 // for most things now (except the main repl), prefer EvalFunction() instead of EvalExpressions.
 func (env *Zlisp) EvalExpressions(xs []Sexp) (Sexp, error) {
 	//P("inside EvalExpressions with env %p: xs[0] = %s", env, xs[0].SexpString(0))
@@ -477,11 +607,14 @@ func (env *Zlisp) EvalExpressions(xs []Sexp) (Sexp, error) {
 }
 
 func (env *Zlisp) LoadFile(file io.Reader) error {
+	if f, isFile := file.(*os.File); isFile {
+		return env.LoadStream(&SourceStream{RuneScanner: bufio.NewReader(f), File: f.Name()})
+	}
 	return env.LoadStream(bufio.NewReader(file))
 }
 
 func (env *Zlisp) LoadString(str string) error {
-	return env.LoadStream(bytes.NewBuffer([]byte(str)))
+	return env.LoadStream(strings.NewReader(str))
 }
 
 func (env *Zlisp) AddFunction(name string, function ZlispUserFunction) {
@@ -494,16 +627,16 @@ func (env *Zlisp) AddBuilder(name string, function ZlispUserFunction) {
 
 func (env *Zlisp) AddGlobal(name string, obj Sexp) {
 	sym := env.MakeSymbol(name)
-	env.linearstack.elements[0].(*Scope).Map[sym.number] = obj
+	env.linearstack.elements[0].(*Scope).set(sym.number, obj)
 }
 
 func (env *Zlisp) AddMacro(name string, function ZlispUserFunction) {
 	sym := env.MakeSymbol(name)
-	env.macros[sym.number] = MakeUserFunction(name, function)
+	env.macros.set(sym.number, MakeUserFunction(name, function))
 }
 
 func (env *Zlisp) HasMacro(sym *SexpSymbol) bool {
-	_, found := env.macros[sym.number]
+	_, found := env.macros.get(sym.number)
 	return found
 }
 
@@ -570,9 +703,21 @@ func (env *Zlisp) ReachedEnd() bool {
 func (env *Zlisp) GetStackTrace(err error) string {
 	str := fmt.Sprintf("error in %s:%d: %v\n",
 		env.curfunc.name, env.pc, err)
+	var overflow *StackOverflow
+	if errors.As(err, &overflow) {
+		// the error shows the innermost calls already;
+		// there are too many to list them all.
+		env.addrstack.TruncateToSize(0)
+		return str
+	}
 	for !env.addrstack.IsEmpty() {
 		fun, pos, _ := env.addrstack.PopAddr()
-		str += fmt.Sprintf("in %s:%d\n", fun.name, pos)
+		// pos is the return address; the call is just before it.
+		if srcpos := fun.PosAt(pos - 1); srcpos != nil {
+			str += fmt.Sprintf("in %s:%d (%s)\n", fun.name, pos, srcpos)
+		} else {
+			str += fmt.Sprintf("in %s:%d\n", fun.name, pos)
+		}
 	}
 	return str
 }
@@ -581,6 +726,7 @@ func (env *Zlisp) Clear() {
 	env.datastack.tos = -1
 	env.linearstack.tos = 0
 	env.addrstack.tos = -1
+	env.handlers = nil
 
 	env.mainfunc = env.MakeFunction("__main", 0, false,
 		make([]Instruction, 0), nil)
@@ -597,12 +743,22 @@ func (env *Zlisp) FindObject(name string) (Sexp, bool) {
 	return obj, true
 }
 
+// Apply calls fun with args and returns its result. Go code may
+// call it at any time: from a builtin that is itself running under
+// Run, from a callback held on to after the script that made it
+// has finished, or between runs. Where the interpreter was, and
+// its stacks, are put back afterwards, whether fun succeeds or
+// fails. Like the rest of env, Apply is not safe for use by more
+// than one goroutine at a time; give each its own env.Duplicate().
 func (env *Zlisp) Apply(fun *SexpFunction, args []Sexp) (Sexp, error) {
-	VPrintf("\n\n debug Apply not working on user funcs: fun = '%#v'   and args = '%#v'\n\n", fun, args)
 	if fun.user {
 		return fun.userfun(env, fun.name, args)
 	}
 
+	saved := env.saveFrame()
+	defer env.restoreFrame(saved)
+
+	// returning to pc -1 ends the Run below.
 	env.pc = -2
 	for _, expr := range args {
 		env.datastack.PushExpr(expr)
@@ -617,10 +773,122 @@ func (env *Zlisp) Apply(fun *SexpFunction, args []Sexp) (Sexp, error) {
 	return env.Run()
 }
 
+// frame is where the interpreter was, and how deep its stacks,
+// before an Apply.
+type frame struct {
+	fun    *SexpFunction
+	pc     int
+	data   int
+	addr   int
+	linear int
+	loop   int
+}
+
+func (env *Zlisp) saveFrame() frame {
+	return frame{
+		fun:    env.curfunc,
+		pc:     env.pc,
+		data:   env.datastack.Size(),
+		addr:   env.addrstack.Size(),
+		linear: env.linearstack.Size(),
+		loop:   env.loopstack.Size(),
+	}
+}
+
+// restoreFrame unwinds whatever a failed call left on the stacks.
+func (env *Zlisp) restoreFrame(f frame) {
+	env.curfunc, env.pc = f.fun, f.pc
+	for _, s := range []struct {
+		stack *Stack
+		size  int
+	}{
+		{env.datastack, f.data},
+		{env.addrstack, f.addr},
+		{env.linearstack, f.linear},
+		{env.loopstack, f.loop},
+	} {
+		if s.stack.Size() > s.size {
+			s.stack.TruncateToSize(s.size)
+		}
+	}
+}
+
+// CancelledError is returned by RunContext (and EvalStringContext)
+// when the context is done before the script finishes. Func and Pc
+// tell where the interpreter was when it noticed.
+type CancelledError struct {
+	Func string
+	Pc   int
+	Err  error // the ctx.Err() that stopped us
+}
+
+func (e *CancelledError) Error() string {
+	return fmt.Sprintf("execution cancelled in %s:%d: %v", e.Func, e.Pc, e.Err)
+}
+
+func (e *CancelledError) Unwrap() error {
+	return e.Err
+}
+
+// RunContext is like Run, but checks ctx every ContextCheckInterval
+// instructions and returns a *CancelledError once ctx is done.
+// Goroutines started with (go ...) during the run inherit ctx.
+// After a cancellation the stacks are left as they were, so
+// call env.Clear() before re-using env.
+func (env *Zlisp) RunContext(ctx context.Context) (Sexp, error) {
+	prev := env.ctx
+	env.ctx = ctx
+	defer func() { env.ctx = prev }()
+	return env.Run()
+}
+
+func (env *Zlisp) checkContext() error {
+	select {
+	case <-env.ctx.Done():
+		if err := env.budgetSpent(); err != nil {
+			return err
+		}
+		return &CancelledError{Func: env.curfunc.name, Pc: env.pc, Err: env.ctx.Err()}
+	default:
+	}
+	return nil
+}
+
 func (env *Zlisp) Run() (Sexp, error) {
 
+	if env.runDepth == 0 {
+		if !env.sharesBudget {
+			env.budget = nil
+		}
+		if env.debugger != nil {
+			env.debugger.start()
+		}
+	}
+	env.runDepth++
+	defer func() {
+		if len(env.handlers) > 0 {
+			env.dropHandlers(env.runDepth)
+		}
+		env.runDepth--
+	}()
+
+	if env.ctx != nil {
+		if err := env.checkContext(); err != nil {
+			return SexpNull, err
+		}
+	}
+	count := 0
 	for env.pc != -1 && !env.ReachedEnd() {
-		instr := env.curfunc.fun[env.pc]
+		if env.ctx != nil {
+			count++
+			if count%ContextCheckInterval == 0 {
+				if err := env.checkContext(); err != nil {
+					return SexpNull, err
+				}
+			}
+		}
+		fun, pc := env.curfunc, env.pc
+		instr := fun.fun[pc]
 		if env.debugExec {
 			fmt.Printf("\n ====== in '%s', about to run: '%v'\n",
 				env.curfunc.name, instr.InstrString())
@@ -628,13 +896,28 @@ func (env *Zlisp) Run() (Sexp, error) {
 			fmt.Printf("\n ====== in '%s', now running the above.\n",
 				env.curfunc.name)
 		}
+		if env.debugger != nil {
+			// the debugger's errors abort the script; no (try) catches them.
+			if err := env.debugger.before(fun, pc); err != nil {
+				return SexpNull, err
+			}
+		}
 		err := instr.Execute(env)
 		if err == StackUnderFlowErr {
 			err = nil
 		}
 		if err != nil {
+			err = env.positionError(fun, pc, err)
+			if len(env.handlers) > 0 && env.catchError(err) {
+				continue
+			}
 			return SexpNull, err
 		}
+		if env.limits != nil {
+			if err = env.checkStepLimits(); err != nil {
+				return SexpNull, err
+			}
+		}
 		if env.debugExec {
 			fmt.Printf("\n ****** in '%s', after running, stack is: \n",
 				env.curfunc.name)
@@ -699,8 +982,6 @@ func (env *Zlisp) showStackHelper(stack *Stack, name string) {
 
 		case *Scope:
 			s, _ = x.Show(env, nil, label)
-		case Scope:
-			s, _ = x.Show(env, nil, label)
 		default:
 			panic(fmt.Errorf("unrecognized element on %s: %T/val=%v",
 				name, x, x))
@@ -809,7 +1090,7 @@ func (env *Zlisp) IsBuiltinSym(sym *SexpSymbol) (builtin bool, typ string) {
 	if isBuiltin {
 		return true, "built-in function"
 	}
-	_, isBuiltin = env.macros[sym.number]
+	_, isBuiltin = env.macros.get(sym.number)
 	if isBuiltin {
 		return true, "macro"
 	}
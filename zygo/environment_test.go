@@ -1,9 +1,13 @@
 package zygo
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	cv "github.com/glycerine/goconvey/convey"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func Test400SandboxFunctions(t *testing.T) {
@@ -59,3 +63,305 @@ func Test400SandboxFunctions(t *testing.T) {
 		}
 	})
 }
+
+func Test401RunContextCancelsRunawayLoop(t *testing.T) {
+
+	cv.Convey(`Given a script that never terminates, EvalStringContext() should give up once the context deadline passes, returning a *CancelledError that wraps the context error`, t, func() {
+
+		env := NewZlisp()
+		defer env.Stop()
+		env.StandardSetup()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		_, err := env.EvalStringContext(ctx, `(for [(def i 0) true (set i (+ i 1))] i)`)
+		cv.So(err, cv.ShouldNotBeNil)
+		ce, isCancel := err.(*CancelledError)
+		cv.So(isCancel, cv.ShouldBeTrue)
+		cv.So(ce.Func, cv.ShouldEqual, "__main")
+		cv.So(errors.Is(err, context.DeadlineExceeded), cv.ShouldBeTrue)
+
+		// and a blocked channel receive should be interrupted too.
+		env.Clear()
+		ctx2, cancel2 := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel2()
+		_, err = env.EvalStringContext(ctx2, `(<! (makeChan))`)
+		cv.So(errors.Is(err, context.DeadlineExceeded), cv.ShouldBeTrue)
+
+		// the environment is usable again after Clear().
+		env.Clear()
+		res, err := env.EvalString(`(+ 1 2)`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res, cv.ShouldResemble, &SexpInt{Val: 3})
+	})
+}
+
+func Test402ResourceLimitsStopRun(t *testing.T) {
+
+	cv.Convey(`Given ResourceLimits on an environment, Run should fail with a *ResourceLimitExceeded naming the limit that was hit`, t, func() {
+
+		env := NewZlisp()
+		defer env.Stop()
+		env.StandardSetup()
+
+		limitHit := func(code string) string {
+			env.Clear()
+			_, err := env.EvalString(code)
+			if err == nil {
+				return ""
+			}
+			re, ok := err.(*ResourceLimitExceeded)
+			if !ok {
+				return fmt.Sprintf("unexpected error type %T: %v", err, err)
+			}
+			return re.Limit
+		}
+
+		env.SetResourceLimits(&ResourceLimits{MaxInstructions: 1000})
+		cv.So(limitHit(`(for [(def i 0) true (set i (+ i 1))] i)`), cv.ShouldEqual, "MaxInstructions")
+		// the budget is per Run, so a small script still fits afterwards.
+		cv.So(limitHit(`(+ 1 2)`), cv.ShouldEqual, "")
+
+		// (go ...) blocks spend the budget of the Run starting
+		// them, and are stopped once it is spent.
+		env.SetResourceLimits(&ResourceLimits{MaxInstructions: 2000})
+		cv.So(limitHit(`(defn spin [] (for [(def i 0) (< i 100) (set i (+ i 1))] i)) (spin)`), cv.ShouldEqual, "")
+		cv.So(limitHit(`(waitAll [(go (spin)) (go (spin)) (go (spin))])`), cv.ShouldEqual, "MaxInstructions")
+		cv.So(limitHit(`(def ch (makeChan)) (def g (go (recv ch))) (for [(def i 0) true (set i (+ i 1))] i)`), cv.ShouldEqual, "MaxInstructions")
+		g, _ := env.FindObject("g")
+		_, err := g.(*SexpGoroutine).Wait()
+		_, isLimit := err.(*ResourceLimitExceeded)
+		cv.So(isLimit, cv.ShouldBeTrue)
+
+		env.SetResourceLimits(&ResourceLimits{MaxScopeStack: 20})
+		cv.So(limitHit(`(defn r [n] (cond (== n 0) 0 (+ 1 (r (- n 1))))) (r 100)`), cv.ShouldEqual, "MaxScopeStack")
+
+		env.SetResourceLimits(&ResourceLimits{MaxArrayLen: 10})
+		cv.So(limitHit(`(makeArray 11)`), cv.ShouldEqual, "MaxArrayLen")
+		cv.So(limitHit(`(makeArray 10)`), cv.ShouldEqual, "")
+
+		env.SetResourceLimits(&ResourceLimits{MaxStringLen: 5})
+		cv.So(limitHit(`(concat "abc" "def")`), cv.ShouldEqual, "MaxStringLen")
+		cv.So(limitHit(`(append "abcde" 'f')`), cv.ShouldEqual, "MaxStringLen")
+		cv.So(limitHit(`(append "abcd" 'e')`), cv.ShouldEqual, "")
+
+		// concat and append check the size before making the result.
+		env.SetResourceLimits(&ResourceLimits{MaxArrayLen: 10})
+		cv.So(limitHit(`(def a (makeArray 10)) (concat a a a a a a a a)`), cv.ShouldEqual, "MaxArrayLen")
+		cv.So(limitHit(`(appendslice a [1])`), cv.ShouldEqual, "MaxArrayLen")
+
+		env.SetResourceLimits(&ResourceLimits{MaxHashKeys: 2})
+		cv.So(limitHit(`(def h (hash a:1 b:2)) (hset h c: 3)`), cv.ShouldEqual, "MaxHashKeys")
+
+		env.SetResourceLimits(nil)
+		cv.So(limitHit(`(makeArray 11)`), cv.ShouldEqual, "")
+	})
+}
+
+func Test403TryCatchGivesSexpError(t *testing.T) {
+
+	cv.Convey(`Given (throw) and (try ... (catch e ...)), the caught value should be a *SexpError naming the function that failed, and an uncaught throw should come back from Run as a *SexpError`, t, func() {
+
+		env := NewZlisp()
+		defer env.Stop()
+		env.StandardSetup()
+
+		res, err := env.EvalString(`(defn f [] (throw "from f")) (try (f) (catch e e))`)
+		cv.So(err, cv.ShouldBeNil)
+		sxerr, isErr := res.(*SexpError)
+		cv.So(isErr, cv.ShouldBeTrue)
+		cv.So(sxerr.Error(), cv.ShouldEqual, "1:12: from f")
+		cv.So(sxerr.Func, cv.ShouldEqual, "f")
+
+		env.Clear()
+		res, err = env.EvalString(`(try (unjson "{") (catch e e))`)
+		cv.So(err, cv.ShouldBeNil)
+		sxerr, isErr = res.(*SexpError)
+		cv.So(isErr, cv.ShouldBeTrue)
+		cv.So(sxerr.Func, cv.ShouldEqual, "unjson")
+
+		env.Clear()
+		_, err = env.EvalString(`(throw (hash a:1))`)
+		sxerr, isErr = err.(*SexpError)
+		cv.So(isErr, cv.ShouldBeTrue)
+		cv.So(sxerr.Func, cv.ShouldEqual, "__main")
+		_, isHash := sxerr.Value.(*SexpHash)
+		cv.So(isHash, cv.ShouldBeTrue)
+
+		// limits are not catchable from scripts.
+		env.Clear()
+		env.SetResourceLimits(&ResourceLimits{MaxArrayLen: 3})
+		_, err = env.EvalString(`(try (makeArray 4) (catch e 0))`)
+		_, isLimit := err.(*ResourceLimitExceeded)
+		cv.So(isLimit, cv.ShouldBeTrue)
+	})
+}
+
+type Widget407 struct{ X int }
+
+func Test407TypeRegistryIsPerEnvironment(t *testing.T) {
+
+	cv.Convey(`A (struct ...) declared in one environment should not be visible in another, nor in the shared GoStructRegistry`, t, func() {
+		env1 := NewZlisp()
+		defer env1.Stop()
+		env1.StandardSetup()
+		env2 := NewZlisp()
+		defer env2.Stop()
+		env2.StandardSetup()
+
+		_, err := env1.EvalString(`(struct Tenant407 [(field Name: string)]) (Tenant407 Name:"a")`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(env1.LookupType("Tenant407"), cv.ShouldNotBeNil)
+		cv.So(env2.LookupType("Tenant407"), cv.ShouldBeNil)
+		cv.So(GoStructRegistry.Lookup("Tenant407"), cv.ShouldBeNil)
+
+		// and the other environment may declare its own, differently.
+		_, err = env2.EvalString(`(struct Tenant407 [(field Age: int64)]) (Tenant407 Age:3)`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(env1.LookupType("Tenant407"), cv.ShouldNotEqual, env2.LookupType("Tenant407"))
+
+		// the shared base types remain visible to both.
+		cv.So(env1.LookupType("snoopy"), cv.ShouldNotBeNil)
+		cv.So(env1.LookupType("snoopy"), cv.ShouldEqual, env2.LookupType("snoopy"))
+	})
+
+	cv.Convey(`env.RegisterUserdef should pre-register a type into that environment alone`, t, func() {
+		env1 := NewZlisp()
+		defer env1.Stop()
+		env1.StandardSetup()
+		env2 := NewZlisp()
+		defer env2.Stop()
+		env2.StandardSetup()
+
+		env1.RegisterUserdef(NewRegisteredType(func(env *Zlisp, h *SexpHash) (interface{}, error) {
+			return &Snoopy{}, nil
+		}), false, "Pre407")
+
+		res, err := env1.EvalString(`(defined? "Pre407")`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(IsTruthy(res), cv.ShouldBeTrue)
+		cv.So(env1.LookupType("Pre407"), cv.ShouldNotBeNil)
+		cv.So(env2.LookupType("Pre407"), cv.ShouldBeNil)
+		res, err = env2.EvalString(`(defined? "Pre407")`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(IsTruthy(res), cv.ShouldBeFalse)
+	})
+
+	cv.Convey(`Go values and interface declarations should find their types in the environment that made them`, t, func() {
+		env1 := NewZlisp()
+		defer env1.Stop()
+		env1.StandardSetup()
+		env2 := NewZlisp()
+		defer env2.Stop()
+		env2.StandardSetup()
+
+		rt := NewRegisteredType(func(env *Zlisp, h *SexpHash) (interface{}, error) {
+			return &Widget407{}, nil
+		})
+		env1.RegisterUserdef(rt, false, "zygo.Widget407")
+		x, err := env1.GoToSexpValue(reflect.ValueOf(&Widget407{}))
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(x.Type(), cv.ShouldEqual, rt)
+		x, err = env2.GoToSexpValue(reflect.ValueOf(&Widget407{}))
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(x.Type(), cv.ShouldBeNil)
+
+		env1.RegisterUserdef(rt, false, "Iface407")
+		decl, err := env1.EvalString(`(interface Iface407 [])`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(decl.Type(), cv.ShouldEqual, rt)
+		decl, err = env2.EvalString(`(interface Iface407 [])`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(decl.Type(), cv.ShouldBeNil)
+	})
+}
+
+func Test416TailCallsDoNotGrowTheStacks(t *testing.T) {
+
+	cv.Convey(`calls in tail position, to the function itself or any other, directly, through let and begin, by dispatch or through apply, should run in place of their caller`, t, func() {
+		env := NewZlisp()
+		defer env.Stop()
+		env.StandardSetup()
+
+		deepest := 0
+		env.AddFunction("depth", func(env *Zlisp, name string, args []Sexp) (Sexp, error) {
+			if n := env.addrstack.Size(); n > deepest {
+				deepest = n
+			}
+			if n := env.linearstack.Size(); n > deepest {
+				deepest = n
+			}
+			return SexpNull, nil
+		})
+
+		for _, src := range []string{
+			`(defn isEven [n] (depth) (cond (== n 0) true (isOdd (- n 1))))
+			 (defn isOdd [n] (let [m (- n 1)] (cond (< m 0) false (begin (depth) (isEven m)))))
+			 (isEven 1000)`,
+			`(defn pick [n] (cond (== 0 (mod n 2)) hop skip))
+			 (defn hop [n] (depth) (cond (<= n 0) true ((pick n) (- n 1))))
+			 (defn skip [n] (hop (- n 1)))
+			 (hop 1000)`,
+			`(defn down [n] (depth) (cond (== n 0) true (apply down [(- n 1)])))
+			 (down 1000)`,
+		} {
+			deepest = 0
+			x, err := env.EvalString(src)
+			cv.So(err, cv.ShouldBeNil)
+			cv.So(IsTruthy(x), cv.ShouldBeTrue)
+			cv.So(deepest, cv.ShouldBeLessThan, 10)
+			cv.So(env.linearstack.Size(), cv.ShouldEqual, 1)
+		}
+
+		// (begin ... (f)) as the function to call is no tail call.
+		_, err := env.EvalString(`(defn g [] (fn [] 7)) (defn h [] ((begin 1 (g)))) (assert (== (h) 7))`)
+		cv.So(err, cv.ShouldBeNil)
+	})
+}
+
+func Test420StackSizesAndStackOverflow(t *testing.T) {
+
+	cv.Convey(`stack sizes should be configurable, and deep recursion past them should fail with a StackOverflow showing the innermost calls, leaving the environment usable`, t, func() {
+		env := NewZlisp(WithStackSizes(StackSizes{CallStack: 50}))
+		defer env.Stop()
+		env.StandardSetup()
+		cv.So(env.StackSizes(), cv.ShouldResemble, StackSizes{
+			CallStack: 50, ScopeStack: ScopeStackSize, DataStack: DataStackSize, LoopStack: LoopStackSize})
+
+		_, err := env.EvalString(`(defn down [n] (cond (== n 0) 0 (+ 1 (down (- n 1))))) (down 40)`)
+		cv.So(err, cv.ShouldBeNil)
+
+		_, err = env.EvalString(`(down 100)`)
+		so, isOverflow := err.(*StackOverflow)
+		cv.So(isOverflow, cv.ShouldBeTrue)
+		cv.So(so.Stack, cv.ShouldEqual, "CallStack")
+		cv.So(so.Depth, cv.ShouldEqual, 51)
+		cv.So(len(so.Frames), cv.ShouldEqual, StackOverflowFrames)
+		cv.So(so.Frames[1], cv.ShouldStartWith, "down (")
+		cv.So(err.Error(), cv.ShouldContainSubstring, "... and 41 more")
+		env.Clear()
+
+		// tail calls do not count against the call stack
+		x, err := env.EvalString(`(defn loop [n] (cond (== n 0) 7 (loop (- n 1)))) (loop 1000)`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(x.SexpString(nil), cv.ShouldEqual, `7`)
+
+		// a (try) can catch it
+		x, err = env.EvalString(`(try (down 100) (catch e 8))`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(x.SexpString(nil), cv.ShouldEqual, `8`)
+
+		env.SetStackSizes(StackSizes{ScopeStack: 30})
+		_, err = env.EvalString(`(down 100)`)
+		so, isOverflow = err.(*StackOverflow)
+		cv.So(isOverflow, cv.ShouldBeTrue)
+		cv.So(so.Stack, cv.ShouldEqual, "ScopeStack")
+		env.Clear()
+
+		env.SetStackSizes(StackSizes{LoopStack: 1})
+		_, err = env.EvalString(`(for [(def i 0) (< i 1) (set i 1)] (for [(def j 0) (< j 1) (set j 1)] 0))`)
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "stack overflow: LoopStack exceeded 1 entries")
+	})
+}
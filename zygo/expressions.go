@@ -26,6 +26,7 @@ type Sexp interface {
 type SexpPair struct {
 	Head Sexp
 	Tail Sexp
+	Pos  *Pos // where the parser found it; nil if made at runtime
 }
 
 type SexpPointer struct {
@@ -36,6 +37,11 @@ type SexpPointer struct {
 }
 
 func NewSexpPointer(pointedTo Sexp) *SexpPointer {
+	return newSexpPointer(nil, pointedTo)
+}
+
+// newSexpPointer registers any new pointer type with env.
+func newSexpPointer(env *Zlisp, pointedTo Sexp) *SexpPointer {
 	pointedToType := pointedTo.Type()
 
 	var reftarg reflect.Value
@@ -49,7 +55,7 @@ func NewSexpPointer(pointedTo Sexp) *SexpPointer {
 		reftarg = reflect.ValueOf(pointedTo)
 	}
 
-	ptrRt := GoStructRegistry.GetOrCreatePointerType(pointedToType)
+	ptrRt := env.TypeRegistry().GetOrCreatePointerType(pointedToType)
 	Q("pointer type is ptrRt = '%#v'", ptrRt)
 	p := &SexpPointer{
 		ReflectTarget: reftarg,
@@ -92,23 +98,23 @@ type SexpStr struct {
 }
 
 func (r SexpStr) Type() *RegisteredType {
-	return GoStructRegistry.Registry["string"]
+	return GoStructRegistry.Lookup("string")
 }
 
 func (r *SexpInt) Type() *RegisteredType {
-	return GoStructRegistry.Registry["int64"]
+	return GoStructRegistry.Lookup("int64")
 }
 
 func (r *SexpFloat) Type() *RegisteredType {
-	return GoStructRegistry.Registry["float64"]
+	return GoStructRegistry.Lookup("float64")
 }
 
 func (r *SexpBool) Type() *RegisteredType {
-	return GoStructRegistry.Registry["bool"]
+	return GoStructRegistry.Lookup("bool")
 }
 
 func (r *SexpChar) Type() *RegisteredType {
-	return GoStructRegistry.Registry["int32"]
+	return GoStructRegistry.Lookup("int32")
 }
 
 func (r *RegisteredType) Type() *RegisteredType {
@@ -124,14 +130,29 @@ func (r *SexpRaw) Type() *RegisteredType {
 	return r.Typ
 }
 
+// SexpReflect wraps a Go value. Typ, when set, is the type the
+// value was declared with; otherwise it is looked up by name, in
+// the environment that made the value if that is known.
 type SexpReflect struct {
 	Val reflect.Value
+	Typ *RegisteredType
+
+	env *Zlisp
 }
 
 func (r *SexpReflect) Type() *RegisteredType {
+	if r.Typ != nil {
+		return r.Typ
+	}
 	k := reflectName(reflect.Value(r.Val))
 	Q("SexpReflect.Type() looking up type named '%s'", k)
-	ty, ok := GoStructRegistry.Registry[k]
+	var ty *RegisteredType
+	if r.env != nil {
+		ty = r.env.LookupType(k)
+	} else {
+		ty = GoStructRegistry.Lookup(k)
+	}
+	ok := ty != nil
 	if !ok {
 		Q("SexpReflect.Type(): type named '%s' not found", k)
 		return nil
@@ -140,12 +161,28 @@ func (r *SexpReflect) Type() *RegisteredType {
 	return ty
 }
 
+// SexpError is an error as a zygo value. It is what (throw)
+// raises and what (try ... (catch e ...)) binds e to. Func names
+// the function that failed, Pc its instruction index there, and
+// Pos the source position, when known. Value is the argument to
+// throw, or nil for errors from Go.
 type SexpError struct {
 	error
+	Value Sexp
+	Func  string
+	Pc    int
+	Pos   *Pos
+}
+
+func (e *SexpError) Error() string {
+	if e.Pos == nil {
+		return e.error.Error()
+	}
+	return e.Pos.String() + ": " + e.error.Error()
 }
 
 func (r *SexpError) Type() *RegisteredType {
-	return GoStructRegistry.Registry["error"]
+	return GoStructRegistry.Lookup("error")
 }
 
 func (r *SexpSentinel) Type() *RegisteredType {
@@ -210,7 +247,7 @@ func (sent *SexpSentinel) SexpString(ps *PrintState) string {
 }
 
 func Cons(a Sexp, b Sexp) *SexpPair {
-	return &SexpPair{a, b}
+	return &SexpPair{Head: a, Tail: b}
 }
 
 func (pair *SexpPair) SexpString(ps *PrintState) string {
@@ -257,7 +294,7 @@ func (r *SexpArray) Type() *RegisteredType {
 			// take type from first element
 			ty := r.Val[0].Type()
 			if ty != nil {
-				r.Typ = GoStructRegistry.GetOrCreateSliceType(ty)
+				r.Typ = r.Env.TypeRegistry().GetOrCreateSliceType(ty)
 			}
 		} else {
 			// empty array
@@ -312,7 +349,7 @@ func (arr *SexpArray) SexpString(ps *PrintState) string {
 }
 
 func (e *SexpError) SexpString(ps *PrintState) string {
-	return e.error.Error()
+	return e.Error()
 }
 
 type EmbedPath struct {
@@ -339,11 +376,17 @@ type HashFieldDet struct {
 	FieldName    string
 	FieldJsonTag string
 	EmbedPath    []EmbedPath // we are embedded if len(EmbedPath) > 0
+	Required     bool        // from a zygo:"name,required" struct tag
+	HasDefault   bool
+	Default      string // from a zygo:"name,default=..." struct tag
 }
+
+// SexpHash is a hash, record or struct value. Its entries are
+// kept as described in hashorder.go; the Map and KeyOrder
+// fields it used to have are gone, so Go code that read them
+// should call Keys, Each or HashGet instead.
 type SexpHash struct {
 	TypeName         string
-	Map              map[int][]*SexpPair
-	KeyOrder         []Sexp
 	GoStructFactory  *RegisteredType
 	NumKeys          int
 	GoMethods        []reflect.Method
@@ -366,6 +409,12 @@ type SexpHash struct {
 	ZMain      SexpFunction
 	ZMethods   map[string]*SexpFunction
 	Env        *Zlisp
+
+	// entries in key order, with nil for deleted ones,
+	// and indexed by key hash; see hashorder.go.
+	order []*hashEntry
+	holes int
+	index map[uint64][]*hashEntry
 }
 
 var MethodNotFound = fmt.Errorf("method not found")
@@ -512,7 +561,7 @@ func (sym *SexpSymbol) SexpString(ps *PrintState) string {
 }
 
 func (r *SexpSymbol) Type() *RegisteredType {
-	return GoStructRegistry.Registry["symbol"]
+	return GoStructRegistry.Lookup("symbol")
 }
 
 func (sym SexpSymbol) Name() string {
@@ -527,6 +576,7 @@ func (sym SexpSymbol) Number() int {
 type SexpInterfaceDecl struct {
 	name    string
 	methods []*SexpFunction
+	env     *Zlisp
 }
 
 func (r *SexpInterfaceDecl) SexpString(ps *PrintState) string {
@@ -546,7 +596,10 @@ func (r *SexpInterfaceDecl) SexpString(ps *PrintState) string {
 
 func (r *SexpInterfaceDecl) Type() *RegisteredType {
 	// todo: how to register/what to register?
-	return GoStructRegistry.Registry[r.name]
+	if r.env != nil {
+		return r.env.LookupType(r.name)
+	}
+	return GoStructRegistry.Lookup(r.name)
 }
 
 // SexpFunction
@@ -575,13 +628,6 @@ func (sf *SexpFunction) Copy() *SexpFunction {
 }
 
 func (sf *SexpFunction) SetClosing(clos *Closing, parentFunc *SexpFunction) {
-	ps4 := NewPrintStateWithIndent(4)
-	pre, err := sf.ShowClosing(clos.env, ps4, "prev")
-	_ = pre
-	panicOn(err)
-	newnew, err := sf.ShowClosing(clos.env, ps4, "newnew")
-	_ = newnew
-	panicOn(err)
 	//P("99999 for sfun = %p, in sfun.SetClosing(), prev value is %p = '%s'\n",
 	//	sf, sf.closingOverScopes, pre)
 	//P("88888 in sfun.SetClosing(), new  value is %p = '%s'\n", clos, newnew)
@@ -146,7 +146,7 @@ func FuncBuilder(env *Zlisp, name string,
 	origa = append(origa, args...)
 	orig := MakeList(origa)
 
-	funcargs := inHash.KeyOrder
+	funcargs := inHash.Keys()
 
 	gen := NewGenerator(env)
 	gen.Tail = true
@@ -189,7 +189,7 @@ func FuncBuilder(env *Zlisp, name string,
 	// minimal sanity check that we return the number of arguments
 	// on the stack that are declared
 	if len(body) == 0 {
-		for range retHash.KeyOrder {
+		for i := 0; i < retHash.NumKeys; i++ {
 			gen.AddInstruction(PushInstr{expr: SexpNull})
 		}
 	}
@@ -1,12 +1,13 @@
 package zygo
 
 import (
-	"bytes"
 	"fmt"
 	"os"
 	"reflect"
 	"runtime"
+	"strings"
 	"unicode"
+	"unicode/utf8"
 )
 
 var WrongNargs error = fmt.Errorf("wrong number of arguments")
@@ -358,15 +359,12 @@ func HashAccessFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 		if len(args) != 1 {
 			return SexpNull, WrongNargs
 		}
-		keys := make([]Sexp, 0)
-		n := len(hash.KeyOrder)
+		keys := hash.Keys()
 		arr := &SexpArray{Env: env}
-		for i := 0; i < n; i++ {
-			keys = append(keys, (hash.KeyOrder)[i])
-
-			// try to get a .Typ value going too... from the first available.
-			if arr.Typ == nil {
-				arr.Typ = (hash.KeyOrder)[i].Type()
+		// try to get a .Typ value going too... from the first available.
+		for _, key := range keys {
+			if arr.Typ = key.Type(); arr.Typ != nil {
+				break
 			}
 		}
 		arr.Val = keys
@@ -378,7 +376,7 @@ func HashAccessFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 		switch posreq := args[1].(type) {
 		case *SexpInt:
 			pos := int(posreq.Val)
-			if pos < 0 || pos >= len(hash.KeyOrder) {
+			if pos < 0 || pos >= hash.NumKeys {
 				return SexpNull, fmt.Errorf("hpair position request %d out of bounds", pos)
 			}
 			return hash.HashPairi(pos)
@@ -485,10 +483,16 @@ func AppendFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 	case *SexpArray:
 		switch name {
 		case "append":
+			if err := env.CheckArrayLen(len(t.Val) + 1); err != nil {
+				return SexpNull, err
+			}
 			return &SexpArray{Val: append(t.Val, args[1]), Env: env, Typ: t.Typ}, nil
 		case "appendslice":
 			switch sl := args[1].(type) {
 			case *SexpArray:
+				if err := env.CheckArrayLen(len(t.Val) + len(sl.Val)); err != nil {
+					return SexpNull, err
+				}
 				return &SexpArray{Val: append(t.Val, sl.Val...), Env: env, Typ: t.Typ}, nil
 			default:
 				return SexpNull, fmt.Errorf("Second argument of appendslice must be slice")
@@ -497,6 +501,11 @@ func AppendFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 			return SexpNull, fmt.Errorf("unrecognized append variant: '%s'", name)
 		}
 	case *SexpStr:
+		if chr, isChar := args[1].(*SexpChar); isChar {
+			if err := env.CheckStringLen(len(t.S) + utf8.RuneLen(chr.Val)); err != nil {
+				return SexpNull, err
+			}
+		}
 		return AppendStr(t, args[1])
 	}
 
@@ -513,6 +522,10 @@ func ConcatFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 		return SexpNull, err
 	}
 
+	if err = env.checkConcatLen(args); err != nil {
+		return SexpNull, err
+	}
+
 	switch t := args[0].(type) {
 	case *SexpArray:
 		return ConcatArray(t, args[1:])
@@ -545,7 +558,10 @@ func ReadFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 	default:
 		return SexpNull, WrongType
 	}
-	env.parser.ResetAddNewInput(bytes.NewBuffer([]byte(str)))
+	env.parser.inUse.Lock()
+	defer env.parser.inUse.Unlock()
+	env.parser.lexer.Reset()
+	env.parser.lexer.AddNextStream(strings.NewReader(str))
 	exp, err := env.parser.ParseExpression(0)
 	return exp, err
 }
@@ -658,6 +674,8 @@ func TypeQueryFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 		result = IsEmpty(args[0])
 	case "func?":
 		result = IsFunc(args[0])
+	case "error?":
+		result = IsError(args[0])
 	}
 
 	return &SexpBool{Val: result}, nil
@@ -792,6 +810,9 @@ func MakeArrayFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 	default:
 		return SexpNull, fmt.Errorf("first argument must be integer")
 	}
+	if err := env.CheckArrayLen(size); err != nil {
+		return SexpNull, err
+	}
 
 	var fill Sexp
 	if len(args) == 2 {
@@ -981,6 +1002,9 @@ func CoreFunctions() map[string]ZlispUserFunction {
 		"zero?":     TypeQueryFunction,
 		"empty?":    TypeQueryFunction,
 		"func?":     TypeQueryFunction,
+		"error?":    TypeQueryFunction,
+		"throw":     ThrowFunction,
+		"errmsg":    ErrmsgFunction,
 		"not":       NotFunction,
 		"apply":     ApplyFunction,
 		"map":       MapFunction,
@@ -1045,18 +1069,21 @@ func StrFunctions() map[string]ZlispUserFunction {
 
 func EncodingFunctions() map[string]ZlispUserFunction {
 	return map[string]ZlispUserFunction{
-		"json":      JsonFunction,
-		"unjson":    JsonFunction,
-		"msgpack":   JsonFunction,
-		"unmsgpack": JsonFunction,
-		"gob":       GobEncodeFunction,
-		"msgmap":    ConstructorFunction,
+		"json":         JsonFunction,
+		"unjson":       JsonFunction,
+		"msgpack":      JsonFunction,
+		"unmsgpack":    JsonFunction,
+		"gob":          GobEncodeFunction,
+		"msgmap":       ConstructorFunction,
+		"jsonschema":   JsonSchemaFunction,
+		"unjsonschema": JsonSchemaFunction,
 	}
 }
 
 func ReflectionFunctions() map[string]ZlispUserFunction {
 	return map[string]ZlispUserFunction{
 		"methodls":              GoMethodListFunction,
+		"makego":                MakeGoFunction,
 		"_method":               CallGoMethodFunction,
 		"registerDemoFunctions": ScriptFacingRegisterDemoStructs,
 	}
@@ -1523,7 +1550,7 @@ func AddressOfFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 		return SexpNull, WrongNargs
 	}
 
-	return NewSexpPointer(args[0]), nil
+	return newSexpPointer(env, args[0]), nil
 }
 
 func DerefFunction(env *Zlisp, name string, args []Sexp) (result Sexp, err error) {
@@ -1551,7 +1578,7 @@ func DerefFunction(env *Zlisp, name string, args []Sexp) (result Sexp, err error
 	case *SexpPointer:
 		ptr = e
 	case *SexpReflect:
-		ptr = NewSexpPointer(e)
+		ptr = newSexpPointer(env, e)
 	default:
 		return SexpNull, fmt.Errorf("%s only operates on pointers (*SexpPointer); we saw %T instead", name, e)
 	}
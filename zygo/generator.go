@@ -12,6 +12,19 @@ type Generator struct {
 	Tail         bool
 	scopes       int
 	instructions []Instruction
+
+	// pos is where the innermost list being generated was
+	// parsed from; call instructions remember it for errors.
+	pos *Pos
+
+	// lex is the innermost scope of the function body being
+	// generated, for resolving lexical addresses; nil outside
+	// of functions.
+	lex *lexScope
+
+	// tryDepth counts the (try) handlers open around the code
+	// being generated, for break and continue.
+	tryDepth int
 }
 
 type Loop struct {
@@ -21,6 +34,7 @@ type Loop struct {
 	loopLen        int
 	breakOffset    int // i.e. relative to loopStart
 	continueOffset int // i.e. relative to loopStart
+	tryDepth       int // (try) handlers open when the loop was generated
 }
 
 func (loop *Loop) IsStackElem() {}
@@ -73,6 +87,7 @@ func (gen *Generator) GenerateBegin(expressions []Sexp) error {
 
 func buildSexpFun(
 	env *Zlisp,
+	outer *lexScope,
 	name string,
 	funcargs *SexpArray,
 	funcbody []Sexp,
@@ -82,6 +97,7 @@ func buildSexpFun(
 
 	gen := NewGenerator(env)
 	gen.Tail = true
+	gen.lex = newLexFunc(outer)
 
 	if len(name) == 0 {
 		gen.funcname = env.GenSymbol("__anon").name
@@ -121,11 +137,13 @@ func buildSexpFun(
 	}
 	for i := len(argsyms) - 1; i >= 0; i-- {
 		gen.AddInstruction(PopStackPutEnvInstr{argsyms[i]})
+		gen.bindLex(argsyms[i])
 	}
 	err := gen.GenerateBegin(funcbody)
 	if err != nil {
 		return MissingFunction, err
 	}
+	gen.lex.fn.finish()
 
 	gen.AddInstruction(RemoveScopeInstr{})
 	gen.AddInstruction(ReturnInstr{nil})
@@ -157,7 +175,7 @@ func (gen *Generator) GenerateFn(args []Sexp, orig Sexp) error {
 
 	VPrintf("GenerateFn() about to call buildSexpFun\n")
 	funcbody := args[1:]
-	sfun, err := buildSexpFun(gen.env, "", funcargs, funcbody, orig)
+	sfun, err := buildSexpFun(gen.env, gen.lex, "", funcargs, funcbody, orig)
 	if err != nil {
 		return err
 	}
@@ -183,6 +201,7 @@ func (gen *Generator) GenerateDef(args []Sexp, opname string) error {
 		dup = false
 		Q("def sees assign to pair, using AssignInstr{}")
 		instr = AssignInstr{}
+		gen.wildLex()
 		err := gen.Generate(args[0])
 		if err != nil {
 			return err
@@ -198,6 +217,9 @@ func (gen *Generator) GenerateDef(args []Sexp, opname string) error {
 		case "set":
 			Q("GenerateDef is doing set with UpdateInstr: lhs = '%s'", lhs.SexpString(nil))
 			instr = UpdateInstr{lhs}
+			if ref := gen.resolve(lhs); ref != nil {
+				instr = LexStoreInstr{sym: lhs, ref: ref}
+			}
 		default:
 			panic(fmt.Errorf("unknown opname '%s'", opname))
 		}
@@ -215,6 +237,13 @@ func (gen *Generator) GenerateDef(args []Sexp, opname string) error {
 		gen.AddInstruction(DupInstr(0))
 	}
 	gen.AddInstruction(instr)
+	switch x := instr.(type) {
+	case PopStackPutEnvInstr:
+		gen.bindLex(x.sym)
+	case UpdateInstr:
+		// binds in the current scope if not found anywhere.
+		gen.bindLex(x.sym)
+	}
 	return nil
 }
 
@@ -251,7 +280,7 @@ func (gen *Generator) GenerateDefn(args []Sexp, orig Sexp) error {
 
 	VPrintf("GenerateDefn() about to call buildSexpFun\n")
 
-	sfun, err := buildSexpFun(gen.env, sym.name, funcargs, args[2:], orig)
+	sfun, err := buildSexpFun(gen.env, gen.lex, sym.name, funcargs, args[2:], orig)
 	if err != nil {
 		return err
 	}
@@ -263,6 +292,7 @@ func (gen *Generator) GenerateDefn(args []Sexp, orig Sexp) error {
 
 	gen.AddInstruction(CreateClosureInstr{sfun})
 	gen.AddInstruction(PopStackPutEnvInstr{sym})
+	gen.bindLex(sym)
 	gen.AddInstruction(PushInstr{SexpNull})
 
 	return nil
@@ -300,12 +330,13 @@ func (gen *Generator) GenerateDefmac(args []Sexp, orig Sexp) error {
 			sym.name, xpr.SexpString(nil))
 	}
 
-	sfun, err := buildSexpFun(gen.env, sym.name, funcargs, args[2:], orig)
+	// macros are not closures, they see nothing of ours.
+	sfun, err := buildSexpFun(gen.env, nil, sym.name, funcargs, args[2:], orig)
 	if err != nil {
 		return err
 	}
 
-	gen.env.macros[sym.number] = sfun
+	gen.env.macros.set(sym.number, sfun)
 	gen.AddInstruction(PushInstr{SexpNull})
 
 	return nil
@@ -334,7 +365,7 @@ func (gen *Generator) GenerateMacexpand(args []Sexp) error {
 	if islist {
 		switch t := list.Head.(type) {
 		case *SexpSymbol:
-			macro, ismacrocall = gen.env.macros[t.number]
+			macro, ismacrocall = gen.env.macros.get(t.number)
 		default:
 			ismacrocall = false
 		}
@@ -371,11 +402,15 @@ func (gen *Generator) GenerateShortCircuit(or bool, args []Sexp) error {
 	subgen.scopes = gen.scopes
 	subgen.Tail = gen.Tail
 	subgen.funcname = gen.funcname
+	subgen.lex = gen.lex
+	subgen.tryDepth = gen.tryDepth
 	subgen.Generate(args[size-1])
 	instructions := subgen.instructions
 
 	for i := size - 2; i >= 0; i-- {
 		subgen = NewGenerator(gen.env)
+		subgen.lex = gen.lex
+		subgen.tryDepth = gen.tryDepth
 		subgen.Generate(args[i])
 		subgen.AddInstruction(DupInstr(0))
 		subgen.AddInstruction(BranchInstr{or, len(instructions) + 2})
@@ -396,6 +431,8 @@ func (gen *Generator) GenerateCond(args []Sexp) error {
 	subgen.Tail = gen.Tail
 	subgen.scopes = gen.scopes
 	subgen.funcname = gen.funcname
+	subgen.lex = gen.lex
+	subgen.tryDepth = gen.tryDepth
 	err := subgen.Generate(args[len(args)-1])
 	if err != nil {
 		return err
@@ -474,6 +511,11 @@ func (gen *Generator) GenerateLet(name string, args []Sexp) error {
 
 	gen.AddInstruction(AddScopeInstr{Name: "runtime " + name})
 	gen.scopes++
+	gen.pushLex()
+
+	// only the body is in tail position, not the bindings.
+	tail := gen.Tail
+	gen.Tail = false
 
 	if name == "letseq" {
 		for i, rs := range rstatements {
@@ -482,6 +524,7 @@ func (gen *Generator) GenerateLet(name string, args []Sexp) error {
 				return err
 			}
 			gen.AddInstruction(PopStackPutEnvInstr{lstatements[i]})
+			gen.bindLex(lstatements[i])
 		}
 	} else if name == "let" {
 		for _, rs := range rstatements {
@@ -492,14 +535,17 @@ func (gen *Generator) GenerateLet(name string, args []Sexp) error {
 		}
 		for i := len(lstatements) - 1; i >= 0; i-- {
 			gen.AddInstruction(PopStackPutEnvInstr{lstatements[i]})
+			gen.bindLex(lstatements[i])
 		}
 	}
+	gen.Tail = tail
 	err := gen.GenerateBegin(args[1:])
 	if err != nil {
 		return err
 	}
 	gen.AddInstruction(RemoveScopeInstr{})
 	gen.scopes--
+	gen.popLex()
 
 	return nil
 }
@@ -521,6 +567,179 @@ func (gen *Generator) GenerateAssert(args []Sexp) error {
 	return nil
 }
 
+// (try body* (catch e handler*) (finally cleanup*))
+//
+// Either clause may be left out. If body fails, the stacks are
+// unwound to where they stood at the try, e is bound to a SexpError
+// describing the failure, and handler's value becomes the value of
+// the try. The cleanup expressions always run, whether body and
+// handler succeed or not; their value is discarded, and a failure
+// that was not caught is raised again after they run.
+func (gen *Generator) GenerateTry(args []Sexp) error {
+	var body, handler, cleanup []Sexp
+	var errsym *SexpSymbol
+	hasCatch := false
+	hasFinally := false
+
+	for _, arg := range args {
+		clause, rest := tryClause(arg)
+		switch clause {
+		case "catch":
+			if hasCatch || hasFinally {
+				return fmt.Errorf("try: catch must come once, after the body and before finally")
+			}
+			if len(rest) == 0 {
+				return fmt.Errorf("try: catch needs a symbol to bind the error to")
+			}
+			sym, isSym := rest[0].(*SexpSymbol)
+			if !isSym {
+				return fmt.Errorf("try: catch needs a symbol to bind the error to, not '%s'",
+					rest[0].SexpString(nil))
+			}
+			hasCatch = true
+			errsym = sym
+			handler = rest[1:]
+		case "finally":
+			if hasFinally {
+				return fmt.Errorf("try: only one finally allowed")
+			}
+			hasFinally = true
+			cleanup = rest
+		default:
+			if hasCatch || hasFinally {
+				return fmt.Errorf("try: body expressions must come before catch and finally")
+			}
+			body = append(body, arg)
+		}
+	}
+	if len(body) == 0 {
+		body = []Sexp{SexpNull}
+	}
+	if len(handler) == 0 {
+		handler = []Sexp{SexpNull}
+	}
+
+	subgen := NewGenerator(gen.env)
+	sub := func(scopes int, xs []Sexp) ([]Instruction, error) {
+		subgen.Reset()
+		subgen.scopes = scopes
+		subgen.funcname = gen.funcname
+		subgen.lex = gen.lex
+		subgen.tryDepth = gen.tryDepth
+		err := subgen.GenerateBegin(xs)
+		return subgen.instructions, err
+	}
+
+	// a tail call would jump over our TryEndInstr, so none inside.
+	if hasFinally {
+		gen.tryDepth++
+	}
+	if hasCatch {
+		gen.tryDepth++
+	}
+	body_code, err := sub(gen.scopes, body)
+	if hasCatch {
+		gen.tryDepth--
+	}
+	if err != nil {
+		if hasFinally {
+			gen.tryDepth--
+		}
+		return err
+	}
+
+	protected := body_code
+	if hasCatch {
+		gen.pushLex()
+		gen.bindLex(errsym)
+		handler_code, err := sub(gen.scopes+1, handler)
+		gen.popLex()
+		if hasFinally {
+			gen.tryDepth--
+		}
+		if err != nil {
+			return err
+		}
+		catch_code := []Instruction{
+			AddScopeInstr{Name: "runtime catch"},
+			PopStackPutEnvInstr{errsym},
+		}
+		catch_code = append(catch_code, handler_code...)
+		catch_code = append(catch_code, RemoveScopeInstr{})
+
+		protected = []Instruction{TryStartInstr{len(body_code) + 3}}
+		protected = append(protected, body_code...)
+		protected = append(protected, TryEndInstr{},
+			JumpInstr{addpc: len(catch_code) + 1})
+		protected = append(protected, catch_code...)
+	} else if hasFinally {
+		gen.tryDepth--
+	}
+
+	if !hasFinally {
+		gen.AddInstructions(protected)
+		return nil
+	}
+
+	// normal path: cleanup then skip over the error path. error
+	// path: the SexpError is on the stack, run cleanup and rethrow.
+	// Each path gets code of its own, so that loops in the
+	// cleanup have their own Loop to break out of.
+	cleanup_code, err := sub(gen.scopes, cleanup)
+	if err != nil {
+		return err
+	}
+	n := len(cleanup_code)
+	gen.AddInstruction(TryStartInstr{len(protected) + n + 4})
+	gen.AddInstructions(protected)
+	gen.AddInstruction(TryEndInstr{})
+	gen.AddInstructions(cleanup_code)
+	if n > 0 {
+		gen.AddInstruction(PopInstr(0))
+	} else {
+		gen.AddInstruction(LabelInstr{"finally"})
+	}
+	gen.AddInstruction(JumpInstr{addpc: n + 3})
+	cleanup_code, err = sub(gen.scopes, cleanup)
+	if err != nil {
+		return err
+	}
+	gen.AddInstructions(cleanup_code)
+	if n > 0 {
+		gen.AddInstruction(PopInstr(0))
+	} else {
+		gen.AddInstruction(LabelInstr{"finally"})
+	}
+	gen.AddInstruction(RethrowInstr{})
+	return nil
+}
+
+// tryClause reports whether arg is a (catch ...) or (finally ...)
+// clause of a try, returning the clause name and its arguments.
+func tryClause(arg Sexp) (string, []Sexp) {
+	pair, isPair := arg.(*SexpPair)
+	if !isPair {
+		return "", nil
+	}
+	sym, isSym := pair.Head.(*SexpSymbol)
+	if !isSym || (sym.name != "catch" && sym.name != "finally") {
+		return "", nil
+	}
+	rest, err := ListToArray(pair.Tail)
+	if err != nil {
+		return "", nil
+	}
+	return sym.name, rest
+}
+
+// closeTries drops the try handlers opened since loop began,
+// before a break or continue jumps out of them.
+func (gen *Generator) closeTries(loop *Loop) {
+	for i := loop.tryDepth; i < gen.tryDepth; i++ {
+		gen.AddInstruction(TryEndInstr{})
+	}
+}
+
 func (gen *Generator) GenerateInclude(args []Sexp) error {
 	if len(args) < 1 {
 		return WrongNargs
@@ -577,6 +796,7 @@ func (gen *Generator) GenerateInclude(args []Sexp) error {
 }
 
 func (gen *Generator) GenerateCallBySymbol(sym *SexpSymbol, args []Sexp, orig Sexp) error {
+	// these pass tail position on to their last expression.
 	switch sym.name {
 	case "and":
 		return gen.GenerateShortCircuit(false, args)
@@ -584,6 +804,21 @@ func (gen *Generator) GenerateCallBySymbol(sym *SexpSymbol, args []Sexp, orig Se
 		return gen.GenerateShortCircuit(true, args)
 	case "cond":
 		return gen.GenerateCond(args)
+	case "begin":
+		return gen.GenerateBegin(args)
+	case "let":
+		return gen.GenerateLet("let", args)
+	case "letseq":
+		return gen.GenerateLet("letseq", args)
+	}
+
+	// these put nothing in tail position, and a call's
+	// arguments are not in it either.
+	tail := gen.Tail
+	gen.Tail = false
+	defer func() { gen.Tail = tail }()
+
+	switch sym.name {
 	case "quote":
 		return gen.GenerateQuote(args)
 	case "def":
@@ -594,14 +829,10 @@ func (gen *Generator) GenerateCallBySymbol(sym *SexpSymbol, args []Sexp, orig Se
 		return gen.GenerateFn(args, orig)
 	case "defn":
 		return gen.GenerateDefn(args, orig)
-	case "begin":
-		return gen.GenerateBegin(args)
-	case "let":
-		return gen.GenerateLet("let", args)
-	case "letseq":
-		return gen.GenerateLet("letseq", args)
 	case "assert":
 		return gen.GenerateAssert(args)
+	case "try":
+		return gen.GenerateTry(args)
 	case "defmac":
 		return gen.GenerateDefmac(args, orig)
 	case "macexpand":
@@ -629,7 +860,7 @@ func (gen *Generator) GenerateCallBySymbol(sym *SexpSymbol, args []Sexp, orig Se
 	}
 
 	// this is where macros are run
-	macro, found := gen.env.macros[sym.number]
+	macro, found := gen.env.macros.get(sym.number)
 	if found {
 		// calling Apply on the current environment will screw up
 		// the stack, creating a duplicate environment is safer
@@ -638,16 +869,21 @@ func (gen *Generator) GenerateCallBySymbol(sym *SexpSymbol, args []Sexp, orig Se
 		if err != nil {
 			return err
 		}
+		gen.Tail = tail
 		return gen.Generate(expr)
 	}
 
-	oldtail := gen.Tail
-	gen.Tail = false
+	switch sym.name {
+	case "eval", "source", "=", ":=", ".":
+		// these bind names where we cannot see them.
+		gen.wildLex()
+	}
+
 	err := gen.GenerateAll(args)
 	if err != nil {
 		return err
 	}
-	if oldtail && sym.name == gen.funcname {
+	if tail && sym.name == gen.funcname {
 		// to do a tail call
 		// pop off all the extra scopes
 		// then jump to beginning of function
@@ -656,27 +892,36 @@ func (gen *Generator) GenerateCallBySymbol(sym *SexpSymbol, args []Sexp, orig Se
 		}
 		gen.AddInstruction(GotoInstr{1}) // goto 1 instead of 0 to avoid adding a new scope
 	} else {
-		gen.AddInstruction(CallInstr{sym, len(args)})
+		gen.AddInstruction(CallInstr{sym: sym, nargs: len(args), pos: gen.pos,
+			tail: tail, scopes: gen.scopes, ref: gen.resolve(sym)})
 	}
-	gen.Tail = oldtail
 	return nil
 }
 
 func (gen *Generator) GenerateBuilder(fun Sexp, args []Sexp) error {
 	//Q("GenerateBuilder is pushing unevaluated arguments onto the stack")
+	tail := gen.Tail
+	gen.Tail = false
+	defer func() { gen.Tail = tail }()
+	// builders bind names where we cannot see them.
+	gen.wildLex()
 	n := len(args)
 	for i := 0; i < n; i++ {
 		gen.AddInstruction(PushInstr{args[i]})
 	}
 	gen.Generate(fun)
-	gen.AddInstruction(DispatchInstr{len(args)})
+	gen.AddInstruction(DispatchInstr{nargs: len(args), pos: gen.pos})
 	return nil
 }
 
 func (gen *Generator) GenerateDispatch(fun Sexp, args []Sexp) error {
+	tail := gen.Tail
+	gen.Tail = false
+	defer func() { gen.Tail = tail }()
 	gen.GenerateAll(args)
 	gen.Generate(fun)
-	gen.AddInstruction(DispatchInstr{len(args)})
+	gen.AddInstruction(DispatchInstr{nargs: len(args), pos: gen.pos,
+		tail: tail, scopes: gen.scopes})
 	return nil
 }
 
@@ -733,11 +978,14 @@ func (gen *Generator) GenerateCall(expr *SexpPair) error {
 }
 
 func (gen *Generator) GenerateArray(arr *SexpArray) error {
+	tail := gen.Tail
+	gen.Tail = false
+	defer func() { gen.Tail = tail }()
 	err := gen.GenerateAll(arr.Val)
 	if err != nil {
 		return err
 	}
-	gen.AddInstruction(CallInstr{gen.env.MakeSymbol("array"), len(arr.Val)})
+	gen.AddInstruction(CallInstr{sym: gen.env.MakeSymbol("array"), nargs: len(arr.Val), pos: gen.pos})
 	return nil
 }
 
@@ -747,10 +995,15 @@ func (gen *Generator) Generate(expr Sexp) error {
 	}
 	switch e := expr.(type) {
 	case *SexpSymbol:
-		gen.AddInstruction(EnvToStackInstr{e})
+		gen.AddInstruction(gen.load(e))
 		return nil
 	case *SexpPair:
 		if IsList(e) {
+			if e.Pos != nil {
+				outer := gen.pos
+				gen.pos = e.Pos
+				defer func() { gen.pos = outer }()
+			}
 			isAssign, pos := IsAssignmentList(e, 0)
 			legalLeftHandSide := true
 			if isAssign && pos > 0 {
@@ -869,6 +1122,10 @@ func (gen *Generator) GenerateForLoop(args []Sexp) error {
 		}
 	}
 
+	loop.tryDepth = gen.tryDepth
+	if max := gen.env.stacks.LoopStack; gen.env.loopstack.Size() >= max {
+		return &StackOverflow{Stack: "LoopStack", Size: max}
+	}
 	gen.env.loopstack.Push(loop)
 	defer gen.env.loopstack.Pop()
 
@@ -884,12 +1141,15 @@ func (gen *Generator) GenerateForLoop(args []Sexp) error {
 	// inadvertently.
 	gen.AddInstruction(AddScopeInstr{Name: "runtime " + loop.stmtname.name})
 	gen.AddInstruction(PushStackmarkInstr{sym: loop.stmtname})
+	gen.pushLex()
 
 	// generate the body of the loop
 	subgenBody := NewGenerator(gen.env)
 	subgenBody.Tail = gen.Tail
 	subgenBody.scopes = gen.scopes
 	subgenBody.funcname = gen.funcname
+	subgenBody.lex = gen.lex
+	subgenBody.tryDepth = gen.tryDepth
 	err = subgenBody.GenerateBegin(args[startgen:])
 	if err != nil {
 		return err
@@ -903,6 +1163,8 @@ func (gen *Generator) GenerateForLoop(args []Sexp) error {
 	subgenInit.Tail = gen.Tail
 	subgenInit.scopes = gen.scopes
 	subgenInit.funcname = gen.funcname
+	subgenInit.lex = gen.lex
+	subgenInit.tryDepth = gen.tryDepth
 	err = subgenInit.Generate(controlargs.Val[0])
 	if err != nil {
 		return err
@@ -916,6 +1178,8 @@ func (gen *Generator) GenerateForLoop(args []Sexp) error {
 	subgenT.Tail = gen.Tail
 	subgenT.scopes = gen.scopes
 	subgenT.funcname = gen.funcname
+	subgenT.lex = gen.lex
+	subgenT.tryDepth = gen.tryDepth
 
 	err = subgenT.Generate(controlargs.Val[1])
 	if err != nil {
@@ -930,6 +1194,8 @@ func (gen *Generator) GenerateForLoop(args []Sexp) error {
 	subgenIncr.Tail = gen.Tail
 	subgenIncr.scopes = gen.scopes
 	subgenIncr.funcname = gen.funcname
+	subgenIncr.lex = gen.lex
+	subgenIncr.tryDepth = gen.tryDepth
 
 	err = subgenIncr.Generate(controlargs.Val[2])
 	if err != nil {
@@ -937,6 +1203,7 @@ func (gen *Generator) GenerateForLoop(args []Sexp) error {
 	}
 	subgenIncr.AddInstruction(PopUntilStackmarkInstr{sym: loop.stmtname})
 	incr_code := subgenIncr.instructions
+	gen.popLex()
 
 	exit_loop := len_body_code + 3
 	jump_to_test := len(incr_code) + 2
@@ -1061,6 +1328,9 @@ func (gen *Generator) GenerateMultiDef(args []Sexp) error {
 	// than a statement.
 	gen.AddInstruction(DupInstr(0))
 	gen.AddInstruction(BindlistInstr{syms: syms})
+	for _, sym := range syms {
+		gen.bindLex(sym)
+	}
 	return nil
 }
 
@@ -1204,11 +1474,12 @@ func (gen *Generator) generateSyntaxQuoteHash(arg Sexp) error {
 	default:
 		return fmt.Errorf("arg to generateSyntaxQuoteHash() must be a hash; got %T", a)
 	}
-	n := HashCountKeys(hash)
+	keys := hash.Keys()
+	n := len(keys)
 	gen.AddInstruction(PushInstr{SexpMarker})
 	for i := 0; i < n; i++ {
 		// must reverse order here to preserve order on rebuild
-		key := hash.KeyOrder[(n-i)-1]
+		key := keys[(n-i)-1]
 		val, err := hash.HashGet(nil, key)
 		if err != nil {
 			return err
@@ -1293,6 +1564,7 @@ scanUpTheLoops:
 
 	myPos := len(gen.instructions)
 	VPrintf("\n debug GenerateContinue() : myPos =%d  loop=%#v\n", myPos, loop)
+	gen.closeTries(loop)
 	gen.AddInstruction(&ContinueInstr{loop: loop})
 	return nil
 }
@@ -1361,6 +1633,7 @@ scanUpTheLoops:
 	}
 
 	VPrintf("\n debug GenerateBreak() : loop=%#v\n", loop)
+	gen.closeTries(loop)
 	gen.AddInstruction(&BreakInstr{loop: loop})
 
 	return nil
@@ -1377,6 +1650,7 @@ func (gen *Generator) GenerateNewScope(expressions []Sexp) error {
 	}
 
 	gen.AddInstruction(AddScopeInstr{Name: "newScope"})
+	gen.pushLex()
 	for _, expr := range expressions[:size-1] {
 		err := gen.Generate(expr)
 		if err != nil {
@@ -1392,6 +1666,7 @@ func (gen *Generator) GenerateNewScope(expressions []Sexp) error {
 		return err
 	}
 	gen.AddInstruction(RemoveScopeInstr{})
+	gen.popLex()
 	return nil
 }
 
@@ -1421,6 +1696,10 @@ func (gen *Generator) GeneratePackage(expressions []Sexp) error {
 
 	gen.AddInstruction(AddScopeInstr{Name: pkgName})
 	gen.AddInstruction(PushStackmarkInstr{sym: symPkgName})
+	// the package's scope leaves with it.
+	gen.wildLex()
+	gen.pushLex()
+	defer gen.popLex()
 
 	if size > 1 {
 		for _, expr := range expressions[1 : size-1] {
@@ -0,0 +1,477 @@
+package zygo
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"runtime"
+	"sort"
+	"time"
+)
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+var sexpType = reflect.TypeOf((*Sexp)(nil)).Elem()
+
+// AddGoFunc makes the Go function fn callable from env's scripts
+// as name, with no hand-written ZlispUserFunction needed. Each
+// argument is converted to the type of its parameter, a variadic
+// one included: numbers, strings and bools directly, records,
+// arrays and the like through SexpToGoStructs. Parameters of a
+// Sexp type get the zygo value as is. Results come back through
+// GoToSexpValue; several results come back as an array. A
+// trailing error result, if not nil, is raised as a zygo error.
+func (env *Zlisp) AddGoFunc(name string, fn interface{}) error {
+	fv := reflect.ValueOf(fn)
+	if fv.Kind() != reflect.Func || fv.IsNil() {
+		return fmt.Errorf("AddGoFunc '%s': need a func, not %T", name, fn)
+	}
+	ft := fv.Type()
+	hasErr := ft.NumOut() > 0 && ft.Out(ft.NumOut()-1) == errorType
+	env.AddFunction(name, func(env *Zlisp, name string, args []Sexp) (Sexp, error) {
+		r, err := env.callGo(name, fv, args)
+		if err != nil {
+			return SexpNull, err
+		}
+		if hasErr {
+			r = r[:len(r)-1]
+		}
+		switch len(r) {
+		case 0:
+			return SexpNull, nil
+		case 1:
+			return r[0], nil
+		}
+		return env.NewSexpArray(r), nil
+	})
+	return nil
+}
+
+// callGo calls the Go func fv with args, converted to its
+// parameter types, and returns its results as zygo values.
+// A trailing error result, if not nil, is returned as err.
+func (env *Zlisp) callGo(name string, fv reflect.Value, args []Sexp) (r []Sexp, err error) {
+	ft := fv.Type()
+	nin := ft.NumIn()
+	if ft.IsVariadic() {
+		if len(args) < nin-1 {
+			return nil, fmt.Errorf("%s needs at least %d arguments, but we have %d",
+				name, nin-1, len(args))
+		}
+	} else if len(args) != nin {
+		return nil, fmt.Errorf("%s needs %d arguments, but we have %d",
+			name, nin, len(args))
+	}
+
+	in := make([]reflect.Value, len(args))
+	for i, arg := range args {
+		var typ reflect.Type
+		if ft.IsVariadic() && i >= nin-1 {
+			typ = ft.In(nin - 1).Elem()
+		} else {
+			typ = ft.In(i)
+		}
+		in[i], err = env.sexpToGoValue(arg, typ)
+		if err != nil {
+			return nil, fmt.Errorf("argument %d of %s: %s", i, name, err)
+		}
+	}
+
+	// protect against panics in the Go code we call.
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			tr := make([]byte, 16384)
+			tr = tr[:runtime.Stack(tr, false)]
+			r = nil
+			err = fmt.Errorf("%s panicked: '%v'\nstack trace:\n%s", name, recovered, tr)
+		}
+	}()
+	out := fv.Call(in)
+
+	n := len(out)
+	if n > 0 && ft.Out(n-1) == errorType && !out[n-1].IsNil() {
+		return nil, out[n-1].Interface().(error)
+	}
+	r = make([]Sexp, n)
+	for i, o := range out {
+		r[i], err = env.GoToSexpValue(o)
+		if err != nil {
+			return nil, fmt.Errorf("result %d of %s: %s", i, name, err)
+		}
+	}
+	return r, nil
+}
+
+// sexpToGoValue converts x to a Go value of type typ.
+func (env *Zlisp) sexpToGoValue(x Sexp, typ reflect.Type) (v reflect.Value, err error) {
+	bad := func() (reflect.Value, error) {
+		return reflect.Value{}, fmt.Errorf("cannot use %s as %s", x.SexpString(nil), typ)
+	}
+
+	switch typ.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Uintptr, reflect.Float32, reflect.Float64:
+		var n reflect.Value
+		switch t := x.(type) {
+		case *SexpInt:
+			n = reflect.ValueOf(t.Val)
+		case *SexpChar:
+			n = reflect.ValueOf(int64(t.Val))
+		case *SexpFloat:
+			n = reflect.ValueOf(t.Val)
+		case *SexpStr:
+			if typ != durationType {
+				return bad()
+			}
+			d, err := time.ParseDuration(t.S)
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			return reflect.ValueOf(d), nil
+		default:
+			return bad()
+		}
+		switch typ.Kind() {
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			// converting there and back again would not
+			// notice the sign being lost.
+			if (n.Kind() == reflect.Int64 && n.Int() < 0) || (n.Kind() == reflect.Float64 && n.Float() < 0) {
+				return reflect.Value{}, fmt.Errorf("%s does not fit in %s", x.SexpString(nil), typ)
+			}
+		}
+		v = n.Convert(typ)
+		if f, isFloat := x.(*SexpFloat); isFloat && (typ.Kind() == reflect.Float32 || typ.Kind() == reflect.Float64) {
+			// a float need only be in range: NaN and the
+			// infinities are floats too, and float32 rounds.
+			if v.OverflowFloat(f.Val) {
+				return reflect.Value{}, fmt.Errorf("%s does not fit in %s", x.SexpString(nil), typ)
+			}
+			return v, nil
+		}
+		if v.Convert(n.Type()).Interface() != n.Interface() {
+			return reflect.Value{}, fmt.Errorf("%s does not fit in %s", x.SexpString(nil), typ)
+		}
+		return v, nil
+	case reflect.String:
+		switch t := x.(type) {
+		case *SexpStr:
+			return reflect.ValueOf(t.S).Convert(typ), nil
+		case *SexpSymbol:
+			return reflect.ValueOf(t.name).Convert(typ), nil
+		}
+		return bad()
+	case reflect.Bool:
+		if t, isBool := x.(*SexpBool); isBool {
+			return reflect.ValueOf(t.Val).Convert(typ), nil
+		}
+		return bad()
+	case reflect.Interface:
+		if typ.NumMethod() == 0 && typ != sexpType {
+			// interface{} gets a plain Go value.
+			if x == SexpNull {
+				return reflect.Zero(typ), nil
+			}
+			defer recoverConversion(x, typ, &err)
+			return reflect.ValueOf(sexpToGoAny(x, env, nil)), nil
+		}
+	}
+
+	xv := reflect.ValueOf(x)
+	if xv.Type().AssignableTo(typ) {
+		return xv, nil
+	}
+	if x == SexpNull {
+		switch typ.Kind() {
+		case reflect.Ptr, reflect.Slice, reflect.Map, reflect.Interface:
+			return reflect.Zero(typ), nil
+		}
+		return bad()
+	}
+	if sr, isReflect := x.(*SexpReflect); isReflect && sr.Val.Type().AssignableTo(typ) {
+		return sr.Val, nil
+	}
+
+	switch typ.Kind() {
+	case reflect.Slice, reflect.Array:
+		arr, isArr := x.(*SexpArray)
+		if !isArr || typ.Elem().Kind() == reflect.Uint8 {
+			break
+		}
+		if typ.Kind() == reflect.Array && len(arr.Val) != typ.Len() {
+			return reflect.Value{}, fmt.Errorf("need %d elements for %s, not %d",
+				typ.Len(), typ, len(arr.Val))
+		}
+		v = reflect.New(typ).Elem()
+		if typ.Kind() == reflect.Slice {
+			v = reflect.MakeSlice(typ, len(arr.Val), len(arr.Val))
+		}
+		for i, ele := range arr.Val {
+			ev, err := env.sexpToGoValue(ele, typ.Elem())
+			if err != nil {
+				return reflect.Value{}, fmt.Errorf("element %d: %s", i, err)
+			}
+			v.Index(i).Set(ev)
+		}
+		return v, nil
+	case reflect.Map:
+		h, isHash := x.(*SexpHash)
+		if !isHash {
+			return bad()
+		}
+		v = reflect.MakeMapWithSize(typ, h.NumKeys)
+		for _, key := range h.Keys() {
+			val, err := h.HashGet(env, key)
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			kv, err := env.sexpToGoValue(key, typ.Key())
+			if err != nil {
+				return reflect.Value{}, fmt.Errorf("key %s: %s", key.SexpString(nil), err)
+			}
+			ev, err := env.sexpToGoValue(val, typ.Elem())
+			if err != nil {
+				return reflect.Value{}, fmt.Errorf("value for %s: %s", key.SexpString(nil), err)
+			}
+			v.SetMapIndex(kv, ev)
+		}
+		return v, nil
+	case reflect.Ptr:
+		if typ.Elem().Kind() == reflect.Struct {
+			// SexpToGoStructs knows records.
+			break
+		}
+		ev, err := env.sexpToGoValue(x, typ.Elem())
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		v = reflect.New(typ.Elem())
+		v.Elem().Set(ev)
+		return v, nil
+	}
+
+	defer recoverConversion(x, typ, &err)
+	p := reflect.New(typ)
+	_, err = SexpToGoStructs(x, p.Interface(), env, nil)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	return p.Elem(), nil
+}
+
+// SexpToGoStructs panics on values it cannot convert.
+func recoverConversion(x Sexp, typ reflect.Type, err *error) {
+	if recovered := recover(); recovered != nil {
+		*err = fmt.Errorf("cannot use %s as %s: %v", x.SexpString(nil), typ, recovered)
+	}
+}
+
+// mapKeyLess orders map keys: numbers by value, anything
+// else by how it prints.
+func mapKeyLess(a, b reflect.Value) bool {
+	switch a.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return a.Int() < b.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return a.Uint() < b.Uint()
+	case reflect.Float32, reflect.Float64:
+		return a.Float() < b.Float()
+	}
+	return fmt.Sprint(a.Interface()) < fmt.Sprint(b.Interface())
+}
+
+// GoToSexpValue converts the Go value v to a zygo value. Sexp
+// values are returned as they are; slices become arrays, maps
+// hashes, and structs of a registered type records, as fromgo
+// makes them; values with no zygo equivalent are wrapped in a
+// SexpReflect.
+func (env *Zlisp) GoToSexpValue(v reflect.Value) (Sexp, error) {
+	if !v.IsValid() {
+		return SexpNull, nil
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface, reflect.Map, reflect.Slice, reflect.Func, reflect.Chan:
+		if v.IsNil() {
+			return SexpNull, nil
+		}
+	}
+	if v.Type().Implements(sexpType) {
+		return v.Interface().(Sexp), nil
+	}
+	if v.Type().Implements(errorType) {
+		return &SexpError{error: v.Interface().(error)}, nil
+	}
+
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return &SexpInt{Val: v.Int()}, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u := v.Uint()
+		if u > math.MaxInt64 {
+			return SexpNull, fmt.Errorf("%d from %s does not fit in an int", u, v.Type())
+		}
+		return &SexpInt{Val: int64(u)}, nil
+	case reflect.Float32, reflect.Float64:
+		return &SexpFloat{Val: v.Float()}, nil
+	case reflect.String:
+		return &SexpStr{S: v.String()}, nil
+	case reflect.Bool:
+		return &SexpBool{Val: v.Bool()}, nil
+	case reflect.Interface:
+		return env.GoToSexpValue(v.Elem())
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8 {
+			return &SexpRaw{Val: v.Bytes()}, nil
+		}
+		arr := make([]Sexp, v.Len())
+		for i := range arr {
+			x, err := env.GoToSexpValue(v.Index(i))
+			if err != nil {
+				return SexpNull, err
+			}
+			arr[i] = x
+		}
+		return env.NewSexpArray(arr), nil
+	case reflect.Map:
+		keys := v.MapKeys()
+		// a stable order, for display and iteration.
+		sort.Slice(keys, func(i, j int) bool {
+			return mapKeyLess(keys[i], keys[j])
+		})
+		pairs := make([]Sexp, 0, 2*len(keys))
+		for _, k := range keys {
+			var key Sexp
+			if k.Kind() == reflect.String {
+				key = env.MakeSymbol(k.String())
+			} else {
+				var err error
+				key, err = env.GoToSexpValue(k)
+				if err != nil {
+					return SexpNull, err
+				}
+			}
+			val, err := env.GoToSexpValue(v.MapIndex(k))
+			if err != nil {
+				return SexpNull, err
+			}
+			pairs = append(pairs, key, val)
+		}
+		return MakeHash(pairs, "hash", env)
+	case reflect.Struct:
+		if v.Type() == timeType {
+			return &SexpTime{Tm: v.Interface().(time.Time)}, nil
+		}
+		// records are filled from pointers to structs.
+		p := reflect.New(v.Type())
+		p.Elem().Set(v)
+		v = p
+	}
+
+	if v.Kind() == reflect.Ptr {
+		if rt := env.goTypeOf(v.Type()); rt != nil {
+			h, err := MakeHash(nil, rt.RegisteredName, env)
+			if err != nil {
+				return SexpNull, err
+			}
+			err = h.FillHashFromShadow(env, v.Interface())
+			if err != nil {
+				return SexpNull, err
+			}
+			return h, nil
+		}
+	}
+	return &SexpReflect{Val: v, env: env}, nil
+}
+
+// goTypeOf finds a registered type whose factory makes values of
+// type t, preferring env's own types to the shared ones.
+func (env *Zlisp) goTypeOf(t reflect.Type) (found *RegisteredType) {
+	for _, rt := range env.TypeRegistry().named() {
+		if rt.hasShadowStruct && rt.TypeCache == t {
+			found = rt
+		}
+	}
+	return found
+}
+
+// MakeGoFunc sets the func variable that fptr points to, so that
+// calling it calls fn. Its arguments are converted with
+// GoToSexpValue, and fn's result to the func's result types; a
+// func with several results takes them from the array fn returns.
+// If the func's last result is an error, it reports fn's failure
+// there; otherwise a failure panics.
+func (env *Zlisp) MakeGoFunc(fn *SexpFunction, fptr interface{}) error {
+	pv := reflect.ValueOf(fptr)
+	if pv.Kind() != reflect.Ptr || pv.Elem().Kind() != reflect.Func {
+		return fmt.Errorf("MakeGoFunc: need a pointer to a func variable, not %T", fptr)
+	}
+	ft := pv.Elem().Type()
+	pv.Elem().Set(reflect.MakeFunc(ft, func(in []reflect.Value) []reflect.Value {
+		if ft.IsVariadic() {
+			last := in[len(in)-1]
+			in = in[:len(in)-1]
+			for i := 0; i < last.Len(); i++ {
+				in = append(in, last.Index(i))
+			}
+		}
+		args := make([]Sexp, len(in))
+		for i, v := range in {
+			x, err := env.GoToSexpValue(v)
+			if err != nil {
+				return env.goFuncResults(ft, nil, fmt.Errorf("argument %d: %s", i, err))
+			}
+			args[i] = x
+		}
+		res, err := env.Apply(fn, args)
+		return env.goFuncResults(ft, res, err)
+	}))
+	return nil
+}
+
+// goFuncResults makes the results of a func of type ft from what
+// the zygo function it calls returned.
+func (env *Zlisp) goFuncResults(ft reflect.Type, res Sexp, err error) []reflect.Value {
+	n := ft.NumOut()
+	hasErr := n > 0 && ft.Out(n-1) == errorType
+	if hasErr {
+		n--
+	}
+
+	out := make([]reflect.Value, ft.NumOut())
+	if err == nil && n > 0 {
+		results := []Sexp{res}
+		if n > 1 {
+			arr, isArr := res.(*SexpArray)
+			if !isArr || len(arr.Val) != n {
+				err = fmt.Errorf("need an array of %d results, not %s", n, res.SexpString(nil))
+			} else {
+				results = arr.Val
+			}
+		}
+		for i := 0; err == nil && i < n; i++ {
+			out[i], err = env.sexpToGoValue(results[i], ft.Out(i))
+			if err != nil {
+				err = fmt.Errorf("result %d: %s", i, err)
+			} else if out[i].Type() != ft.Out(i) {
+				// MakeFunc wants the very type, not one assignable to it.
+				out[i] = out[i].Convert(ft.Out(i))
+			}
+		}
+	}
+	if err != nil && !hasErr {
+		panic(err)
+	}
+
+	for i := 0; i < n; i++ {
+		if err != nil || !out[i].IsValid() {
+			out[i] = reflect.Zero(ft.Out(i))
+		}
+	}
+	if hasErr {
+		if err != nil {
+			out[n] = reflect.ValueOf(&err).Elem()
+		} else {
+			out[n] = reflect.Zero(errorType)
+		}
+	}
+	return out
+}
@@ -0,0 +1,205 @@
+package zygo
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"testing"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+func Test409AddGoFuncByReflection(t *testing.T) {
+
+	cv.Convey(`env.AddGoFunc should let scripts call any Go func, converting arguments and results, with variadic parameters, several results, and a trailing error raised as a zygo error`, t, func() {
+		env := NewZlisp()
+		defer env.Stop()
+		env.StandardSetup()
+		_, err := env.RegisterGoType("Cfg", Cfg408{})
+		cv.So(err, cv.ShouldBeNil)
+
+		cv.So(env.AddGoFunc("repeat", strings.Repeat), cv.ShouldBeNil)
+		cv.So(env.AddGoFunc("sum", func(base float32, xs ...int) float32 {
+			for _, x := range xs {
+				base += float32(x)
+			}
+			return base
+		}), cv.ShouldBeNil)
+		cv.So(env.AddGoFunc("divmod", func(a, b uint8) (uint8, uint8, error) {
+			if b == 0 {
+				return 0, 0, errors.New("divide by zero")
+			}
+			return a / b, a % b, nil
+		}), cv.ShouldBeNil)
+		cv.So(env.AddGoFunc("rename", func(c *Cfg408, name string) Cfg408 {
+			c.Name = name
+			return *c
+		}), cv.ShouldBeNil)
+		cv.So(env.AddGoFunc("words", func(s string) []string { return strings.Fields(s) }), cv.ShouldBeNil)
+		cv.So(env.AddGoFunc("describe", func(x interface{}) string { return fmt.Sprintf("%T", x) }), cv.ShouldBeNil)
+		cv.So(env.AddGoFunc("first", func(xs Sexp) Sexp { return xs.(*SexpArray).Val[0] }), cv.ShouldBeNil)
+		cv.So(env.AddGoFunc("boom", func() { panic("kaboom") }), cv.ShouldBeNil)
+		cv.So(env.AddGoFunc("half", func(n uint) uint { return n / 2 }), cv.ShouldBeNil)
+		cv.So(env.AddGoFunc("huge", func() uint64 { return math.MaxUint64 }), cv.ShouldBeNil)
+		cv.So(env.AddGoFunc("notAFunc", 3), cv.ShouldNotBeNil)
+
+		res, err := env.EvalString(`(repeat "ab" 3)`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.(*SexpStr).S, cv.ShouldEqual, "ababab")
+
+		res, err = env.EvalString(`(sum 0.5 1 2 3)`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.(*SexpFloat).Val, cv.ShouldEqual, 6.5)
+		res, err = env.EvalString(`(sum 0.5)`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.(*SexpFloat).Val, cv.ShouldEqual, 0.5)
+
+		// floats need only be in range.
+		res, err = env.EvalString(`(sum (/ 0.0 0.0))`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(math.IsNaN(res.(*SexpFloat).Val), cv.ShouldBeTrue)
+		res, err = env.EvalString(`(sum (/ -1.0 0.0) 1)`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(math.IsInf(res.(*SexpFloat).Val, -1), cv.ShouldBeTrue)
+		res, err = env.EvalString(`(sum 0.1)`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.(*SexpFloat).Val, cv.ShouldEqual, float64(float32(0.1)))
+
+		res, err = env.EvalString(`(divmod 17 5)`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, "[3 2]")
+
+		res, err = env.EvalString(`(half 9)`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.(*SexpInt).Val, cv.ShouldEqual, 4)
+
+		res, err = env.EvalString(`(rename (Cfg name:"old" port:8080) "new")`)
+		cv.So(err, cv.ShouldBeNil)
+		h := res.(*SexpHash)
+		cv.So(h.TypeName, cv.ShouldEqual, "Cfg")
+		name, err := h.HashGet(env, env.MakeSymbol("name"))
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(name.(*SexpStr).S, cv.ShouldEqual, "new")
+		port, err := h.HashGet(env, env.MakeSymbol("port"))
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(port.(*SexpInt).Val, cv.ShouldEqual, 8080)
+
+		res, err = env.EvalString(`(words " a b  c ")`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.SexpString(nil), cv.ShouldEqual, `["a" "b" "c"]`)
+
+		res, err = env.EvalString(`(describe 3)`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.(*SexpStr).S, cv.ShouldEqual, "int64")
+
+		res, err = env.EvalString(`(first [7 8])`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.(*SexpInt).Val, cv.ShouldEqual, 7)
+
+		for _, bad := range []string{
+			`(divmod 1 0)`, `(divmod 300 1)`, `(divmod "a" 1)`,
+			`(repeat "ab")`, `(boom)`, `(sum 1e300)`,
+			`(half -1)`, `(half -2.0)`, `(huge)`,
+		} {
+			env.Clear()
+			_, err = env.EvalString(bad)
+			cv.So(err, cv.ShouldNotBeNil)
+		}
+		env.Clear()
+		_, err = env.EvalString(`(divmod 1 0)`)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "divide by zero")
+		env.Clear()
+		_, err = env.EvalString(`(half -1)`)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "-1 does not fit in uint")
+		env.Clear()
+		_, err = env.EvalString(`(huge)`)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "18446744073709551615 from uint64 does not fit in an int")
+	})
+}
+
+func Test410CallZygoFunctionsFromGo(t *testing.T) {
+
+	cv.Convey(`env.Apply should call a script function from Go between runs, leaving env fit to carry on, even when the function fails`, t, func() {
+		env := NewZlisp()
+		defer env.Stop()
+		env.StandardSetup()
+
+		_, err := env.EvalString(`(defn add [a b] (+ a b)) (defn bad [] (throw "no"))`)
+		cv.So(err, cv.ShouldBeNil)
+		add, _ := env.FindObject("add")
+		bad, _ := env.FindObject("bad")
+
+		res, err := env.Apply(add.(*SexpFunction), []Sexp{&SexpInt{Val: 1}, &SexpInt{Val: 2}})
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.(*SexpInt).Val, cv.ShouldEqual, 3)
+
+		depth := env.datastack.Size()
+		_, err = env.Apply(bad.(*SexpFunction), nil)
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(env.datastack.Size(), cv.ShouldEqual, depth)
+
+		res, err = env.EvalString(`(add 5 5)`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.(*SexpInt).Val, cv.ShouldEqual, 10)
+	})
+
+	cv.Convey(`env.MakeGoFunc should fill a typed Go func that calls a script function, including from inside a builtin running under Run`, t, func() {
+		env := NewZlisp()
+		defer env.Stop()
+		env.StandardSetup()
+
+		cv.So(env.AddGoFunc("sortWith", func(less *SexpFunction, xs []int64) ([]int64, error) {
+			var cmp func(a, b int64) (bool, error)
+			err := env.MakeGoFunc(less, &cmp)
+			if err != nil {
+				return nil, err
+			}
+			sort.Slice(xs, func(i, j int) bool {
+				if err != nil {
+					return false
+				}
+				var lt bool
+				lt, err = cmp(xs[i], xs[j])
+				return lt
+			})
+			return xs, err
+		}), cv.ShouldBeNil)
+
+		res, err := env.EvalString(`
+(def sorted (sortWith (fn [a b] (> a b)) [3 1 4 1 5]))
+(+ (aget sorted 0) (* 10 (aget sorted 4)))`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(res.(*SexpInt).Val, cv.ShouldEqual, 15)
+
+		env.Clear()
+		_, err = env.EvalString(`(sortWith (fn [a b] (throw "cannot compare")) [2 1])`)
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "cannot compare")
+
+		env.Clear()
+		_, err = env.EvalString(`
+(defn square [x] [x (* x x)])
+(defn shout [& words] (len words))`)
+		cv.So(err, cv.ShouldBeNil)
+		square, _ := env.FindObject("square")
+		shout, _ := env.FindObject("shout")
+
+		var sq func(int) (int, int)
+		cv.So(env.MakeGoFunc(square.(*SexpFunction), &sq), cv.ShouldBeNil)
+		x, x2 := sq(7)
+		cv.So(x, cv.ShouldEqual, 7)
+		cv.So(x2, cv.ShouldEqual, 49)
+
+		var sh func(...string) Sexp
+		cv.So(env.MakeGoFunc(shout.(*SexpFunction), &sh), cv.ShouldBeNil)
+		cv.So(sh("hey", "you", "there").(*SexpInt).Val, cv.ShouldEqual, 3)
+
+		var toInt func(string) int
+		cv.So(env.MakeGoFunc(square.(*SexpFunction), &toInt), cv.ShouldBeNil)
+		cv.So(func() { toInt("a") }, cv.ShouldPanic)
+
+		cv.So(env.MakeGoFunc(square.(*SexpFunction), sq), cv.ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,143 @@
+package zygo
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// RegisterGoType makes the Go struct type of proto (a struct, or
+// a pointer to one) available to env's scripts under name, with no
+// hand-written factory needed. (name key: value ...) then makes a
+// record whose fields are type checked against those of the Go
+// struct, that togo turns into the Go struct, and whose methods
+// _method can call. Struct types found in its fields, nested or
+// embedded, are registered too, under their Go names, unless env
+// knows them already.
+func (env *Zlisp) RegisterGoType(name string, proto interface{}) (*RegisteredType, error) {
+	t := reflect.TypeOf(proto)
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("RegisterGoType '%s': need a struct, not %T", name, proto)
+	}
+	return env.registerGoType(name, t), nil
+}
+
+func (env *Zlisp) registerGoType(name string, t reflect.Type) *RegisteredType {
+	rt := NewRegisteredType(func(env *Zlisp, h *SexpHash) (interface{}, error) {
+		return reflect.New(t).Interface(), nil
+	})
+	rt.GenDefMap = true
+	rt.DisplayAs = name
+	uds := NewRecordDefn()
+	uds.env = env
+	uds.SetName(name)
+	rt.UserStructDefn = uds
+
+	// register before looking at the fields, so that
+	// a struct may refer to itself.
+	env.RegisterUserdef(rt, true, name)
+	env.addGoFields(uds, t)
+	return rt
+}
+
+// addGoFields declares in uds the exported fields of struct type
+// t, keyed as records key them: by the name in their zygo or json
+// tag, else by their Go name; see parseFieldTag. The fields of
+// embedded structs are promoted, as Go does. A field whose values
+// zygo cannot type, such as an interface, map or time, gets a nil
+// type, which lets any value through.
+func (env *Zlisp) addGoFields(uds *RecordDefn, t reflect.Type) {
+	var embedded []reflect.Type
+	for i := 0; i < t.NumField(); i++ {
+		fld := t.Field(i)
+		if fld.Anonymous {
+			et := fld.Type
+			if et.Kind() == reflect.Ptr {
+				et = et.Elem()
+			}
+			if et.Kind() == reflect.Struct {
+				embedded = append(embedded, et)
+			}
+		}
+		if fld.PkgPath != "" {
+			// unexported
+			continue
+		}
+		tag := parseFieldTag(fld)
+		if tag.Skip {
+			continue
+		}
+		key := tag.Key
+		if _, already := uds.FieldType[key]; already {
+			continue
+		}
+		rt := env.goFieldType(fld.Type)
+		uds.FieldType[key] = rt
+
+		// show types by name: a struct may refer to itself.
+		shown := fld.Type.String()
+		if rt != nil {
+			shown = rt.ShortName()
+		}
+		h, err := MakeHash([]Sexp{env.MakeSymbol(key), env.MakeSymbol(shown)}, "field", env)
+		panicOn(err)
+		uds.Fields = append(uds.Fields, (*SexpField)(h))
+	}
+	// outer fields take precedence over promoted ones.
+	for _, et := range embedded {
+		env.addGoFields(uds, et)
+	}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// goFieldType gives the type that zygo values of Go type t report,
+// or nil if there is none to check against.
+func (env *Zlisp) goFieldType(t reflect.Type) *RegisteredType {
+	if t == durationType {
+		// given as an int, or a string like "1m30s".
+		return nil
+	}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Uintptr:
+		return env.LookupType("int64")
+	case reflect.Float32, reflect.Float64:
+		return env.LookupType("float64")
+	case reflect.String:
+		return env.LookupType("string")
+	case reflect.Bool:
+		return env.LookupType("bool")
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			// raw bytes
+			return nil
+		}
+		elem := env.goFieldType(t.Elem())
+		if elem == nil {
+			return nil
+		}
+		return env.TypeRegistry().GetOrCreateSliceType(elem)
+	case reflect.Ptr:
+		// records stand in for pointers to structs, too.
+		return env.goFieldType(t.Elem())
+	case reflect.Struct:
+		if t == timeType || t.Name() == "" {
+			return nil
+		}
+		if rt := env.LookupType(t.String()); rt != nil && rt.TypeCache == reflect.PtrTo(t) {
+			return rt
+		}
+		if env.LookupType(t.Name()) != nil {
+			// the name is taken by some other type; leave it be.
+			return nil
+		}
+		return env.registerGoType(t.Name(), t)
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package zygo
+
+import (
+	"testing"
+	"time"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+type Base408 struct {
+	Id int `json:"id"`
+}
+
+type Inner408 struct {
+	Depth int64 `json:"depth"`
+}
+
+type Cfg408 struct {
+	Base408
+	Name  string         `json:"name"`
+	Port  int            `json:"port"`
+	Tags  []string       `json:"tags"`
+	Inner Inner408       `json:"inner"`
+	Next  *Cfg408        `json:"next"`
+	Extra map[string]int `json:"extra"`
+	Ratio float64
+	Owner string `json:"owner,omitempty"`
+	Cache []byte `json:"-"`
+}
+
+func (c *Cfg408) Describe(prefix string) string {
+	return prefix + c.Name
+}
+
+func Test408RegisterGoTypeByReflection(t *testing.T) {
+
+	cv.Convey(`env.RegisterGoType should give scripts a type checked constructor, togo conversion and _method calls for a Go struct, its nested and embedded structs included`, t, func() {
+		env := NewZlisp()
+		defer env.Stop()
+		env.StandardSetup()
+
+		rt, err := env.RegisterGoType("Cfg", Cfg408{})
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(env.LookupType("Cfg"), cv.ShouldEqual, rt)
+		cv.So(env.LookupType("Inner408"), cv.ShouldNotBeNil)
+		cv.So(env.LookupType("Base408"), cv.ShouldNotBeNil)
+		cv.So(rt.UserStructDefn.FieldType["port"], cv.ShouldEqual, env.LookupType("int64"))
+		cv.So(rt.UserStructDefn.FieldType["next"], cv.ShouldEqual, rt)
+		cv.So(rt.UserStructDefn.FieldType["extra"], cv.ShouldBeNil)
+		cv.So(rt.SexpString(nil), cv.ShouldContainSubstring, "extra: map[string]int")
+		_, hasCache := rt.UserStructDefn.FieldType["-"]
+		cv.So(hasCache, cv.ShouldBeFalse)
+
+		x, err := env.EvalString(`
+(def c (Cfg name:"web" port:80 tags:["a" "b"] id:7 Ratio:0.5 owner:"ops"
+            inner:(Inner408 depth:3) next:(Cfg name:"db")))
+(togo c)
+[c]`)
+		cv.So(err, cv.ShouldBeNil)
+		cfg := x.(*SexpArray).Val[0].(*SexpHash).GoShadowStruct.(*Cfg408)
+		cv.So(cfg.Name, cv.ShouldEqual, "web")
+		cv.So(cfg.Port, cv.ShouldEqual, 80)
+		cv.So(cfg.Id, cv.ShouldEqual, 7)
+		cv.So(cfg.Tags, cv.ShouldResemble, []string{"a", "b"})
+		cv.So(cfg.Inner.Depth, cv.ShouldEqual, 3)
+		cv.So(cfg.Next.Name, cv.ShouldEqual, "db")
+		cv.So(cfg.Ratio, cv.ShouldEqual, 0.5)
+		cv.So(cfg.Owner, cv.ShouldEqual, "ops")
+
+		x, err = env.EvalString(`(_method c Describe: "svc ")`)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(x.(*SexpArray).Val[0].(*SexpStr).S, cv.ShouldEqual, "svc web")
+
+		_, err = env.EvalString(`(Cfg port:"eighty")`)
+		cv.So(err, cv.ShouldNotBeNil)
+		env.Clear()
+		_, err = env.EvalString(`(Cfg nope:1)`)
+		cv.So(err, cv.ShouldNotBeNil)
+
+		_, err = env.RegisterGoType("NotAStruct", 3)
+		cv.So(err, cv.ShouldNotBeNil)
+	})
+}
+
+type Admin413 struct {
+	Email string `json:"mail" zygo:"email,required"`
+	Level int    `json:"level"`
+}
+
+type Server413 struct {
+	Host    string        `json:"hostname" zygo:"host,required"`
+	Port    int           `json:"port" zygo:",default=8080"`
+	Timeout time.Duration `zygo:"timeout,default=30s"`
+	Secret  string        `json:"secret" zygo:"-"`
+	Admin   *Admin413     `json:"admin"`
+}
+
+type Agent413 struct {
+	Name    string `json:"name,omitempty"`
+	Version int    `json:",omitempty"`
+	Token   string `json:"-"`
+	Shown   string `json:"-" zygo:"shown"`
+}
+
+func Test413ZygoStructTags(t *testing.T) {
+
+	cv.Convey(`zygo struct tags should rename fields apart from their json names, leave some out, fill in defaults, and require others, naming a missing one by its full path`, t, func() {
+		env := NewZlisp()
+		defer env.Stop()
+		env.StandardSetup()
+
+		_, err := env.RegisterGoType("server", Server413{})
+		panicOn(err)
+
+		x, err := env.EvalString(`(def s (server host:"h1" admin:(Admin413 email:"a@b" level:2)))`)
+		panicOn(err)
+		_, err = ToGoFunction(env, "togo", []Sexp{x})
+		panicOn(err)
+		cv.So(x.(*SexpHash).GoShadowStruct, cv.ShouldResemble, &Server413{
+			Host: "h1", Port: 8080, Timeout: 30 * time.Second,
+			Admin: &Admin413{Email: "a@b", Level: 2}})
+
+		for _, bad := range []string{`(server hostname:"h")`, `(server secret:"x")`} {
+			_, err = env.EvalString(bad)
+			cv.So(err, cv.ShouldNotBeNil)
+			cv.So(err.Error(), cv.ShouldContainSubstring, "has no field")
+			env.Clear()
+		}
+
+		_, err = env.EvalString(`(togo (server port:1))`)
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "server.host: missing required field")
+		env.Clear()
+
+		_, err = env.EvalString(`(togo (server host:"h" admin:(Admin413 level:1)))`)
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "server.admin.email: missing required field")
+		env.Clear()
+
+		back, err := MakeHash(nil, "server", env)
+		panicOn(err)
+		panicOn(back.FillHashFromShadow(env, &Server413{Host: "h2", Port: 1, Secret: "shh",
+			Admin: &Admin413{Email: "c@d"}}))
+		cv.So(back.SexpString(nil), cv.ShouldEqual,
+			` (server host:"h2" port:1 timeout:0 admin: (Admin413 email:"c@d" level:0))`)
+		// json tag options are not part of the name, and
+		// json:"-" leaves a field out.
+		rt, err := env.RegisterGoType("agent", Agent413{})
+		panicOn(err)
+		_, hasDash := rt.UserStructDefn.FieldType["-"]
+		cv.So(hasDash, cv.ShouldBeFalse)
+		x, err = env.EvalString(`(agent name:"a" Version:2 shown:"s")`)
+		cv.So(err, cv.ShouldBeNil)
+		_, err = ToGoFunction(env, "togo", []Sexp{x})
+		panicOn(err)
+		cv.So(x.(*SexpHash).GoShadowStruct, cv.ShouldResemble, &Agent413{Name: "a", Version: 2, Shown: "s"})
+		for _, bad := range []string{`(agent Token:"t")`, `(agent Name:"a")`} {
+			env.Clear()
+			_, err = env.EvalString(bad)
+			cv.So(err, cv.ShouldNotBeNil)
+		}
+	})
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	tm "github.com/glycerine/tmframe"
 	"reflect"
+	"sync"
 	"time"
 )
 
@@ -27,10 +28,27 @@ import (
 // for each record defined in the registry. e.g.
 // for snoopy, hornet, hellcat, etc.
 //
+// GoStructRegistry holds the builtin types and those that Go code
+// registers at init time; it is shared by every environment. Types
+// that scripts define, with (struct ...) and the like, go instead
+// into a registry of the environment's own that is layered over
+// this one (see env.TypeRegistry), so they stay out of the way of
+// other environments in the same process.
 var GoStructRegistry GoStructRegistryType
 
-// the registry type
+// the registry type. (go ...) blocks may define types
+// while others look them up, so the maps are guarded by
+// mut: read them through Lookup and All.
 type GoStructRegistryType struct {
+	mut sync.RWMutex
+
+	// base, if set, is consulted for names not registered here.
+	base *GoStructRegistryType
+
+	// names registered here, in order, when base is set.
+	// The shared registry keeps them in ListRegisteredTypes.
+	names []string
+
 	// comprehensive
 	Registry map[string]*RegisteredType
 
@@ -45,6 +63,8 @@ type GoStructRegistryType struct {
 var ListRegisteredTypes = []string{}
 
 func (r *GoStructRegistryType) RegisterBuiltin(name string, e *RegisteredType) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
 	r.register(name, e, false)
 	e.IsUser = false
 }
@@ -57,11 +77,14 @@ func (r *GoStructRegistryType) RegisterPointer(pointedToName string, pointedToTy
 		}
 		return &p, nil
 	}}
+	r.mut.Lock()
+	defer r.mut.Unlock()
 	r.register(fmt.Sprintf("(* %s)", pointedToName), newRT, false)
 	newRT.IsPointer = true
 	return newRT
 }
 
+// register must be called with r.mut held.
 func (r *GoStructRegistryType) register(name string, e *RegisteredType, isUser bool) {
 	if !e.initDone {
 		e.Init()
@@ -70,13 +93,15 @@ func (r *GoStructRegistryType) register(name string, e *RegisteredType, isUser b
 	e.Aliases[name] = true
 	e.Aliases[e.ReflectName] = true
 
-	_, found := r.Registry[name]
-	if !found {
-		ListRegisteredTypes = append(ListRegisteredTypes, name)
-	}
-	_, found2 := r.Registry[e.ReflectName]
-	if !found2 {
-		ListRegisteredTypes = append(ListRegisteredTypes, e.ReflectName)
+	for _, nm := range []string{name, e.ReflectName} {
+		if r.lookup(nm) != nil {
+			continue
+		}
+		if r.base == nil {
+			ListRegisteredTypes = append(ListRegisteredTypes, nm)
+		} else {
+			r.names = append(r.names, nm)
+		}
 	}
 
 	if isUser {
@@ -118,6 +143,16 @@ func (r *GoStructRegistryType) RegisterUserdef(
 	hasShadowStruct bool,
 	names ...string) {
 
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.registerUserdef(e, hasShadowStruct, names...)
+}
+
+func (r *GoStructRegistryType) registerUserdef(
+	e *RegisteredType,
+	hasShadowStruct bool,
+	names ...string) {
+
 	for i, name := range names {
 		e0 := e
 		if i > 0 {
@@ -137,8 +172,107 @@ func (r *GoStructRegistryType) RegisterUserdef(
 	}
 }
 
+// NewGoStructRegistry returns an empty registry layered over base.
+func NewGoStructRegistry(base *GoStructRegistryType) *GoStructRegistryType {
+	return &GoStructRegistryType{
+		base:     base,
+		Registry: make(map[string]*RegisteredType),
+		Builtin:  make(map[string]*RegisteredType),
+		Userdef:  make(map[string]*RegisteredType),
+	}
+}
+
 func (r *GoStructRegistryType) Lookup(name string) *RegisteredType {
-	return r.Registry[name]
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+	return r.lookup(name)
+}
+
+// lookup must be called with r.mut held.
+func (r *GoStructRegistryType) lookup(name string) *RegisteredType {
+	if rt, found := r.Registry[name]; found {
+		return rt
+	}
+	if r.base != nil {
+		return r.base.Lookup(name)
+	}
+	return nil
+}
+
+// All returns every type visible through r, keyed by name:
+// those of the base, overlaid with r's own.
+func (r *GoStructRegistryType) All() map[string]*RegisteredType {
+	var all map[string]*RegisteredType
+	if r.base != nil {
+		all = r.base.All()
+	} else {
+		all = make(map[string]*RegisteredType)
+	}
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+	for k, v := range r.Registry {
+		all[k] = v
+	}
+	return all
+}
+
+// Names lists the names registered, in order, base first.
+func (r *GoStructRegistryType) Names() []string {
+	var names []string
+	if r.base != nil {
+		names = r.base.Names()
+	}
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+	if r.base == nil {
+		return append(names, ListRegisteredTypes...)
+	}
+	return append(names, r.names...)
+}
+
+// named returns the types registered under their own
+// name (rather than a reflect alias), base first.
+func (r *GoStructRegistryType) named() []*RegisteredType {
+	var types []*RegisteredType
+	if r.base != nil {
+		types = r.base.named()
+	}
+	r.mut.RLock()
+	defer r.mut.RUnlock()
+	for _, e := range r.Builtin {
+		types = append(types, e)
+	}
+	for _, e := range r.Userdef {
+		types = append(types, e)
+	}
+	return types
+}
+
+// TypeRegistry returns env's own type registry, layered over
+// GoStructRegistry; register types there to make them visible
+// to env (and its (go ...) blocks) alone. With a nil env, it
+// returns the shared GoStructRegistry.
+func (env *Zlisp) TypeRegistry() *GoStructRegistryType {
+	if env == nil || env.types == nil {
+		return &GoStructRegistry
+	}
+	return env.types
+}
+
+// LookupType finds the type called name as env sees it.
+func (env *Zlisp) LookupType(name string) *RegisteredType {
+	return env.TypeRegistry().Lookup(name)
+}
+
+// RegisterUserdef registers e in env alone, under each of names,
+// and binds each name to its type in env's global scope, as
+// ImportBaseTypes does for the shared types.
+func (env *Zlisp) RegisterUserdef(e *RegisteredType, hasShadowStruct bool, names ...string) {
+	reg := env.TypeRegistry()
+	reg.RegisterUserdef(e, hasShadowStruct, names...)
+	for _, name := range names {
+		env.AddGlobal(name, reg.Lookup(name))
+	}
 }
 
 // the type of all maker functions
@@ -183,17 +317,11 @@ func (p *RegisteredType) TypeCheckRecord(hash *SexpHash) error {
 		Q("in RegisteredType.TypeCheckRecord, TypeName == field, skipping.")
 		return nil
 	}
-	if p.UserStructDefn != nil {
+	if p.UserStructDefn != nil || len(hash.DetOrder) > 0 {
 		Q("in RegisteredType.TypeCheckRecord, type checking against '%#v'", p.UserStructDefn)
 
-		var err error
-		for _, key := range hash.KeyOrder {
-			obs, _ := hash.HashGet(nil, key)
-			err = hash.TypeCheckField(key, obs)
-			if err != nil {
-				return err
-			}
-		}
+		// nested records too, naming fields by their full path.
+		return hash.checkFields(hash.TypeName, make(map[*SexpHash]bool))
 	}
 	return nil
 }
@@ -376,7 +504,7 @@ func TypeListFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 	if narg != 0 {
 		return SexpNull, WrongNargs
 	}
-	r := ListRegisteredTypes
+	r := env.TypeRegistry().Names()
 	s := make([]Sexp, len(r))
 	for i := range r {
 		s[i] = &SexpStr{S: r[i]}
@@ -385,11 +513,7 @@ func TypeListFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 }
 
 func (env *Zlisp) ImportBaseTypes() {
-	for _, e := range GoStructRegistry.Builtin {
-		env.AddGlobal(e.RegisteredName, e)
-	}
-
-	for _, e := range GoStructRegistry.Userdef {
+	for _, e := range env.TypeRegistry().named() {
 		env.AddGlobal(e.RegisteredName, e)
 	}
 }
@@ -414,7 +538,9 @@ func compareRegisteredTypes(a *RegisteredType, bs Sexp) (int, error) {
 func (gsr *GoStructRegistryType) GetOrCreatePointerType(pointedToType *RegisteredType) *RegisteredType {
 	Q("pointedToType = %#v", pointedToType)
 	ptrName := "*" + pointedToType.RegisteredName
-	ptrRt := gsr.Lookup(ptrName)
+	gsr.mut.Lock()
+	defer gsr.mut.Unlock()
+	ptrRt := gsr.lookup(ptrName)
 	if ptrRt != nil {
 		Q("type named '%v' already registered, reusing the pointer type", ptrName)
 	} else {
@@ -425,7 +551,7 @@ func (gsr *GoStructRegistryType) GetOrCreatePointerType(pointedToType *Registere
 		})
 		ptrRt.DisplayAs = fmt.Sprintf("(* %s)", pointedToType.DisplayAs)
 		ptrRt.RegisteredName = ptrName
-		gsr.RegisterUserdef(ptrRt, false, ptrName)
+		gsr.registerUserdef(ptrRt, false, ptrName)
 	}
 	return ptrRt
 }
@@ -433,7 +559,9 @@ func (gsr *GoStructRegistryType) GetOrCreatePointerType(pointedToType *Registere
 func (gsr *GoStructRegistryType) GetOrCreateSliceType(rt *RegisteredType) *RegisteredType {
 	//sliceName := "sliceOf" + rt.RegisteredName
 	sliceName := "[]" + rt.RegisteredName
-	sliceRt := gsr.Lookup(sliceName)
+	gsr.mut.Lock()
+	defer gsr.mut.Unlock()
+	sliceRt := gsr.lookup(sliceName)
 	if sliceRt != nil {
 		Q("type named '%v' already registered, re-using the type", sliceName)
 	} else {
@@ -444,7 +572,7 @@ func (gsr *GoStructRegistryType) GetOrCreateSliceType(rt *RegisteredType) *Regis
 		})
 		sliceRt.DisplayAs = fmt.Sprintf("(%s)", sliceName)
 		sliceRt.RegisteredName = sliceName
-		gsr.RegisterUserdef(sliceRt, false, sliceName)
+		gsr.registerUserdef(sliceRt, false, sliceName)
 	}
 	return sliceRt
 }
@@ -478,4 +606,7 @@ func RegisterDemoStructs() {
 	gsr.RegisterUserdef(&RegisteredType{GenDefMap: true, Factory: func(env *Zlisp, h *SexpHash) (interface{}, error) {
 		return &SetOfPlanes{}, nil
 	}}, true, "setOfPlanes")
+	gsr.RegisterUserdef(&RegisteredType{GenDefMap: true, Factory: func(env *Zlisp, h *SexpHash) (interface{}, error) {
+		return &Cockpit{}, nil
+	}}, true, "cockpit")
 }
@@ -0,0 +1,365 @@
+package zygo
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/maphash"
+	"math"
+)
+
+// Hash storage.
+//
+// A SexpHash keeps its entries in order, the order their keys
+// were first set, and indexes them by a structural hash of the
+// key. Setting, getting and deleting a key are all constant
+// time: a delete leaves a hole in the order that is skipped,
+// and the holes are squeezed out once they are half of it.
+//
+// Keys are hashed and compared by value, so any value can be a
+// key: numbers, strings, symbols, and arrays and hashes of
+// them, nested as deeply as you like. Two keys are the same
+// key when they are the same type and hold the same values;
+// hashes are compared without regard to their key order.
+// Anything else -- functions, Go values -- is its own key.
+//
+// Since a composite key is hashed by what it holds, the hash
+// keeps a copy of it, made by frozenKey, and hands out copies
+// of that, so changing an array after using it as a key does
+// not strand the entry under a stale hash code.
+
+// hashEntry is one key and its value.
+type hashEntry struct {
+	key  Sexp
+	val  Sexp
+	code uint64
+
+	// pos is the entry's index in order, or -1 once
+	// it has been deleted.
+	pos int
+}
+
+var hashSeed = maphash.MakeSeed()
+
+// hash tags keep values of different types that have the same
+// bytes, such as 1 and 1.0, from hashing alike.
+const (
+	hashTagInt byte = iota + 1
+	hashTagFloat
+	hashTagChar
+	hashTagBool
+	hashTagStr
+	hashTagSymbol
+	hashTagRaw
+	hashTagSentinel
+	hashTagArray
+	hashTagPair
+	hashTagHash
+	hashTagTime
+	hashTagPointer
+)
+
+// hashKey returns the key that expr is stored under, and its
+// hash code. A list is evaluated first, in env, and its value
+// used; without an env, a list cannot be a key.
+func hashKey(env *Zlisp, expr Sexp) (Sexp, uint64, error) {
+	if _, isList := expr.(*SexpPair); isList {
+		if env == nil {
+			return nil, 0, fmt.Errorf("cannot hash type %T", expr)
+		}
+		res, err := EvalFunction(env, "eval-hash-key", []Sexp{expr})
+		if err != nil {
+			return nil, 0, fmt.Errorf("error during eval of "+
+				"hash key: %s", err)
+		}
+		if _, isList := res.(*SexpPair); isList {
+			return nil, 0, fmt.Errorf("list '%s' found where hash key needed", res.SexpString(nil))
+		}
+		expr = res
+	}
+	var h maphash.Hash
+	h.SetSeed(hashSeed)
+	writeHash(&h, expr)
+	return expr, h.Sum64(), nil
+}
+
+func writeHash(h *maphash.Hash, expr Sexp) {
+	var buf [8]byte
+	word := func(tag byte, x uint64) {
+		h.WriteByte(tag)
+		binary.LittleEndian.PutUint64(buf[:], x)
+		h.Write(buf[:])
+	}
+	switch e := expr.(type) {
+	case *SexpInt:
+		word(hashTagInt, uint64(e.Val))
+	case *SexpFloat:
+		word(hashTagFloat, math.Float64bits(e.Val))
+	case *SexpChar:
+		word(hashTagChar, uint64(e.Val))
+	case *SexpBool:
+		b := uint64(0)
+		if e.Val {
+			b = 1
+		}
+		word(hashTagBool, b)
+	case *SexpStr:
+		word(hashTagStr, uint64(len(e.S)))
+		h.WriteString(e.S)
+	case *SexpSymbol:
+		word(hashTagSymbol, uint64(e.number))
+	case *SexpRaw:
+		word(hashTagRaw, uint64(len(e.Val)))
+		h.Write(e.Val)
+	case *SexpSentinel:
+		word(hashTagSentinel, uint64(e.Val))
+	case *SexpTime:
+		word(hashTagTime, uint64(e.Tm.UnixNano()))
+	case *SexpArray:
+		word(hashTagArray, uint64(len(e.Val)))
+		for _, x := range e.Val {
+			writeHash(h, x)
+		}
+	case *SexpPair:
+		h.WriteByte(hashTagPair)
+		writeHash(h, e.Head)
+		writeHash(h, e.Tail)
+	case *SexpHash:
+		// entries are summed, so that key order
+		// does not change the hash.
+		word(hashTagHash, uint64(e.NumKeys))
+		h.WriteString(e.TypeName)
+		var sum uint64
+		var eh maphash.Hash
+		for _, ent := range e.order {
+			if ent == nil {
+				continue
+			}
+			eh.SetSeed(hashSeed)
+			writeHash(&eh, ent.key)
+			writeHash(&eh, ent.val)
+			sum += eh.Sum64()
+		}
+		binary.LittleEndian.PutUint64(buf[:], sum)
+		h.Write(buf[:])
+	default:
+		h.WriteByte(hashTagPointer)
+		h.WriteString(fmt.Sprintf("%p", expr))
+	}
+}
+
+// keysEqual reports whether a and b are the same key. It
+// agrees with writeHash: equal keys hash alike.
+func keysEqual(a, b Sexp) bool {
+	if a == b {
+		return true
+	}
+	switch x := a.(type) {
+	case *SexpInt:
+		y, ok := b.(*SexpInt)
+		return ok && x.Val == y.Val
+	case *SexpFloat:
+		y, ok := b.(*SexpFloat)
+		return ok && math.Float64bits(x.Val) == math.Float64bits(y.Val)
+	case *SexpChar:
+		y, ok := b.(*SexpChar)
+		return ok && x.Val == y.Val
+	case *SexpBool:
+		y, ok := b.(*SexpBool)
+		return ok && x.Val == y.Val
+	case *SexpStr:
+		y, ok := b.(*SexpStr)
+		return ok && x.S == y.S
+	case *SexpSymbol:
+		y, ok := b.(*SexpSymbol)
+		return ok && x.number == y.number
+	case *SexpRaw:
+		y, ok := b.(*SexpRaw)
+		return ok && string(x.Val) == string(y.Val)
+	case *SexpSentinel:
+		y, ok := b.(*SexpSentinel)
+		return ok && x.Val == y.Val
+	case *SexpTime:
+		y, ok := b.(*SexpTime)
+		return ok && x.Tm.UnixNano() == y.Tm.UnixNano()
+	case *SexpArray:
+		y, ok := b.(*SexpArray)
+		if !ok || len(x.Val) != len(y.Val) {
+			return false
+		}
+		for i := range x.Val {
+			if !keysEqual(x.Val[i], y.Val[i]) {
+				return false
+			}
+		}
+		return true
+	case *SexpPair:
+		y, ok := b.(*SexpPair)
+		return ok && keysEqual(x.Head, y.Head) && keysEqual(x.Tail, y.Tail)
+	case *SexpHash:
+		y, ok := b.(*SexpHash)
+		if !ok || x.TypeName != y.TypeName || x.NumKeys != y.NumKeys {
+			return false
+		}
+		for _, ent := range x.order {
+			if ent == nil {
+				continue
+			}
+			other := y.find(ent.code, ent.key)
+			if other == nil || !keysEqual(ent.val, other.val) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// find returns the entry for key, which hashes to code,
+// or nil if there is none.
+func (hash *SexpHash) find(code uint64, key Sexp) *hashEntry {
+	for _, ent := range hash.index[code] {
+		if keysEqual(ent.key, key) {
+			return ent
+		}
+	}
+	return nil
+}
+
+// frozenKey returns key, or for a composite key a deep copy of
+// it that nothing else refers to.
+func frozenKey(key Sexp) Sexp {
+	switch k := key.(type) {
+	case *SexpArray:
+		cp := *k
+		cp.Val = make([]Sexp, len(k.Val))
+		for i, x := range k.Val {
+			cp.Val[i] = frozenKey(x)
+		}
+		return &cp
+	case *SexpPair:
+		return &SexpPair{Head: frozenKey(k.Head), Tail: frozenKey(k.Tail)}
+	case *SexpRaw:
+		return &SexpRaw{Val: append([]byte(nil), k.Val...), Typ: k.Typ}
+	case *SexpHash:
+		cp := &SexpHash{TypeName: k.TypeName, Env: k.Env}
+		for _, ent := range k.order {
+			if ent != nil {
+				cp.insert(ent.code, frozenKey(ent.key), frozenKey(ent.val))
+			}
+		}
+		return cp
+	}
+	return key
+}
+
+// insert adds a new entry for key at the end of the order.
+// key must not be shared with the caller; see frozenKey.
+func (hash *SexpHash) insert(code uint64, key, val Sexp) {
+	if hash.index == nil {
+		hash.index = make(map[uint64][]*hashEntry)
+	}
+	ent := &hashEntry{key: key, val: val, code: code, pos: len(hash.order)}
+	hash.order = append(hash.order, ent)
+	hash.index[code] = append(hash.index[code], ent)
+	hash.NumKeys++
+}
+
+// remove takes ent out of the index and the order.
+func (hash *SexpHash) remove(ent *hashEntry) {
+	bucket := hash.index[ent.code]
+	for i, x := range bucket {
+		if x == ent {
+			bucket = append(bucket[:i], bucket[i+1:]...)
+			break
+		}
+	}
+	if len(bucket) == 0 {
+		delete(hash.index, ent.code)
+	} else {
+		hash.index[ent.code] = bucket
+	}
+	hash.order[ent.pos] = nil
+	ent.pos = -1
+	hash.holes++
+	hash.NumKeys--
+	if hash.holes > 8 && hash.holes > len(hash.order)/2 {
+		hash.compact()
+	}
+}
+
+// compact squeezes the holes left by deletes out of the order.
+// It makes a new slice, so that an Each already ranging over
+// the old one is not disturbed.
+func (hash *SexpHash) compact() {
+	if hash.holes == 0 {
+		return
+	}
+	order := make([]*hashEntry, 0, hash.NumKeys)
+	for _, ent := range hash.order {
+		if ent != nil {
+			ent.pos = len(order)
+			order = append(order, ent)
+		}
+	}
+	hash.order = order
+	hash.holes = 0
+}
+
+// Keys returns the keys of hash in order.
+func (hash *SexpHash) Keys() []Sexp {
+	keys := make([]Sexp, 0, hash.NumKeys)
+	for _, ent := range hash.order {
+		if ent != nil {
+			keys = append(keys, frozenKey(ent.key))
+		}
+	}
+	return keys
+}
+
+// Each calls f with each key and value of hash, in order, until
+// f returns false. f may set and delete keys as it goes; keys
+// it deletes that have not been reached yet are skipped, and
+// keys it adds are not visited. f must not change the keys
+// it is given.
+func (hash *SexpHash) Each(f func(key, val Sexp) bool) {
+	for _, ent := range hash.order {
+		if ent != nil && ent.pos >= 0 && !f(ent.key, ent.val) {
+			return
+		}
+	}
+}
+
+// entryAt returns the entry at position pos in the order, or
+// nil if there is none.
+func (hash *SexpHash) entryAt(pos int) *hashEntry {
+	hash.compact()
+	if pos < 0 || pos >= len(hash.order) {
+		return nil
+	}
+	return hash.order[pos]
+}
+
+// copyEntries replaces the entries of hash with
+// copies of those in src.
+func (hash *SexpHash) copyEntries(src *SexpHash) {
+	hash.order = make([]*hashEntry, 0, src.NumKeys)
+	hash.index = make(map[uint64][]*hashEntry, src.NumKeys)
+	hash.holes = 0
+	hash.NumKeys = 0
+	for _, ent := range src.order {
+		if ent != nil {
+			hash.insert(ent.code, ent.key, ent.val)
+		}
+	}
+}
+
+// pairs returns the keys and values of hash, in order, as
+// (key . val) pairs.
+func (hash *SexpHash) pairs() []*SexpPair {
+	pairs := make([]*SexpPair, 0, hash.NumKeys)
+	hash.Each(func(key, val Sexp) bool {
+		pairs = append(pairs, Cons(key, val))
+		return true
+	})
+	return pairs
+}
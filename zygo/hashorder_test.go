@@ -0,0 +1,70 @@
+package zygo
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+func Test419OrderedHashWithAnyKey(t *testing.T) {
+
+	cv.Convey(`hashes should keep keys in insertion order through deletes and re-inserts, accept any value as a key, and build and prune large maps in linear time`, t, func() {
+		env := NewZlisp()
+		defer env.Stop()
+		env.StandardSetup()
+
+		for src, want := range map[string]string{
+			// delete and re-insert moves a key to the end
+			`(def h (hash a:1 b:2 c:3)) (hdel h %b) (hset h %b 4) (keys h)`: `[a c b]`,
+			// overwriting keeps the place
+			`(def h (hash a:1 b:2)) (hset h %a 3) [(keys h) (hpair h 0)]`: `[[a b] (a 3)]`,
+			// deleting a missing key changes nothing
+			`(def h (hash a:1)) (hdel h %z) (len h)`: `1`,
+			// floats, bools, nested arrays and hashes are keys, by value
+			`(def h (hash)) (hset h 1.5 %f) (hset h true %t) (hset h [1 [2 "x"]] %a) (hset h (hash x:1 y:2) %h)
+			 [(hget h 1.5) (hget h true) (hget h [1 [2 "x"]]) (hget h (hash y:2 x:1))]`: `[f t a h]`,
+			// 1 and 1.0 are different keys
+			`(def h (hash)) (hset h 1 %i) (hset h 1.0 %f) [(len h) (hget h 1)]`: `[2 i]`,
+			// changing an array after it is used as a key, or one
+			// handed out by keys, leaves the stored key alone
+			`(def k [1 2]) (def h (hash)) (hset h k %a) (aset k 0 9) (hset h k %b)
+			 (aset (aget (keys h) 0) 1 7) [(len h) (hget h [1 2]) (hget h [9 2]) (keys h)]`: `[2 a b [[1 2] [9 2]]]`,
+		} {
+			x, err := env.EvalString(src)
+			cv.So(err, cv.ShouldBeNil)
+			cv.So(x.SexpString(nil), cv.ShouldEqual, want)
+		}
+
+		// 50k keys, then delete every other one.
+		const n = 50000
+		h, err := MakeHash(nil, "hash", env)
+		panicOn(err)
+		t0 := time.Now()
+		for i := 0; i < n; i++ {
+			panicOn(h.HashSet(&SexpStr{S: fmt.Sprintf("k%d", i)}, &SexpInt{Val: int64(i)}))
+		}
+		for i := 0; i < n; i += 2 {
+			panicOn(h.HashDelete(&SexpStr{S: fmt.Sprintf("k%d", i)}))
+		}
+		cv.So(time.Since(t0), cv.ShouldBeLessThan, 5*time.Second)
+		cv.So(h.NumKeys, cv.ShouldEqual, n/2)
+		keys := h.Keys()
+		cv.So(len(keys), cv.ShouldEqual, n/2)
+		cv.So(keys[0].(*SexpStr).S, cv.ShouldEqual, "k1")
+		cv.So(keys[n/2-1].(*SexpStr).S, cv.ShouldEqual, fmt.Sprintf("k%d", n-1))
+		p, err := h.HashPairi(1)
+		panicOn(err)
+		cv.So(p.SexpString(nil), cv.ShouldEqual, `("k3" 3)`)
+
+		// the int hash codes and Map snapshot are still there
+		// for Go code written against them.
+		code, err := HashExpression(nil, &SexpStr{S: "k3"})
+		panicOn(err)
+		pairs := (*h.CopyMap())[code]
+		cv.So(len(pairs), cv.ShouldEqual, 1)
+		cv.So(pairs[0].Head.SexpString(nil), cv.ShouldEqual, `"k3"`)
+		cv.So(pairs[0].Tail.SexpString(nil), cv.ShouldEqual, `3`)
+	})
+}
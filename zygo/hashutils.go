@@ -3,64 +3,23 @@ package zygo
 import (
 	"errors"
 	"fmt"
-	"hash/fnv"
 	"reflect"
+	"sort"
 	"strings"
 )
 
 var NoAttachedGoStruct = fmt.Errorf("hash has no attach Go struct")
 
+// HashExpression returns the hash code that expr is stored
+// under as a hash key, cut down to an int. A list is evaluated
+// first, in env.
+//
+// Deprecated: the hash codes are uint64 now, and keys that hash
+// alike are told apart by value; HashExpression is kept only for
+// callers written against the int codes.
 func HashExpression(env *Zlisp, expr Sexp) (int, error) {
-
-	hashcode, isList, err := hashHelper(expr)
-	if err != nil {
-		return 0, err
-	}
-	if !isList {
-		return hashcode, nil
-	}
-
-	// can we evaluate it?
-	if env != nil {
-		res, err := EvalFunction(env, "eval-hash-key", []Sexp{expr})
-		if err != nil {
-			return 0, fmt.Errorf("error during eval of "+
-				"hash key: %s", err)
-		}
-		// 2nd try
-		hashcode2, isList2, err := hashHelper(res)
-		if err != nil {
-			return 0, fmt.Errorf("evaluated key function to '%s' but could not hash type %T: %s", res.SexpString(nil), res, err)
-		}
-		if !isList2 {
-			return hashcode2, nil
-		}
-		return 0, fmt.Errorf("list '%s' found where hash key needed", res.SexpString(nil))
-	} // end if env == nil
-	return 0, fmt.Errorf("cannot hash type %T", expr)
-}
-
-func hashHelper(expr Sexp) (hashcode int, isList bool, err error) {
-	switch e := expr.(type) {
-	case *SexpInt:
-		return int(e.Val), false, nil
-	case *SexpChar:
-		return int(e.Val), false, nil
-	case *SexpSymbol:
-		return e.number, false, nil
-	case *SexpStr:
-		hasher := fnv.New32()
-		_, err := hasher.Write([]byte(e.S))
-		if err != nil {
-			return 0, false, err
-		}
-		return int(hasher.Sum32()), false, nil
-	case *SexpPair:
-		return 0, true, nil
-	case *SexpArray:
-		return int(Blake2bUint64([]byte(e.SexpString(nil)))), false, nil
-	}
-	return 0, false, fmt.Errorf("cannot hash type %T", expr)
+	_, code, err := hashKey(env, expr)
+	return int(code), err
 }
 
 func MakeHash(args []Sexp, typename string, env *Zlisp) (*SexpHash, error) {
@@ -92,7 +51,7 @@ func MakeHash(args []Sexp, typename string, env *Zlisp) (*SexpHash, error) {
 	var iface interface{}
 	jsonMap := make(map[string]*HashFieldDet)
 
-	factory := GoStructRegistry.Lookup(typename)
+	factory := env.LookupType(typename)
 	if factory == nil {
 		factory = &RegisteredType{Factory: MakeGoStructFunc(func(env *Zlisp, h *SexpHash) (interface{}, error) { return MakeHash(nil, typename, env) })}
 		factory.Aliases = make(map[string]bool)
@@ -109,8 +68,6 @@ func MakeHash(args []Sexp, typename string, env *Zlisp) (*SexpHash, error) {
 	//Q("generating SexpHash with typename: '%s'", typename)
 	hash := SexpHash{
 		TypeName:         typename,
-		Map:              make(map[int][]*SexpPair),
-		KeyOrder:         []Sexp{},
 		GoStructFactory:  factory,
 		NumKeys:          memberCount,
 		GoMethods:        meth,
@@ -141,7 +98,8 @@ func MakeHash(args []Sexp, typename string, env *Zlisp) (*SexpHash, error) {
 	}
 
 	//Q("doing factory, foundRecordType := GoStructRegistry.Registry[typename]")
-	factoryShad, foundRecordType := GoStructRegistry.Registry[typename]
+	factoryShad := env.LookupType(typename)
+	foundRecordType := factoryShad != nil
 	if foundRecordType {
 		//Q("factoryShad = '%#v' for typename='%s'\n", factoryShad, typename)
 		if factoryShad.hasShadowStruct {
@@ -165,7 +123,7 @@ func MakeHash(args []Sexp, typename string, env *Zlisp) (*SexpHash, error) {
 		factory.ReflectName = typename
 		factory.DisplayAs = typename
 
-		GoStructRegistry.RegisterUserdef(factory, false, typename)
+		env.TypeRegistry().RegisterUserdef(factory, false, typename)
 	}
 
 	return &hash, nil
@@ -223,25 +181,12 @@ func (hash *SexpHash) HashGet(env *Zlisp, key Sexp) (res Sexp, err error) {
 }
 
 func (hash *SexpHash) HashGetDefault(env *Zlisp, key Sexp, defaultval Sexp) (Sexp, error) {
-	hashval, err := HashExpression(env, key)
+	key, code, err := hashKey(env, key)
 	if err != nil {
 		return SexpNull, err
 	}
-	//P("HashGetDefault, hashval='%#v', key='%s'", hashval, key.SexpString(nil))
-	//for kk := range hash.Map {
-	//	P("hash.Map has key '%#v'", kk)
-	//}
-	arr, ok := hash.Map[hashval]
-	//P("arr='%#v', ok='%#v'", arr, ok)
-	if !ok {
-		return defaultval, nil
-	}
-
-	for _, pair := range arr {
-		res, err := env.Compare(pair.Head, key)
-		if err == nil && res == 0 {
-			return pair.Tail, nil
-		}
+	if ent := hash.find(code, key); ent != nil {
+		return ent.val, nil
 	}
 	return defaultval, nil
 }
@@ -272,7 +217,7 @@ func (h *SexpHash) TypeCheckField(key Sexp, val Sexp) error {
 		//Q("SexpHash.TypeCheckField() sees nil has.GoStructFactory.UserStructDefn, bailing out.")
 
 		// check in the registry for this type!
-		rt := GoStructRegistry.Lookup(h.TypeName)
+		rt := h.Env.LookupType(h.TypeName)
 
 		// was it found? If so, use it!
 		if rt != nil && rt.UserStructDefn != nil {
@@ -303,6 +248,10 @@ func (h *SexpHash) TypeCheckField(key Sexp, val Sexp) error {
 		if !ok {
 			return fmt.Errorf("%s has no field '%s' [err 2]", p.UserStructDefn.Name, k)
 		}
+		if declaredTyp == nil {
+			// declared, but not typed; see RegisterGoType.
+			return nil
+		}
 		obsTyp := val.Type()
 		if obsTyp == nil {
 			// allow certain types to be nil, e.g. [] and nil itself
@@ -356,124 +305,80 @@ func (hash *SexpHash) HashSet(key Sexp, val Sexp) error {
 		}
 	}
 
-	hashval, err := HashExpression(nil, key)
+	_, code, err := hashKey(nil, key)
 	if err != nil {
 		return err
 	}
-	arr, ok := hash.Map[hashval]
-
-	if !ok {
-		hash.Map[hashval] = []*SexpPair{Cons(key, val)}
-		hash.KeyOrder = append(hash.KeyOrder, key)
-		hash.NumKeys++
-		Q("in HashSet, added key to KeyOrder: '%v'", key)
+	if ent := hash.find(code, key); ent != nil {
+		ent.val = val
 		return nil
 	}
-
-	found := false
-	for i, pair := range arr {
-		res, err := hash.Env.Compare(pair.Head, key)
-		if err == nil && res == 0 {
-			arr[i] = Cons(key, val)
-			found = true
-		}
-	}
-
-	if !found {
-		arr = append(arr, Cons(key, val))
-		hash.KeyOrder = append(hash.KeyOrder, key)
-		hash.NumKeys++
+	if err := hash.Env.CheckHashKeys(hash.NumKeys + 1); err != nil {
+		return err
 	}
-
-	hash.Map[hashval] = arr
-
+	hash.insert(code, frozenKey(key), val)
 	return nil
 }
 
 func (hash *SexpHash) HashDelete(key Sexp) error {
-	hashval, err := HashExpression(nil, key)
+	_, code, err := hashKey(nil, key)
 	if err != nil {
 		return err
 	}
-	arr, ok := hash.Map[hashval]
-
 	// if it doesn't exist, no need to delete it
-	if !ok {
-		return nil
+	if ent := hash.find(code, key); ent != nil {
+		hash.remove(ent)
 	}
-
-	hash.NumKeys--
-	for i, pair := range arr {
-		res, err := hash.Env.Compare(pair.Head, key)
-		if err == nil && res == 0 {
-			hash.Map[hashval] = append(arr[0:i], arr[i+1:]...)
-			break
-		}
-	}
-
 	return nil
 }
 
 func HashCountKeys(hash *SexpHash) int {
-	var num int
-	for _, arr := range hash.Map {
-		num += len(arr)
-	}
-	if num != hash.NumKeys {
-		panic(fmt.Errorf("HashCountKeys disagreement on count: num=%d, (*hash.NumKeys)=%d", num, hash.NumKeys))
-	}
-	return num
+	return hash.NumKeys
 }
 
 func HashIsEmpty(hash *SexpHash) bool {
-	for _, arr := range hash.Map {
-		if len(arr) > 0 {
-			return false
-		}
-	}
-	return true
+	return hash.NumKeys == 0
 }
 
+// SetHashKeyOrder puts the keys of hash in the order given by
+// the array keyOrd. Keys it does not mention follow, in the
+// order they were in.
 func SetHashKeyOrder(hash *SexpHash, keyOrd Sexp) error {
-	// truncate down to zero, then build back up correctly.
-	hash.KeyOrder = hash.KeyOrder[:0]
-
 	keys, isArr := keyOrd.(*SexpArray)
 	if !isArr {
 		return fmt.Errorf("must have SexpArray for keyOrd, but instead we have: %T with value='%#v'", keyOrd, keyOrd)
 	}
+	order := make([]*hashEntry, 0, hash.NumKeys)
 	for _, key := range keys.Val {
-		hash.KeyOrder = append(hash.KeyOrder, key)
+		_, code, err := hashKey(nil, key)
+		if err != nil {
+			return err
+		}
+		if ent := hash.find(code, key); ent != nil && ent.pos >= 0 {
+			ent.pos = -1
+			order = append(order, ent)
+		}
 	}
-
+	for _, ent := range hash.order {
+		if ent != nil && ent.pos >= 0 {
+			order = append(order, ent)
+		}
+	}
+	for i, ent := range order {
+		ent.pos = i
+	}
+	hash.order = order
+	hash.holes = 0
 	return nil
 }
 
 func (hash *SexpHash) HashPairi(pos int) (*SexpPair, error) {
-	nk := hash.NumKeys
-	if pos > nk {
+	ent := hash.entryAt(pos)
+	if ent == nil {
 		return &SexpPair{}, fmt.Errorf("hpair error: pos %d is beyond our key count %d",
-			pos, nk)
-	}
-	lenKeyOrder := len(hash.KeyOrder)
-	var err error
-	var key, val Sexp
-	found := false
-	for k := pos; k < lenKeyOrder; k++ {
-		key = hash.KeyOrder[k]
-		val, err = hash.HashGet(nil, key)
-
-		if err == nil {
-			found = true
-			break
-		}
-		// what about deleted keys? just skip to the next!
+			pos, hash.NumKeys)
 	}
-	if !found {
-		panic(fmt.Errorf("hpair internal error: could not get element at pos %d in lenKeyOrder=%d", pos, lenKeyOrder))
-	}
-
-	return Cons(key, &SexpPair{Head: val, Tail: SexpNull}), nil
+	return Cons(frozenKey(ent.key), &SexpPair{Head: ent.val, Tail: SexpNull}), nil
 }
 
 func GoMethodListFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
@@ -567,20 +472,22 @@ func fillJsonMap(json2ptr *map[string]*HashFieldDet, fx *[]Sexp, fl *[]reflect.S
 		fld := tye.Field(i)
 		*fl = append(*fl, fld)
 		*fx = append(*fx, &SexpStr{S: fld.Name + " " + fld.Type.String() + suffix})
+		// the zygo tag's name, else the json tag, else the Go name.
+		tag := parseFieldTag(fld)
 		det := &HashFieldDet{
 			FieldNum:     i,
 			FieldType:    fld.Type,
 			StructField:  fld,
 			FieldName:    fld.Name,
-			FieldJsonTag: fld.Name, // fallback. changed below if json tag available.
+			FieldJsonTag: tag.Key,
+			Required:     tag.Required,
+			HasDefault:   tag.HasDefault,
+			Default:      tag.Default,
 		}
-		jsonTag := fld.Tag.Get("json")
-		if jsonTag != "" {
-			det.FieldJsonTag = jsonTag
-			(*json2ptr)[jsonTag] = det
-		} else {
-			(*json2ptr)[fld.Name] = det
+		if tag.Skip {
+			continue
 		}
+		(*json2ptr)[tag.Key] = det
 		*detOrder = append(*detOrder, det)
 		det.EmbedPath = append(embedPath,
 			EmbedPath{ChildName: fld.Name, ChildFieldNum: i})
@@ -628,7 +535,7 @@ func GenericHpairFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 
 	switch seq := args[0].(type) {
 	case *SexpHash:
-		if pos < 0 || pos >= len(seq.KeyOrder) {
+		if pos < 0 || pos >= seq.NumKeys {
 			return SexpNull, fmt.Errorf("hpair position request %d out of bounds", pos)
 		}
 		return seq.HashPairi(pos)
@@ -651,7 +558,21 @@ func (h *SexpHash) FillHashFromShadow(env *Zlisp, src interface{}) error {
 
 	for i, det := range h.DetOrder {
 		Q("\n looking at det for %s; %v-th entry in h.DetOrder\n", det.FieldJsonTag, i)
-		goField := vaSrc.Field(det.FieldNum)
+		// follow the path down through any embedded structs.
+		goField, reached := vaSrc, true
+		for _, p := range det.EmbedPath {
+			if goField.Kind() == reflect.Ptr {
+				if goField.IsNil() {
+					reached = false
+					break
+				}
+				goField = goField.Elem()
+			}
+			goField = goField.Field(p.ChildFieldNum)
+		}
+		if !reached || !goField.CanInterface() {
+			continue
+		}
 		val, err := fillHashHelper(goField.Interface(), 0, env, false)
 		if err != nil {
 			Q("got err='%s' back from fillHashhelper", err)
@@ -673,10 +594,25 @@ func (h *SexpHash) FillHashFromShadow(env *Zlisp, src interface{}) error {
 func fillHashHelper(r interface{}, depth int, env *Zlisp, preferSym bool) (Sexp, error) {
 	Q("fillHashHelper() at depth %d, decoded type is %T\n", depth, r)
 
-	// check for one of our registered structs
+	if rv := reflect.ValueOf(r); rv.Kind() == reflect.Ptr && rv.IsNil() {
+		return SexpNull, nil
+	}
+
+	// check for one of our registered structs, by the
+	// name it was registered under if we can.
+	if rt := env.goTypeOf(reflect.TypeOf(r)); rt != nil {
+		retHash, err := MakeHash([]Sexp{}, rt.RegisteredName, env)
+		if err != nil {
+			return SexpNull, err
+		}
+		if err = retHash.FillHashFromShadow(env, r); err != nil {
+			return SexpNull, err
+		}
+		return retHash, nil
+	}
 
 	// go through the type registry upfront
-	for hashName, factory := range GoStructRegistry.Registry {
+	for hashName, factory := range env.TypeRegistry().All() {
 		//P("fillHashHelper is trying hashName='%s'", hashName)
 		st, err := factory.Factory(env, nil)
 		if err != nil {
@@ -766,7 +702,10 @@ func fillHashHelper(r interface{}, depth int, env *Zlisp, preferSym bool) (Sexp,
 			} else {
 				sym := env.MakeSymbol(sortedMapKey[i])
 				pairs = append(pairs, sym)
-				ele := decodeGoToSexpHelper(sortedMapVal[i], depth+1, env, preferSym)
+				ele, err := fillHashHelper(sortedMapVal[i], depth+1, env, preferSym)
+				if err != nil {
+					return SexpNull, err
+				}
 				pairs = append(pairs, ele)
 			}
 		}
@@ -789,10 +728,81 @@ func fillHashHelper(r interface{}, depth int, env *Zlisp, preferSym bool) (Sexp,
 	case bool:
 		return &SexpBool{Val: val}, nil
 
-	default:
-		Q("unknown type in type switch, val = %#v.  type = %T.\n", val, val)
 	}
 
+	Q("no case in type switch, val = %#v.  type = %T.\n", r, r)
+	return fillHashReflect(reflect.ValueOf(r), depth, env, preferSym)
+}
+
+// fillHashReflect translates by kind the Go values that
+// fillHashHelper has no case for: other sizes of numbers,
+// named types such as time.Duration, slices, arrays and maps.
+// Maps with string or integer keys become hashes.
+func fillHashReflect(v reflect.Value, depth int, env *Zlisp, preferSym bool) (Sexp, error) {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return &SexpInt{Val: v.Int()}, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return &SexpInt{Val: int64(v.Uint())}, nil
+	case reflect.Float32, reflect.Float64:
+		return &SexpFloat{Val: v.Float()}, nil
+	case reflect.String:
+		return fillHashHelper(v.String(), depth, env, preferSym)
+	case reflect.Bool:
+		return &SexpBool{Val: v.Bool()}, nil
+	case reflect.Ptr:
+		if v.IsNil() {
+			return SexpNull, nil
+		}
+		if v.Elem().Kind() == reflect.Struct {
+			// not a registered struct.
+			return SexpNull, nil
+		}
+		return fillHashHelper(v.Elem().Interface(), depth+1, env, preferSym)
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return SexpNull, nil
+		}
+		slice := make([]Sexp, v.Len())
+		for i := range slice {
+			sx, err := fillHashHelper(v.Index(i).Interface(), depth+1, env, preferSym)
+			if err != nil {
+				return SexpNull, fmt.Errorf("error in fillHashHelper() call: '%s'", err)
+			}
+			slice[i] = sx
+		}
+		return &SexpArray{Val: slice, Env: env}, nil
+	case reflect.Map:
+		if v.IsNil() {
+			return SexpNull, nil
+		}
+		keys := v.MapKeys()
+		switch v.Type().Key().Kind() {
+		case reflect.String:
+			sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			sort.Slice(keys, func(i, j int) bool { return keys[i].Int() < keys[j].Int() })
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			sort.Slice(keys, func(i, j int) bool { return keys[i].Uint() < keys[j].Uint() })
+		default:
+			return SexpNull, fmt.Errorf("map keys must be strings or integers, not %v", v.Type().Key())
+		}
+		pairs := make([]Sexp, 0, 2*len(keys))
+		for _, k := range keys {
+			var key Sexp
+			if k.Kind() == reflect.String {
+				key = env.MakeSymbol(k.String())
+			} else {
+				key, _ = fillHashReflect(k, depth+1, env, preferSym)
+			}
+			val, err := fillHashHelper(v.MapIndex(k).Interface(), depth+1, env, preferSym)
+			if err != nil {
+				return SexpNull, err
+			}
+			pairs = append(pairs, key, val)
+		}
+		return MakeHash(pairs, "hash", env)
+	}
 	return SexpNull, nil
 }
 
@@ -820,6 +830,12 @@ func (h *SexpHash) nestedPathGetSet(env *Zlisp, dotpaths []string, setVal *Sexp)
 		//P("\n i=%v in nestedPathGet, dotpaths[i][1:]='%v' call to "+
 		//	"HashGet returned '%s'\n", i, dotpaths[i][1:], ret.SexpString(nil))
 		if err != nil {
+			if i == lenpath-1 {
+				// not a field; maybe a Go method, as in (obj.Method args...)
+				if meth := askh.boundGoMethod(env, dotpaths[i][1:]); meth != nil {
+					return meth, nil
+				}
+			}
 			return SexpNull, err
 		}
 		if i == lenpath-1 {
@@ -867,32 +883,26 @@ func (hash *SexpHash) SexpString(ps *PrintState) string {
 	}
 	str := " (" + hash.TypeName + " " + prettyEnd
 
-	for _, key := range hash.KeyOrder {
-		val, err := hash.HashGet(hash.Env, key)
-		if err == nil {
-			switch s := key.(type) {
-			case *SexpStr:
-				str += indInner + s.S + ":"
-			case *SexpSymbol:
-				str += indInner + s.name + ":"
-			default:
-				str += indInner + key.SexpString(innerPs) + ":"
-			}
-			str += val.SexpString(innerPs) + " " + prettyEnd
-
-		} else {
-			// ignore deleted keys
-			// don't panic(err)
+	hash.Each(func(key, val Sexp) bool {
+		switch s := key.(type) {
+		case *SexpStr:
+			str += indInner + s.S + ":"
+		case *SexpSymbol:
+			str += indInner + s.name + ":"
+		default:
+			str += indInner + key.SexpString(innerPs) + ":"
 		}
-	}
-	if len(hash.Map) > 0 {
+		str += val.SexpString(innerPs) + " " + prettyEnd
+		return true
+	})
+	if hash.NumKeys > 0 {
 		return str[:len(str)-1] + ")" + prettyEnd
 	}
 	return str + ")" + prettyEnd
 }
 
 func (r *SexpHash) Type() *RegisteredType {
-	return GoStructRegistry.Registry[r.TypeName]
+	return r.Env.LookupType(r.TypeName)
 }
 
 func compareHash(a *SexpHash, bs Sexp) (int, error) {
@@ -912,10 +922,17 @@ func compareHash(a *SexpHash, bs Sexp) (int, error) {
 	return 0, nil
 }
 
+// CopyMap returns the entries of p grouped by hash code, in the
+// shape the Map field used to have.
+//
+// Deprecated: a SexpHash no longer keeps a Map. Use Keys, Each
+// or HashGet.
 func (p *SexpHash) CopyMap() *map[int][]*SexpPair {
 	cp := make(map[int][]*SexpPair)
-	for k, v := range p.Map {
-		cp[k] = v
+	for _, ent := range p.order {
+		if ent != nil {
+			cp[int(ent.code)] = append(cp[int(ent.code)], Cons(frozenKey(ent.key), ent.val))
+		}
 	}
 	return &cp
 }
@@ -925,11 +942,8 @@ func (p *SexpHash) CopyMap() *map[int][]*SexpPair {
 func (p *SexpHash) CloneFrom(src *SexpHash) {
 
 	p.TypeName = src.TypeName
-	p.Map = *(src.CopyMap())
-
-	p.KeyOrder = src.KeyOrder
+	p.copyEntries(src)
 	p.GoStructFactory = src.GoStructFactory
-	p.NumKeys = src.NumKeys
 	p.GoMethods = src.GoMethods
 	p.GoFields = src.GoFields
 	p.GoMethSx = src.GoMethSx
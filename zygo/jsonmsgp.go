@@ -105,12 +105,12 @@ func (hash *SexpHash) jsonHashHelper() string {
 	str := fmt.Sprintf(`{"Atype":"%s", `, hash.TypeName)
 
 	ko := []string{}
-	n := len(hash.KeyOrder)
+	n := hash.NumKeys
 	if n == 0 {
 		return str[:len(str)-2] + "}"
 	}
 
-	for _, key := range hash.KeyOrder {
+	for _, key := range hash.Keys() {
 		keyst := key.SexpString(nil)
 		ko = append(ko, keyst)
 		val, err := hash.HashGet(nil, key)
@@ -355,8 +355,19 @@ func decodeGoToSexpHelper(r interface{}, depth int, env *Zlisp, preferSym bool)
 
 	default:
 		// do we have a struct for it?
+		rv := reflect.ValueOf(val)
+		if rv.Kind() == reflect.Struct {
+			p := reflect.New(rv.Type())
+			p.Elem().Set(rv)
+			rv = p
+		}
+		if rv.Kind() == reflect.Ptr && !rv.IsNil() && rv.Elem().Kind() == reflect.Struct {
+			if sx, err := fillHashHelper(rv.Interface(), depth, env, preferSym); err == nil && sx != SexpNull {
+				return sx
+			}
+		}
 		nm := fmt.Sprintf("%T", val)
-		rt := GoStructRegistry.Lookup(nm)
+		rt := env.LookupType(nm)
 		if rt == nil {
 			fmt.Printf("unknown type '%s' in type switch, val = %#v.  type = %T.\n", nm, val, val)
 		} else {
@@ -467,20 +478,18 @@ func SexpToGo(sexp Sexp, env *Zlisp, dedup map[*SexpHash]interface{}) (result in
 		}
 
 		m := make(map[string]interface{})
-		for _, arr := range e.Map {
-			for _, pair := range arr {
-				key := SexpToGo(pair.Head, env, dedup)
-				val := SexpToGo(pair.Tail, env, dedup)
-				keyString, isStringKey := key.(string)
-				if !isStringKey {
-					panic(fmt.Errorf("key '%v' should have been a string, but was not.", key))
-				}
-				m[keyString] = val
+		for _, pair := range e.pairs() {
+			key := SexpToGo(pair.Head, env, dedup)
+			val := SexpToGo(pair.Tail, env, dedup)
+			keyString, isStringKey := key.(string)
+			if !isStringKey {
+				panic(fmt.Errorf("key '%v' should have been a string, but was not.", key))
 			}
+			m[keyString] = val
 		}
 		m["Atype"] = e.TypeName
 		ko := make([]interface{}, 0)
-		for _, k := range e.KeyOrder {
+		for _, k := range e.Keys() {
 			ko = append(ko, SexpToGo(k, env, dedup))
 		}
 		m["zKeyOrder"] = ko
@@ -529,7 +538,8 @@ func ToGoFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 		} else {
 			//P("ToGo: tn '%s' does not have GoShadowStruct set, making a new one", tn)
 
-			factory, hasMaker := GoStructRegistry.Registry[tn]
+			factory := env.LookupType(tn)
+			hasMaker := factory != nil
 			if !hasMaker {
 				return SexpNull, fmt.Errorf("type '%s' not registered in GoStructRegistry", tn)
 			}
@@ -539,6 +549,11 @@ func ToGoFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 			}
 		}
 
+		// required fields and types, named by their full path.
+		err = asHash.checkFields(tn, make(map[*SexpHash]bool))
+		if err != nil {
+			return SexpNull, err
+		}
 		_, err = SexpToGoStructs(asHash, newStruct, env, nil)
 		if err != nil {
 			return SexpNull, err
@@ -593,6 +608,52 @@ func GoonDumpFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
 	return SexpNull, nil
 }
 
+// sexpToGoAny converts sexp to the plain Go value an interface{}
+// should hold: records of a registered type become their Go
+// structs, other hashes map[string]interface{}, and arrays
+// []interface{}, recursively.
+func sexpToGoAny(sexp Sexp, env *Zlisp, dedup map[*SexpHash]interface{}) interface{} {
+	if dedup == nil {
+		dedup = make(map[*SexpHash]interface{})
+	}
+	switch e := sexp.(type) {
+	case *SexpSentinel:
+		return nil
+	case *SexpTime:
+		return e.Tm
+	case *SexpReflect:
+		return e.Val.Interface()
+	case *SexpArray:
+		ar := make([]interface{}, len(e.Val))
+		for i, ele := range e.Val {
+			ar[i] = sexpToGoAny(ele, env, dedup)
+		}
+		return ar
+	case *SexpHash:
+		if already, ok := dedup[e]; ok {
+			return already
+		}
+		if e.TypeName != "hash" {
+			if rt := env.LookupType(e.TypeName); rt != nil {
+				st, err := rt.Factory(env, e)
+				if err == nil && IsExactlySinglePointer(st) {
+					_, err = SexpToGoStructs(e, st, env, dedup)
+					panicOn(err)
+					return st
+				}
+			}
+		}
+		m := make(map[string]interface{}, e.NumKeys)
+		for _, pair := range e.pairs() {
+			key := sexpToGoAny(pair.Head, env, dedup)
+			m[fmt.Sprint(key)] = sexpToGoAny(pair.Tail, env, dedup)
+		}
+		dedup[e] = m
+		return m
+	}
+	return SexpToGo(sexp, env, dedup)
+}
+
 // try to convert to registered go structs if possible,
 // filling in the structure of target (should be a pointer).
 func SexpToGoStructs(
@@ -603,6 +664,16 @@ func SexpToGoStructs(
 
 ) (result interface{}, err error) {
 	Q("top of SexpToGoStructs")
+	if tv := reflect.ValueOf(target); tv.Kind() == reflect.Ptr &&
+		tv.Type().Elem().Kind() == reflect.Interface && tv.Type().Elem().NumMethod() == 0 {
+		// an interface{} can hold anything: give it plain Go values.
+		if v := sexpToGoAny(sexp, env, dedup); v != nil {
+			tv.Elem().Set(reflect.ValueOf(v))
+		} else {
+			tv.Elem().Set(reflect.Zero(tv.Type().Elem()))
+		}
+		return target, nil
+	}
 	cacheHit := false
 	if dedup == nil {
 		dedup = make(map[*SexpHash]interface{})
@@ -670,6 +741,18 @@ func SexpToGoStructs(
 		if targElemKind != reflect.Array && targElemKind != reflect.Slice {
 			panic(fmt.Errorf("tried to translate from SexpArray into non-array/type: %v", targKind))
 		}
+		if targElemKind == reflect.Array {
+			// fixed size: fill in place.
+			if len(src.Val) > targElemTyp.Len() {
+				panic(fmt.Errorf("%d elements will not fit in %v", len(src.Val), targElemTyp))
+			}
+			for i, ele := range src.Val {
+				if _, err := SexpToGoStructs(ele, targVa.Elem().Index(i).Addr().Interface(), env, dedup); err != nil {
+					return nil, err
+				}
+			}
+			break
+		}
 		// allocate the slice
 		n := len(src.Val)
 		slc := reflect.MakeSlice(targElemTyp, 0, n)
@@ -695,24 +778,33 @@ func SexpToGoStructs(
 		// ugorji msgpack will give us int64 not int,
 		// so match that to make the decodings comparable.
 		//P("*SexpInt code src.Val='%#v'.. targVa.Elem()='%#v'/Type: %T", src.Val, targVa.Elem().Interface(), targVa.Elem().Interface())
-		switch targVa.Elem().Interface().(type) {
-		case float64:
+		switch targElemKind {
+		case reflect.Float32, reflect.Float64:
 			targVa.Elem().SetFloat(float64(src.Val))
-		case int64:
-			targVa.Elem().SetInt(int64(src.Val))
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			targVa.Elem().SetUint(uint64(src.Val))
 		default:
 			targVa.Elem().SetInt(int64(src.Val))
 		}
 	case *SexpStr:
+		if targElemTyp == durationType {
+			// durations may be written as "1m30s", too.
+			d, err := time.ParseDuration(src.S)
+			if err != nil {
+				panic(err)
+			}
+			targVa.Elem().SetInt(int64(d))
+			break
+		}
 		targVa.Elem().SetString(src.S)
 	case *SexpChar:
 		targVa.Elem().Set(reflect.ValueOf(rune(src.Val)))
 	case *SexpFloat:
-		switch targVa.Elem().Interface().(type) {
-		case int64:
+		switch targElemKind {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
 			targVa.Elem().SetInt(int64(src.Val))
-		case float64:
-			targVa.Elem().SetFloat(float64(src.Val))
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			targVa.Elem().SetUint(uint64(src.Val))
 		default:
 			targVa.Elem().SetFloat(float64(src.Val))
 		}
@@ -733,58 +825,23 @@ func SexpToGoStructs(
 		tn := src.TypeName
 		Q("tn='%s', target.(type) == %T", tn, target)
 		if tn == "hash" {
-			//  not done with 'hash' translation to Go, targTyp.Elem().Kind()='map', targTyp.Elem()='map[string]float64'
-			//P(fmt.Sprintf("not done with 'hash' translation to Go, targTyp.Elem().Kind()='%v', targTyp.Elem()='%v'", targTyp.Elem().Kind(), targTyp.Elem()))
-			switch target.(type) {
-			case *map[string]string:
-				m := make(map[string]string)
-				for _, arr := range src.Map {
-					for _, pair := range arr {
-						key := SexpToGo(pair.Head, env, dedup)
-						val := SexpToGo(pair.Tail, env, dedup)
-						keys, isstr := key.(string)
-						if !isstr {
-							panic(fmt.Errorf("key '%v' should have been an string, but was not.", key))
-						}
-						vals, isstr := val.(string)
-						if !isstr {
-							panic(fmt.Errorf("val '%v' should have been an string, but was not.", val))
-						}
-						m[keys] = vals
-					}
+			if targElemKind != reflect.Map {
+				panic(fmt.Errorf("tried to translate from hash into non-map type: %v", targElemTyp))
+			}
+			m := reflect.MakeMapWithSize(targElemTyp, src.NumKeys)
+			for _, pair := range src.pairs() {
+				key := reflect.New(targElemTyp.Key())
+				if _, err := SexpToGoStructs(pair.Head, key.Interface(), env, dedup); err != nil {
+					return nil, err
 				}
-				targVa.Elem().Set(reflect.ValueOf(m))
-				return target, nil
-
-			case *map[int64]float64:
-				//P("target is a map[int64]float64")
-
-				m := make(map[int64]float64)
-				for _, arr := range src.Map {
-					for _, pair := range arr {
-						key := SexpToGo(pair.Head, env, dedup)
-						val := SexpToGo(pair.Tail, env, dedup)
-						keyint64, isint64Key := key.(int64)
-						if !isint64Key {
-							panic(fmt.Errorf("key '%v' should have been an int64, but was not.", key))
-						}
-						switch x := val.(type) {
-						case float64:
-							m[keyint64] = x
-						case int64:
-							m[keyint64] = float64(x)
-						default:
-							panic(fmt.Errorf("val '%v' should have been an float64, but was not.", val))
-						}
-					}
+				val := reflect.New(targElemTyp.Elem())
+				if _, err := SexpToGoStructs(pair.Tail, val.Interface(), env, dedup); err != nil {
+					return nil, err
 				}
-				targVa.Elem().Set(reflect.ValueOf(m))
-				return target, nil
+				m.SetMapIndex(key.Elem(), val.Elem())
 			}
-			panic("not done here yet")
-			// TODO: don't try to translate into a Go struct,
-			// but instead... what? just a map[string]interface{}
-			//return nil, nil
+			targVa.Elem().Set(m)
+			return target, nil
 		}
 
 		switch targTyp.Elem().Kind() {
@@ -800,7 +857,8 @@ func SexpToGoStructs(
 		}
 
 		// use targVa, but check against the type in the registry for sanity/type checking.
-		factory, hasMaker := GoStructRegistry.Registry[tn]
+		factory := env.LookupType(tn)
+		hasMaker := factory != nil
 		if !hasMaker {
 			panic(fmt.Errorf("type '%s' not registered in GoStructRegistry", tn))
 			//return nil, fmt.Errorf("type '%s' not registered in GoStructRegistry", tn)
@@ -854,71 +912,73 @@ func SexpToGoStructs(
 			panic(fmt.Errorf("type checking failed compare the factor associated with SexpHash and the provided target *T: expected '%s' (associated with typename '%s' in the GoStructRegistry) but saw '%s' type in target", tn, factType, targTyp))
 		}
 		//maploop:
-		for _, arr := range src.Map {
-			for _, pair := range arr {
-				recordKey = ""
-				switch k := pair.Head.(type) {
-				case *SexpStr:
-					recordKey = k.S
-				case *SexpSymbol:
-					recordKey = k.name
-				default:
-					fmt.Printf(" skipping field '%#v' which we don't know how to lookup.", pair.Head)
-					panic(fmt.Sprintf("unknown fields disallowed: we didn't recognize '%#v'", pair.Head))
-					continue
-				}
-				// We've got to match pair.Head to
-				// one of the struct fields: we'll use
-				// the json tags for that. Or their
-				// full exact name if they didn't have
-				// a json tag.
-				Q(" JsonTagMap = %#v", src.JsonTagMap)
-				det, found := src.JsonTagMap[recordKey]
+		for _, pair := range src.pairs() {
+			recordKey = ""
+			switch k := pair.Head.(type) {
+			case *SexpStr:
+				recordKey = k.S
+			case *SexpSymbol:
+				recordKey = k.name
+			default:
+				fmt.Printf(" skipping field '%#v' which we don't know how to lookup.", pair.Head)
+				panic(fmt.Sprintf("unknown fields disallowed: we didn't recognize '%#v'", pair.Head))
+				continue
+			}
+			// We've got to match pair.Head to
+			// one of the struct fields: we'll use
+			// the json tags for that. Or their
+			// full exact name if they didn't have
+			// a json tag.
+			Q(" JsonTagMap = %#v", src.JsonTagMap)
+			det, found := src.JsonTagMap[recordKey]
+			if !found {
+				// try once more, with uppercased version
+				// of record key
+				upperKey := strings.ToUpper(recordKey[:1]) + recordKey[1:]
+				det, found = src.JsonTagMap[upperKey]
 				if !found {
-					// try once more, with uppercased version
-					// of record key
-					upperKey := strings.ToUpper(recordKey[:1]) + recordKey[1:]
-					det, found = src.JsonTagMap[upperKey]
-					if !found {
-						fmt.Printf(" skipping field '%s' in this hash/which we could not find in the JsonTagMap", recordKey)
-						panic(fmt.Sprintf("unkown field '%s' not allowed; could not find in the JsonTagMap. Fieldnames are case sensitive.", recordKey))
-						continue
-					}
-				}
-				Q(" ****  recordKey = '%s'\n", recordKey)
-				Q(" we found in pair.Tail: %T !", pair.Tail)
-
-				dref := targVa.Elem()
-				Q(" deref = %#v / type %T", dref, dref)
-
-				Q(" det = %#v", det)
-
-				// fld should hold our target when
-				// done recursing through any embedded structs.
-				// TODO: handle embedded pointers to structs too.
-				var fld reflect.Value
-				Q(" we have an det.EmbedPath of '%#v'", det.EmbedPath)
-				// drill down to the actual target
-				fld = dref
-				for i, p := range det.EmbedPath {
-					Q("about to call fld.Field(%d) on fld = '%#v'/type=%T", p.ChildFieldNum, fld, fld)
-					fld = fld.Field(p.ChildFieldNum)
-					Q(" dropping down i=%d through EmbedPath at '%s', fld = %#v ", i, p.ChildName, fld)
+					fmt.Printf(" skipping field '%s' in this hash/which we could not find in the JsonTagMap", recordKey)
+					panic(fmt.Sprintf("unkown field '%s' not allowed; could not find in the JsonTagMap. Fieldnames are case sensitive.", recordKey))
+					continue
 				}
-				Q(" fld = %#v ", fld)
+			}
+			Q(" ****  recordKey = '%s'\n", recordKey)
+			Q(" we found in pair.Tail: %T !", pair.Tail)
+
+			dref := targVa.Elem()
+			Q(" deref = %#v / type %T", dref, dref)
+
+			Q(" det = %#v", det)
+
+			// fld should hold our target when
+			// done recursing through any embedded structs.
+			// TODO: handle embedded pointers to structs too.
+			var fld reflect.Value
+			Q(" we have an det.EmbedPath of '%#v'", det.EmbedPath)
+			// drill down to the actual target
+			fld = dref
+			for i, p := range det.EmbedPath {
+				Q("about to call fld.Field(%d) on fld = '%#v'/type=%T", p.ChildFieldNum, fld, fld)
+				fld = fld.Field(p.ChildFieldNum)
+				Q(" dropping down i=%d through EmbedPath at '%s', fld = %#v ", i, p.ChildName, fld)
+			}
+			Q(" fld = %#v ", fld)
 
-				// INVAR: fld points at our target to fill
-				ptrFld := fld.Addr()
-				tmp, needed := unexportHelper(&ptrFld, &fld)
-				if needed {
-					ptrFld = *tmp
-				}
-				_, err := SexpToGoStructs(pair.Tail, ptrFld.Interface(), env, dedup)
-				if err != nil {
-					panic(err)
-					//return nil, err
-				}
+			// INVAR: fld points at our target to fill
+			ptrFld := fld.Addr()
+			tmp, needed := unexportHelper(&ptrFld, &fld)
+			if needed {
+				ptrFld = *tmp
 			}
+			_, err := SexpToGoStructs(pair.Tail, ptrFld.Interface(), env, dedup)
+			if err != nil {
+				panic(err)
+				//return nil, err
+			}
+		}
+		recordKey = ""
+		if err := src.fillDefaults(env, targVa); err != nil {
+			panic(err)
 		}
 	case *SexpPair:
 		panic("unimplemented")
@@ -58,9 +58,9 @@ type Event struct {
 		panicOn(err)
 		sexp, err := GoToSexp(iface, env)
 		panicOn(err)
-		// must get into same order to have sane comparison, so borrow the KeyOrder to be sure.
+		// must get into same order to have sane comparison, so take the key order from x to be sure.
 		hhh := sexp.(*SexpHash)
-		hhh.KeyOrder = x.(*SexpHash).KeyOrder
+		panicOn(SetHashKeyOrder(hhh, &SexpArray{Val: x.(*SexpHash).Keys(), Env: env}))
 		sexpStr := sexp.SexpString(nil)
 		expectedSexpr := ` (eventdemo id:123 user: (persondemo first:"Liz" last:"C") flight:"AZD234" pilot:["Roger" "Ernie"] cancelled:true)`
 		cv.So(sexpStr, cv.ShouldResemble, expectedSexpr)
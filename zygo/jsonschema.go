@@ -0,0 +1,609 @@
+package zygo
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+)
+
+// JSON Schema export and import
+// =============================
+//
+// (jsonschema Car) gives a JSON Schema document for the struct
+// type Car, with the structs it refers to under $defs. Fields of
+// a (struct ...) are required if declared with required:true;
+// those of a Go struct if its zygo tag says so (see structtag.go)
+// and its json tag does not say omitempty.
+//
+// (unjsonschema "car.schema.json") declares a struct for each
+// object schema in the file's $defs, and for the document itself
+// if it describes an object, named by its title or the optional
+// second argument. Nested object schemas become structs too.
+
+const jsonSchemaDialect = "https://json-schema.org/draft/2020-12/schema"
+
+// jsonObj is a JSON object that keeps its keys in the order set.
+type jsonObj struct {
+	keys []string
+	vals map[string]interface{}
+}
+
+func newJsonObj(kv ...interface{}) *jsonObj {
+	o := &jsonObj{vals: make(map[string]interface{})}
+	for i := 0; i+1 < len(kv); i += 2 {
+		o.set(kv[i].(string), kv[i+1])
+	}
+	return o
+}
+
+func (o *jsonObj) set(key string, val interface{}) {
+	if _, already := o.vals[key]; !already {
+		o.keys = append(o.keys, key)
+	}
+	o.vals[key] = val
+}
+
+func (o *jsonObj) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, k := range o.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		kb, _ := json.Marshal(k)
+		buf.Write(kb)
+		buf.WriteByte(':')
+		vb, err := json.Marshal(o.vals[k])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(vb)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+type schemaGen struct {
+	env  *Zlisp
+	defs *jsonObj
+}
+
+// JSONSchema returns a JSON Schema document describing the
+// records of type rt, a (struct ...) or a registered Go struct.
+func (env *Zlisp) JSONSchema(rt *RegisteredType) ([]byte, error) {
+	g := &schemaGen{env: env, defs: newJsonObj()}
+	root, err := g.typeSchema(rt)
+	if err != nil {
+		return nil, err
+	}
+	doc := newJsonObj("$schema", jsonSchemaDialect)
+	for _, k := range root.keys {
+		doc.set(k, root.vals[k])
+	}
+	if len(g.defs.keys) > 0 {
+		doc.set("$defs", g.defs)
+	}
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+func schemaRef(name string) *jsonObj {
+	return newJsonObj("$ref", "#/$defs/"+name)
+}
+
+func (g *schemaGen) typeSchema(rt *RegisteredType) (*jsonObj, error) {
+	if rt == nil {
+		return newJsonObj(), nil
+	}
+	if rt.hasShadowStruct && rt.TypeCache != nil {
+		return g.goSchema(rt.TypeCache), nil
+	}
+	if rt.UserStructDefn != nil {
+		return g.recordSchema(rt.UserStructDefn)
+	}
+	name := rt.RegisteredName
+	switch {
+	case name == "[]":
+		return newJsonObj("type", "array"), nil
+	case strings.HasPrefix(name, "[]"), strings.HasPrefix(name, "*"):
+		elemName := strings.TrimPrefix(strings.TrimPrefix(name, "[]"), "*")
+		elem := g.env.LookupType(elemName)
+		if elem == nil {
+			return nil, fmt.Errorf("unknown type '%s'", elemName)
+		}
+		items, err := g.typeSchema(elem)
+		if err != nil || name[0] == '*' {
+			// a pointer is described by what it points to.
+			return items, err
+		}
+		return newJsonObj("type", "array", "items", items), nil
+	}
+	switch name {
+	case "int", "int8", "int16", "int32", "int64", "rune",
+		"uint8", "uint16", "uint32", "uint64", "byte":
+		return newJsonObj("type", "integer"), nil
+	case "float32", "float64":
+		return newJsonObj("type", "number"), nil
+	case "string":
+		return newJsonObj("type", "string"), nil
+	case "bool":
+		return newJsonObj("type", "boolean"), nil
+	case "time.Time":
+		return newJsonObj("type", "string", "format", "date-time"), nil
+	case "hash":
+		return newJsonObj("type", "object"), nil
+	}
+	return newJsonObj(), nil
+}
+
+// recordSchema defines a (struct ...) under $defs and refers to it.
+func (g *schemaGen) recordSchema(defn *RecordDefn) (*jsonObj, error) {
+	if _, done := g.defs.vals[defn.Name]; done {
+		return schemaRef(defn.Name), nil
+	}
+	def := newJsonObj("type", "object")
+	g.defs.set(defn.Name, def) // first, as a struct may refer to itself.
+	props := newJsonObj()
+	var required []string
+	for _, f := range defn.Fields {
+		fh := (*SexpHash)(f)
+		if fh.NumKeys == 0 {
+			continue
+		}
+		name := fh.Keys()[0].(*SexpSymbol).name
+		ps, err := g.typeSchema(defn.FieldType[name])
+		if err != nil {
+			return nil, fmt.Errorf("struct %s field %s: %s", defn.Name, name, err)
+		}
+		if d, err := fh.HashGet(nil, g.env.MakeSymbol("deprecated")); err == nil && IsTruthy(d) {
+			ps.set("deprecated", true)
+		}
+		props.set(name, ps)
+		if r, err := fh.HashGet(nil, g.env.MakeSymbol("required")); err == nil && IsTruthy(r) {
+			required = append(required, name)
+		}
+	}
+	def.set("properties", props)
+	if len(required) > 0 {
+		def.set("required", required)
+	}
+	def.set("additionalProperties", false)
+	return schemaRef(defn.Name), nil
+}
+
+// goSchema describes values of Go type t, as togo and fromgo
+// convert them.
+func (g *schemaGen) goSchema(t reflect.Type) *jsonObj {
+	switch t {
+	case timeType:
+		return newJsonObj("type", "string", "format", "date-time")
+	case durationType:
+		return newJsonObj("type", "integer")
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return g.goSchema(t.Elem())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return newJsonObj("type", "integer")
+	case reflect.Float32, reflect.Float64:
+		return newJsonObj("type", "number")
+	case reflect.String:
+		return newJsonObj("type", "string")
+	case reflect.Bool:
+		return newJsonObj("type", "boolean")
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return newJsonObj("type", "string", "contentEncoding", "base64")
+		}
+		return newJsonObj("type", "array", "items", g.goSchema(t.Elem()))
+	case reflect.Map:
+		return newJsonObj("type", "object", "additionalProperties", g.goSchema(t.Elem()))
+	case reflect.Struct:
+		name := t.Name()
+		if rt := g.env.goTypeOf(reflect.PtrTo(t)); rt != nil {
+			name = rt.RegisteredName
+		}
+		if name == "" {
+			def := newJsonObj("type", "object")
+			g.goFields(def, t)
+			return def
+		}
+		if _, done := g.defs.vals[name]; !done {
+			def := newJsonObj("type", "object")
+			g.defs.set(name, def)
+			g.goFields(def, t)
+		}
+		return schemaRef(name)
+	}
+	return newJsonObj()
+}
+
+func (g *schemaGen) goFields(def *jsonObj, t reflect.Type) {
+	props := newJsonObj()
+	var required []string
+	var addFields func(t reflect.Type)
+	addFields = func(t reflect.Type) {
+		var embedded []reflect.Type
+		for i := 0; i < t.NumField(); i++ {
+			fld := t.Field(i)
+			tag := parseFieldTag(fld)
+			if tag.Skip {
+				continue
+			}
+			if fld.Anonymous {
+				et := fld.Type
+				if et.Kind() == reflect.Ptr {
+					et = et.Elem()
+				}
+				// as encoding/json, promote the fields of an
+				// embedded struct its json tag does not name.
+				jsonName := strings.Split(fld.Tag.Get("json"), ",")[0]
+				if et.Kind() == reflect.Struct && jsonName == "" {
+					embedded = append(embedded, et)
+					continue
+				}
+			}
+			if fld.PkgPath != "" {
+				continue
+			}
+			if _, already := props.vals[tag.Key]; already {
+				continue
+			}
+			ps := g.goSchema(fld.Type)
+			if tag.HasDefault {
+				ps.set("default", tag.Default)
+			}
+			props.set(tag.Key, ps)
+			// encoding/json leaves omitempty fields out when
+			// they are zero, so a document may lack them.
+			if tag.Required && !tag.OmitEmpty {
+				required = append(required, tag.Key)
+			}
+		}
+		// outer fields take precedence over promoted ones.
+		for _, et := range embedded {
+			addFields(et)
+		}
+	}
+	addFields(t)
+	def.set("properties", props)
+	if len(required) > 0 {
+		def.set("required", required)
+	}
+	def.set("additionalProperties", false)
+}
+
+// DeclareJSONSchema declares in env a struct for each object
+// schema in the JSON Schema document schema: its $defs (or
+// definitions), and the document itself if it is one, named
+// name, or by its title. Structs may refer to each other.
+// It returns the types declared, in order.
+func (env *Zlisp) DeclareJSONSchema(schema []byte, name string) ([]*RegisteredType, error) {
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(schema, &doc); err != nil {
+		return nil, fmt.Errorf("bad JSON Schema: %s", err)
+	}
+	d := &schemaDecl{env: env, raw: make(map[string]json.RawMessage), types: make(map[string]*RegisteredType)}
+	for _, defsKey := range []string{"$defs", "definitions"} {
+		if defs, ok := doc[defsKey]; ok {
+			names, err := orderedKeys(defs)
+			if err != nil {
+				return nil, err
+			}
+			var m map[string]json.RawMessage
+			if err := json.Unmarshal(defs, &m); err != nil {
+				return nil, err
+			}
+			for _, n := range names {
+				d.add(n, m[n])
+			}
+		}
+	}
+	var root schemaNode
+	if err := json.Unmarshal(schema, &root); err != nil {
+		return nil, err
+	}
+	if root.isObject() {
+		if name == "" {
+			name = root.Title
+		}
+		if name == "" {
+			return nil, fmt.Errorf("the schema describes an object, but has no title to name its struct by")
+		}
+		d.add(name, schema)
+	}
+
+	// declare them all, then fill them in, so that
+	// they can refer to each other in any order.
+	for i := 0; i < len(d.order); i++ {
+		if err := d.fill(d.order[i]); err != nil {
+			return nil, err
+		}
+	}
+	var declared []*RegisteredType
+	for _, n := range d.order {
+		declared = append(declared, d.types[n])
+	}
+	return declared, nil
+}
+
+type schemaNode struct {
+	Ref        string          `json:"$ref"`
+	Title      string          `json:"title"`
+	Type       interface{}     `json:"type"`
+	Items      *schemaNode     `json:"items"`
+	Properties json.RawMessage `json:"properties"`
+	Required   []string        `json:"required"`
+	AnyOf      []*schemaNode   `json:"anyOf"`
+	OneOf      []*schemaNode   `json:"oneOf"`
+	Deprecated bool            `json:"deprecated"`
+}
+
+// types lists the JSON types n allows, null aside.
+func (n *schemaNode) types() []string {
+	var ts []string
+	switch t := n.Type.(type) {
+	case string:
+		ts = append(ts, t)
+	case []interface{}:
+		for _, x := range t {
+			if s, ok := x.(string); ok {
+				ts = append(ts, s)
+			}
+		}
+	}
+	var nonNull []string
+	for _, t := range ts {
+		if t != "null" {
+			nonNull = append(nonNull, t)
+		}
+	}
+	return nonNull
+}
+
+func (n *schemaNode) isObject() bool {
+	ts := n.types()
+	return len(n.Properties) > 0 && (len(ts) == 0 || (len(ts) == 1 && ts[0] == "object"))
+}
+
+type schemaDecl struct {
+	env   *Zlisp
+	order []string
+	raw   map[string]json.RawMessage
+	types map[string]*RegisteredType
+}
+
+// add declares an empty struct name, to be filled in from raw.
+func (d *schemaDecl) add(name string, raw json.RawMessage) {
+	if _, dup := d.types[name]; dup {
+		return
+	}
+	uds := NewRecordDefn()
+	uds.env = d.env
+	uds.SetName(name)
+	rt := NewRegisteredType(func(env *Zlisp, h *SexpHash) (interface{}, error) {
+		return uds, nil
+	})
+	rt.UserStructDefn = uds
+	rt.DisplayAs = name
+	d.env.RegisterUserdef(rt, false, name)
+
+	d.order = append(d.order, name)
+	d.raw[name] = raw
+	d.types[name] = d.env.LookupType(name)
+}
+
+func (d *schemaDecl) fill(name string) error {
+	var n schemaNode
+	if err := json.Unmarshal(d.raw[name], &n); err != nil {
+		return fmt.Errorf("schema for %s: %s", name, err)
+	}
+	props, err := orderedKeys(n.Properties)
+	if err != nil {
+		return fmt.Errorf("schema for %s: %s", name, err)
+	}
+	var m map[string]json.RawMessage
+	if len(n.Properties) > 0 {
+		if err := json.Unmarshal(n.Properties, &m); err != nil {
+			return err
+		}
+	}
+	required := make(map[string]bool)
+	for _, r := range n.Required {
+		required[r] = true
+	}
+	var flds []*SexpField
+	for _, p := range props {
+		var pn schemaNode
+		if err := json.Unmarshal(m[p], &pn); err != nil {
+			return fmt.Errorf("schema for %s.%s: %s", name, p, err)
+		}
+		rt, err := d.fieldType(name, p, &pn, m[p])
+		if err != nil {
+			return fmt.Errorf("schema for %s.%s: %s", name, p, err)
+		}
+		var typ Sexp = SexpNull
+		if rt != nil {
+			typ = rt
+		}
+		pairs := []Sexp{d.env.MakeSymbol(p), typ}
+		if required[p] {
+			pairs = append(pairs, d.env.MakeSymbol("required"), &SexpBool{Val: true})
+		}
+		if pn.Deprecated {
+			pairs = append(pairs, d.env.MakeSymbol("deprecated"), &SexpBool{Val: true})
+		}
+		h, err := MakeHash(pairs, "field", d.env)
+		if err != nil {
+			return err
+		}
+		flds = append(flds, (*SexpField)(h))
+	}
+	// fill in place: fields declared earlier refer to this very type.
+	uds := d.types[name].UserStructDefn
+	uds.Fields = flds
+	for _, f := range flds {
+		g := (*SexpHash)(f)
+		key := g.Keys()[0]
+		t, _ := g.HashGet(nil, key)
+		rt, _ := t.(*RegisteredType)
+		uds.FieldType[key.(*SexpSymbol).name] = rt
+	}
+	return nil
+}
+
+// fieldType gives the type of field prop of struct owner, as
+// schema n describes it; nil for one that allows any value.
+func (d *schemaDecl) fieldType(owner, prop string, n *schemaNode, raw json.RawMessage) (*RegisteredType, error) {
+	if n.Ref != "" {
+		for _, prefix := range []string{"#/$defs/", "#/definitions/"} {
+			if strings.HasPrefix(n.Ref, prefix) {
+				if rt := d.types[n.Ref[len(prefix):]]; rt != nil {
+					return rt, nil
+				}
+			}
+		}
+		return nil, fmt.Errorf("cannot resolve $ref '%s'", n.Ref)
+	}
+	alts := append(n.AnyOf, n.OneOf...)
+	if len(alts) > 0 {
+		var only *schemaNode
+		for _, a := range alts {
+			if ts := a.types(); len(ts) == 0 && a.Ref == "" {
+				continue // null, or anything
+			}
+			if only != nil {
+				return nil, nil // a union: anything goes.
+			}
+			only = a
+		}
+		if only == nil {
+			return nil, nil
+		}
+		return d.fieldType(owner, prop, only, nil)
+	}
+	if n.isObject() && raw != nil {
+		// nested object: a struct of its own.
+		name := owner + goExportedName(prop)
+		if n.Title != "" {
+			name = n.Title
+		}
+		d.add(name, raw)
+		return d.types[name], nil
+	}
+	ts := n.types()
+	if len(ts) != 1 {
+		return nil, nil
+	}
+	switch ts[0] {
+	case "integer":
+		return d.env.LookupType("int64"), nil
+	case "number":
+		return d.env.LookupType("float64"), nil
+	case "string":
+		return d.env.LookupType("string"), nil
+	case "boolean":
+		return d.env.LookupType("bool"), nil
+	case "array":
+		if n.Items == nil {
+			return nil, nil
+		}
+		itemsRaw, _ := json.Marshal(n.Items)
+		if n.Items.isObject() {
+			// keep the properties' order.
+			var whole map[string]json.RawMessage
+			json.Unmarshal(raw, &whole)
+			itemsRaw = whole["items"]
+		}
+		elem, err := d.fieldType(owner, prop, n.Items, itemsRaw)
+		if err != nil || elem == nil {
+			return nil, err
+		}
+		return d.env.TypeRegistry().GetOrCreateSliceType(elem), nil
+	}
+	// objects without properties are hashes, which
+	// records do not type.
+	return nil, nil
+}
+
+// orderedKeys lists the keys of the JSON object raw in the
+// order they appear.
+func orderedKeys(raw json.RawMessage) ([]string, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return nil, fmt.Errorf("expected a JSON object")
+	}
+	var keys []string
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, t.(string))
+		var skip json.RawMessage
+		if err := dec.Decode(&skip); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// JsonSchemaFunction implements (jsonschema Type), and
+// (unjsonschema "path.json" [name]), which returns the names
+// of the structs declared.
+func JsonSchemaFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
+	switch name {
+	case "jsonschema":
+		if len(args) != 1 {
+			return SexpNull, WrongNargs
+		}
+		rt, isType := args[0].(*RegisteredType)
+		if !isType {
+			return SexpNull, fmt.Errorf("%s needs a type, not %T", name, args[0])
+		}
+		doc, err := env.JSONSchema(rt)
+		if err != nil {
+			return SexpNull, fmt.Errorf("%s: %s", name, err)
+		}
+		return &SexpStr{S: string(doc)}, nil
+	}
+
+	if len(args) < 1 || len(args) > 2 {
+		return SexpNull, WrongNargs
+	}
+	path, isStr := args[0].(*SexpStr)
+	if !isStr {
+		return SexpNull, fmt.Errorf("%s needs the path of a JSON Schema file, not %T", name, args[0])
+	}
+	rootName := ""
+	if len(args) == 2 {
+		switch x := args[1].(type) {
+		case *SexpStr:
+			rootName = x.S
+		case *SexpSymbol:
+			rootName = x.name
+		default:
+			return SexpNull, fmt.Errorf("%s: struct name must be a string or symbol", name)
+		}
+	}
+	data, err := ioutil.ReadFile(path.S)
+	if err != nil {
+		return SexpNull, err
+	}
+	declared, err := env.DeclareJSONSchema(data, rootName)
+	if err != nil {
+		return SexpNull, fmt.Errorf("%s: %s", name, err)
+	}
+	// names, not the types, which print their whole definition.
+	r := make([]Sexp, len(declared))
+	for i, rt := range declared {
+		r[i] = env.MakeSymbol(rt.ShortName())
+	}
+	return env.NewSexpArray(r), nil
+}
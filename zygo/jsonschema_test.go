@@ -0,0 +1,192 @@
+package zygo
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+type Base415 struct {
+	Id int `json:"id,omitempty"`
+}
+
+type Agent415 struct {
+	Base415 `json:",omitempty"`
+	Name    string `json:"name,omitempty" zygo:",required"`
+	Zone    string `json:"zone" zygo:",required"`
+	Token   string `json:"-"`
+}
+
+func Test415JsonSchemaExportAndImport(t *testing.T) {
+
+	cv.Convey(`(jsonschema T) should describe struct T and the structs it refers to, and (unjsonschema file) should declare structs from a schema`, t, func() {
+		env := NewZlisp()
+		defer env.Stop()
+		env.StandardSetup()
+
+		x, err := env.EvalString(`
+(struct Wheel [(field size: float64)])
+(struct Truck [
+  (field plate:  string       required:true)
+  (field axles:  int64)
+  (field wheels: ([]Wheel))
+  (field tow:    (* Truck))
+  (field old:    bool         deprecated:true)
+])
+(jsonschema Truck)
+`)
+		panicOn(err)
+		cv.So(x.(*SexpStr).S, cv.ShouldEqual, `{
+  "$schema": "https://json-schema.org/draft/2020-12/schema",
+  "$ref": "#/$defs/Truck",
+  "$defs": {
+    "Truck": {
+      "type": "object",
+      "properties": {
+        "plate": {
+          "type": "string"
+        },
+        "axles": {
+          "type": "integer"
+        },
+        "wheels": {
+          "type": "array",
+          "items": {
+            "$ref": "#/$defs/Wheel"
+          }
+        },
+        "tow": {
+          "$ref": "#/$defs/Truck"
+        },
+        "old": {
+          "type": "boolean",
+          "deprecated": true
+        }
+      },
+      "required": [
+        "plate"
+      ],
+      "additionalProperties": false
+    },
+    "Wheel": {
+      "type": "object",
+      "properties": {
+        "size": {
+          "type": "number"
+        }
+      },
+      "additionalProperties": false
+    }
+  }
+}`)
+
+		// Go structs: fields keyed, and required, as their tags say.
+		rt, err := env.RegisterGoType("server415", Server413{})
+		panicOn(err)
+		doc, err := env.JSONSchema(rt)
+		panicOn(err)
+		var schema struct {
+			Ref  string `json:"$ref"`
+			Defs map[string]struct {
+				Properties map[string]map[string]interface{}
+				Required   []string
+			} `json:"$defs"`
+		}
+		panicOn(json.Unmarshal(doc, &schema))
+		cv.So(schema.Ref, cv.ShouldEqual, "#/$defs/server415")
+		server := schema.Defs["server415"]
+		cv.So(server.Required, cv.ShouldResemble, []string{"host"})
+		cv.So(server.Properties["port"]["default"], cv.ShouldEqual, "8080")
+		cv.So(server.Properties["timeout"]["type"], cv.ShouldEqual, "integer")
+		_, hasSecret := server.Properties["secret"]
+		cv.So(hasSecret, cv.ShouldBeFalse)
+		cv.So(server.Properties["admin"]["$ref"], cv.ShouldStartWith, "#/$defs/")
+
+		// json tag options are not part of the names, and
+		// omitempty fields may be missing.
+		rt, err = env.RegisterGoType("agent415", Agent415{})
+		panicOn(err)
+		doc, err = env.JSONSchema(rt)
+		panicOn(err)
+		panicOn(json.Unmarshal(doc, &schema))
+		agent := schema.Defs["agent415"]
+		var props []string
+		for p := range agent.Properties {
+			props = append(props, p)
+		}
+		sort.Strings(props)
+		cv.So(props, cv.ShouldResemble, []string{"id", "name", "zone"})
+		cv.So(agent.Required, cv.ShouldResemble, []string{"zone"})
+
+		// import
+		dir, err := ioutil.TempDir("", "zygo-jsonschema")
+		panicOn(err)
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "order.schema.json")
+		panicOn(ioutil.WriteFile(path, []byte(`{
+  "$schema": "https://json-schema.org/draft/2020-12/schema",
+  "title": "Order",
+  "type": "object",
+  "properties": {
+    "id":    {"type": "integer"},
+    "lines": {"type": "array", "items": {"$ref": "#/$defs/Line"}},
+    "ship":  {"type": "object", "properties": {"city": {"type": "string"}}, "required": ["city"]},
+    "note":  {"type": ["string", "null"]},
+    "meta":  {"type": "object"}
+  },
+  "required": ["id"],
+  "$defs": {
+    "Line": {
+      "type": "object",
+      "properties": {
+        "sku":   {"type": "string"},
+        "qty":   {"type": "integer"},
+        "price": {"type": "number"},
+        "order": {"$ref": "#/$defs/Order"}
+      }
+    }
+  }
+}`), 0644))
+
+		x, err = env.EvalString(`(unjsonschema "` + path + `")`)
+		panicOn(err)
+		cv.So(x.SexpString(nil), cv.ShouldEqual, `[Line Order OrderShip]`)
+		cv.So(env.DeclaredStructs(), cv.ShouldResemble,
+			[]string{"Wheel", "Truck", "Line", "Order", "OrderShip"})
+
+		x, err = env.EvalString(`
+(def o (Order id:7 lines:[(Line sku:"a" qty:2 price:1.5)] ship:(OrderShip city:"Oslo") note:"hi"))
+[(:qty (aget (:lines o) 0)) (:city (:ship o))]`)
+		panicOn(err)
+		cv.So(x.SexpString(nil), cv.ShouldEqual, `[2 "Oslo"]`)
+
+		_, err = env.EvalString(`(Order id:"seven")`)
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "cannot assign")
+		env.Clear()
+
+		// and back again.
+		order, err := env.JSONSchema(env.LookupType("Order"))
+		panicOn(err)
+		var back struct {
+			Defs map[string]struct {
+				Properties map[string]map[string]interface{}
+				Required   []string
+			} `json:"$defs"`
+		}
+		panicOn(json.Unmarshal(order, &back))
+		cv.So(back.Defs["Order"].Required, cv.ShouldResemble, []string{"id"})
+		cv.So(back.Defs["OrderShip"].Required, cv.ShouldResemble, []string{"city"})
+		cv.So(back.Defs["Line"].Properties["order"]["$ref"], cv.ShouldEqual, "#/$defs/Order")
+		cv.So(back.Defs["Order"].Properties["note"]["type"], cv.ShouldEqual, "string")
+
+		_, err = env.EvalString(`(jsonschema 3)`)
+		cv.So(err, cv.ShouldNotBeNil)
+		env.Clear()
+	})
+}
@@ -54,6 +54,31 @@ const (
 type Token struct {
 	typ TokenType
 	str string
+	pos Pos
+}
+
+// Pos is a position in the source: a 1-based line and column,
+// and the file name if the input came from a file.
+type Pos struct {
+	File string
+	Line int
+	Col  int
+}
+
+func (p Pos) String() string {
+	if p.File == "" {
+		return fmt.Sprintf("%d:%d", p.Line, p.Col)
+	}
+	return fmt.Sprintf("%s:%d:%d", p.File, p.Line, p.Col)
+}
+
+// SourceStream names the file that a stream of source
+// comes from, so that the positions the lexer records
+// carry the file name. Line numbering restarts with
+// each SourceStream.
+type SourceStream struct {
+	io.RuneScanner
+	File string
 }
 
 var EndTk = Token{typ: TokenEnd}
@@ -131,10 +156,16 @@ type Lexer struct {
 	prevPrevToken Token
 	stream        io.RuneScanner
 	next          []io.RuneScanner
-	linenum       int
+
+	// cur is the position of the rune being lexed, and
+	// start that of the first rune of the pending token.
+	cur   Pos
+	start Pos
 }
 
 func (lexer *Lexer) AppendToken(tok Token) {
+	tok.pos = lexer.start
+	lexer.start = lexer.cur
 	lexer.tokens = append(lexer.tokens, tok)
 	lexer.prevPrevToken = lexer.prevToken
 	lexer.prevToken = tok
@@ -146,23 +177,28 @@ func (lexer *Lexer) PrependToken(tok Token) {
 
 func NewLexer(p *Parser) *Lexer {
 	return &Lexer{
-		parser:  p,
-		tokens:  make([]Token, 0, 10),
-		buffer:  new(bytes.Buffer),
-		state:   LexerNormal,
-		linenum: 1,
+		parser: p,
+		tokens: make([]Token, 0, 10),
+		buffer: new(bytes.Buffer),
+		state:  LexerNormal,
+		cur:    Pos{Line: 1, Col: 1},
 	}
 }
 
 func (lexer *Lexer) Linenum() int {
-	return lexer.linenum
+	return lexer.cur.Line
+}
+
+// Pos returns the position the lexer has reached.
+func (lexer *Lexer) Pos() Pos {
+	return lexer.cur
 }
 
 func (lex *Lexer) Reset() {
 	lex.stream = nil
 	lex.tokens = lex.tokens[:0]
 	lex.state = LexerNormal
-	lex.linenum = 1
+	lex.cur = Pos{Line: 1, Col: 1}
 	lex.buffer.Reset()
 }
 
@@ -676,7 +712,6 @@ top:
 			lexer.AppendToken(lexer.DecodeBrace(r))
 			return nil
 		case '\n':
-			lexer.linenum++
 			fallthrough
 		case ' ':
 			fallthrough
@@ -724,7 +759,16 @@ func (lexer *Lexer) PeekNextToken() (tok Token, err error) {
 			}
 		}
 
+		if lexer.state == LexerNormal && lexer.buffer.Len() == 0 {
+			lexer.start = lexer.cur
+		}
 		err = lexer.LexNextRune(r)
+		if r == '\n' {
+			lexer.cur.Line++
+			lexer.cur.Col = 1
+		} else {
+			lexer.cur.Col++
+		}
 		if err != nil {
 			return EndTk, err
 		}
@@ -763,6 +807,9 @@ func (lex *Lexer) PromoteNextStream() (ok bool) {
 	//Q("Promoting next stream!\n")
 	lex.stream = lex.next[0]
 	lex.next = lex.next[1:]
+	if ss, isSource := lex.stream.(*SourceStream); isSource {
+		lex.cur = Pos{File: ss.File, Line: 1, Col: 1}
+	}
 	return true
 }
 
@@ -204,3 +204,31 @@ func Test042ImaginaryFloatingPointRegex(t *testing.T) {
 		cv.So(ans, cv.ShouldEqual, true)
 	})
 }
+
+func Test002ParsedListsAndRuntimeErrorsCarryPositions(t *testing.T) {
+
+	cv.Convey(`Given source spread over several lines, parsed lists should record their line and column, and a runtime error should be reported at the position of the call that failed`, t, func() {
+
+		str := "(def a 1)\n\n(defn f [x]\n   (+ x \"s\"))\n  (f a)\n"
+		env := NewZlisp()
+		defer env.parser.Stop()
+		env.StandardSetup()
+
+		env.parser.ResetAddNewInput(&SourceStream{RuneScanner: bytes.NewBufferString(str), File: "config.zy"})
+		expressions, err := env.parser.ParseTokens()
+		panicOn(err)
+		cv.So(len(expressions), cv.ShouldEqual, 3)
+		cv.So(expressions[0].(*SexpPair).Pos, cv.ShouldResemble, &Pos{File: "config.zy", Line: 1, Col: 1})
+		cv.So(expressions[1].(*SexpPair).Pos, cv.ShouldResemble, &Pos{File: "config.zy", Line: 3, Col: 1})
+		cv.So(expressions[2].(*SexpPair).Pos, cv.ShouldResemble, &Pos{File: "config.zy", Line: 5, Col: 3})
+
+		err = env.LoadExpressions(expressions)
+		panicOn(err)
+		_, err = env.Run()
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(err.Error(), cv.ShouldStartWith, "config.zy:4:4: Error calling '+':")
+		pe, isPos := err.(*PosError)
+		cv.So(isPos, cv.ShouldBeTrue)
+		cv.So(pe.Pos, cv.ShouldResemble, Pos{File: "config.zy", Line: 4, Col: 4})
+	})
+}
@@ -0,0 +1,254 @@
+package zygo
+
+import (
+	"fmt"
+)
+
+// Lexical addressing.
+//
+// Inside a function body the generator can see which scopes
+// will be on the linearstack when each expression runs: the
+// function's own scope holding its parameters, then one for
+// every let, for, catch and newScope it is nested in. It tracks
+// them as lexScopes, and resolves a symbol bound in one of them
+// to a lexRef: how many scopes down from the top of the stack
+// the binding lives. Symbols bound in the function that created
+// a closure are resolved the same way, against the stack the
+// closure captured. Loads and stores through a lexRef go
+// straight to that scope instead of searching for the name.
+//
+// Globals, and anything bound where the generator cannot see
+// it, are still looked up by name. So is any symbol whose
+// address might be wrong at runtime: when a scope between the
+// reference and the binding gains a binding of the same name
+// later in the body (a def in a loop, say), or when the
+// function does something that binds names we cannot see, such
+// as eval, source, or the struct and func builders.
+
+// lexScope is the generator's picture of one runtime Scope.
+type lexScope struct {
+	names  map[int]bool
+	parent *lexScope // nil for a function's own scope
+	fn     *lexFunc
+}
+
+// lexFunc is what the generator learns about one function body.
+type lexFunc struct {
+	// outer is the scope the closure over this function is
+	// created in; nil at the top level.
+	outer *lexScope
+
+	// wild is set when the function binds names the generator
+	// cannot see; all of its refs are then looked up by name.
+	wild bool
+
+	refs []*lexRef
+}
+
+// lexRef is the lexical address of one symbol reference.
+type lexRef struct {
+	sym   int
+	depth int
+
+	// closed refs address the stack captured by the
+	// closure, rather than the linearstack.
+	closed bool
+
+	// dynamic refs are looked up by name after all.
+	dynamic bool
+
+	// path holds the scopes searched before the binding
+	// was found, checked again when the function is done.
+	path []*lexScope
+}
+
+func (r *lexRef) String() string {
+	switch {
+	case r.dynamic:
+		return "dynamic"
+	case r.closed:
+		return fmt.Sprintf("closed %d", r.depth)
+	}
+	return fmt.Sprintf("local %d", r.depth)
+}
+
+func newLexFunc(outer *lexScope) *lexScope {
+	fn := &lexFunc{outer: outer}
+	return &lexScope{names: make(map[int]bool), fn: fn}
+}
+
+// finish marks the refs whose addresses cannot be trusted
+// as dynamic. Call it once the function body is generated.
+func (fn *lexFunc) finish() {
+	for _, ref := range fn.refs {
+		if fn.wild {
+			ref.dynamic = true
+			continue
+		}
+		for _, s := range ref.path {
+			if s.names[ref.sym] {
+				ref.dynamic = true
+				break
+			}
+		}
+	}
+}
+
+// pushLex and popLex follow the AddScopeInstr and
+// RemoveScopeInstr the generator emits.
+func (gen *Generator) pushLex() {
+	if gen.lex != nil {
+		gen.lex = &lexScope{names: make(map[int]bool), parent: gen.lex, fn: gen.lex.fn}
+	}
+}
+
+func (gen *Generator) popLex() {
+	if gen.lex != nil {
+		gen.lex = gen.lex.parent
+	}
+}
+
+// bindLex notes that sym gets bound in the current scope.
+func (gen *Generator) bindLex(sym *SexpSymbol) {
+	if gen.lex != nil {
+		gen.lex.names[sym.number] = true
+	}
+}
+
+// wildLex notes that the current function binds names
+// we cannot see.
+func (gen *Generator) wildLex() {
+	if gen.lex != nil {
+		gen.lex.fn.wild = true
+	}
+}
+
+// resolve returns the lexical address of sym, or nil if it
+// must be looked up by name.
+func (gen *Generator) resolve(sym *SexpSymbol) *lexRef {
+	if gen.lex == nil || sym.isDot || sym.isSigil || sym.colonTail {
+		return nil
+	}
+	if gen.env.HasMacro(sym) {
+		return nil
+	}
+	fn := gen.lex.fn
+	var path []*lexScope
+	depth := 0
+	for s := gen.lex; s != nil; s = s.parent {
+		if s.names[sym.number] {
+			ref := &lexRef{sym: sym.number, depth: depth, path: path}
+			fn.refs = append(fn.refs, ref)
+			return ref
+		}
+		path = append(path, s)
+		depth++
+	}
+	depth = 0
+	for s := fn.outer; s != nil; s = s.parent {
+		if s.names[sym.number] {
+			ref := &lexRef{sym: sym.number, depth: depth, closed: true, path: path}
+			fn.refs = append(fn.refs, ref)
+			s.fn.refs = append(s.fn.refs, ref)
+			return ref
+		}
+		path = append(path, s)
+		depth++
+	}
+	return nil
+}
+
+// load is the instruction that pushes the value of sym.
+func (gen *Generator) load(sym *SexpSymbol) Instruction {
+	ref := gen.resolve(sym)
+	if ref == nil {
+		return EnvToStackInstr{sym}
+	}
+	return LexLoadInstr{sym: sym, ref: ref}
+}
+
+// addressed returns the scope ref points at, or nil when
+// the symbol has to be looked up by name.
+func (env *Zlisp) addressed(ref *lexRef) *Scope {
+	if ref == nil || ref.dynamic {
+		return nil
+	}
+	stack := env.linearstack
+	if ref.closed {
+		if env.curfunc == nil || env.curfunc.closingOverScopes == nil {
+			return nil
+		}
+		stack = env.curfunc.closingOverScopes.Stack
+	}
+	i := stack.tos - ref.depth
+	if i < 0 {
+		return nil
+	}
+	scope, _ := stack.elements[i].(*Scope)
+	return scope
+}
+
+// lookup finds sym at its address if it has one, and falls
+// back to LexicalLookupSymbol if not, or if the binding is not
+// there (yet).
+func (env *Zlisp) lookup(sym *SexpSymbol, ref *lexRef) (Sexp, error) {
+	if scope := env.addressed(ref); scope != nil {
+		if expr, ok := scope.get(sym.number); ok {
+			return expr, nil
+		}
+	}
+	expr, err, _ := env.LexicalLookupSymbol(sym, nil)
+	return expr, err
+}
+
+// LexLoadInstr is EnvToStackInstr for a symbol with a
+// lexical address.
+type LexLoadInstr struct {
+	sym *SexpSymbol
+	ref *lexRef
+}
+
+func (g LexLoadInstr) InstrString() string {
+	return fmt.Sprintf("lexLoad %s (%s)", g.sym.name, g.ref)
+}
+
+func (g LexLoadInstr) Execute(env *Zlisp) error {
+	if g.ref.dynamic {
+		return EnvToStackInstr{g.sym}.Execute(env)
+	}
+	expr, err := env.lookup(g.sym, g.ref)
+	if err != nil {
+		return err
+	}
+	env.datastack.PushExpr(expr)
+	env.pc++
+	return nil
+}
+
+// LexStoreInstr is UpdateInstr, (set), for a symbol with
+// a lexical address.
+type LexStoreInstr struct {
+	sym *SexpSymbol
+	ref *lexRef
+}
+
+func (s LexStoreInstr) InstrString() string {
+	return fmt.Sprintf("lexStore %s (%s)", s.sym.name, s.ref)
+}
+
+func (s LexStoreInstr) Execute(env *Zlisp) error {
+	scope := env.addressed(s.ref)
+	if scope == nil {
+		return UpdateInstr{s.sym}.Execute(env)
+	}
+	expr, err := env.datastack.PopExpr()
+	if err != nil {
+		return err
+	}
+	if scope.setIfPresent(s.sym.number, expr) {
+		env.pc++
+		return nil
+	}
+	env.datastack.PushExpr(expr)
+	return UpdateInstr{s.sym}.Execute(env)
+}
@@ -0,0 +1,78 @@
+package zygo
+
+import (
+	"testing"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+// lexAddresses lists the addressed loads and stores in fun
+// and the functions it creates closures over.
+func lexAddresses(fun ZlispFunction) []string {
+	var addrs []string
+	for _, instr := range fun {
+		switch x := instr.(type) {
+		case LexLoadInstr, LexStoreInstr:
+			addrs = append(addrs, x.InstrString())
+		case CreateClosureInstr:
+			addrs = append(addrs, lexAddresses(x.sfun.fun)...)
+		}
+	}
+	return addrs
+}
+
+func Test417LexicalAddressing(t *testing.T) {
+
+	cv.Convey(`locals and closed-over variables should be loaded and stored by lexical address, and give the same answers as looking them up by name`, t, func() {
+		env := NewZlisp()
+		defer env.Stop()
+		env.StandardSetup()
+
+		addrs := func(name string) []string {
+			x, err, _ := env.LexicalLookupSymbol(env.MakeSymbol(name), nil)
+			panicOn(err)
+			return lexAddresses(x.(*SexpFunction).fun)
+		}
+
+		x, err := env.EvalString(`
+(defn f [a b] (let [c (+ a b)] (* c a)))
+(defn adder [n] (fn [x] (+ x n)))
+(defn counter [] (let [c 0] (fn [] (set c (+ c 1)) c)))
+(def ctr (counter))
+(ctr)
+[(f 2 3) ((adder 3) 4) (ctr)]`)
+		panicOn(err)
+		cv.So(x.SexpString(nil), cv.ShouldEqual, `[10 7 2]`)
+		cv.So(addrs("f"), cv.ShouldResemble, []string{
+			"lexLoad a (local 1)", "lexLoad b (local 1)",
+			"lexLoad c (local 0)", "lexLoad a (local 1)"})
+		cv.So(addrs("adder"), cv.ShouldResemble, []string{
+			"lexLoad x (local 0)", "lexLoad n (closed 0)"})
+		cv.So(addrs("counter"), cv.ShouldResemble, []string{
+			"lexLoad c (closed 0)", "lexStore c (closed 0)", "lexLoad c (closed 0)"})
+
+		for src, want := range map[string]string{
+			// shadowing
+			`(defn g [x] (let [x (+ x 1)] x)) (g 1)`: `2`,
+			// a def after a use, in the same scope and in an inner one
+			`(defn h [x] (let [y 0] (def r x) (def x 2) [r x])) (h 1)`: `[1 2]`,
+			// a def that may not happen
+			`(defn k [x c] (let [] (cond c (def x 2) 0) x)) [(k 1 false) (k 1 true)]`: `[1 2]`,
+			// a def in a loop changes what later iterations see
+			`(defn m [x] (def out [])
+			   (for [(def i 0) (< i 2) (set i (+ i 1))] (set out (append out x)) (def x 2))
+			   out)
+			 (m 1)`: `[1 2]`,
+			// eval binds names the generator cannot see
+			`(defn e [x] (let [] (eval (quote (def x 2))) x)) (e 1)`: `2`,
+			// set of a name bound nowhere binds it in the current scope
+			`(defn s [] (set fresh 2) fresh) (s)`: `2`,
+		} {
+			x, err := env.EvalString(src)
+			cv.So(err, cv.ShouldBeNil)
+			cv.So(x.SexpString(nil), cv.ShouldEqual, want)
+		}
+		cv.So(addrs("m"), cv.ShouldContain, "lexLoad x (dynamic)")
+		cv.So(addrs("e"), cv.ShouldResemble, []string{"lexLoad x (dynamic)"})
+	})
+}
@@ -0,0 +1,331 @@
+package zygo
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// ResourceLimits bounds what a script may consume. Attach
+// them to an environment with SetResourceLimits. A zero
+// field means no limit on that resource.
+type ResourceLimits struct {
+	// MaxInstructions caps the number of VM instructions
+	// executed by one outermost call to Run. Nested Runs,
+	// e.g. from Apply, and the (go ...) blocks it starts
+	// count against the same budget; once it is spent, the
+	// goroutines fail too.
+	MaxInstructions int64
+
+	// MaxDataStack and MaxScopeStack cap the depth of the
+	// data stack and of the scope (linear) stack.
+	MaxDataStack  int
+	MaxScopeStack int
+
+	// MaxStringLen, MaxArrayLen and MaxHashKeys cap the size
+	// of strings, arrays and hashes produced by builtins.
+	// makeArray, append, appendslice, concat and hash
+	// insertion check the size before allocating; other
+	// builtins have what they return checked.
+	MaxStringLen int
+	MaxArrayLen  int
+	MaxHashKeys  int
+}
+
+// ResourceLimitExceeded is returned by Run when one of
+// the ResourceLimits is hit. Limit names the field of
+// ResourceLimits that was exceeded, e.g. "MaxInstructions".
+type ResourceLimitExceeded struct {
+	Limit string
+	Max   int64
+	Have  int64
+	Func  string
+	Pc    int
+}
+
+func (e *ResourceLimitExceeded) Error() string {
+	return fmt.Sprintf("resource limit %s exceeded in %s:%d: %d > %d",
+		e.Limit, e.Func, e.Pc, e.Have, e.Max)
+}
+
+// SetResourceLimits installs lim on env; nil removes all limits.
+// The limits are shared with environments made by Clone and
+// Duplicate, such as those running (go ...) blocks.
+func (env *Zlisp) SetResourceLimits(lim *ResourceLimits) {
+	env.limits = lim
+}
+
+// ResourceLimits returns the limits in force, or nil if none.
+func (env *Zlisp) ResourceLimits() *ResourceLimits {
+	return env.limits
+}
+
+func (env *Zlisp) limitErr(limit string, max, have int64) error {
+	return &ResourceLimitExceeded{
+		Limit: limit,
+		Max:   max,
+		Have:  have,
+		Func:  env.curfunc.name,
+		Pc:    env.pc,
+	}
+}
+
+// instrBudget counts the instructions run against
+// MaxInstructions. The outermost Run of an environment starts
+// a fresh one, and the environments Duplicated from it, like
+// those running its (go ...) blocks, share it.
+type instrBudget struct {
+	used int64 // atomic
+
+	// spent is closed once used passes MaxInstructions,
+	// to wake goroutines blocked on channels.
+	spent chan struct{}
+	once  sync.Once
+}
+
+func (env *Zlisp) instrBudget() *instrBudget {
+	if env.budget == nil {
+		env.budget = &instrBudget{spent: make(chan struct{})}
+	}
+	return env.budget
+}
+
+// budgetContext gives an environment about to run a (go ...)
+// block a context that is cancelled once the budget it shares
+// is spent, or when stop is closed.
+func (env *Zlisp) budgetContext(stop chan struct{}) {
+	parent := env.ctx
+	if parent == nil {
+		parent = context.Background()
+	}
+	ctx, cancel := context.WithCancel(parent)
+	spent := env.instrBudget().spent
+	go func() {
+		select {
+		case <-spent:
+		case <-stop:
+		}
+		cancel()
+	}()
+	env.ctx = ctx
+}
+
+// budgetSpent returns the error for an environment stopped
+// because another spent the budget it shares, or nil.
+func (env *Zlisp) budgetSpent() error {
+	if env.limits == nil || env.budget == nil {
+		return nil
+	}
+	select {
+	case <-env.budget.spent:
+		max := env.limits.MaxInstructions
+		return env.limitErr("MaxInstructions", max, atomic.LoadInt64(&env.budget.used))
+	default:
+	}
+	return nil
+}
+
+// checkStepLimits is called by Run after each instruction
+// when limits are set.
+func (env *Zlisp) checkStepLimits() error {
+	lim := env.limits
+	b := env.instrBudget()
+	used := atomic.AddInt64(&b.used, 1)
+	if lim.MaxInstructions > 0 && used > lim.MaxInstructions {
+		b.once.Do(func() { close(b.spent) })
+		return env.limitErr("MaxInstructions", lim.MaxInstructions, used)
+	}
+	if lim.MaxDataStack > 0 && env.datastack.Size() > lim.MaxDataStack {
+		return env.limitErr("MaxDataStack", int64(lim.MaxDataStack), int64(env.datastack.Size()))
+	}
+	if lim.MaxScopeStack > 0 && env.linearstack.Size() > lim.MaxScopeStack {
+		return env.limitErr("MaxScopeStack", int64(lim.MaxScopeStack), int64(env.linearstack.Size()))
+	}
+	return nil
+}
+
+// CheckArrayLen lets builtins reject an array of length n
+// before allocating it.
+func (env *Zlisp) CheckArrayLen(n int) error {
+	if env == nil || env.limits == nil || env.limits.MaxArrayLen <= 0 {
+		return nil
+	}
+	if n > env.limits.MaxArrayLen {
+		return env.limitErr("MaxArrayLen", int64(env.limits.MaxArrayLen), int64(n))
+	}
+	return nil
+}
+
+// CheckStringLen lets builtins reject a string of length n
+// before building it.
+func (env *Zlisp) CheckStringLen(n int) error {
+	if env == nil || env.limits == nil || env.limits.MaxStringLen <= 0 {
+		return nil
+	}
+	if n > env.limits.MaxStringLen {
+		return env.limitErr("MaxStringLen", int64(env.limits.MaxStringLen), int64(n))
+	}
+	return nil
+}
+
+// CheckHashKeys lets builtins reject a hash holding n keys.
+func (env *Zlisp) CheckHashKeys(n int) error {
+	if env == nil || env.limits == nil || env.limits.MaxHashKeys <= 0 {
+		return nil
+	}
+	if n > env.limits.MaxHashKeys {
+		return env.limitErr("MaxHashKeys", int64(env.limits.MaxHashKeys), int64(n))
+	}
+	return nil
+}
+
+// checkConcatLen rejects what concat would make of args
+// before it is made.
+func (env *Zlisp) checkConcatLen(args []Sexp) error {
+	if env.limits == nil {
+		return nil
+	}
+	n := 0
+	switch args[0].(type) {
+	case *SexpStr:
+		for _, x := range args {
+			if s, isStr := x.(*SexpStr); isStr {
+				n += len(s.S)
+			}
+		}
+		return env.CheckStringLen(n)
+	case *SexpArray:
+		for _, x := range args {
+			if a, isArr := x.(*SexpArray); isArr {
+				n += len(a.Val)
+			}
+		}
+		return env.CheckArrayLen(n)
+	}
+	return nil
+}
+
+// checkResultSize inspects the value a builtin returned.
+func (env *Zlisp) checkResultSize(res Sexp) error {
+	switch r := res.(type) {
+	case *SexpStr:
+		return env.CheckStringLen(len(r.S))
+	case *SexpArray:
+		return env.CheckArrayLen(len(r.Val))
+	case *SexpHash:
+		return env.CheckHashKeys(r.NumKeys)
+	}
+	return nil
+}
+
+// StackSizes caps the depth of the VM's stacks. Set them with
+// WithStackSizes or SetStackSizes; a zero field takes the
+// default, CallStackSize, ScopeStackSize, DataStackSize or
+// LoopStackSize.
+type StackSizes struct {
+	// CallStack caps the calls in progress, and so the
+	// depth of (non-tail) recursion.
+	CallStack int
+
+	// ScopeStack caps the scopes open at once: one per
+	// call in progress, and one per let, for and the like.
+	ScopeStack int
+
+	DataStack int
+
+	// LoopStack caps how deeply loops may nest in the
+	// code being compiled.
+	LoopStack int
+}
+
+// StackOverflowFrames is how many calls a StackOverflow
+// error shows.
+const StackOverflowFrames = 10
+
+// StackOverflow is returned by Run when a call would grow one
+// of the VM's stacks past its StackSizes. Stack names the field
+// of StackSizes, e.g. "CallStack". Frames shows the innermost
+// calls in progress, innermost first, as "name (position)";
+// Depth counts them all.
+type StackOverflow struct {
+	Stack  string
+	Size   int
+	Depth  int
+	Frames []string
+}
+
+func (e *StackOverflow) Error() string {
+	s := fmt.Sprintf("stack overflow: %s exceeded %d entries", e.Stack, e.Size)
+	if len(e.Frames) == 0 {
+		return s
+	}
+	s += fmt.Sprintf(", %d calls deep:", e.Depth)
+	for _, f := range e.Frames {
+		s += "\n    in " + f
+	}
+	if more := e.Depth - len(e.Frames); more > 0 {
+		s += fmt.Sprintf("\n    ... and %d more", more)
+	}
+	return s
+}
+
+// SetStackSizes sets how deep env's stacks may grow. Environments
+// made from env by Clone and Duplicate get the same sizes.
+func (env *Zlisp) SetStackSizes(s StackSizes) {
+	if s.CallStack <= 0 {
+		s.CallStack = CallStackSize
+	}
+	if s.ScopeStack <= 0 {
+		s.ScopeStack = ScopeStackSize
+	}
+	if s.DataStack <= 0 {
+		s.DataStack = DataStackSize
+	}
+	if s.LoopStack <= 0 {
+		s.LoopStack = LoopStackSize
+	}
+	env.stacks = s
+}
+
+// StackSizes returns the sizes in force, defaults filled in.
+func (env *Zlisp) StackSizes() StackSizes {
+	return env.stacks
+}
+
+// checkStacks is called before each call, which is what
+// grows the stacks without bound.
+func (env *Zlisp) checkStacks() error {
+	switch {
+	case env.addrstack.Size() >= env.stacks.CallStack:
+		return env.stackOverflow("CallStack", env.stacks.CallStack)
+	case env.linearstack.Size() >= env.stacks.ScopeStack:
+		return env.stackOverflow("ScopeStack", env.stacks.ScopeStack)
+	case env.datastack.Size() >= env.stacks.DataStack:
+		return env.stackOverflow("DataStack", env.stacks.DataStack)
+	}
+	return nil
+}
+
+func (env *Zlisp) stackOverflow(stack string, size int) error {
+	frame := func(fun *SexpFunction, pc int) string {
+		if pos := fun.PosAt(pc); pos != nil {
+			return fmt.Sprintf("%s (%s)", fun.name, pos)
+		}
+		return fun.name
+	}
+	e := &StackOverflow{
+		Stack:  stack,
+		Size:   size,
+		Depth:  env.addrstack.Size() + 1,
+		Frames: []string{frame(env.curfunc, env.pc)},
+	}
+	// each address is where a caller resumes, just
+	// after its call.
+	for i := 0; i < env.addrstack.Size() && len(e.Frames) < StackOverflowFrames; i++ {
+		elem, _ := env.addrstack.Get(i)
+		addr := elem.(Address)
+		e.Frames = append(e.Frames, frame(addr.function, addr.position-1))
+	}
+	return e
+}
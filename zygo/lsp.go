@@ -0,0 +1,1011 @@
+package zygo
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// The Language Server Protocol.
+//
+// `zygo lsp` serves an editor the JSON-RPC of the protocol at
+// https://microsoft.github.io/language-server-protocol/ on
+// stdin and stdout. Each time a .zy file is opened or changed
+// it is analyzed afresh, without being run: lexed, to check
+// that its brackets balance, parsed, and compiled form by
+// form, with the macros it defines, and the calls in it
+// checked against the builtins, the special forms and what
+// the file defines. From what it found the server answers
+// requests for diagnostics, completion, hover and go to
+// definition.
+//
+// The macros are the only code of the file that runs, and they
+// run under lspMacroLimits and within lspAnalysisTimeout, so that
+// one that never finishes is reported rather than hanging the
+// server.
+
+// LspMain implements `zygo lsp`.
+func LspMain(args []string) error {
+	fs := flag.NewFlagSet("zygo lsp", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: zygo lsp\n\nspeaks the Language Server Protocol on stdin and stdout.\n")
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+
+	// macros run as files are compiled; what they print
+	// must not get mixed up with the protocol.
+	out := os.Stdout
+	os.Stdout = os.Stderr
+	defer func() { os.Stdout = out }()
+	return ServeLSP(os.Stdin, out)
+}
+
+// ServeLSP serves the Language Server Protocol, reading from in
+// and writing to out, until the editor sends exit or in ends.
+func ServeLSP(in io.Reader, out io.Writer) error {
+	s := &lspServer{w: out, docs: make(map[string]*lspDoc)}
+	return s.serve(in)
+}
+
+type lspMessage struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type lspResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result"`
+}
+
+type lspErrorResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Error   *lspError       `json:"error"`
+}
+
+type lspNotification struct {
+	JSONRPC string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params"`
+}
+
+type lspError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *lspError) Error() string {
+	return e.Message
+}
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspLocation struct {
+	URI   string   `json:"uri"`
+	Range lspRange `json:"range"`
+}
+
+type lspDiagnostic struct {
+	Range    lspRange `json:"range"`
+	Severity int      `json:"severity"`
+	Source   string   `json:"source"`
+	Message  string   `json:"message"`
+}
+
+const (
+	lspSeverityError   = 1
+	lspSeverityWarning = 2
+)
+
+type lspCompletionItem struct {
+	Label    string `json:"label"`
+	Kind     int    `json:"kind"`
+	Detail   string `json:"detail,omitempty"`
+	SortText string `json:"sortText,omitempty"`
+}
+
+// completion item kinds
+const (
+	lspKindFunction = 3
+	lspKindField    = 5
+	lspKindVariable = 6
+	lspKindKeyword  = 14
+	lspKindStruct   = 22
+)
+
+type lspTextDocumentPosition struct {
+	TextDocument struct {
+		URI string `json:"uri"`
+	} `json:"textDocument"`
+	Position lspPosition `json:"position"`
+}
+
+type lspServer struct {
+	w    io.Writer
+	docs map[string]*lspDoc
+}
+
+func (s *lspServer) serve(in io.Reader) error {
+	r := bufio.NewReader(in)
+	for {
+		buf, err := readFramed(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var msg lspMessage
+		if err := json.Unmarshal(buf, &msg); err != nil {
+			return fmt.Errorf("bad message: %s", err)
+		}
+		if msg.Method == "" {
+			// a response; we send no requests.
+			continue
+		}
+		if msg.Method == "exit" {
+			return nil
+		}
+		result, err := s.handle(&msg)
+		if msg.ID == nil {
+			// notifications get no response.
+			continue
+		}
+		if err != nil {
+			e, ok := err.(*lspError)
+			if !ok {
+				e = &lspError{Code: -32603, Message: err.Error()}
+			}
+			err = writeFramed(s.w, &lspErrorResponse{JSONRPC: "2.0", ID: msg.ID, Error: e})
+		} else {
+			err = writeFramed(s.w, &lspResponse{JSONRPC: "2.0", ID: msg.ID, Result: result})
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *lspServer) handle(msg *lspMessage) (interface{}, error) {
+	switch msg.Method {
+	case "initialize":
+		return map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				"textDocumentSync":   map[string]interface{}{"openClose": true, "change": 1},
+				"completionProvider": map[string]interface{}{"triggerCharacters": []string{"("}},
+				"hoverProvider":      true,
+				"definitionProvider": true,
+			},
+			"serverInfo": map[string]interface{}{"name": "zygo", "version": Version()},
+		}, nil
+	case "shutdown":
+		return nil, nil
+	case "textDocument/didOpen":
+		var p struct {
+			TextDocument struct {
+				URI  string `json:"uri"`
+				Text string `json:"text"`
+			} `json:"textDocument"`
+		}
+		if err := lspParams(msg.Params, &p); err != nil {
+			return nil, err
+		}
+		return nil, s.update(p.TextDocument.URI, p.TextDocument.Text)
+	case "textDocument/didChange":
+		var p struct {
+			TextDocument struct {
+				URI string `json:"uri"`
+			} `json:"textDocument"`
+			ContentChanges []struct {
+				Text string `json:"text"`
+			} `json:"contentChanges"`
+		}
+		if err := lspParams(msg.Params, &p); err != nil {
+			return nil, err
+		}
+		if n := len(p.ContentChanges); n > 0 {
+			// we ask for whole documents.
+			return nil, s.update(p.TextDocument.URI, p.ContentChanges[n-1].Text)
+		}
+		return nil, nil
+	case "textDocument/didClose":
+		var p struct {
+			TextDocument struct {
+				URI string `json:"uri"`
+			} `json:"textDocument"`
+		}
+		if err := lspParams(msg.Params, &p); err != nil {
+			return nil, err
+		}
+		delete(s.docs, p.TextDocument.URI)
+		return nil, s.publish(p.TextDocument.URI, nil)
+	case "textDocument/completion", "textDocument/hover", "textDocument/definition":
+		var p lspTextDocumentPosition
+		if err := lspParams(msg.Params, &p); err != nil {
+			return nil, err
+		}
+		doc := s.docs[p.TextDocument.URI]
+		if doc == nil {
+			return nil, nil
+		}
+		switch msg.Method {
+		case "textDocument/completion":
+			return doc.complete(p.Position), nil
+		case "textDocument/hover":
+			return doc.hover(p.Position), nil
+		default:
+			return doc.definition(p.Position), nil
+		}
+	}
+	if msg.ID == nil {
+		return nil, nil
+	}
+	return nil, &lspError{Code: -32601, Message: fmt.Sprintf("method '%s' not found", msg.Method)}
+}
+
+// lspParams decodes the params of a message into v.
+func lspParams(raw json.RawMessage, v interface{}) error {
+	if len(raw) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return &lspError{Code: -32602, Message: fmt.Sprintf("bad params: %s", err)}
+	}
+	return nil
+}
+
+// update analyzes the new text of the document at uri, and
+// publishes what is wrong with it.
+func (s *lspServer) update(uri, text string) error {
+	doc := analyzeDoc(uri, text, s.docs[uri])
+	s.docs[uri] = doc
+	return s.publish(uri, doc.diags)
+}
+
+func (s *lspServer) publish(uri string, diags []lspDiagnostic) error {
+	if diags == nil {
+		diags = []lspDiagnostic{}
+	}
+	return writeFramed(s.w, &lspNotification{JSONRPC: "2.0", Method: "textDocument/publishDiagnostics",
+		Params: map[string]interface{}{"uri": uri, "diagnostics": diags}})
+}
+
+// lspDef is something a file defines.
+type lspDef struct {
+	Name   string
+	Kind   string // function, macro, variable or struct
+	Sig    string // how it was defined, as (defn name [params])
+	Fields []string
+	Tok    Token // the name, where it is defined
+}
+
+// lspDoc is an open file, as last analyzed.
+type lspDoc struct {
+	uri   string
+	lines []string
+	env   *Zlisp
+	toks  []Token
+	defs  []*lspDef
+	diags []lspDiagnostic
+
+	// opens indexes the tokens that open lists by their
+	// position, which is the Pos of the list parsed.
+	opens map[Pos]int
+}
+
+// specialForms are compiled by the Generator itself.
+var specialForms = []string{
+	"and", "or", "cond", "begin", "let", "letseq", "quote", "def",
+	"mdef", "fn", "defn", "assert", "try", "defmac", "macexpand",
+	"syntaxQuote", "include", "for", "set", "break", "continue",
+	"newScope", "package", "return",
+}
+
+// arity is how many arguments a builtin takes; max is -1 if
+// there is no limit.
+type arity struct {
+	min, max int
+}
+
+func (a arity) String() string {
+	switch {
+	case a.min == a.max && a.min == 1:
+		return "1 argument"
+	case a.min == a.max:
+		return fmt.Sprintf("%d arguments", a.min)
+	case a.max < 0:
+		return fmt.Sprintf("at least %d argument%s", a.min, plural(a.min))
+	}
+	return fmt.Sprintf("%d to %d arguments", a.min, a.max)
+}
+
+func plural(n int) string {
+	if n == 1 {
+		return ""
+	}
+	return "s"
+}
+
+// builtinArity holds the arities the builtins of
+// AllBuiltinFunctions check for. Those that take anything,
+// or whose count depends on their arguments, are left out.
+// Test424BuiltinArity checks each against its builtin.
+var builtinArity = map[string]arity{
+	"pretty": {1, 1}, "<": {2, 2}, ">": {2, 2}, "<=": {2, 2}, ">=": {2, 2},
+	"==": {2, 2}, "!=": {2, 2}, "isnan": {1, 1}, "isNaN": {1, 1},
+	"sll": {2, 2}, "sra": {2, 2}, "srl": {2, 2}, "mod": {2, 2},
+	"+": {1, -1}, "-": {1, -1}, "*": {1, -1}, "**": {1, -1}, "/": {1, -1},
+	"bitAnd": {2, 2}, "bitOr": {2, 2}, "bitXor": {2, 2}, "bitNot": {1, 1},
+	"read": {1, 1}, "cons": {2, 2}, "first": {1, 1}, "second": {1, 1},
+	"rest": {1, 1}, "car": {1, 1}, "cdr": {1, 1},
+	"type?": {1, 1}, "list?": {1, 1}, "null?": {1, 1}, "array?": {1, 1},
+	"hash?": {1, 1}, "number?": {1, 1}, "int?": {1, 1}, "float?": {1, 1},
+	"char?": {1, 1}, "symbol?": {1, 1}, "string?": {1, 1}, "zero?": {1, 1},
+	"empty?": {1, 1}, "func?": {1, 1}, "error?": {1, 1},
+	"throw": {1, 1}, "errmsg": {1, 1}, "not": {1, 1}, "apply": {2, 2},
+	"map": {2, 2}, "makeArray": {1, -1}, "aget": {2, 3}, "aset": {3, 3},
+	"sget": {2, 2}, "hget": {2, 3}, "hset": {3, 3}, "hdel": {2, 2},
+	"keys": {1, 1}, "hpair": {2, 2}, "slice": {3, 3}, "len": {1, 1},
+	"append": {2, 2}, "appendslice": {2, 2}, "concat": {1, -1},
+	"str": {1, 1}, "->": {2, -1}, "flatten": {1, -1}, "quotelist": {1, 1},
+	"fieldls": {1, 1}, "defined?": {1, 1}, "stop": {0, 1}, "GOOS": {0, 0},
+	"&": {1, 1}, "deref": {1, 1}, "derefSet": {2, 2}, ".": {2, 2},
+	"arrayidx": {2, 2}, "hashidx": {2, 2},
+	"nsplit": {1, 1}, "split": {2, 2}, "chomp": {1, 1}, "trim": {1, 1},
+	"println": {1, -1}, "print": {1, -1}, "printf": {1, -1}, "sprintf": {1, -1},
+	"raw2str": {1, 1}, "str2sym": {1, 1}, "sym2str": {1, 1}, "gensym": {0, 1},
+	"symnum": {1, 1}, "json": {1, 1}, "unjson": {1, 1}, "msgpack": {1, 1}, "unmsgpack": {1, 1},
+	"gob": {1, 1}, "jsonschema": {1, 1}, "unjsonschema": {1, 2},
+	"methodls": {1, 1}, "_method": {2, -1},
+	"source": {1, -1}, "togo": {1, 1}, "fromgo": {1, 1}, "dump": {1, 1},
+	"slurpf": {1, 1}, "writef": {2, 2}, "save": {2, 2}, "owritef": {2, 2},
+	"bload": {1, 1}, "bsave": {2, 2}, "greenpack": {1, 1}, "system": {1, -1},
+	"exit": {1, 1}, "_closdump": {1, 1}, "rmsym": {1, 1}, "typelist": {0, 0},
+}
+
+var allBuiltins = AllBuiltinFunctions()
+
+// lspMacroLimits bound each macro expansion during analysis,
+// and lspAnalysisTimeout the whole of compiling one file.
+var lspMacroLimits = ResourceLimits{MaxInstructions: 1000000}
+
+var lspAnalysisTimeout = 5 * time.Second
+
+func isSpecialForm(name string) bool {
+	for _, f := range specialForms {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// analyzeDoc lexes, parses and compiles text. If it does not
+// parse, what prev defined is kept, for completion.
+func analyzeDoc(uri, text string, prev *lspDoc) *lspDoc {
+	env := NewZlispSandbox()
+	env.StandardSetup()
+	doc := &lspDoc{uri: uri, lines: strings.Split(text, "\n"), env: env, opens: make(map[Pos]int)}
+
+	lexer := NewLexer(env.parser)
+	lexer.AddNextStream(strings.NewReader(text))
+	for {
+		tok, err := lexer.GetNextToken()
+		if err != nil {
+			doc.diag(lspRange{Start: doc.lspPos(lexer.Pos()), End: doc.lspPos(lexer.Pos())}, lspSeverityError, err.Error())
+			break
+		}
+		if tok.typ == TokenEnd {
+			break
+		}
+		if tok.typ == TokenLParen || tok.typ == TokenLCurly {
+			doc.opens[tok.pos] = len(doc.toks)
+		}
+		doc.toks = append(doc.toks, tok)
+	}
+	if len(doc.diags) == 0 {
+		doc.checkBrackets()
+	}
+	var xs []Sexp
+	if len(doc.diags) == 0 {
+		var pos Pos
+		var err error
+		xs, pos, err = env.parser.parse(strings.NewReader(text))
+		if err != nil {
+			doc.diag(lspRange{Start: doc.lspPos(pos), End: doc.lspPos(pos)}, lspSeverityError, err.Error())
+		}
+		xs = env.prepareLoadExpressions(xs)
+	}
+	if len(doc.diags) > 0 {
+		if prev != nil {
+			doc.defs = prev.defs
+		}
+		return doc
+	}
+
+	for _, x := range xs {
+		lspWalk(x, doc.define)
+	}
+	lim := lspMacroLimits
+	env.SetResourceLimits(&lim)
+	ctx, cancel := context.WithTimeout(context.Background(), lspAnalysisTimeout)
+	env.ctx = ctx
+	for _, x := range xs {
+		doc.compile(x)
+	}
+	env.ctx = nil
+	cancel()
+	env.SetResourceLimits(nil)
+	doc.lint(xs)
+	return doc
+}
+
+func (doc *lspDoc) diag(r lspRange, severity int, msg string) {
+	doc.diags = append(doc.diags, lspDiagnostic{Range: r, Severity: severity, Source: "zygo", Message: msg})
+}
+
+var closerOf = map[TokenType]TokenType{
+	TokenLParen: TokenRParen, TokenLSquare: TokenRSquare, TokenLCurly: TokenRCurly,
+}
+
+var bracketText = map[TokenType]string{
+	TokenLParen: "(", TokenRParen: ")", TokenLSquare: "[",
+	TokenRSquare: "]", TokenLCurly: "{", TokenRCurly: "}",
+}
+
+// checkBrackets reports brackets that are not closed, or that
+// close what they did not open.
+func (doc *lspDoc) checkBrackets() {
+	var open []Token
+	for _, tok := range doc.toks {
+		switch tok.typ {
+		case TokenLParen, TokenLSquare, TokenLCurly:
+			open = append(open, tok)
+		case TokenRParen, TokenRSquare, TokenRCurly:
+			if len(open) == 0 {
+				doc.diag(doc.tokRange(tok), lspSeverityError, fmt.Sprintf("unexpected '%s'", bracketText[tok.typ]))
+				continue
+			}
+			o := open[len(open)-1]
+			open = open[:len(open)-1]
+			if closerOf[o.typ] != tok.typ {
+				doc.diag(doc.tokRange(tok), lspSeverityError, fmt.Sprintf("'%s' does not close the '%s' at %s",
+					bracketText[tok.typ], bracketText[o.typ], o.pos))
+			}
+		}
+	}
+	for _, o := range open {
+		doc.diag(doc.tokRange(o), lspSeverityError, fmt.Sprintf("'%s' is not closed", bracketText[o.typ]))
+	}
+}
+
+// lspWalk calls f on each list in x, and the lists inside it
+// for as long as f returns true.
+func lspWalk(x Sexp, f func(list *SexpPair, items []Sexp) bool) {
+	switch e := x.(type) {
+	case *SexpPair:
+		items, err := ListToArray(e)
+		if err != nil || len(items) == 0 || !f(e, items) {
+			return
+		}
+		for _, item := range items {
+			lspWalk(item, f)
+		}
+	case *SexpArray:
+		for _, item := range e.Val {
+			lspWalk(item, f)
+		}
+	}
+}
+
+func headName(items []Sexp) string {
+	if sym, ok := items[0].(*SexpSymbol); ok {
+		return sym.name
+	}
+	return ""
+}
+
+// define notes the definition made by list, if any.
+func (doc *lspDoc) define(list *SexpPair, items []Sexp) bool {
+	head := headName(items)
+	switch head {
+	case "quote", "syntaxQuote":
+		return false
+	case "defn", "defmac", "func", "def", "struct":
+	default:
+		return true
+	}
+	if len(items) < 2 {
+		return true
+	}
+	name, ok := items[1].(*SexpSymbol)
+	if !ok {
+		return true
+	}
+	def := &lspDef{Name: name.name}
+	switch head {
+	case "defn", "defmac":
+		def.Kind = "function"
+		if head == "defmac" {
+			def.Kind = "macro"
+		}
+		def.Sig = fmt.Sprintf("(%s %s)", head, name.name)
+		if len(items) > 2 {
+			def.Sig = fmt.Sprintf("(%s %s %s)", head, name.name, items[2].SexpString(nil))
+		}
+	case "func":
+		def.Kind = "function"
+		def.Sig = "(func " + name.name
+		for i := 2; i < 4 && i < len(items); i++ {
+			def.Sig += " " + declString(items[i])
+		}
+		def.Sig += ")"
+	case "def":
+		def.Kind = "variable"
+		def.Sig = fmt.Sprintf("(def %s)", name.name)
+		if len(items) > 2 {
+			def.Sig = fmt.Sprintf("(def %s %s)", name.name, items[2].SexpString(nil))
+		}
+	case "struct":
+		def.Kind = "struct"
+		var fields []string
+		if len(items) > 2 {
+			if arr, ok := items[2].(*SexpArray); ok {
+				for _, f := range arr.Val {
+					fl, err := ListToArray(f)
+					if err != nil || len(fl) < 2 || headName(fl) != "field" {
+						continue
+					}
+					if sym, ok := fl[1].(*SexpSymbol); ok {
+						def.Fields = append(def.Fields, sym.name)
+						decl := declString(&SexpArray{Val: fl[1:]})
+						fields = append(fields, "(field "+decl[1:len(decl)-1]+")")
+					}
+				}
+			}
+		}
+		def.Sig = fmt.Sprintf("(struct %s [%s])", name.name, strings.Join(fields, " "))
+	}
+	def.Tok = Token{typ: TokenSymbol, str: name.name}
+	if list.Pos != nil {
+		def.Tok.pos = *list.Pos
+		if i, ok := doc.opens[*list.Pos]; ok && i+2 < len(doc.toks) && doc.toks[i+2].str == name.name {
+			def.Tok = doc.toks[i+2]
+		}
+	}
+	doc.defs = append(doc.defs, def)
+	return true
+}
+
+// declString shows the [name type ...] of a func declaration
+// as it is written, [name:type ...].
+func declString(x Sexp) string {
+	arr, ok := x.(*SexpArray)
+	if !ok || len(arr.Val)%2 != 0 {
+		return x.SexpString(nil)
+	}
+	var decls []string
+	for i := 0; i < len(arr.Val); i += 2 {
+		decls = append(decls, arr.Val[i].SexpString(nil)+":"+arr.Val[i+1].SexpString(nil))
+	}
+	return "[" + strings.Join(decls, " ") + "]"
+}
+
+// compile generates code for the top level form x, reporting
+// the error if that fails.
+func (doc *lspDoc) compile(x Sexp) {
+	list, ok := x.(*SexpPair)
+	if !ok || list.Head == nil {
+		return
+	}
+	if sym, ok := list.Head.(*SexpSymbol); ok && sym.name == "include" {
+		// that would read the files included, from
+		// wherever we happen to be.
+		return
+	}
+	var err error
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("%v", r)
+			}
+		}()
+		err = NewGenerator(doc.env).Generate(x)
+	}()
+	if err != nil {
+		// the message of the innermost form is last.
+		msg := strings.TrimSpace(err.Error())
+		if i := strings.LastIndex(msg, "\n"); i >= 0 {
+			msg = msg[i+1:]
+		}
+		doc.diag(doc.headRange(list), lspSeverityError, msg)
+	}
+}
+
+// lint checks the calls in xs: that what they call is known,
+// and that builtins get as many arguments as they take.
+func (doc *lspDoc) lint(xs []Sexp) {
+	// names bound by arrays, as the parameters of
+	// functions and the bindings of let are, and by
+	// assignment, could be called as functions.
+	bound := make(map[string]bool)
+	// what a file includes or sources may define anything.
+	includes := false
+	// the catch and finally clauses of try are no calls.
+	clauses := make(map[*SexpPair]bool)
+	var bind func(x Sexp)
+	bind = func(x Sexp) {
+		switch e := x.(type) {
+		case *SexpSymbol:
+			bound[e.name] = true
+		case *SexpArray:
+			for _, item := range e.Val {
+				bind(item)
+			}
+		case *SexpPair:
+			if items, err := ListToArray(e); err == nil {
+				for _, item := range items {
+					bind(item)
+				}
+			}
+		}
+	}
+	for _, x := range xs {
+		lspWalk(x, func(list *SexpPair, items []Sexp) bool {
+			switch headName(items) {
+			case "quote", "syntaxQuote":
+				return false
+			case "mdef", "defmap":
+				for _, item := range items[1:] {
+					bind(item)
+				}
+			case "include", "source":
+				includes = true
+			case "try":
+				for _, item := range items[1:] {
+					if clause, ok := item.(*SexpPair); ok {
+						if h, ok := clause.Head.(*SexpSymbol); ok && (h.name == "catch" || h.name == "finally") {
+							clauses[clause] = true
+						}
+					}
+				}
+			}
+			if isAssign, pos := IsAssignmentList(list, 0); isAssign {
+				for _, item := range items[:pos] {
+					bind(item)
+				}
+			}
+			for _, item := range items {
+				if arr, ok := item.(*SexpArray); ok {
+					bind(arr)
+				}
+			}
+			return true
+		})
+	}
+	for _, def := range doc.defs {
+		bound[def.Name] = true
+	}
+
+	for _, x := range xs {
+		lspWalk(x, func(list *SexpPair, items []Sexp) bool {
+			sym, ok := items[0].(*SexpSymbol)
+			if !ok {
+				return true
+			}
+			name := sym.name
+			switch {
+			case name == "quote" || name == "syntaxQuote" || name == "defmac":
+				return false
+			case doc.isMacro(name):
+				// the arguments of a macro are its own.
+				return false
+			case sym.isDot || sym.isSigil || sym.colonTail || strings.Contains(name, "."):
+				return true
+			}
+			if isAssign, _ := IsAssignmentList(list, 0); isAssign || clauses[list] {
+				return true
+			}
+			if !includes && !bound[name] && !isSpecialForm(name) && allBuiltins[name] == nil &&
+				doc.env.LookupType(name) == nil {
+				if _, found := doc.env.FindObject(name); !found {
+					doc.diag(doc.headRange(list), lspSeverityWarning,
+						fmt.Sprintf("unknown function or special form '%s'", name))
+					return true
+				}
+			}
+			if a, ok := builtinArity[name]; ok && !bound[name] {
+				n := 0
+				for _, item := range items[1:] {
+					if _, isComment := item.(*SexpComment); !isComment {
+						n++
+					}
+				}
+				if n < a.min || (a.max >= 0 && n > a.max) {
+					doc.diag(doc.headRange(list), lspSeverityError,
+						fmt.Sprintf("%s takes %s, not %d", name, a, n))
+				}
+			}
+			return true
+		})
+	}
+}
+
+func (doc *lspDoc) isMacro(name string) bool {
+	_, found := doc.env.macros.get(doc.env.MakeSymbol(name).number)
+	return found
+}
+
+func (doc *lspDoc) macros() []string {
+	var names []string
+	for num := range doc.env.macros.snapshot() {
+		names = append(names, doc.env.symtable.name(num))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// headRange is where list and the name it calls are.
+func (doc *lspDoc) headRange(list *SexpPair) lspRange {
+	if list.Pos == nil {
+		return lspRange{}
+	}
+	i, ok := doc.opens[*list.Pos]
+	if !ok {
+		start := doc.lspPos(*list.Pos)
+		return lspRange{Start: start, End: start}
+	}
+	r := doc.tokRange(doc.toks[i])
+	if i+1 < len(doc.toks) && doc.toks[i+1].typ == TokenSymbol {
+		r.End = doc.tokRange(doc.toks[i+1]).End
+	}
+	return r
+}
+
+// lspPos converts p, with its column counted in runes from 1,
+// to the protocol's position, counted in UTF-16 units from 0.
+func (doc *lspDoc) lspPos(p Pos) lspPosition {
+	n := 0
+	if p.Line >= 1 && p.Line <= len(doc.lines) {
+		for i, r := range []rune(doc.lines[p.Line-1]) {
+			if i >= p.Col-1 {
+				break
+			}
+			n += utf16Len(r)
+		}
+	}
+	return lspPosition{Line: p.Line - 1, Character: n}
+}
+
+// pos converts the protocol's position back to a Pos.
+func (doc *lspDoc) pos(lp lspPosition) Pos {
+	p := Pos{Line: lp.Line + 1, Col: 1}
+	if lp.Line >= 0 && lp.Line < len(doc.lines) {
+		n := 0
+		for _, r := range doc.lines[lp.Line] {
+			if n >= lp.Character {
+				break
+			}
+			n += utf16Len(r)
+			p.Col++
+		}
+	}
+	return p
+}
+
+func utf16Len(r rune) int {
+	if n := utf16.RuneLen(r); n > 0 {
+		return n
+	}
+	return 1
+}
+
+func (doc *lspDoc) tokRange(tok Token) lspRange {
+	n := len([]rune(tok.str))
+	if b, ok := bracketText[tok.typ]; ok {
+		n = len(b)
+	}
+	end := tok.pos
+	end.Col += n
+	return lspRange{Start: doc.lspPos(tok.pos), End: doc.lspPos(end)}
+}
+
+// symbolAt returns the symbol the protocol's position lp is
+// on, or just after.
+func (doc *lspDoc) symbolAt(lp lspPosition) (Token, bool) {
+	p := doc.pos(lp)
+	for _, tok := range doc.toks {
+		switch tok.typ {
+		case TokenSymbol, TokenSymbolColon, TokenDotSymbol:
+		default:
+			continue
+		}
+		if tok.pos.Line == p.Line && tok.pos.Col <= p.Col && p.Col <= tok.pos.Col+len([]rune(tok.str)) {
+			return tok, true
+		}
+	}
+	return Token{}, false
+}
+
+func (doc *lspDoc) lookup(name string) *lspDef {
+	for _, def := range doc.defs {
+		if def.Name == name {
+			return def
+		}
+	}
+	return nil
+}
+
+func (doc *lspDoc) definition(lp lspPosition) interface{} {
+	tok, ok := doc.symbolAt(lp)
+	if !ok {
+		return nil
+	}
+	def := doc.lookup(tok.str)
+	if def == nil {
+		return nil
+	}
+	return lspLocation{URI: doc.uri, Range: doc.tokRange(def.Tok)}
+}
+
+func (doc *lspDoc) hover(lp lspPosition) interface{} {
+	tok, ok := doc.symbolAt(lp)
+	if !ok {
+		return nil
+	}
+	name := tok.str
+	var text string
+	switch def := doc.lookup(name); {
+	case def != nil:
+		text = fmt.Sprintf("```zygo\n%s\n```\n%s defined at line %d", def.Sig, def.Kind, def.Tok.pos.Line)
+	case isSpecialForm(name):
+		text = fmt.Sprintf("`%s`: special form", name)
+	case doc.isMacro(name):
+		text = fmt.Sprintf("`%s`: macro", name)
+	case allBuiltins[name] != nil:
+		text = fmt.Sprintf("`%s`: builtin function", name)
+		if a, ok := builtinArity[name]; ok {
+			text += ", takes " + a.String()
+		}
+	default:
+		return nil
+	}
+	return map[string]interface{}{
+		"contents": map[string]interface{}{"kind": "markdown", "value": text},
+		"range":    doc.tokRange(tok),
+	}
+}
+
+// complete lists what could be typed at lp: the fields of the
+// record being constructed there, if any, what the file
+// defines, the macros, the special forms and the builtins.
+func (doc *lspDoc) complete(lp lspPosition) interface{} {
+	prefix := ""
+	if lp.Line >= 0 && lp.Line < len(doc.lines) {
+		line := []rune(doc.lines[lp.Line])
+		end := doc.pos(lp).Col - 1
+		if end > len(line) {
+			end = len(line)
+		}
+		start := end
+		for start > 0 && !strings.ContainsRune(" \t()[]{}\"'`;,^%", line[start-1]) {
+			start--
+		}
+		prefix = string(line[start:end])
+	}
+
+	items := []lspCompletionItem{}
+	seen := make(map[string]bool)
+	add := func(label string, kind int, detail, sortText string) {
+		if seen[label] || !strings.HasPrefix(label, prefix) {
+			return
+		}
+		seen[label] = true
+		items = append(items, lspCompletionItem{Label: label, Kind: kind, Detail: detail, SortText: sortText + label})
+	}
+
+	for _, f := range doc.fieldsAt(doc.pos(lp)) {
+		add(f+":", lspKindField, "field", "0")
+	}
+	for _, def := range doc.defs {
+		kind := lspKindFunction
+		switch def.Kind {
+		case "variable":
+			kind = lspKindVariable
+		case "struct":
+			kind = lspKindStruct
+		}
+		add(def.Name, kind, def.Sig, "1")
+	}
+	for _, name := range doc.macros() {
+		add(name, lspKindFunction, "macro", "2")
+	}
+	for _, name := range specialForms {
+		add(name, lspKindKeyword, "special form", "2")
+	}
+	var builtins []string
+	for name := range allBuiltins {
+		builtins = append(builtins, name)
+	}
+	for _, g := range doc.env.globals() {
+		if _, isFunc := g.Value.(*SexpFunction); isFunc {
+			builtins = append(builtins, g.Name)
+		}
+	}
+	sort.Strings(builtins)
+	for _, name := range builtins {
+		detail := "builtin"
+		if a, ok := builtinArity[name]; ok {
+			detail += ", takes " + a.String()
+		}
+		add(name, lspKindFunction, detail, "3")
+	}
+	return map[string]interface{}{"isIncomplete": false, "items": items}
+}
+
+// fieldsAt returns the fields of the struct, if any, whose
+// constructor is called by the innermost list open at p.
+func (doc *lspDoc) fieldsAt(p Pos) []string {
+	var open []int
+	for i, tok := range doc.toks {
+		if tok.pos.Line > p.Line || (tok.pos.Line == p.Line && tok.pos.Col >= p.Col) {
+			break
+		}
+		switch tok.typ {
+		case TokenLParen, TokenLSquare, TokenLCurly:
+			open = append(open, i)
+		case TokenRParen, TokenRSquare, TokenRCurly:
+			if len(open) > 0 {
+				open = open[:len(open)-1]
+			}
+		}
+	}
+	if len(open) == 0 {
+		return nil
+	}
+	i := open[len(open)-1]
+	if doc.toks[i].typ != TokenLParen || i+1 >= len(doc.toks) || doc.toks[i+1].typ != TokenSymbol {
+		return nil
+	}
+	name := doc.toks[i+1].str
+	for _, def := range doc.defs {
+		if def.Name == name && def.Kind == "struct" {
+			return def.Fields
+		}
+	}
+	if rt := doc.env.LookupType(name); rt != nil && rt.UserStructDefn != nil {
+		var fields []string
+		for _, f := range rt.UserStructDefn.Fields {
+			if fh := (*SexpHash)(f); fh.NumKeys > 0 {
+				fields = append(fields, fh.Keys()[0].SexpString(nil))
+			}
+		}
+		return fields
+	}
+	return nil
+}
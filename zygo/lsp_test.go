@@ -0,0 +1,229 @@
+package zygo
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"testing"
+	"time"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+const lspSrc = `(defn square [x] (* x x))
+(struct Car [(field id:int64) (field name:string)])
+(func area [w:float64 h:float64] [a:float64] (* w h))
+(def c (Car id:1 name:"a"))
+(square (area 2.0 3.0))
+(hget)
+(defun half [x] (/ x 2))
+`
+
+// lspClient plays the editor's part.
+type lspClient struct {
+	w  io.Writer
+	r  *bufio.Reader
+	id int
+}
+
+func (c *lspClient) send(msg map[string]interface{}) {
+	msg["jsonrpc"] = "2.0"
+	panicOn(writeFramed(c.w, msg))
+}
+
+func (c *lspClient) read() map[string]interface{} {
+	buf, err := readFramed(c.r)
+	panicOn(err)
+	var m map[string]interface{}
+	panicOn(json.Unmarshal(buf, &m))
+	return m
+}
+
+func (c *lspClient) call(method string, params interface{}) interface{} {
+	c.id++
+	c.send(map[string]interface{}{"id": c.id, "method": method, "params": params})
+	m := c.read()
+	if e, ok := m["error"]; ok {
+		panic(e)
+	}
+	return m["result"]
+}
+
+// diagnostics sends a notification that changes the file, and
+// returns the messages of the diagnostics published for it.
+func (c *lspClient) diagnostics(method string, params interface{}) []string {
+	c.send(map[string]interface{}{"method": method, "params": params})
+	m := c.read()
+	var msgs []string
+	for _, d := range m["params"].(map[string]interface{})["diagnostics"].([]interface{}) {
+		msgs = append(msgs, d.(map[string]interface{})["message"].(string))
+	}
+	return msgs
+}
+
+func at(line, char int) map[string]interface{} {
+	return map[string]interface{}{
+		"textDocument": map[string]interface{}{"uri": "file:///prog.zy"},
+		"position":     map[string]interface{}{"line": line, "character": char},
+	}
+}
+
+func change(text string) map[string]interface{} {
+	return map[string]interface{}{
+		"textDocument":   map[string]interface{}{"uri": "file:///prog.zy", "version": 2},
+		"contentChanges": []map[string]interface{}{{"text": text}},
+	}
+}
+
+func labels(result interface{}) []string {
+	var ls []string
+	for _, item := range result.(map[string]interface{})["items"].([]interface{}) {
+		ls = append(ls, item.(map[string]interface{})["label"].(string))
+	}
+	return ls
+}
+
+func Test423LanguageServerProtocol(t *testing.T) {
+
+	cv.Convey(`zygo lsp should publish diagnostics for unbalanced forms, unknown functions and builtins given the wrong number of arguments, and complete, hover and go to definitions`, t, func() {
+		inR, inW := io.Pipe()
+		outR, outW := io.Pipe()
+		served := make(chan error, 1)
+		go func() {
+			served <- ServeLSP(inR, outW)
+			outW.Close()
+		}()
+		c := &lspClient{w: inW, r: bufio.NewReader(outR)}
+
+		caps := c.call("initialize", map[string]interface{}{"capabilities": map[string]interface{}{}})
+		cv.So(caps.(map[string]interface{})["capabilities"].(map[string]interface{})["hoverProvider"], cv.ShouldEqual, true)
+		c.send(map[string]interface{}{"method": "initialized", "params": map[string]interface{}{}})
+
+		diags := c.diagnostics("textDocument/didOpen", map[string]interface{}{
+			"textDocument": map[string]interface{}{"uri": "file:///prog.zy", "languageId": "zygo", "version": 1, "text": lspSrc},
+		})
+		cv.So(diags, cv.ShouldResemble, []string{
+			"hget takes 2 to 3 arguments, not 0",
+			"unknown function or special form 'defun'",
+		})
+
+		// hover, and go to definition
+		hover := c.call("textDocument/hover", at(4, 10)).(map[string]interface{})
+		cv.So(hover["contents"].(map[string]interface{})["value"], cv.ShouldContainSubstring, "(func area [w:float64 h:float64] [a:float64])")
+		hover = c.call("textDocument/hover", at(5, 2)).(map[string]interface{})
+		cv.So(hover["contents"].(map[string]interface{})["value"], cv.ShouldContainSubstring, "builtin function, takes 2 to 3 arguments")
+		def := c.call("textDocument/definition", at(4, 3)).(map[string]interface{})
+		cv.So(def["uri"], cv.ShouldEqual, "file:///prog.zy")
+		start := def["range"].(map[string]interface{})["start"].(map[string]interface{})
+		cv.So(start["line"], cv.ShouldEqual, 0)
+		cv.So(start["character"], cv.ShouldEqual, 6)
+		cv.So(c.call("textDocument/definition", at(4, 0)), cv.ShouldBeNil)
+
+		// half typed: what was defined is still completed.
+		diags = c.diagnostics("textDocument/didChange", change(lspSrc+"(Car n\n(squ"))
+		cv.So(diags, cv.ShouldResemble, []string{"'(' is not closed", "'(' is not closed"})
+		fields := labels(c.call("textDocument/completion", at(7, 6)))
+		cv.So(fields[0], cv.ShouldEqual, "name:")
+		cv.So(fields, cv.ShouldContain, "not")
+		cv.So(labels(c.call("textDocument/completion", at(8, 4))), cv.ShouldResemble, []string{"square"})
+		cv.So(labels(c.call("textDocument/completion", at(8, 3))), cv.ShouldContain, "square")
+
+		diags = c.diagnostics("textDocument/didChange", change("(defmac twice [x] ^(begin ~x ~x))\n(twice (println 1))\n"))
+		cv.So(len(diags), cv.ShouldEqual, 0)
+		cv.So(labels(c.call("textDocument/completion", at(1, 3))), cv.ShouldContain, "twice")
+
+		// a macro that never finishes is stopped, and so is one
+		// that waits forever.
+		diags = c.diagnostics("textDocument/didChange", change("(defmac m [] (for [(def i 0) true (set i 1)] 1) %1)\n(m)\n(hget)\n"))
+		cv.So(diags, cv.ShouldResemble, []string{
+			"resource limit MaxInstructions exceeded in m:10: 1000001 > 1000000",
+			"hget takes 2 to 3 arguments, not 0",
+		})
+		timeout := lspAnalysisTimeout
+		lspAnalysisTimeout = 100 * time.Millisecond
+		diags = c.diagnostics("textDocument/didChange", change("(defmac w [] (<! (makeChan)) %1)\n(w)\n"))
+		lspAnalysisTimeout = timeout
+		cv.So(diags, cv.ShouldResemble, []string{"execution cancelled in <!:-1: context deadline exceeded"})
+
+		cv.So(c.call("shutdown", nil), cv.ShouldBeNil)
+		c.send(map[string]interface{}{"method": "exit"})
+		cv.So(<-served, cv.ShouldBeNil)
+	})
+}
+
+func Test424BuiltinArity(t *testing.T) {
+
+	cv.Convey(`each arity the language server knows for a builtin should be the one the builtin checks for`, t, func() {
+		env := NewZlisp()
+		defer env.Stop()
+		env.StandardSetup()
+
+		// builtins check their argument count before or after
+		// the type of their first argument, so each count is
+		// tried with a few kinds of arguments.
+		h, err := MakeHash(nil, "hash", env)
+		panicOn(err)
+		firsts := []Sexp{SexpNull, h, &SexpArray{Env: env}, &SexpPointer{Target: &SexpInt{}}}
+		rests := []Sexp{SexpNull, &SexpInt{}}
+		wrongNargs := func(f *SexpFunction, n int) bool {
+			for _, first := range firsts {
+				for _, rest := range rests {
+					args := make([]Sexp, n)
+					for i := range args {
+						args[i] = rest
+					}
+					if n > 0 {
+						args[0] = first
+					}
+					var err error
+					func() {
+						defer func() { recover() }()
+						_, err = f.userfun(env, f.name, args)
+					}()
+					if err == WrongNargs {
+						return true
+					}
+				}
+			}
+			return false
+		}
+
+		// the builtins that are missing, or whose argument
+		// counts disagree with builtinArity.
+		var wrong []string
+		check := func(f *SexpFunction, n int, want bool) {
+			if wrongNargs(f, n) != want {
+				wrong = append(wrong, fmt.Sprintf("(%s) with %d arguments", f.name, n))
+			}
+		}
+		for name, a := range builtinArity {
+			x, _ := env.FindObject(name)
+			f, isFunc := x.(*SexpFunction)
+			if !isFunc || !f.user {
+				wrong = append(wrong, name+" is not a builtin")
+				continue
+			}
+			if a.min > 0 {
+				check(f, a.min-1, true)
+			}
+			if a.max >= 0 {
+				check(f, a.max+1, true)
+			}
+			// exit would exit, and dump takes its time.
+			if name == "exit" || name == "dump" {
+				continue
+			}
+			hi := a.max
+			if hi < 0 {
+				hi = a.min + 2
+			}
+			for n := a.min; n <= hi; n++ {
+				check(f, n, false)
+			}
+		}
+		sort.Strings(wrong)
+		cv.So(wrong, cv.ShouldBeEmpty)
+	})
+}
@@ -1 +1,303 @@
 package zygo
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/format"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const zygoImportPath = "github.com/glycerine/zygomys/zygo"
+
+// GenerateGo returns the Go source, in package pkg, of a struct
+// for each of the (struct ...) types named, and for the struct
+// types they refer to, along with a RegisterStructs func that
+// registers them all with GoStructRegistry under their zygo
+// names, as RegisterDemoStructs does the demo structs. Fields
+// keep their zygo names in their json and msg tags, so records
+// convert to and from the Go structs as they are; a field
+// declared with gotags: gets those tags instead.
+func (env *Zlisp) GenerateGo(pkg string, names ...string) ([]byte, error) {
+	g := &goGen{
+		env:     env,
+		pkg:     pkg,
+		imports: make(map[string]bool),
+		done:    make(map[string]bool),
+	}
+	if pkg != "zygo" {
+		g.qual = "zygo."
+		g.imports[zygoImportPath] = true
+	}
+	for _, name := range names {
+		rt := env.LookupType(name)
+		if rt == nil || rt.UserStructDefn == nil || rt.hasShadowStruct {
+			return nil, fmt.Errorf("'%s' is not a struct declared with (struct ...)", name)
+		}
+		g.want(rt.UserStructDefn)
+	}
+	if len(g.order) == 0 {
+		return nil, fmt.Errorf("no structs to generate")
+	}
+
+	var body bytes.Buffer
+	for i := 0; i < len(g.order); i++ {
+		// may add to g.order, as fields name other structs.
+		if err := g.genStruct(&body, g.order[i]); err != nil {
+			return nil, err
+		}
+	}
+	g.genRegister(&body)
+
+	var src bytes.Buffer
+	fmt.Fprintf(&src, "// Code generated by zygo; DO NOT EDIT.\n\npackage %s\n\n", pkg)
+	if len(g.imports) > 0 {
+		paths := make([]string, 0, len(g.imports))
+		for p := range g.imports {
+			paths = append(paths, p)
+		}
+		sort.Strings(paths)
+		fmt.Fprintf(&src, "import (\n")
+		for _, p := range paths {
+			fmt.Fprintf(&src, "\t%q\n", p)
+		}
+		fmt.Fprintf(&src, ")\n\n")
+	}
+	src.Write(body.Bytes())
+	return format.Source(src.Bytes())
+}
+
+// goGen holds the state of one GenerateGo call.
+type goGen struct {
+	env     *Zlisp
+	pkg     string
+	qual    string // how pkg refers to package zygo
+	imports map[string]bool
+	done    map[string]bool
+	order   []*RecordDefn
+}
+
+func (g *goGen) want(defn *RecordDefn) string {
+	if !g.done[defn.Name] {
+		g.done[defn.Name] = true
+		g.order = append(g.order, defn)
+	}
+	return goExportedName(defn.Name)
+}
+
+func (g *goGen) genStruct(w *bytes.Buffer, defn *RecordDefn) error {
+	fmt.Fprintf(w, "type %s struct {\n", goExportedName(defn.Name))
+	for _, f := range defn.Fields {
+		fh := (*SexpHash)(f)
+		if fh.NumKeys == 0 {
+			continue
+		}
+		name := fh.Keys()[0].(*SexpSymbol).name
+		typ, err := g.typeExpr(defn.FieldType[name])
+		if err != nil {
+			return fmt.Errorf("struct %s field %s: %s", defn.Name, name, err)
+		}
+		tags := fmt.Sprintf(`json:"%s" msg:"%s"`, name, name)
+		if e, err := fh.HashGet(nil, g.env.MakeSymbol("e")); err == nil {
+			if zid, isInt := e.(*SexpInt); isInt {
+				tags += fmt.Sprintf(` zid:"%d"`, zid.Val)
+			}
+		}
+		if gt, err := fh.HashGet(nil, g.env.MakeSymbol("gotags")); err == nil {
+			if s, isStr := gt.(*SexpStr); isStr {
+				tags = s.S
+			}
+		}
+		comment := ""
+		if d, err := fh.HashGet(nil, g.env.MakeSymbol("deprecated")); err == nil && IsTruthy(d) {
+			comment = " // deprecated"
+		}
+		fmt.Fprintf(w, "\t%s %s `%s`%s\n", goExportedName(name), typ, tags, comment)
+	}
+	fmt.Fprintf(w, "}\n\n")
+	return nil
+}
+
+func (g *goGen) genRegister(w *bytes.Buffer) {
+	fmt.Fprintf(w, "// RegisterStructs makes the structs above known to zygo.\n")
+	fmt.Fprintf(w, "func RegisterStructs() {\n\tgsr := &%sGoStructRegistry\n", g.qual)
+	for _, defn := range g.order {
+		fmt.Fprintf(w, "\tgsr.RegisterUserdef(&%sRegisteredType{GenDefMap: true, "+
+			"Factory: func(env *%sZlisp, h *%sSexpHash) (interface{}, error) {\n"+
+			"\t\treturn &%s{}, nil\n\t}}, true, %q)\n",
+			g.qual, g.qual, g.qual, goExportedName(defn.Name), defn.Name)
+	}
+	fmt.Fprintf(w, "}\n")
+}
+
+// typeExpr gives the Go type for a field of type rt.
+func (g *goGen) typeExpr(rt *RegisteredType) (string, error) {
+	if rt == nil {
+		return "interface{}", nil
+	}
+	if rt.hasShadowStruct && rt.TypeCache != nil && rt.TypeCache.Kind() == reflect.Ptr {
+		return g.goTypeName(rt.TypeCache.Elem()), nil
+	}
+	if rt.UserStructDefn != nil {
+		return g.want(rt.UserStructDefn), nil
+	}
+	name := rt.RegisteredName
+	switch {
+	case name == "[]":
+		return "[]interface{}", nil
+	case strings.HasPrefix(name, "[]"), strings.HasPrefix(name, "*"):
+		prefix := name[:1]
+		if prefix == "[" {
+			prefix = "[]"
+		}
+		elem := g.env.LookupType(name[len(prefix):])
+		if elem == nil {
+			return "", fmt.Errorf("unknown type '%s'", name[len(prefix):])
+		}
+		s, err := g.typeExpr(elem)
+		return prefix + s, err
+	}
+	switch name {
+	case "int", "int8", "int16", "int32", "int64", "rune",
+		"uint8", "uint16", "uint32", "uint64", "byte",
+		"float32", "float64", "complex64", "complex128",
+		"bool", "string", "error":
+		return name, nil
+	case "time.Time":
+		g.imports["time"] = true
+		return name, nil
+	case "hash":
+		return "map[string]interface{}", nil
+	}
+	return "interface{}", nil
+}
+
+// goTypeName names the Go struct type t from package pkg.
+func (g *goGen) goTypeName(t reflect.Type) string {
+	switch t.PkgPath() {
+	case "":
+		return t.String()
+	case zygoImportPath:
+		return g.qual + t.Name()
+	}
+	g.imports[t.PkgPath()] = true
+	return t.String()
+}
+
+// goExportedName makes an exported Go identifier of a zygo name.
+func goExportedName(name string) string {
+	r := []rune(name)
+	for i, c := range r {
+		if !unicode.IsLetter(c) && !unicode.IsDigit(c) {
+			r[i] = '_'
+		}
+	}
+	if len(r) == 0 || !unicode.IsLetter(r[0]) {
+		return "X" + string(r)
+	}
+	r[0] = unicode.ToUpper(r[0])
+	return string(r)
+}
+
+// DeclaredStructs lists the types that scripts have declared in
+// env with (struct ...), in the order declared.
+func (env *Zlisp) DeclaredStructs() []string {
+	var names []string
+	for _, name := range env.TypeRegistry().Names() {
+		rt := env.LookupType(name)
+		if rt != nil && rt.UserStructDefn != nil && !rt.hasShadowStruct &&
+			rt.UserStructDefn.Name == name {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// MakeGoFunction implements (makego ["pkg"] StructName ...),
+// returning the source of GenerateGo as a string; pkg defaults
+// to main.
+func MakeGoFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
+	pkg := "main"
+	if len(args) > 0 {
+		if s, isStr := args[0].(*SexpStr); isStr {
+			pkg = s.S
+			args = args[1:]
+		}
+	}
+	if len(args) == 0 {
+		return SexpNull, WrongNargs
+	}
+	names := make([]string, len(args))
+	for i, a := range args {
+		switch x := a.(type) {
+		case *RegisteredType:
+			names[i] = x.RegisteredName
+			if x.UserStructDefn != nil {
+				names[i] = x.UserStructDefn.Name
+			}
+		case *SexpSymbol:
+			names[i] = x.name
+		case *SexpStr:
+			names[i] = x.S
+		default:
+			return SexpNull, fmt.Errorf("%s: need struct types, not %T", name, a)
+		}
+	}
+	src, err := env.GenerateGo(pkg, names...)
+	if err != nil {
+		return SexpNull, fmt.Errorf("%s: %s", name, err)
+	}
+	return &SexpStr{S: string(src)}, nil
+}
+
+// GenMain implements `zygo gen`: it runs the scripts named in
+// args and writes the Go source for every struct they declare.
+func GenMain(args []string) error {
+	fs := flag.NewFlagSet("zygo gen", flag.ContinueOnError)
+	pkg := fs.String("pkg", "main", "package of the generated Go source")
+	out := fs.String("o", "", "file to write the Go source to (default stdout)")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: zygo gen [-pkg name] [-o file.go] script.zy ...\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("no scripts given")
+	}
+
+	env := NewZlisp()
+	defer env.Stop()
+	env.StandardSetup()
+	for _, fname := range fs.Args() {
+		f, err := os.Open(fname)
+		if err != nil {
+			return err
+		}
+		err = env.LoadFile(f)
+		f.Close()
+		if err == nil {
+			_, err = env.Run()
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", fname, err)
+		}
+	}
+
+	src, err := env.GenerateGo(*pkg, env.DeclaredStructs()...)
+	if err != nil {
+		return err
+	}
+	if *out == "" {
+		_, err = os.Stdout.Write(src)
+		return err
+	}
+	return ioutil.WriteFile(*out, src, 0644)
+}
@@ -0,0 +1,65 @@
+package zygo
+
+import (
+	"testing"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+func Test414MakegoGeneratesGoStructs(t *testing.T) {
+
+	cv.Convey(`(makego ...) should give the Go source of the structs declared, those they refer to, and a func to register them`, t, func() {
+		env := NewZlisp()
+		defer env.Stop()
+		env.StandardSetup()
+
+		x, err := env.EvalString(`
+(struct Cat [(field name: string)])
+(struct Car [
+  (field id:       int64       e:0 gotags:` + "`json:\"ID\"`" + `)
+  (field tags:     ([]string)  e:1)
+  (field next:     (* Car))
+  (field cats:     ([]Cat))
+  (field old:      bool        deprecated:true)
+])
+(makego "garage" Car)
+`)
+		panicOn(err)
+		cv.So(x.(*SexpStr).S, cv.ShouldEqual, `// Code generated by zygo; DO NOT EDIT.
+
+package garage
+
+import (
+	"github.com/glycerine/zygomys/zygo"
+)
+
+type Car struct {
+	Id   int64    `+"`json:\"ID\"`"+`
+	Tags []string `+"`json:\"tags\" msg:\"tags\" zid:\"1\"`"+`
+	Next *Car     `+"`json:\"next\" msg:\"next\"`"+`
+	Cats []Cat    `+"`json:\"cats\" msg:\"cats\"`"+`
+	Old  bool     `+"`json:\"old\" msg:\"old\"`"+` // deprecated
+}
+
+type Cat struct {
+	Name string `+"`json:\"name\" msg:\"name\"`"+`
+}
+
+// RegisterStructs makes the structs above known to zygo.
+func RegisterStructs() {
+	gsr := &zygo.GoStructRegistry
+	gsr.RegisterUserdef(&zygo.RegisteredType{GenDefMap: true, Factory: func(env *zygo.Zlisp, h *zygo.SexpHash) (interface{}, error) {
+		return &Car{}, nil
+	}}, true, "Car")
+	gsr.RegisterUserdef(&zygo.RegisteredType{GenDefMap: true, Factory: func(env *zygo.Zlisp, h *zygo.SexpHash) (interface{}, error) {
+		return &Cat{}, nil
+	}}, true, "Cat")
+}
+`)
+		cv.So(env.DeclaredStructs(), cv.ShouldResemble, []string{"Cat", "Car"})
+
+		_, err = env.EvalString(`(makego snoopy)`)
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(err.Error(), cv.ShouldContainSubstring, "not a struct declared")
+	})
+}
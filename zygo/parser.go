@@ -1,11 +1,14 @@
 package zygo
 
 import (
+	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"math"
 	"strconv"
+	"strings"
 	"sync"
 )
 
@@ -15,155 +18,114 @@ func init() {
 	NaN = math.NaN()
 }
 
+// Parser turns source text into expressions. It parses in
+// the caller's goroutine: input that ends in the middle of an
+// expression gives ErrMoreInputNeeded rather than waiting for
+// more.
 type Parser struct {
 	lexer *Lexer
 	env   *Zlisp
 
-	Done         chan bool
-	reqStop      chan bool
-	AddInput     chan io.RuneScanner
-	ReqReset     chan io.RuneScanner
-	ParsedOutput chan []ParserReply
-
-	mut               sync.Mutex
-	stopped           bool
-	sendMe            []ParserReply
-	FlagSendNeedInput bool
-}
-
-type ParserReply struct {
-	Expr []Sexp
-	Err  error
+	// input is what ResetAddNewInput and NewInput have given
+	// ParseTokens since it last ran, and held the text of an
+	// expression it could not finish, to parse again once the
+	// rest arrives. file is held's file name, if it has one.
+	input []io.RuneScanner
+	held  bytes.Buffer
+	file  string
+
+	// inUse is held for a whole parse; the Parser is shared
+	// by environments made with Clone and Duplicate.
+	inUse sync.Mutex
 }
 
 func (env *Zlisp) NewParser() *Parser {
-	p := &Parser{
-		env:          env,
-		Done:         make(chan bool),
-		reqStop:      make(chan bool),
-		ReqReset:     make(chan io.RuneScanner),
-		AddInput:     make(chan io.RuneScanner),
-		ParsedOutput: make(chan []ParserReply),
-		sendMe:       make([]ParserReply, 0, 1),
-	}
+	p := &Parser{env: env}
 	p.lexer = NewLexer(p)
 	return p
 }
 
+// Start and Stop are left over from when the parser ran in a
+// goroutine of its own; there is nothing to start or stop now.
+func (p *Parser) Start() {}
+
 func (p *Parser) Stop() error {
-	p.mut.Lock()
-	defer p.mut.Unlock()
-	if p.stopped {
-		return nil
-	}
-	p.stopped = true
-	close(p.reqStop)
-	<-p.Done
 	return nil
 }
 
-// Starts launches a background goroutine that runs an
-// infinite parsing loop.
-func (p *Parser) Start() {
-	go func() {
-		defer close(p.Done)
-		expressions := make([]Sexp, 0, SliceDefaultCap)
-
-		// maybe we already have input, be optimistic!
-		// no need to call p.GetMoreInput() before staring
-		// our loop.
-
-		for {
-			expr, err := p.ParseExpression(0)
-			if err != nil || expr == SexpEnd {
-				if err == ParserHaltRequested {
-					return
-				}
-				err = p.GetMoreInput(expressions, err)
-				if err == ParserHaltRequested {
-					return
-				}
-				// GetMoreInput will have delivered what we gave them. Reset since we
-				// don't own that memory any more.
-				expressions = make([]Sexp, 0, SliceDefaultCap)
-			} else {
-				// INVAR: err == nil && expr is not SexpEnd
-				expressions = append(expressions, expr)
-			}
-		}
-	}()
-}
-
-var ParserHaltRequested = fmt.Errorf("parser halt requested")
-var ResetRequested = fmt.Errorf("parser reset requested")
-
 var ErrMoreInputNeeded = fmt.Errorf("parser needs more input")
 
-// This function should *return* when it has more input
-// for the parser/lexer, which will call it when they get wedged.
+// ResetRequested was returned by the parser's old channel
+// interface when a reset was asked for.
 //
-// Listeners on p.ParsedOutput should know the Convention: sending
-// a length 0 []ParserReply on p.ParsedOutput channel means: we need more
-// input! They should send some in on p.AddInput channel; or request
-// a reset and simultaneously give us new input with p.ReqReset channel.
-func (p *Parser) GetMoreInput(deliverThese []Sexp, errorToReport error) error {
-
-	if len(deliverThese) == 0 && errorToReport == nil {
-		p.FlagSendNeedInput = true
-	} else {
-		p.sendMe = append(p.sendMe,
-			ParserReply{
-				Expr: deliverThese,
-				Err:  errorToReport,
-			})
-	}
+// Deprecated: never returned.
+var ResetRequested = fmt.Errorf("parser reset requested")
 
+// parse returns the expressions in streams, read one after
+// the other, along with where the lexer stopped.
+func (p *Parser) parse(streams ...io.RuneScanner) ([]Sexp, Pos, error) {
+	p.inUse.Lock()
+	defer p.inUse.Unlock()
+	p.lexer.Reset()
+	for _, s := range streams {
+		p.lexer.AddNextStream(s)
+	}
+	var xs []Sexp
 	for {
-		select {
-		case <-p.reqStop:
-			return ParserHaltRequested
-		case input := <-p.AddInput:
-			p.lexer.AddNextStream(input)
-			p.FlagSendNeedInput = false
-			return nil
-		case input := <-p.ReqReset:
-			p.lexer.Reset()
-			p.lexer.AddNextStream(input)
-			p.FlagSendNeedInput = false
-			return ResetRequested
-		case p.HaveStuffToSend() <- p.sendMe:
-			p.sendMe = make([]ParserReply, 0, 1)
-			p.FlagSendNeedInput = false
+		x, err := p.ParseExpression(0)
+		if err != nil {
+			return xs, p.lexer.Pos(), err
+		}
+		if x == SexpEnd {
+			return xs, p.lexer.Pos(), nil
 		}
+		xs = append(xs, x)
 	}
 }
 
-func (p *Parser) HaveStuffToSend() chan []ParserReply {
-	if len(p.sendMe) > 0 || p.FlagSendNeedInput {
-		return p.ParsedOutput
-	}
-	return nil
+// ParseString returns the expressions in src, comments
+// included, without loading them.
+func (env *Zlisp) ParseString(src string) ([]Sexp, error) {
+	return env.ParseReader(strings.NewReader(src))
 }
 
-func (p *Parser) Reset() {
-	select {
-	case p.ReqReset <- nil:
-	case <-p.reqStop:
+// ParseReader returns the expressions read from r, comments
+// included, without loading them.
+func (env *Zlisp) ParseReader(r io.Reader) ([]Sexp, error) {
+	rs, isScanner := r.(io.RuneScanner)
+	if !isScanner {
+		rs = bufio.NewReader(r)
 	}
+	return env.parseStream(rs)
 }
 
-func (p *Parser) NewInput(s io.RuneScanner) {
-	select {
-	case p.AddInput <- s:
-	case <-p.reqStop:
+// parseStream is ParseReader for a stream that may be a
+// SourceStream, so that positions carry its file name.
+func (env *Zlisp) parseStream(stream io.RuneScanner) ([]Sexp, error) {
+	xs, pos, err := env.parser.parse(stream)
+	if err != nil {
+		return nil, fmt.Errorf("%s: parse error: %v\n", pos, err)
 	}
+	return xs, nil
 }
 
+// ResetAddNewInput drops any input ParseTokens has held on to,
+// and gives it s to parse next.
 func (p *Parser) ResetAddNewInput(s io.RuneScanner) {
-	select {
-	case p.ReqReset <- s:
-	case <-p.reqStop:
-	}
+	p.Reset()
+	p.input = append(p.input, s)
+}
+
+// NewInput gives ParseTokens more input, following on from
+// what it has already seen.
+func (p *Parser) NewInput(s io.RuneScanner) {
+	p.input = append(p.input, s)
+}
+
+func (p *Parser) Reset() {
+	p.input = nil
+	p.held.Reset()
+	p.file = ""
 }
 
 var UnexpectedEnd error = errors.New("Unexpected end of input")
@@ -184,17 +146,8 @@ tokFilled:
 		if tok.typ != TokenEnd {
 			break tokFilled
 		}
-		// instead of returning UnexpectedEnd, we:
-		err = parser.GetMoreInput(nil, ErrMoreInputNeeded)
-		//Q("\n ParseList(depth=%d) got back from parser.GetMoreInput(): '%v'\n", depth, err)
-		switch err {
-		case ParserHaltRequested:
-			return SexpNull, err
-		case ResetRequested:
-			return SexpEnd, err
-		}
-		// have to still fill tok, so
-		// loop to the top to PeekNextToken
+		// the caller may have more to give us.
+		return SexpNull, ErrMoreInputNeeded
 	}
 
 	if tok.typ == TokenRParen {
@@ -270,15 +223,8 @@ func (parser *Parser) ParseArray(depth int) (Sexp, error) {
 			if tok.typ != TokenEnd {
 				break getTok
 			} else {
-				//instead of return SexpEnd, UnexpectedEnd
-				// we ask for more, and then loop
-				err = parser.GetMoreInput(nil, ErrMoreInputNeeded)
-				switch err {
-				case ParserHaltRequested:
-					return SexpNull, err
-				case ResetRequested:
-					return SexpEnd, err
-				}
+				// the caller may have more to give us.
+				return SexpNull, ErrMoreInputNeeded
 			}
 		}
 
@@ -319,12 +265,14 @@ func (parser *Parser) ParseExpression(depth int) (res Sexp, err error) {
 	switch tok.typ {
 	case TokenLParen:
 		exp, err := parser.ParseList(depth + 1)
+		setPos(exp, tok.pos)
 		return exp, err
 	case TokenLSquare:
 		exp, err := parser.ParseArray(depth + 1)
 		return exp, err
 	case TokenLCurly:
 		exp, err := parser.ParseInfix(depth + 1)
+		setPos(exp, tok.pos)
 		return exp, err
 	case TokenQuote:
 		expr, err := parser.ParseExpression(depth + 1)
@@ -434,28 +382,45 @@ func (parser *Parser) ParseExpression(depth int) (res Sexp, err error) {
 	return SexpNull, fmt.Errorf("Invalid syntax, don't know what to do with %v '%v'", tok.typ, tok)
 }
 
-// ParseTokens is the main service the Parser provides.
-// Currently returns first error encountered, ignoring
-// any expressions after that.
+// setPos records where a list began in the source, so
+// that the generator can tell the calls it makes from it.
+func setPos(x Sexp, pos Pos) {
+	if pair, isPair := x.(*SexpPair); isPair && pos.Line > 0 {
+		pair.Pos = &pos
+	}
+}
+
+// ParseTokens parses the input given to ResetAddNewInput and
+// NewInput. The REPL uses it to read an expression a line at a
+// time: if the input ends in the middle of an expression, it
+// returns ErrMoreInputNeeded and keeps the input, to parse again
+// together with what NewInput gives it next.
 func (p *Parser) ParseTokens() ([]Sexp, error) {
-	select {
-	case out := <-p.ParsedOutput:
-		Q("ParseTokens got p.ParsedOutput out: '%#v'", out)
-		r := make([]Sexp, 0)
-		for _, k := range out {
-			r = append(r, k.Expr...)
-			Q("\n ParseTokens k.Expr = '%v'\n\n", (&SexpArray{Val: k.Expr, Env: p.env}).SexpString(nil))
-			if k.Err != nil {
-				return r, k.Err
+	for _, in := range p.input {
+		if ss, isSource := in.(*SourceStream); isSource && p.held.Len() == 0 {
+			p.file = ss.File
+		}
+		for {
+			r, _, err := in.ReadRune()
+			if err != nil {
+				break
 			}
+			p.held.WriteRune(r)
 		}
-		return r, nil
-	case <-p.reqStop:
-		return nil, ErrShuttingDown
 	}
-}
+	p.input = nil
 
-var ErrShuttingDown error = fmt.Errorf("lexer shutting down")
+	var src io.RuneScanner = bytes.NewReader(p.held.Bytes())
+	if p.file != "" {
+		src = &SourceStream{RuneScanner: src, File: p.file}
+	}
+	xs, _, err := p.parse(src)
+	if err == ErrMoreInputNeeded {
+		return nil, err
+	}
+	p.Reset()
+	return xs, err
+}
 
 func (parser *Parser) ParseBlockComment(start *Token) (sx Sexp, err error) {
 	defer func() {
@@ -478,15 +443,7 @@ func (parser *Parser) ParseBlockComment(start *Token) (sx Sexp, err error) {
 			if tok.typ != TokenEnd {
 				break tokFilled
 			}
-			err = parser.GetMoreInput(nil, ErrMoreInputNeeded)
-			switch err {
-			case ParserHaltRequested:
-				return SexpNull, err
-			case ResetRequested:
-				return SexpEnd, err
-			}
-			// have to still fill tok, so
-			// loop to the top to PeekNextToken
+			return SexpNull, ErrMoreInputNeeded
 		}
 
 		// consume it
@@ -527,15 +484,8 @@ func (parser *Parser) ParseInfix(depth int) (Sexp, error) {
 			if tok.typ != TokenEnd {
 				break getTok
 			} else {
-				//instead of return SexpEnd, UnexpectedEnd
-				// we ask for more, and then loop
-				err = parser.GetMoreInput(nil, ErrMoreInputNeeded)
-				switch err {
-				case ParserHaltRequested:
-					return SexpNull, err
-				case ResetRequested:
-					return SexpEnd, err
-				}
+				// the caller may have more to give us.
+				return SexpNull, ErrMoreInputNeeded
 			}
 		}
 
@@ -0,0 +1,60 @@
+package zygo
+
+import (
+	"bufio"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	cv "github.com/glycerine/goconvey/convey"
+)
+
+func Test418SynchronousParser(t *testing.T) {
+
+	cv.Convey(`parsing should happen in the caller's goroutine: environments need no Stop, ParseString and ParseReader return every expression, and the REPL can still read an expression a line at a time`, t, func() {
+		before := runtime.NumGoroutine()
+		for i := 0; i < 100; i++ {
+			env := NewZlisp()
+			_, err := env.EvalString(`(+ 1 2)`)
+			cv.So(err, cv.ShouldBeNil)
+		}
+		time.Sleep(10 * time.Millisecond)
+		cv.So(runtime.NumGoroutine(), cv.ShouldBeLessThanOrEqualTo, before)
+
+		env := NewZlisp()
+		xs, err := env.ParseString("(a b) ; c\n[1 2]")
+		cv.So(err, cv.ShouldBeNil)
+		cv.So((&SexpArray{Val: xs, Env: env}).SexpString(nil), cv.ShouldEqual, `[(a b) ; c [1 2]]`)
+
+		xs, err = env.ParseReader(strings.NewReader(`{a:1}`))
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(len(xs), cv.ShouldEqual, 1)
+
+		_, err = env.ParseString(`(a (b`)
+		cv.So(err, cv.ShouldNotBeNil)
+		cv.So(err.Error(), cv.ShouldContainSubstring, ErrMoreInputNeeded.Error())
+
+		// line at a time
+		env.parser.ResetAddNewInput(strings.NewReader("(a) (b\n"))
+		xs, err = env.parser.ParseTokens()
+		cv.So(err, cv.ShouldEqual, ErrMoreInputNeeded)
+		cv.So(len(xs), cv.ShouldEqual, 0)
+		env.parser.NewInput(strings.NewReader("/* c\n"))
+		_, err = env.parser.ParseTokens()
+		cv.So(err, cv.ShouldEqual, ErrMoreInputNeeded)
+		env.parser.NewInput(strings.NewReader("*/ c)\n"))
+		xs, err = env.parser.ParseTokens()
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(len(xs), cv.ShouldEqual, 2)
+
+		pr := &Prompter{}
+		in := bufio.NewReader(strings.NewReader("(+ 1\n2)\n(def s \"x\n"))
+		line, xs, err := pr.getExpressionWithLiner(env, in, true)
+		cv.So(err, cv.ShouldBeNil)
+		cv.So(line, cv.ShouldEqual, "(+ 1\n2)")
+		cv.So(xs[0].SexpString(nil), cv.ShouldEqual, `(+ 1 2)`)
+		_, _, err = pr.getExpressionWithLiner(env, in, true)
+		cv.So(err, cv.ShouldNotBeNil)
+	})
+}
@@ -0,0 +1,74 @@
+package zygo
+
+// PosError is a runtime error together with the source
+// position of the call that failed, as in
+//
+//	config.zy:42:7: Error calling '+': ...
+type PosError struct {
+	Pos Pos
+	Err error
+}
+
+func (e *PosError) Error() string {
+	return e.Pos.String() + ": " + e.Err.Error()
+}
+
+func (e *PosError) Unwrap() error {
+	return e.Err
+}
+
+type positioned interface {
+	Position() *Pos
+}
+
+// PosAt returns the source position of the instruction at pc
+// in f. Arguments are evaluated before the call that uses them,
+// so for an instruction without a position of its own we take
+// that of the next call that has one.
+func (f *SexpFunction) PosAt(pc int) *Pos {
+	if pc < 0 {
+		return nil
+	}
+	for i := pc; i < len(f.fun); i++ {
+		if p, ok := f.fun[i].(positioned); ok && p.Position() != nil {
+			return p.Position()
+		}
+	}
+	return nil
+}
+
+// positionError attaches the position of the instruction that
+// failed, fun's instruction pc, to err. Nested Runs (from
+// builtins like apply) leave that to the outermost Run, so
+// the position names the script's call, and messages that
+// builtins wrap are not littered with positions.
+func (env *Zlisp) positionError(fun *SexpFunction, pc int, err error) error {
+	switch e := err.(type) {
+	case *CancelledError, *ResourceLimitExceeded, *StackOverflow, *PosError:
+		return err
+	case *SexpError:
+		if e.Pos == nil {
+			e.Pos = fun.PosAt(pc)
+		}
+		return err
+	}
+	if env.runDepth > 1 {
+		return err
+	}
+	if pos := fun.PosAt(pc); pos != nil {
+		return &PosError{Pos: *pos, Err: err}
+	}
+	return err
+}
+
+// errorWithoutPos gives the message of err without the
+// leading source position, if any.
+func errorWithoutPos(err error) string {
+	switch e := err.(type) {
+	case *PosError:
+		return e.Err.Error()
+	case *SexpError:
+		return e.error.Error()
+	}
+	return err.Error()
+}
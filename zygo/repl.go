@@ -2,7 +2,6 @@ package zygo
 
 import (
 	"bufio"
-	"bytes"
 	"encoding/gob"
 	"fmt"
 	"io"
@@ -94,19 +93,11 @@ func (pr *Prompter) getExpressionWithLiner(env *Zlisp, reader *bufio.Reader, noL
 		return "", nil, err
 	}
 
-	err = UnexpectedEnd
-	var x []Sexp
-
 	// test parse, but don't load or generate bytecode
-	env.parser.ResetAddNewInput(bytes.NewBuffer([]byte(line + "\n")))
-	x, err = env.parser.ParseTokens()
-	//P("\n after ResetAddNewInput, err = %v. x = '%s'\n", err, SexpArray(x).SexpString())
-
-	if len(x) > 0 {
-		xs = append(xs, x...)
-	}
+	env.parser.ResetAddNewInput(strings.NewReader(line + "\n"))
+	xs, err = env.parser.ParseTokens()
 
-	for err == ErrMoreInputNeeded || err == UnexpectedEnd || err == ResetRequested {
+	for err == ErrMoreInputNeeded {
 		if noLiner {
 			fmt.Printf(continuationPrompt)
 			nextline, err = getLine(reader)
@@ -114,31 +105,15 @@ func (pr *Prompter) getExpressionWithLiner(env *Zlisp, reader *bufio.Reader, noL
 			nextline, err = pr.Getline(&continuationPrompt)
 		}
 		if err != nil {
+			env.parser.Reset()
 			return "", nil, err
 		}
-		env.parser.NewInput(bytes.NewBuffer([]byte(nextline + "\n")))
-		x, err = env.parser.ParseTokens()
-		if len(x) > 0 {
-			for i := range x {
-				if x[i] == SexpEnd {
-					P("found an SexpEnd token, omitting it")
-					continue
-				}
-				xs = append(xs, x[i])
-			}
-		}
-		switch err {
-		case nil:
-			line += "\n" + nextline
-			Q("no problem parsing line '%s' into '%s', proceeding...\n", line, (&SexpArray{Val: x, Env: env}).SexpString(nil))
-			return line, xs, nil
-		case ResetRequested:
-			continue
-		case ErrMoreInputNeeded:
-			continue
-		default:
-			return "", nil, fmt.Errorf("Error on line %d: %v\n", env.parser.lexer.Linenum(), err)
-		}
+		line += "\n" + nextline
+		env.parser.NewInput(strings.NewReader(nextline + "\n"))
+		xs, err = env.parser.ParseTokens()
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("Error on line %d: %v\n", env.parser.lexer.Linenum(), err)
 	}
 	return line, xs, nil
 }
@@ -183,6 +158,8 @@ func Repl(env *Zlisp, cfg *ZlispConfig) {
 		pr = &Prompter{prompt: cfg.Prompt}
 	}
 	infixSym := env.MakeSymbol("infix")
+	debug := &replDebugger{pr: pr, reader: reader, noLiner: cfg.NoLiner, out: os.Stdout,
+		sources: make(map[string][]string)}
 
 	for {
 		line, exprsInput, err := pr.getExpressionWithLiner(env, reader, cfg.NoLiner)
@@ -281,6 +258,15 @@ func Repl(env *Zlisp, cfg *ZlispConfig) {
 			continue
 		}
 
+		if debugCommands[first] {
+			d := env.Debugger()
+			if d.OnStop == nil {
+				d.OnStop = debug.onStop
+			}
+			replDebugCommand(d, os.Stdout, line, false)
+			continue
+		}
+
 		var expr Sexp
 		n := len(exprsInput)
 		if n > 0 {
@@ -440,9 +426,9 @@ func ReplMain(cfg *ZlispConfig) {
 		RegisterDemoStructs()
 	}
 	if cfg.Sandboxed {
-		env = NewZlispSandbox()
+		env = NewZlispSandbox(WithStackSizes(cfg.Stacks))
 	} else {
-		env = NewZlisp()
+		env = NewZlisp(WithStackSizes(cfg.Stacks))
 	}
 	env.StandardSetup()
 	if cfg.LoadDemoStructs {
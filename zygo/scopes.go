@@ -5,13 +5,19 @@ import (
 	"fmt"
 	"sort"
 	"strings"
+	"sync"
 )
 
 // Scopes map names to values. Scope nesting avoids variable name collisions and
 // allows namespace maintainance. Most scopes (inside loops, inside functions)
 // are implicitly created. Packages are scopes that the user can manipulate
 // explicitly.
+//
+// A scope may be shared between goroutines (the global scope
+// always is, with every (go ...) block), so Map must only be
+// touched with mut held; use get, set and del.
 type Scope struct {
+	mut         sync.RWMutex
 	Map         map[int]Sexp
 	IsGlobal    bool
 	Name        string
@@ -66,13 +72,47 @@ func (env *Zlisp) NewNamedScope(name string) *Scope {
 
 func (s *Scope) CloneScope() *Scope {
 	n := s.env.NewScope()
+	s.mut.RLock()
 	for k, v := range s.Map {
 		n.Map[k] = v
 	}
+	s.mut.RUnlock()
 	return n
 }
 
-func (s Scope) IsStackElem() {}
+func (s *Scope) get(num int) (Sexp, bool) {
+	s.mut.RLock()
+	defer s.mut.RUnlock()
+	v, ok := s.Map[num]
+	return v, ok
+}
+
+func (s *Scope) set(num int, v Sexp) {
+	s.mut.Lock()
+	s.Map[num] = v
+	s.mut.Unlock()
+}
+
+// setIfPresent updates num only if it is already bound.
+func (s *Scope) setIfPresent(num int, v Sexp) bool {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	_, found := s.Map[num]
+	if found {
+		s.Map[num] = v
+	}
+	return found
+}
+
+func (s *Scope) del(num int) bool {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	_, found := s.Map[num]
+	delete(s.Map, num)
+	return found
+}
+
+func (s *Scope) IsStackElem() {}
 
 func (stack *Stack) PushScope() {
 	s := stack.env.NewScope()
@@ -103,11 +143,11 @@ func (stack *Stack) lookupSymbol(sym *SexpSymbol, minFrame int, setVal *Sexp) (S
 			}
 			switch scope := elem.(type) {
 			case (*Scope):
-				expr, ok := scope.Map[sym.number]
+				expr, ok := scope.get(sym.number)
 				if ok {
 					//P("lookupSymbol at stack scope# i=%v, we found sym '%s' with value '%s'", i, sym.name, expr.SexpString(0))
 					if setVal != nil {
-						scope.Map[sym.number] = *setVal
+						scope.set(sym.number, *setVal)
 					}
 					return expr, nil, scope
 				}
@@ -147,7 +187,7 @@ func (stack *Stack) LookupSymbolUntilFunction(sym *SexpSymbol, setVal *Sexp) (Se
 			switch scope := elem.(type) {
 			case (*Scope):
 				VPrintf("   ...looking up in scope '%s'\n", scope.Name)
-				expr, ok := scope.Map[sym.number]
+				expr, ok := scope.get(sym.number)
 				if ok {
 					if setVal != nil {
 						scope.UpdateSymbolInScope(sym, *setVal)
@@ -189,9 +229,12 @@ func (stack *Stack) BindSymbol(sym *SexpSymbol, expr Sexp) error {
 	if stack.IsEmpty() {
 		panic("empty stack!!")
 	}
-	cur, already := stack.elements[stack.tos].(*Scope).Map[sym.number]
+	scope := stack.elements[stack.tos].(*Scope)
+	scope.mut.Lock()
+	defer scope.mut.Unlock()
+	cur, already := scope.Map[sym.number]
 	if already {
-		Q("BindSymbol already sees symbol %v, currently bound to '%v'", sym.name, cur.SexpString(nil))
+		Q("BindSymbol already sees symbol %v, currently bound to '%v'", sym.name, cur)
 
 		lhsTy := cur.Type()
 		rhsTy := expr.Type()
@@ -199,7 +242,7 @@ func (stack *Stack) BindSymbol(sym *SexpSymbol, expr Sexp) error {
 			// for backcompat with closure.zy, just do the binding for now if the LHS isn't typed.
 			//return fmt.Errorf("left-hand-side had nil type")
 			// TODO: fix this? or require removal of previous symbol binding to avoid type errors?
-			stack.elements[stack.tos].(*Scope).Map[sym.number] = expr
+			scope.Map[sym.number] = expr
 			return nil
 		}
 		if rhsTy == nil {
@@ -211,11 +254,11 @@ func (stack *Stack) BindSymbol(sym *SexpSymbol, expr Sexp) error {
 		}
 
 		// both sides have type
-		Q("BindSymbol: both sides have type. rhs=%v, lhs=%v", rhsTy.SexpString(nil), lhsTy.SexpString(nil))
+		Q("BindSymbol: both sides have type. rhs=%v, lhs=%v", rhsTy, lhsTy)
 
 		if lhsTy == rhsTy {
 			Q("BindSymbol: YES types match exactly. Good.")
-			stack.elements[stack.tos].(*Scope).Map[sym.number] = expr
+			scope.Map[sym.number] = expr
 			return nil
 		}
 
@@ -234,7 +277,7 @@ func (stack *Stack) BindSymbol(sym *SexpSymbol, expr Sexp) error {
 		if lhsTy.TypeCache != nil && rhsTy.TypeCache != nil {
 			if rhsTy.TypeCache.AssignableTo(lhsTy.TypeCache) {
 				Q("BindSymbol: YES: rhsTy.TypeCache (%v) is AssigntableTo(lhsTy.TypeCache) (%v). Good.", rhsTy.TypeCache, lhsTy.TypeCache)
-				stack.elements[stack.tos].(*Scope).Map[sym.number] = expr
+				scope.Map[sym.number] = expr
 				return nil
 			}
 		}
@@ -243,7 +286,7 @@ func (stack *Stack) BindSymbol(sym *SexpSymbol, expr Sexp) error {
 	} else {
 		Q("BindSymbol: new symbol %v", sym.name)
 	}
-	stack.elements[stack.tos].(*Scope).Map[sym.number] = expr
+	scope.Map[sym.number] = expr
 	return nil
 }
 
@@ -252,32 +295,29 @@ func (stack *Stack) DeleteSymbolFromTopOfStackScope(sym *SexpSymbol) error {
 		panic("empty stack!!")
 		//return errors.New("no scope available")
 	}
-	_, present := stack.elements[stack.tos].(*Scope).Map[sym.number]
+	present := stack.elements[stack.tos].(*Scope).del(sym.number)
 	if !present {
 		return fmt.Errorf("symbol `%s` not found", sym.name)
 	}
-	delete(stack.elements[stack.tos].(*Scope).Map, sym.number)
 	return nil
 }
 
 // used to implement (set v 10)
 func (scope *Scope) UpdateSymbolInScope(sym *SexpSymbol, expr Sexp) error {
 
-	_, found := scope.Map[sym.number]
+	found := scope.setIfPresent(sym.number, expr)
 	if !found {
 		return fmt.Errorf("symbol `%s` not found", sym.name)
 	}
-	scope.Map[sym.number] = expr
 	return nil
 }
 
 func (scope *Scope) DeleteSymbolInScope(sym *SexpSymbol) error {
 
-	_, found := scope.Map[sym.number]
+	found := scope.del(sym.number)
 	if !found {
 		return fmt.Errorf("symbol `%s` not found", sym.name)
 	}
-	delete(scope.Map, sym.number)
 	return nil
 }
 
@@ -316,13 +356,19 @@ func (scop *Scope) Show(env *Zlisp, ps *PrintState, label string) (s string, err
 		s += fmt.Sprintf("%s (global scope - omitting content for brevity)\n", rep4)
 		return
 	}
-	if len(scop.Map) == 0 {
+	scop.mut.RLock()
+	vals := make(map[int]Sexp, len(scop.Map))
+	for k, v := range scop.Map {
+		vals[k] = v
+	}
+	scop.mut.RUnlock()
+	if len(vals) == 0 {
 		s += fmt.Sprintf("%s empty-scope: no symbols\n", rep4)
 		return
 	}
 	sortme := []*SymtabE{}
-	for symbolNumber, val := range scop.Map {
-		symbolName := env.revsymtable[symbolNumber]
+	for symbolNumber, val := range vals {
+		symbolName := env.symtable.name(symbolNumber)
 		sortme = append(sortme, &SymtabE{Key: symbolName, Val: val.SexpString(ps)})
 	}
 	sort.Sort(SymtabSorter(sortme))
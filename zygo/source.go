@@ -2,7 +2,6 @@ package zygo
 
 import (
 	"bufio"
-	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -80,18 +79,16 @@ func (env *Zlisp) SourceExpressions(expressions []Sexp) error {
 }
 
 func (env *Zlisp) SourceStream(stream io.RuneScanner) error {
-	env.parser.ResetAddNewInput(stream)
-	expressions, err := env.parser.ParseTokens()
+	expressions, err := env.parseStream(stream)
 	if err != nil {
-		return errors.New(fmt.Sprintf(
-			"Error parsing on line %d: %v\n", env.parser.lexer.Linenum(), err))
+		return err
 	}
 
 	return env.SourceExpressions(expressions)
 }
 
 func (env *Zlisp) SourceFile(file *os.File) error {
-	return env.SourceStream(bufio.NewReader(file))
+	return env.SourceStream(&SourceStream{RuneScanner: bufio.NewReader(file), File: file.Name()})
 }
 
 func SourceFileFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
@@ -138,25 +138,15 @@ func (stack *Stack) Get(n int) (StackElem, error) {
 	return stack.elements[stack.tos-n], nil
 }
 
+// Pop shrinks the stack in place; closures that capture a
+// stack of scopes take a Clone, so nothing else shares its
+// elements.
 func (stack *Stack) Pop() (StackElem, error) {
-	// always make a new array,
-	// so we can use for the closure stack-of-scopes.
-
 	elem, err := stack.Get(0)
 	if err != nil {
 		return nil, err
 	}
-
-	// invar n > 0
-	n := stack.Size()
-	if n == 0 {
-		return nil, fmt.Errorf("Stack.Pop() on emtpy stack")
-	}
-
-	el := make([]StackElem, n-1)
-	copy(el, stack.elements)
-	stack.elements = el
-	stack.tos--
+	stack.TruncateToSize(stack.tos)
 	return elem, nil
 }
 
@@ -194,9 +184,18 @@ func (stack *Stack) Show(env *Zlisp, ps *PrintState, label string) (string, erro
 
 // set newsize to 0 to truncate everything
 func (stack *Stack) TruncateToSize(newsize int) {
-	el := make([]StackElem, newsize)
-	copy(el, stack.elements)
-	stack.elements = el
+	n := len(stack.elements)
+	if newsize < n {
+		// clear what we drop, so it can be collected.
+		for i := newsize; i < n; i++ {
+			stack.elements[i] = nil
+		}
+		stack.elements = stack.elements[:newsize]
+	} else {
+		for len(stack.elements) < newsize {
+			stack.elements = append(stack.elements, nil)
+		}
+	}
 	stack.tos = newsize - 1
 }
 
@@ -235,7 +234,7 @@ func (s *Stack) nestedPathGetSet(env *Zlisp, dotpaths []string, setVal *Sexp) (S
 			}
 
 			// assign now
-			scop.Map[curSym.number] = *setVal
+			scop.set(curSym.number, *setVal)
 			// done with SET
 			return *setVal, nil
 		}
@@ -0,0 +1,191 @@
+package zygo
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A zygo struct tag gives a field the name that records use for
+// it, apart from its json name, and may mark it required or give
+// it a default:
+//
+//	Port int `json:"port_number" zygo:"port,required"`
+//	Host string `zygo:"host,default=localhost"`
+//	Secret string `zygo:"-"`
+//
+// The name may be left empty to keep the json (or Go) name.
+// A field named "-" is left out of records. A default, if any,
+// must come last, as it runs to the end of the tag. The json
+// tag is read as encoding/json reads it: its name comes before
+// any options like omitempty, and a field it names "-" is left
+// out unless the zygo tag names it.
+type fieldTag struct {
+	Key        string
+	Skip       bool
+	Required   bool
+	HasDefault bool
+	Default    string
+	OmitEmpty  bool
+}
+
+// parseFieldTag gives the record key and options for fld.
+func parseFieldTag(fld reflect.StructField) (ft fieldTag) {
+	ft.Key = fld.Name
+	if jsonTag, ok := fld.Tag.Lookup("json"); ok {
+		parts := strings.Split(jsonTag, ",")
+		switch {
+		case jsonTag == "-":
+			ft.Skip = true
+		case parts[0] != "":
+			ft.Key = parts[0]
+		}
+		for _, opt := range parts[1:] {
+			if opt == "omitempty" {
+				ft.OmitEmpty = true
+			}
+		}
+	}
+	tag, ok := fld.Tag.Lookup("zygo")
+	if !ok {
+		return
+	}
+	if tag == "-" {
+		ft.Skip = true
+		return
+	}
+	parts := strings.Split(tag, ",")
+	if parts[0] != "" {
+		ft.Key = parts[0]
+		ft.Skip = false
+	}
+	for i := 1; i < len(parts); i++ {
+		switch {
+		case parts[i] == "required":
+			ft.Required = true
+		case strings.HasPrefix(parts[i], "default="):
+			ft.HasDefault = true
+			ft.Default = strings.Join(parts[i:], ",")[len("default="):]
+			return
+		}
+	}
+	return
+}
+
+// setFieldDefault parses the text of a default into fld.
+func setFieldDefault(fld reflect.Value, text string) error {
+	if fld.Type() == durationType {
+		d, err := time.ParseDuration(text)
+		if err != nil {
+			return err
+		}
+		fld.SetInt(int64(d))
+		return nil
+	}
+	switch fld.Kind() {
+	case reflect.String:
+		fld.SetString(text)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(text)
+		if err != nil {
+			return err
+		}
+		fld.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(text, 0, fld.Type().Bits())
+		if err != nil {
+			return err
+		}
+		fld.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, err := strconv.ParseUint(text, 0, fld.Type().Bits())
+		if err != nil {
+			return err
+		}
+		fld.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(text, fld.Type().Bits())
+		if err != nil {
+			return err
+		}
+		fld.SetFloat(f)
+	default:
+		return fmt.Errorf("no defaults for %s fields", fld.Type())
+	}
+	return nil
+}
+
+// fillDefaults sets the fields of the Go struct that dst points
+// to that have a default and that record h does not give.
+func (h *SexpHash) fillDefaults(env *Zlisp, dst reflect.Value) error {
+	for _, det := range h.DetOrder {
+		if !det.HasDefault {
+			continue
+		}
+		if val, _ := h.HashGetDefault(env, env.MakeSymbol(det.FieldJsonTag), SexpEnd); val != SexpEnd {
+			continue
+		}
+		fld := dst.Elem()
+		for _, p := range det.EmbedPath {
+			if fld.Kind() == reflect.Ptr {
+				if fld.IsNil() {
+					fld.Set(reflect.New(fld.Type().Elem()))
+				}
+				fld = fld.Elem()
+			}
+			fld = fld.Field(p.ChildFieldNum)
+		}
+		if err := setFieldDefault(fld, det.Default); err != nil {
+			return fmt.Errorf("default for %s.%s: %s", h.TypeName, det.FieldJsonTag, err)
+		}
+	}
+	return nil
+}
+
+// checkFields type checks the fields of record h, reports the
+// required ones it lacks, and does the same for the records it
+// holds, naming any culprit by its full path from path.
+func (h *SexpHash) checkFields(path string, seen map[*SexpHash]bool) error {
+	if seen[h] {
+		return nil
+	}
+	seen[h] = true
+
+	for _, det := range h.DetOrder {
+		if !det.Required {
+			continue
+		}
+		if val, _ := h.HashGetDefault(h.Env, h.Env.MakeSymbol(det.FieldJsonTag), SexpEnd); val == SexpEnd {
+			return fmt.Errorf("%s.%s: missing required field", path, det.FieldJsonTag)
+		}
+	}
+	for _, key := range h.Keys() {
+		val, _ := h.HashGet(h.Env, key)
+		sub := path + "." + key.SexpString(nil)
+		if h.TypeName != "hash" {
+			if err := h.TypeCheckField(key, val); err != nil {
+				return fmt.Errorf("%s: %s", sub, err)
+			}
+		}
+		if err := checkHeldFields(val, sub, seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkHeldFields(val Sexp, path string, seen map[*SexpHash]bool) error {
+	switch x := val.(type) {
+	case *SexpHash:
+		return x.checkFields(path, seen)
+	case *SexpArray:
+		for i, ele := range x.Val {
+			if err := checkHeldFields(ele, fmt.Sprintf("%s[%d]", path, i), seen); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
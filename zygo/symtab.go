@@ -0,0 +1,129 @@
+package zygo
+
+import (
+	"strconv"
+	"sync"
+)
+
+// symbolTable interns symbol names as numbers. One table is
+// shared by an environment and every environment made from
+// it by Clone or Duplicate, such as those running (go ...)
+// blocks, so that a symbol number means the same thing in
+// all of them; hence the lock.
+type symbolTable struct {
+	mut    sync.RWMutex
+	byName map[string]int
+	byNum  map[int]string
+	next   int
+}
+
+func newSymbolTable() *symbolTable {
+	return &symbolTable{
+		byName: make(map[string]int),
+		byNum:  make(map[int]string),
+		next:   1,
+	}
+}
+
+// intern returns the number for name, assigning
+// the next free number if name is new.
+func (t *symbolTable) intern(name string) int {
+	t.mut.RLock()
+	num, ok := t.byName[name]
+	t.mut.RUnlock()
+	if ok {
+		return num
+	}
+
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	num, ok = t.byName[name]
+	if ok {
+		return num
+	}
+	num = t.next
+	t.next++
+	t.byName[name] = num
+	t.byNum[num] = name
+	return num
+}
+
+// gensym interns and returns a name starting with
+// prefix that no symbol has used before.
+func (t *symbolTable) gensym(prefix string) string {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	for {
+		name := prefix + strconv.Itoa(t.next)
+		if _, taken := t.byName[name]; !taken {
+			num := t.next
+			t.next++
+			t.byName[name] = num
+			t.byNum[num] = name
+			return name
+		}
+		t.next++
+	}
+}
+
+func (t *symbolTable) lookup(name string) (int, bool) {
+	t.mut.RLock()
+	defer t.mut.RUnlock()
+	num, ok := t.byName[name]
+	return num, ok
+}
+
+func (t *symbolTable) name(num int) string {
+	t.mut.RLock()
+	defer t.mut.RUnlock()
+	return t.byNum[num]
+}
+
+// each calls f on every entry, on a copy taken under the lock.
+func (t *symbolTable) each(f func(name string, num int)) {
+	t.mut.RLock()
+	cp := make(map[string]int, len(t.byName))
+	for k, v := range t.byName {
+		cp[k] = v
+	}
+	t.mut.RUnlock()
+	for k, v := range cp {
+		f(k, v)
+	}
+}
+
+// macroTable holds the macros by symbol number. Like the
+// symbolTable, it is shared with Clone and Duplicate
+// environments, and (defmac) may write it at any time.
+type macroTable struct {
+	mut sync.RWMutex
+	m   map[int]*SexpFunction
+}
+
+func newMacroTable() *macroTable {
+	return &macroTable{m: make(map[int]*SexpFunction)}
+}
+
+func (t *macroTable) get(num int) (*SexpFunction, bool) {
+	t.mut.RLock()
+	defer t.mut.RUnlock()
+	f, ok := t.m[num]
+	return f, ok
+}
+
+func (t *macroTable) set(num int, f *SexpFunction) {
+	t.mut.Lock()
+	t.m[num] = f
+	t.mut.Unlock()
+}
+
+// snapshot returns a copy of the table.
+func (t *macroTable) snapshot() map[int]*SexpFunction {
+	t.mut.RLock()
+	defer t.mut.RUnlock()
+	cp := make(map[int]*SexpFunction, len(t.m))
+	for k, v := range t.m {
+		cp[k] = v
+	}
+	return cp
+}
@@ -0,0 +1,120 @@
+package zygo
+
+import (
+	"errors"
+	"fmt"
+)
+
+// tryHandler records where a (try) was entered, so that an
+// error inside it can unwind the stacks back to that point
+// and continue at the catch (or finally) code.
+type tryHandler struct {
+	fun         *SexpFunction
+	catchPc     int
+	runDepth    int
+	datastack   int
+	linearstack int
+	addrstack   int
+}
+
+// catchError is called by Run when an instruction fails. If a
+// handler installed by the current Run is open, the stacks are
+// restored, the error is pushed as a *SexpError, and catchError
+// returns true. Cancellation and resource limits are never caught.
+func (env *Zlisp) catchError(err error) bool {
+	switch err.(type) {
+	case *CancelledError, *ResourceLimitExceeded:
+		return false
+	}
+	n := len(env.handlers)
+	if n == 0 {
+		return false
+	}
+	h := env.handlers[n-1]
+	if h.runDepth != env.runDepth {
+		return false
+	}
+	env.handlers = env.handlers[:n-1]
+
+	var sxerr *SexpError
+	switch e := err.(type) {
+	case *SexpError:
+		sxerr = e
+	case *PosError:
+		sxerr = &SexpError{error: e.Err, Func: env.curfunc.name, Pc: env.pc, Pos: &e.Pos}
+	default:
+		sxerr = &SexpError{error: err, Func: env.curfunc.name, Pc: env.pc}
+	}
+
+	env.datastack.TruncateToSize(h.datastack)
+	env.linearstack.TruncateToSize(h.linearstack)
+	env.addrstack.TruncateToSize(h.addrstack)
+	env.curfunc = h.fun
+	env.pc = h.catchPc
+	env.datastack.PushExpr(sxerr)
+	return true
+}
+
+// dropHandlers forgets the handlers of frames that are gone:
+// those of a Run at depth runDepth or deeper, and those from
+// functions whose return left addrstack shallower than it
+// was when their try began.
+func (env *Zlisp) dropHandlers(runDepth int) {
+	n := len(env.handlers)
+	for n > 0 {
+		h := env.handlers[n-1]
+		if h.runDepth < runDepth && h.addrstack <= env.addrstack.Size() {
+			break
+		}
+		n--
+	}
+	env.handlers = env.handlers[:n]
+}
+
+// (throw value) raises an error. A string value becomes the
+// message; anything else is printed to make the message. A
+// SexpError is raised again as is.
+func ThrowFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
+	if len(args) != 1 {
+		return SexpNull, WrongNargs
+	}
+	if sxerr, isErr := args[0].(*SexpError); isErr {
+		return SexpNull, sxerr
+	}
+
+	var msg string
+	switch v := args[0].(type) {
+	case *SexpStr:
+		msg = v.S
+	default:
+		msg = v.SexpString(nil)
+	}
+
+	// report the caller of throw, not throw itself.
+	fname := env.curfunc.name
+	pc := env.pc
+	if elem, err := env.addrstack.Get(0); err == nil {
+		if addr, isAddr := elem.(Address); isAddr {
+			fname = addr.function.name
+			pc = addr.position - 1
+		}
+	}
+	return SexpNull, &SexpError{
+		error: errors.New(msg),
+		Value: args[0],
+		Func:  fname,
+		Pc:    pc,
+	}
+}
+
+// (errmsg e) returns the message of the error e as a string.
+func ErrmsgFunction(env *Zlisp, name string, args []Sexp) (Sexp, error) {
+	if len(args) != 1 {
+		return SexpNull, WrongNargs
+	}
+	sxerr, isErr := args[0].(*SexpError)
+	if !isErr {
+		return SexpNull, fmt.Errorf("errmsg: argument must be an error, not %T", args[0])
+	}
+	return &SexpStr{S: sxerr.error.Error()}, nil
+}
@@ -137,6 +137,14 @@ func IsFunc(expr Sexp) bool {
 	return false
 }
 
+func IsError(expr Sexp) bool {
+	switch expr.(type) {
+	case *SexpError:
+		return true
+	}
+	return false
+}
+
 func TypeOf(expr Sexp) *SexpStr {
 	v := ""
 	switch e := expr.(type) {
@@ -3,6 +3,7 @@ package zygo
 import (
 	"errors"
 	"fmt"
+	"sync/atomic"
 )
 
 type Instruction interface {
@@ -127,7 +128,7 @@ func (g EnvToStackInstr) Execute(env *Zlisp) error {
 	VPrintf("in EnvToStackInstr\n")
 	defer VPrintf("leaving EnvToStackInstr env.pc =%v\n", env.pc)
 
-	macxpr, isMacro := env.macros[g.sym.number]
+	macxpr, isMacro := env.macros.get(g.sym.number)
 	if isMacro {
 		if macxpr.orig != nil {
 			return fmt.Errorf("'%s' is a macro, with definition: %s\n", g.sym.name, macxpr.orig.SexpString(nil))
@@ -211,22 +212,53 @@ func (p UpdateInstr) Execute(env *Zlisp) error {
 type CallInstr struct {
 	sym   *SexpSymbol
 	nargs int
+	pos   *Pos
+
+	// tail is set for a call in tail position, whose caller
+	// has scopes extra scopes open besides its function scope.
+	tail   bool
+	scopes int
+
+	// ref is the lexical address of sym, if it has one.
+	ref *lexRef
+}
+
+func (c CallInstr) Position() *Pos {
+	return c.pos
 }
 
 func (c CallInstr) InstrString() string {
+	if c.tail {
+		return fmt.Sprintf("tail call %s %d", c.sym.name, c.nargs)
+	}
 	return fmt.Sprintf("call %s %d", c.sym.name, c.nargs)
 }
 
+// call calls function, in place of the caller if in tail position.
+func (c CallInstr) call(env *Zlisp, function *SexpFunction, nargs int) error {
+	if c.tail {
+		return env.TailCallFunction(function, nargs, c.scopes)
+	}
+	return env.CallFunction(function, nargs)
+}
+
 func (c CallInstr) Execute(env *Zlisp) error {
 	f, ok := env.builtins[c.sym.number]
 	if ok {
+		if c.sym.name == "apply" && c.nargs == 2 {
+			// apply a zygo function without a nested Run.
+			fun, args, isZygo := env.applyArgs()
+			if isZygo {
+				return c.call(env, fun, args)
+			}
+		}
 		_, err := env.CallUserFunction(f, c.sym.name, c.nargs)
 		return err
 	}
 	var funcobj, indirectFuncName Sexp
 	var err error
 
-	funcobj, err, _ = env.LexicalLookupSymbol(c.sym, nil)
+	funcobj, err = env.lookup(c.sym, c.ref)
 
 	if err != nil {
 		return err
@@ -278,7 +310,7 @@ func (c CallInstr) Execute(env *Zlisp) error {
 		switch g := indirectFuncName.(type) {
 		case *SexpFunction:
 			if !g.user {
-				return env.CallFunction(g, c.nargs)
+				return c.call(env, g, c.nargs)
 			}
 			_, err := env.CallUserFunction(g, f.name, c.nargs)
 			return err
@@ -290,7 +322,7 @@ func (c CallInstr) Execute(env *Zlisp) error {
 
 	case *SexpFunction:
 		if !f.user {
-			return env.CallFunction(f, c.nargs)
+			return c.call(env, f, c.nargs)
 		}
 		_, err := env.CallUserFunction(f, c.sym.name, c.nargs)
 		return err
@@ -314,9 +346,21 @@ func (c CallInstr) Execute(env *Zlisp) error {
 
 type DispatchInstr struct {
 	nargs int
+	pos   *Pos
+
+	// as for CallInstr
+	tail   bool
+	scopes int
+}
+
+func (d DispatchInstr) Position() *Pos {
+	return d.pos
 }
 
 func (d DispatchInstr) InstrString() string {
+	if d.tail {
+		return fmt.Sprintf("tail dispatch %d", d.nargs)
+	}
 	return fmt.Sprintf("dispatch %d", d.nargs)
 }
 
@@ -329,6 +373,9 @@ func (d DispatchInstr) Execute(env *Zlisp) error {
 	switch f := funcobj.(type) {
 	case *SexpFunction:
 		if !f.user {
+			if d.tail {
+				return env.TailCallFunction(f, d.nargs, d.scopes)
+			}
 			return env.CallFunction(f, d.nargs)
 		}
 		_, err := env.CallUserFunction(f, f.name, d.nargs)
@@ -571,54 +618,66 @@ func (s LabelInstr) Execute(env *Zlisp) error {
 	return nil
 }
 
+// BreakInstr and ContinueInstr cache the position of their
+// loop on first use. The same instruction may run in several
+// goroutines at once, so the cache is read and set atomically.
 type BreakInstr struct {
 	loop *Loop
-	pos  int
+	pos  int64
 }
 
-func (s BreakInstr) InstrString() string {
-	if s.pos == 0 {
+func (s *BreakInstr) InstrString() string {
+	pos := atomic.LoadInt64(&s.pos)
+	if pos == 0 {
 		return fmt.Sprintf("break %s", s.loop.stmtname.name)
 	}
-	return fmt.Sprintf("break %s (loop is at %d)", s.loop.stmtname.name, s.pos)
+	return fmt.Sprintf("break %s (loop is at %d)", s.loop.stmtname.name, pos)
 }
 
 func (s *BreakInstr) Execute(env *Zlisp) error {
-	if s.pos == 0 {
-		pos, err := env.FindLoop(s.loop)
-		if err != nil {
-			return err
-		}
-		s.pos = pos
+	pos, err := env.cachedLoopPos(s.loop, &s.pos)
+	if err != nil {
+		return err
 	}
-	env.pc = s.pos + s.loop.breakOffset
+	env.pc = pos + s.loop.breakOffset
 	return nil
 }
 
 type ContinueInstr struct {
 	loop *Loop
-	pos  int
+	pos  int64
 }
 
-func (s ContinueInstr) InstrString() string {
-	if s.pos == 0 {
+func (s *ContinueInstr) InstrString() string {
+	pos := atomic.LoadInt64(&s.pos)
+	if pos == 0 {
 		return fmt.Sprintf("continue %s", s.loop.stmtname.name)
 	}
-	return fmt.Sprintf("continue %s (loop is at pos %d)", s.loop.stmtname.name, s.pos)
+	return fmt.Sprintf("continue %s (loop is at pos %d)", s.loop.stmtname.name, pos)
 }
 
 func (s *ContinueInstr) Execute(env *Zlisp) error {
 	VPrintf("\n executing ContinueInstr with loop: '%#v'\n", s.loop)
-	if s.pos == 0 {
-		pos, err := env.FindLoop(s.loop)
+	pos, err := env.cachedLoopPos(s.loop, &s.pos)
+	if err != nil {
+		return err
+	}
+	env.pc = pos + s.loop.continueOffset
+	VPrintf("\n  more detail ContinueInstr pos=%d, setting pc = %d\n", pos, env.pc)
+	return nil
+}
+
+func (env *Zlisp) cachedLoopPos(loop *Loop, cache *int64) (int, error) {
+	pos := atomic.LoadInt64(cache)
+	if pos == 0 {
+		found, err := env.FindLoop(loop)
 		if err != nil {
-			return err
+			return 0, err
 		}
-		s.pos = pos
+		pos = int64(found)
+		atomic.StoreInt64(cache, pos)
 	}
-	env.pc = s.pos + s.loop.continueOffset
-	VPrintf("\n  more detail ContinueInstr pos=%d, setting pc = %d\n", s.pos, env.pc)
-	return nil
+	return int(pos), nil
 }
 
 type LoopStartInstr struct {
@@ -748,18 +807,21 @@ func (a CreateClosureInstr) Execute(env *Zlisp) error {
 	myInvok := a.sfun.Copy()
 	myInvok.SetClosing(cls, a.sfun)
 
-	ps8 := NewPrintStateWithIndent(8)
-	shown, err := myInvok.ShowClosing(env, ps8,
-		fmt.Sprintf("closedOverScopes of '%s'", myInvok.name))
-	if err != nil {
-		return err
+	if Verbose {
+		// showing the closed over stack is costly.
+		ps8 := NewPrintStateWithIndent(8)
+		shown, err := myInvok.ShowClosing(env, ps8,
+			fmt.Sprintf("closedOverScopes of '%s'", myInvok.name))
+		if err != nil {
+			return err
+		}
+		VPrintf("+++ CreateClosure: assign to '%s' the stack:\n\n%s\n\n",
+			myInvok.SexpString(nil), shown)
+		top := cls.TopScope()
+		VPrintf("222 CreateClosure: top of NewClosing Scope has addr %p and is\n",
+			top)
+		top.Show(env, ps8, fmt.Sprintf("top of NewClosing at %p", top))
 	}
-	VPrintf("+++ CreateClosure: assign to '%s' the stack:\n\n%s\n\n",
-		myInvok.SexpString(nil), shown)
-	top := cls.TopScope()
-	VPrintf("222 CreateClosure: top of NewClosing Scope has addr %p and is\n",
-		top)
-	top.Show(env, ps8, fmt.Sprintf("top of NewClosing at %p", top))
 
 	env.datastack.PushExpr(myInvok)
 	return nil
@@ -840,3 +902,63 @@ func (a PopScopeTransferToDataStackInstr) Execute(env *Zlisp) error {
 	env.datastack.PushExpr(stackClone)
 	return nil
 }
+
+// TryStartInstr installs a handler for errors raised before the
+// matching TryEndInstr. On error, execution resumes at the
+// current pc + catchOffset with the SexpError on the data stack.
+type TryStartInstr struct {
+	catchOffset int
+}
+
+func (t TryStartInstr) InstrString() string {
+	return fmt.Sprintf("try-start catch at +%d", t.catchOffset)
+}
+
+func (t TryStartInstr) Execute(env *Zlisp) error {
+	env.handlers = append(env.handlers, tryHandler{
+		fun:         env.curfunc,
+		catchPc:     env.pc + t.catchOffset,
+		runDepth:    env.runDepth,
+		datastack:   env.datastack.Size(),
+		linearstack: env.linearstack.Size(),
+		addrstack:   env.addrstack.Size(),
+	})
+	env.pc++
+	return nil
+}
+
+type TryEndInstr struct{}
+
+func (t TryEndInstr) InstrString() string {
+	return "try-end"
+}
+
+func (t TryEndInstr) Execute(env *Zlisp) error {
+	n := len(env.handlers)
+	if n == 0 {
+		return fmt.Errorf("try-end without matching try-start")
+	}
+	env.handlers = env.handlers[:n-1]
+	env.pc++
+	return nil
+}
+
+// RethrowInstr raises the SexpError on top of the data stack
+// again, once a finally clause has run.
+type RethrowInstr struct{}
+
+func (t RethrowInstr) InstrString() string {
+	return "rethrow"
+}
+
+func (t RethrowInstr) Execute(env *Zlisp) error {
+	expr, err := env.datastack.PopExpr()
+	if err != nil {
+		return err
+	}
+	sxerr, isErr := expr.(*SexpError)
+	if !isErr {
+		return fmt.Errorf("rethrow: expected error on stack, found %T", expr)
+	}
+	return sxerr
+}